@@ -21,3 +21,11 @@ const (
 func (r K8sResStatus) IsDelete() bool {
 	return r == K8sResStatusDelete
 }
+
+type EventType string // 推送事件的类型
+
+const (
+	EventStatusChange EventType = "StatusChange" // 资源状态变化
+	EventFlapping     EventType = "Flapping"     // 资源状态在窗口期内频繁变化，只推送一次
+	EventReasonChange EventType = "ReasonChange" // 状态未变但失败原因变化，需要订阅者主动开启
+)
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"context"
+	"time"
 
 	"github.com/sunreaver/kubewatcher/constant"
 	"github.com/sunreaver/kubewatcher/resource"
@@ -25,3 +26,13 @@ type K8sController interface {
 type K8sControllerHandler interface {
 	Handle(ctx context.Context, c K8sController, key string, obj interface{}) error
 }
+
+/*
+controller运行过程的观察者，用于统计监控指标
+*/
+type Observer interface {
+	ObserveQueue(kind constant.K8sResKind, queue workqueue.RateLimitingInterface) // controller启动时注册其queue，用于统计queue深度
+	ObserveConsume(kind constant.K8sResKind, duration time.Duration, err error)   // 每次KeyConsume的耗时和结果
+	ObserveRetry(kind constant.K8sResKind)                                        // key处理失败重新入queue
+	ObserveDrop(kind constant.K8sResKind)                                         // key超过重试次数被丢弃
+}
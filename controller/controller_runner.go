@@ -2,6 +2,8 @@ package controller
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sunreaver/kubewatcher/resource"
@@ -11,15 +13,74 @@ import (
 	"k8s.io/client-go/util/workqueue"
 )
 
+const (
+	DefaultMaxRetries = 5 // key处理失败后默认的重试次数
+	MaxPodWorkers     = 1 // 同一deployment的pod并发处理时会竞争更新deployment的状态，pod controller只使用一个worker
+)
+
 // controller的运行器，按照启动多个worker去消费controller的queue数据的流程去运行
 type ControllerRunner struct {
-	Controller K8sController
+	Controller  K8sController
+	observer    Observer                     // 可以为nil
+	workers     int                          // 消费queue的协程数量，为0时使用controller的默认值
+	maxRetries  int                          // key处理失败后的重试次数
+	rateLimiter func() workqueue.RateLimiter // 构造queue的限速器，每个queue一个
+	processing  atomic.Int32                 // 正在处理的key数量
+	done        chan struct{}                // 所有worker退出后关闭
+
+	synced        []cache.InformerSynced // 开始消费queue前需要同步完成的informer
+	registrations []registration         // 注册到informer上的事件处理器，停止时移除
+}
+
+type registration struct {
+	informer cache.SharedIndexInformer
+	handle   cache.ResourceEventHandlerRegistration
+}
+
+type RunnerOption func(*ControllerRunner)
+
+// 设置controller运行过程的观察者
+func WithObserver(o Observer) RunnerOption {
+	return func(cr *ControllerRunner) {
+		cr.observer = o
+	}
+}
+
+// 设置消费queue的协程数量
+func WithWorkers(n int) RunnerOption {
+	return func(cr *ControllerRunner) {
+		cr.workers = n
+	}
+}
+
+// 设置key处理失败后的重试次数，0表示不重试
+func WithMaxRetries(n int) RunnerOption {
+	return func(cr *ControllerRunner) {
+		cr.maxRetries = n
+	}
 }
 
-func NewControllerRunner(c K8sController) *ControllerRunner {
-	return &ControllerRunner{
-		Controller: c,
+/*
+设置queue的限速器，决定失败重试的等待时间
+限速器按key记录失败次数，每个queue需要单独的实例，所以传入构造函数
+*/
+func WithRateLimiter(fn func() workqueue.RateLimiter) RunnerOption {
+	return func(cr *ControllerRunner) {
+		cr.rateLimiter = fn
+	}
+}
+
+func NewControllerRunner(c K8sController, opts ...RunnerOption) *ControllerRunner {
+	cr := &ControllerRunner{
+		Controller:  c,
+		maxRetries:  DefaultMaxRetries,
+		rateLimiter: workqueue.DefaultControllerRateLimiter,
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(cr)
 	}
+	return cr
 }
 
 /*
@@ -36,7 +97,13 @@ func (cr *ControllerRunner) processNextItem(ctx context.Context) bool {
 		return false
 	}
 	defer cqueue.Done(key)
+	cr.processing.Add(1)
+	defer cr.processing.Add(-1)
+	start := time.Now()
 	err := c.KeyConsume(ctx, key.(string))
+	if cr.observer != nil {
+		cr.observer.ObserveConsume(c.GetKind(), time.Since(start), err)
+	}
 	cr.handleErr(err, key)
 	return true
 }
@@ -45,18 +112,24 @@ func (cr *ControllerRunner) processNextItem(ctx context.Context) bool {
 当处理key发生错误时重试
 */
 func (cr *ControllerRunner) handleErr(err error, key interface{}) {
-	const times = 5
+	times := cr.maxRetries
 	c := cr.Controller
 	cqueue := c.GetQueue()
 	if err == nil {
 		cqueue.Forget(key)
 		return
 	}
-	if cqueue.NumRequeues(key) < times { // 允许重试5次
+	if cqueue.NumRequeues(key) < times { // 允许重试maxRetries次
 		cqueue.AddRateLimited(key)
+		if cr.observer != nil {
+			cr.observer.ObserveRetry(c.GetKind())
+		}
 		return
 	}
 	cqueue.Forget(key)
+	if cr.observer != nil {
+		cr.observer.ObserveDrop(c.GetKind())
+	}
 	// k8sruntime.HandleError(err)
 	util.Warnw("handler_err", "key", key, "times", times, "error", err)
 }
@@ -66,14 +139,84 @@ func (cr *ControllerRunner) runWorker(ctx context.Context) {
 	}
 }
 
+/*
+为informer注册事件处理器，controller停止时移除
+外部传入的informer在watcher停止后继续运行，不移除的话事件会一直发往已经关闭的queue
+*/
+func (cr *ControllerRunner) addEventHandler(informer cache.SharedIndexInformer, handler cache.ResourceEventHandler) {
+	handle, err := informer.AddEventHandler(handler)
+	if err != nil {
+		util.Errorw("add_event_handler", "error", err)
+		return
+	}
+	cr.registrations = append(cr.registrations, registration{informer: informer, handle: handle})
+	cr.synced = append(cr.synced, informer.HasSynced)
+}
+
+func (cr *ControllerRunner) removeEventHandlers() {
+	for _, r := range cr.registrations {
+		if err := r.informer.RemoveEventHandler(r.handle); err != nil {
+			util.Warnw("remove_event_handler", "error", err)
+		}
+	}
+}
+
+/*
+启动worker消费queue，ctx结束后关闭queue并等待所有worker退出
+informer同步完成后才开始消费，避免缓存不完整时pod找不到所属的deployment而成为孤儿节点
+*/
 func (cr *ControllerRunner) RunController(ctx context.Context) {
 	c := cr.Controller
-	defer c.GetQueue().ShutDown()
+	defer close(cr.done)
+	defer cr.removeEventHandlers()
+	if cr.observer != nil {
+		cr.observer.ObserveQueue(c.GetKind(), c.GetQueue())
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), cr.synced...) {
+		c.GetQueue().ShutDown() // 同步完成前ctx结束
+		return
+	}
 
+	wg := sync.WaitGroup{}
 	for i := 0; i < c.GetWorkerNum(); i++ {
-		go wait.UntilWithContext(ctx, cr.runWorker, time.Second)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.UntilWithContext(ctx, cr.runWorker, time.Second)
+		}()
 	}
 	<-ctx.Done()
+	c.GetQueue().ShutDown() // 唤醒阻塞在queue.Get上的worker
+	wg.Wait()
+}
+
+// RunController是否还在运行，ctx结束后返回false
+func (cr *ControllerRunner) Running() bool {
+	select {
+	case <-cr.done:
+		return false
+	default:
+		return true
+	}
+}
+
+/*
+queue中没有待处理的key且没有worker正在处理，等待重试的key不计算在内
+*/
+func (cr *ControllerRunner) Idle() bool {
+	return cr.Controller.GetQueue().Len() == 0 && cr.processing.Load() == 0
+}
+
+/*
+等待RunController退出，即所有worker都处理完手上的key
+*/
+func (cr *ControllerRunner) Wait(ctx context.Context) error {
+	select {
+	case <-cr.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 /*
@@ -85,24 +228,43 @@ func (cr *ControllerRunner) RunController(ctx context.Context) {
 4. workqueue 有失败重试机制，可以避免一个event处理失败了丢失处理问题
 5. workqueue 作为缓冲机制，可以启用多个协程处理queue数据
 */
-func BuildDeploymentController(ctx context.Context, depInformer cache.SharedIndexInformer, handler K8sControllerHandler, keyCache *resource.ResourceKeyCache) {
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
-	depInformer.AddEventHandler(NewDeploymentEventHandlerForQueue(queue)) // 为deployment informer注册事件入queue方法
+func BuildDeploymentController(ctx context.Context, platform string, depInformer cache.SharedIndexInformer, handler K8sControllerHandler, keyCache *resource.ResourceKeyCache, opts ...RunnerOption) *ControllerRunner {
+	runner := NewControllerRunner(nil, opts...)
+	queue := workqueue.NewRateLimitingQueue(runner.rateLimiter())
+	runner.addEventHandler(depInformer, NewDeploymentEventHandlerForQueue(queue)) // 为deployment informer注册事件入queue方法
 	// 构造deployment controller
 	depController := NewDeploymentController(queue, depInformer.GetIndexer(), keyCache)
 	depController.SetHandler(handler)
-	// depController.SetWorkerNum(10)
-	runner := NewControllerRunner(depController)
+	depController.SetPlatform(platform)
+	if runner.workers > 0 {
+		depController.SetWorkerNum(runner.workers)
+	}
+	runner.Controller = depController
 	go runner.RunController(ctx)
+	return runner
 }
 
-func BuildPodController(ctx context.Context, podInformer, depInformer, rsInformer cache.SharedIndexInformer, handler K8sControllerHandler, keyCache *resource.ResourceKeyCache) {
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
-	podInformer.AddEventHandler(NewPodEventHandlerForQueue(queue)) // 为pod informer注册事件入queue方法
+/*
+创建pod类型的监听controller，worker数最多为1，见MaxPodWorkers
+*/
+func BuildPodController(ctx context.Context, platform string, podInformer, depInformer, rsInformer cache.SharedIndexInformer, handler K8sControllerHandler, keyCache *resource.ResourceKeyCache, opts ...RunnerOption) *ControllerRunner {
+	runner := NewControllerRunner(nil, opts...)
+	queue := workqueue.NewRateLimitingQueue(runner.rateLimiter())
+	runner.addEventHandler(podInformer, NewPodEventHandlerForQueue(queue)) // 为pod informer注册事件入queue方法
+	// pod关联deployment时需要查询replicaset、deployment的缓存
+	runner.synced = append(runner.synced, depInformer.HasSynced, rsInformer.HasSynced)
 	// 构造pod controller
 	podController := NewPodController(queue, podInformer.GetIndexer(), depInformer.GetIndexer(), rsInformer.GetIndexer(), keyCache)
 	podController.SetHandler(handler)
-	// podController.SetWorkerNum(10)
-	runner := NewControllerRunner(podController)
+	podController.SetPlatform(platform)
+	if runner.workers > MaxPodWorkers {
+		util.Warnw("pod_controller_workers", "workers", runner.workers, "max", MaxPodWorkers)
+		runner.workers = MaxPodWorkers
+	}
+	if runner.workers > 0 {
+		podController.SetWorkerNum(runner.workers)
+	}
+	runner.Controller = podController
 	go runner.RunController(ctx)
+	return runner
 }
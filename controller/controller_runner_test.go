@@ -0,0 +1,25 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sunreaver/kubewatcher/resource"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBuildPodControllerCapsWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	runner := BuildPodController(ctx, "", f.Core().V1().Pods().Informer(), f.Apps().V1().Deployments().Informer(),
+		f.Apps().V1().ReplicaSets().Informer(), nil, resource.NewResourceKeyCache(), WithWorkers(8))
+	if n := runner.Controller.GetWorkerNum(); n != MaxPodWorkers {
+		t.Fatalf("pod workers = %d, want %d", n, MaxPodWorkers)
+	}
+	dep := BuildDeploymentController(ctx, "", f.Apps().V1().Deployments().Informer(), nil, resource.NewResourceKeyCache(), WithWorkers(4))
+	if n := dep.Controller.GetWorkerNum(); n != 4 {
+		t.Fatalf("deployment workers = %d, want 4", n)
+	}
+}
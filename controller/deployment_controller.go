@@ -12,6 +12,7 @@ import (
 )
 
 type DeploymentController struct {
+	platform   string // 所属集群
 	queue      workqueue.RateLimitingInterface
 	depIndexer cache.Indexer
 	handler    K8sControllerHandler
@@ -32,6 +33,14 @@ func (c *DeploymentController) SetWorkerNum(workerNum int) {
 	c.workerNum = workerNum
 }
 
+func (c *DeploymentController) SetPlatform(platform string) {
+	c.platform = platform
+}
+
+func (c *DeploymentController) GetPlatform() string {
+	return c.platform
+}
+
 func (c *DeploymentController) SetHandler(handler K8sControllerHandler) {
 	c.handler = handler
 }
@@ -12,7 +12,7 @@ import (
 )
 
 type PodController struct {
-	platform   string
+	platform   string // 所属集群
 	queue      workqueue.RateLimitingInterface
 	podIndexer cache.Indexer
 	depIndexer cache.Indexer
@@ -48,6 +48,10 @@ func (c *PodController) GetIndexer() map[constant.K8sResKind]cache.Indexer {
 	}
 }
 
+func (c *PodController) SetPlatform(platform string) {
+	c.platform = platform
+}
+
 func (c *PodController) GetPlatform() string {
 	return c.platform
 }
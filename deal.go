@@ -53,13 +53,15 @@ func dealSelf(resource *resource.ResourceCache, sender *sender.Sender, keyCatch
 	oldStatus := resource.GetStatus()
 	oldFailReason := resource.GetReason()
 	needSend := false
+	reasonChanged := false
 	if meta != nil {
-		resource.SetMeta(meta)
+		resource.SetMeta(keyCatch.ProjectMeta(meta))
 	}
 	if len(reason) > 0 && reason != oldFailReason {
 		util.Debugw("k8s_watcher_reason_change", "kind", resource.GetKind(), "key", resource.GetKey(), "reason", oldFailReason, "newReason", reason)
-		// needSend = true
 		resource.SetReason(reason)
+		// 归一化后仍不同才认为原因真的变了
+		reasonChanged = util.NormalizeReason(reason) != util.NormalizeReason(oldFailReason)
 	}
 	// 当前状态与旧状态不一致 或者 状态一致但错误原因变动
 	if nowStatus != oldStatus {
@@ -78,6 +80,11 @@ func dealSelf(resource *resource.ResourceCache, sender *sender.Sender, keyCatch
 	if needSend {
 		// 向外推送
 		sender.AddSendOut(resource.GetSendOut())
+	} else if reasonChanged && nowStatus == constant.K8sResStatusFail {
+		// 状态未变但失败原因变化 作为单独的事件类型推送 由订阅者决定是否接收
+		out := resource.GetSendOut()
+		out.Type = constant.EventReasonChange
+		sender.AddSendOut(out)
 	}
 }
 
@@ -0,0 +1,291 @@
+package kubewatcher
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/resource"
+	"github.com/sunreaver/kubewatcher/util"
+	"k8s.io/client-go/tools/cache"
+)
+
+// 单项检查的结果
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// /healthz、/readyz的返回内容
+type HealthReport struct {
+	OK     bool          `json:"ok"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// 缓存树中的一个节点
+type TreeNode struct {
+	Key      string                `json:"key"`
+	Kind     constant.K8sResKind   `json:"kind"`
+	Name     string                `json:"name"`
+	Status   constant.K8sResStatus `json:"status"`
+	Reason   string                `json:"reason,omitempty"`
+	Children []TreeNode            `json:"children,omitempty"`
+}
+
+/*
+watcher的协程是否存活：sender的推送协程、所有controller和informer都在运行
+informer同步超时会取消informer的ctx，informer和controller随之退出，此时返回错误
+还未启动的watcher、正在自动恢复的watcher视为存活
+*/
+func (w *K8sWatcher) Alive() error {
+	if !w.started.Load() {
+		return nil
+	}
+	if w.sender == nil || !w.sender.Running() {
+		return errors.New("sender is not running")
+	}
+	if w.Recovering() {
+		return nil
+	}
+	_, runners := w.current()
+	if len(runners) == 0 {
+		return errors.New("controllers are not started")
+	}
+	for _, runner := range runners {
+		if !runner.Running() {
+			return errors.Errorf("%s controller stopped", runner.Controller.GetKind())
+		}
+	}
+	for _, i := range w.informers() {
+		if i.informer != nil && i.informer.IsStopped() {
+			return errors.Errorf("%s informer stopped", i.name)
+		}
+	}
+	return nil
+}
+
+/*
+watcher是否可以提供服务：存活且所有informer都已完成首次同步
+*/
+func (w *K8sWatcher) Ready() error {
+	if !w.started.Load() {
+		return errors.New("watcher is not started")
+	}
+	if err := w.Alive(); err != nil {
+		return err
+	}
+	if w.Recovering() {
+		return errors.New("informers are being rebuilt")
+	}
+	for _, i := range w.informers() {
+		if i.informer != nil && !i.informer.HasSynced() {
+			return errors.Errorf("%s informer has not synced", i.name)
+		}
+	}
+	return nil
+}
+
+// 带名字的informer列表，只监控deployment时pod、replicaset的informer为nil
+func (w *K8sWatcher) informers() []namedInformer {
+	informer, _ := w.current()
+	if informer == nil {
+		return nil
+	}
+	return []namedInformer{
+		{"deployment", informer.DepInformer},
+		{"pod", informer.PodInformer},
+		{"replicaset", informer.RSInformer},
+	}
+}
+
+type namedInformer struct {
+	name     string
+	informer cache.SharedIndexInformer
+}
+
+/*
+缓存树，根节点为deployment以及没有上级的资源，按key排序
+namespace不为空时只返回该namespace的资源
+*/
+func (w *K8sWatcher) Tree(namespace string) []TreeNode {
+	roots := make([]*resource.ResourceCache, 0)
+	w.keyCache.Range(func(rc *resource.ResourceCache) bool {
+		if rc.GetParent() != nil {
+			return false
+		}
+		if ns, _ := util.SplitResourceCacheKey(rc.GetKey()); namespace != "" && ns != namespace {
+			return false
+		}
+		roots = append(roots, rc)
+		return false
+	})
+	return treeNodes(roots)
+}
+
+func treeNodes(list []*resource.ResourceCache) []TreeNode {
+	nodes := make([]TreeNode, 0, len(list))
+	for _, rc := range list {
+		children := make([]*resource.ResourceCache, 0)
+		rc.RangeWithoutDelete(func(child *resource.ResourceCache) (stop bool) {
+			if child != nil && child != rc {
+				children = append(children, child)
+			}
+			return false
+		})
+		nodes = append(nodes, TreeNode{
+			Key:      rc.GetKey(),
+			Kind:     rc.GetKind(),
+			Name:     rc.GetName(),
+			Status:   rc.GetStatus(),
+			Reason:   rc.GetReason(),
+			Children: treeNodes(children),
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Key < nodes[j].Key })
+	return nodes
+}
+
+// 健康检查的对象，key为集群名
+type healthTarget struct {
+	name    string
+	watcher *K8sWatcher
+	err     error // watcher之外的错误，例如Manager中启动失败的集群
+}
+
+/*
+提供 /healthz、/readyz、/debug/tree 三个接口，可以挂到已有的http服务上：
+mux.Handle("/watcher/", http.StripPrefix("/watcher", kubewatcher.NewHealthHandler(w)))
+
+/healthz 用于liveness probe，协程退出时返回503
+/readyz 用于readiness probe，informer未同步完成时返回503
+/debug/tree 以JSON返回每个集群的缓存树及状态，支持 ?cluster=、?namespace= 过滤
+*/
+type HealthHandler struct {
+	mux     *http.ServeMux
+	targets func() []healthTarget
+}
+
+func NewHealthHandler(w *K8sWatcher) *HealthHandler {
+	return newHealthHandler(func() []healthTarget {
+		return []healthTarget{{name: w.Platform(), watcher: w}}
+	})
+}
+
+/*
+Manager中所有集群的健康检查
+启动失败（Failed）的集群只影响/readyz，不影响/healthz，避免一个集群不可用导致整个进程被重启
+*/
+func NewManagerHealthHandler(m *Manager) *HealthHandler {
+	return newHealthHandler(func() []healthTarget {
+		list := make([]healthTarget, 0)
+		for _, status := range m.Clusters() {
+			w, exist := m.Watcher(status.Name)
+			if !exist {
+				continue
+			}
+			t := healthTarget{name: status.Name, watcher: w}
+			switch status.State {
+			case ClusterFailed:
+				t.err = errors.Wrap(status.Err, "cluster failed")
+			case ClusterStarting:
+				t.err = errors.New("cluster is starting")
+			}
+			list = append(list, t)
+		}
+		return list
+	})
+}
+
+func newHealthHandler(targets func() []healthTarget) *HealthHandler {
+	h := &HealthHandler{
+		mux:     http.NewServeMux(),
+		targets: targets,
+	}
+	h.mux.HandleFunc("/healthz", h.serveHealthz)
+	h.mux.HandleFunc("/readyz", h.serveReadyz)
+	h.mux.HandleFunc("/debug/tree", h.serveTree)
+	return h
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// 存活检查
+func (h *HealthHandler) Healthz() HealthReport {
+	report := HealthReport{OK: true, Checks: []HealthCheck{}}
+	for _, t := range h.targets() {
+		if t.err != nil {
+			continue // 启动失败或者启动中的集群没有运行中的协程
+		}
+		report.add(t.name, t.watcher.Alive())
+	}
+	return report
+}
+
+// 就绪检查
+func (h *HealthHandler) Readyz() HealthReport {
+	report := HealthReport{OK: true, Checks: []HealthCheck{}}
+	targets := h.targets()
+	if len(targets) == 0 {
+		report.add("clusters", errors.New("no cluster"))
+	}
+	for _, t := range targets {
+		err := t.err
+		if err == nil {
+			err = t.watcher.Ready()
+		}
+		report.add(t.name, err)
+	}
+	return report
+}
+
+func (r *HealthReport) add(name string, err error) {
+	check := HealthCheck{Name: name, OK: err == nil}
+	if err != nil {
+		check.Error = err.Error()
+		r.OK = false
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+func (h *HealthHandler) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, h.Healthz())
+}
+
+func (h *HealthHandler) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, h.Readyz())
+}
+
+func (h *HealthHandler) serveTree(w http.ResponseWriter, r *http.Request) {
+	cluster := r.URL.Query().Get("cluster")
+	namespace := r.URL.Query().Get("namespace")
+	trees := map[string][]TreeNode{}
+	for _, t := range h.targets() {
+		if cluster != "" && t.name != cluster {
+			continue
+		}
+		trees[t.name] = t.watcher.Tree(namespace)
+	}
+	writeJSON(w, http.StatusOK, trees)
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport) {
+	code := http.StatusOK
+	if !report.OK {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, report)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		util.Warnw("health_write", "error", err)
+	}
+}
@@ -0,0 +1,175 @@
+package kubewatcher
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// 请求健康检查接口，把返回的JSON解析到v
+func getJSON(t *testing.T, srv *httptest.Server, path string, v interface{}) int {
+	t.Helper()
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("%s: invalid json: %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+func healthStatus(t *testing.T, srv *httptest.Server, path string) (int, HealthReport) {
+	t.Helper()
+	var report HealthReport
+	code := getJSON(t, srv, path, &report)
+	return code, report
+}
+
+func treeKeys(nodes []TreeNode) []string {
+	keys := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		keys = append(keys, n.Key)
+	}
+	return keys
+}
+
+func TestHealthHandlerWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := fake.NewSimpleClientset(testDeployment("web", false), nsDeployment("other", "api"))
+	w, err := NewWatcher(ctx, WithInformer(startDepInformer(t, ctx, cs)), WithKinds(constant.DeploymentKind), WithPlatform("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHealthHandler(w))
+	defer srv.Close()
+
+	// 启动前视为存活，但还不能提供服务
+	if code, _ := healthStatus(t, srv, "/healthz"); code != http.StatusOK {
+		t.Fatalf("healthz before start = %d, want 200", code)
+	}
+	if code, report := healthStatus(t, srv, "/readyz"); code != http.StatusServiceUnavailable || report.OK {
+		t.Fatalf("readyz before start = %d %+v, want 503", code, report)
+	}
+
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	waitFor(t, func() bool { return len(w.Snapshot()) == 2 })
+	for _, path := range []string{"/healthz", "/readyz"} {
+		code, report := healthStatus(t, srv, path)
+		if code != http.StatusOK || !report.OK || len(report.Checks) != 1 || report.Checks[0].Name != "a" {
+			t.Fatalf("%s = %d %+v, want 200 with a check for cluster a", path, code, report)
+		}
+	}
+
+	cases := []struct {
+		query string
+		want  map[string][]string
+	}{
+		{"", map[string][]string{"a": {"default/web", "other/api"}}},
+		{"?namespace=other", map[string][]string{"a": {"other/api"}}},
+		{"?cluster=a&namespace=default", map[string][]string{"a": {"default/web"}}},
+		{"?cluster=b", map[string][]string{}},
+	}
+	for _, c := range cases {
+		t.Run("tree"+c.query, func(t *testing.T) {
+			trees := map[string][]TreeNode{}
+			if code := getJSON(t, srv, "/debug/tree"+c.query, &trees); code != http.StatusOK {
+				t.Fatalf("code = %d", code)
+			}
+			if len(trees) != len(c.want) {
+				t.Fatalf("clusters = %d, want %d", len(trees), len(c.want))
+			}
+			for cluster, keys := range c.want {
+				if got := treeKeys(trees[cluster]); !equalKeys(got, keys) {
+					t.Fatalf("cluster %s tree = %v, want %v", cluster, got, keys)
+				}
+			}
+		})
+	}
+	if trees := w.Tree(""); trees[0].Kind != constant.DeploymentKind || trees[0].Name != "web" || trees[0].Status != constant.K8sResStatusFail {
+		t.Fatalf("tree node = %+v", trees[0])
+	}
+
+	// controller退出后/healthz和/readyz都返回503
+	w.runLock.RLock()
+	runCancel := w.runCancel
+	w.runLock.RUnlock()
+	runCancel()
+	waitFor(t, func() bool { code, _ := healthStatus(t, srv, "/healthz"); return code == http.StatusServiceUnavailable })
+	for _, path := range []string{"/healthz", "/readyz"} {
+		code, report := healthStatus(t, srv, path)
+		if code != http.StatusServiceUnavailable || report.OK || report.Checks[0].OK || report.Checks[0].Error == "" {
+			t.Fatalf("%s = %d %+v, want 503 with the stopped controller", path, code, report)
+		}
+	}
+}
+
+// 启动失败的集群只影响/readyz
+func TestHealthHandlerManager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := NewManager(ctx, WithKinds(constant.DeploymentKind), WithSyncTimeout(300*time.Millisecond))
+	srv := httptest.NewServer(NewManagerHealthHandler(m))
+	defer srv.Close()
+
+	// 没有集群时不能提供服务
+	if code, _ := healthStatus(t, srv, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz without cluster = %d, want 503", code)
+	}
+	if code, _ := healthStatus(t, srv, "/healthz"); code != http.StatusOK {
+		t.Fatalf("healthz without cluster = %d, want 200", code)
+	}
+
+	healthy := fake.NewSimpleClientset(testDeployment("web", false))
+	if err := m.AddClusterByInformer("healthy", startDepInformer(t, ctx, healthy)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddClusterByInformer("broken", unstartedDepInformer(fake.NewSimpleClientset(testDeployment("api", false)))); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		a, _ := clusterState(m, "healthy")
+		b, _ := clusterState(m, "broken")
+		return a == ClusterRunning && b == ClusterFailed
+	})
+	waitFor(t, func() bool { return len(m.Snapshot()) == 1 })
+
+	code, report := healthStatus(t, srv, "/healthz")
+	if code != http.StatusOK || !report.OK || len(report.Checks) != 1 || report.Checks[0].Name != "healthy" {
+		t.Fatalf("healthz = %d %+v, want 200 checking only the healthy cluster", code, report)
+	}
+	code, report = healthStatus(t, srv, "/readyz")
+	if code != http.StatusServiceUnavailable || report.OK || len(report.Checks) != 2 {
+		t.Fatalf("readyz = %d %+v, want 503 with both clusters", code, report)
+	}
+	for _, check := range report.Checks {
+		if check.OK != (check.Name == "healthy") {
+			t.Fatalf("check %+v, want only the healthy cluster ok", check)
+		}
+	}
+
+	trees := map[string][]TreeNode{}
+	getJSON(t, srv, "/debug/tree?cluster=healthy", &trees)
+	if len(trees) != 1 || !equalKeys(treeKeys(trees["healthy"]), []string{"default/web"}) {
+		t.Fatalf("trees = %+v, want only default/web of the healthy cluster", trees)
+	}
+
+	// 移除启动失败的集群后恢复就绪
+	if _, err := m.RemoveCluster(context.Background(), "broken"); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := healthStatus(t, srv, "/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz after removing the failed cluster = %d, want 200", code)
+	}
+}
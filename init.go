@@ -6,7 +6,7 @@ import (
 	"github.com/sunreaver/kubewatcher/util"
 )
 
-// 设置包内日志
+// 设置包内日志，进程内所有watcher共用
 // nil 则不输出日志
 func SetLog(logger *slog.Logger) {
 	util.SetLogger(logger)
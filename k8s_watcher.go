@@ -2,13 +2,20 @@ package kubewatcher
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
 	"github.com/sunreaver/kubewatcher/controller"
+	"github.com/sunreaver/kubewatcher/metrics"
 	"github.com/sunreaver/kubewatcher/resource"
 	"github.com/sunreaver/kubewatcher/sender"
+	"github.com/sunreaver/kubewatcher/util"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
 )
 
 /*
@@ -17,62 +24,229 @@ import (
 */
 type K8sWatcher struct {
 	ctx       context.Context
-	clientSet *kubernetes.Clientset      // watcher构造informer的clientset，当使用FromClientSet().start()时传入这个
-	informer  *K8sWatcherInformer        // watcher使用的informer，当使用FromInformer().start()时传入这个，且同时传入informer.InformerStartCtx
+	platform  string                     // 集群名，写入推送事件的Cluster
+	clientSet kubernetes.Interface       // watcher构造informer的clientset，当使用FromClientSet().start()时传入这个
+	informer  *K8sWatcherInformer        // watcher使用的informer，外部传入时启动后为调用方对象的副本
 	err       error                      // watcher启动过程中的错误
 	sender    *sender.Sender             // 负责资源事件的向外发送
 	keyCache  *resource.ResourceKeyCache // 存储资源缓存的相关信息 key为资源key value为资源信息
+	metrics   *metrics.Metrics           // 监控指标 为nil则不统计
+	scope     InformerScope              // 通过clientSet构造informer时的监控范围
+	transform cache.TransformFunc        // 通过clientSet构造informer时，对象进入缓存前的处理 为nil则不处理
+	cfg       watcherConfig              // 运行参数
+	started   atomic.Bool                // 是否已经启动，防止重复启动
+
+	election       *leaderElection               // 选主配置 为nil表示不选主
+	elector        *leaderelection.LeaderElector // 根据election构造的选主器
+	electionCancel context.CancelFunc            // 停止选主并释放Lease
+
+	runLock      sync.RWMutex                   // 自动恢复时informer、runners会被替换
+	runners      []*controller.ControllerRunner // 运行中的controller，用于停止时等待worker退出
+	runCancel    context.CancelFunc             // 停止controller
+	senderCancel context.CancelFunc             // 立即停止sender
+
+	errs            chan error         // informer的错误，通过Errors读取
+	recovering      atomic.Bool        // 是否正在重建informer
+	superviseCancel context.CancelFunc // 停止自动恢复
+	recoverHook     func()             // 重建成功后调用，Manager用于更新集群状态
 }
 
 /*
 使用外部的clientSet对象启动一个watcher
 */
-func AsyncStartWatcherByClientSet(ctx context.Context, clientSet *kubernetes.Clientset) (*K8sWatcher, error) {
-	sd := sender.NewSender()
-	watcher := &K8sWatcher{
-		ctx:       ctx,
-		clientSet: clientSet,
-		sender:    sd,
-		keyCache:  resource.NewResourceKeyCache(),
+func AsyncStartWatcherByClientSet(ctx context.Context, clientSet *kubernetes.Clientset, opts ...Option) (*K8sWatcher, error) {
+	watcher := newK8sWatcher(ctx, "", opts...)
+	if clientSet != nil { // 避免把nil指针存成非nil的接口
+		watcher.clientSet = clientSet
 	}
 	return watcher, watcher.fromClientSet().start()
 }
 
 /*
-使用外部的informer对象启动一个watcher
-当使用这个方法时，ctx应该是informer的启动ctx
+使用外部的informer对象启动一个watcher，等待informer同步完成后返回，informer需要由外部启动
+当使用这个方法时，ctx应该是informer的启动ctx，watcher使用ctx的子ctx，Close只停止watcher自己的controller和sender
+platform为集群名，会写入推送事件的Cluster
+同步超时返回*InformerSyncTimeoutError
+*/
+func AsyncStartWatcherByInformer(ctx context.Context, platform string, informer *K8sWatcherInformer, opts ...Option) (*K8sWatcher, error) {
+	watcher := newK8sWatcher(ctx, platform, opts...)
+	watcher.informer = informer
+	return watcher, watcher.fromInformer().start()
+}
+
+/*
+使用Option构造watcher，需要通过WithClientSet、WithRestConfig、WithInformer之一指定数据来源
+返回的watcher还未启动，订阅后调用Start，不会漏掉informer首次同步产生的事件：
+
+	w, err := kubewatcher.NewWatcher(ctx, kubewatcher.WithRestConfig(cfg), kubewatcher.WithWorkers(2, 1))
+	w.Subscribe(fn)
+	err = w.Start()
+*/
+func NewWatcher(ctx context.Context, opts ...Option) (*K8sWatcher, error) {
+	if ctx == nil {
+		return nil, errors.New("ctx can't be null")
+	}
+	watcher := newK8sWatcher(ctx, "", opts...)
+	if watcher.err != nil {
+		return nil, watcher.err
+	}
+	sources := 0
+	for _, set := range []bool{watcher.clientSet != nil, watcher.cfg.restConfig != nil, watcher.informer != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, errors.New("exactly one of WithClientSet, WithRestConfig, WithInformer is required")
+	}
+	if watcher.informer != nil && watcher.cfg.recovery != nil {
+		return nil, errors.New("WithAutoRecovery requires WithClientSet or WithRestConfig")
+	}
+	if watcher.cfg.restConfig != nil {
+		if err := ValidateRestConfig(watcher.cfg.restConfig); err != nil {
+			return nil, err
+		}
+		clientSet, err := BuildK8sClient(*watcher.cfg.restConfig)
+		if err != nil {
+			return nil, err
+		}
+		watcher.clientSet = clientSet
+	}
+	return watcher, nil
+}
+
+/*
+启动NewWatcher构造的watcher，等待informer首次同步完成后返回
 */
-func AsyncStartWatcherByInformer(ctx context.Context, platform string, informer *K8sWatcherInformer) (*K8sWatcher, error) {
-	sd := sender.NewSender()
+func (w *K8sWatcher) Start() error {
+	if !w.started.CompareAndSwap(false, true) {
+		return errors.New("watcher already started")
+	}
+	if w.informer != nil {
+		return w.fromInformer().start()
+	}
+	return w.fromClientSet().start()
+}
+
+func newK8sWatcher(ctx context.Context, platform string, opts ...Option) *K8sWatcher {
 	watcher := &K8sWatcher{
 		ctx:      ctx,
-		informer: informer,
-		sender:   sd,
+		platform: platform,
 		keyCache: resource.NewResourceKeyCache(),
+		cfg:      defaultWatcherConfig(),
+		errs:     make(chan error, watchErrorBuffer),
 	}
-	return watcher, watcher.fromInformer().start()
+	for _, opt := range opts {
+		opt(watcher)
+	}
+	if err := watcher.cfg.validate(); err != nil {
+		watcher.err = err
+	} else if err := watcher.scope.validate(); err != nil {
+		watcher.err = err
+	}
+	watcher.sender = sender.NewSenderWithBuffer(watcher.cfg.senderBuf)
+	watcher.sender.SetCluster(watcher.platform)
+	if watcher.election != nil && watcher.err == nil {
+		watcher.elector, watcher.err = watcher.newLeaderElector()
+	}
+	return watcher
 }
 
 type K8sWatcherInformer struct {
 	DepInformer      cache.SharedIndexInformer
 	PodInformer      cache.SharedIndexInformer
 	RSInformer       cache.SharedIndexInformer
-	informerStartCtx context.Context // 如果是通过informer类型启动，这个ctx是外部informer的ctx，cfg、clientSet启动会从父ctx来自动设置这个ctx
-	informerStartFn  func() error    // 通过cfg或者clientset创建的informer启动方法
-	informerStopFn   func()          // 通过cfg或者clientset创建的informer的关闭方法，是context的cancel，用来关闭informer和controller
+	informerStartCtx context.Context // controller的父ctx，外部传入informer时为watcher ctx的子ctx，cfg、clientSet启动时为informer的ctx
+	informerStartFn  func() error    // 通过cfg或者clientset创建的informer的启动方法；外部传入informer时只等待同步完成
+	informerStopFn   func()          // informerStartCtx的cancel，用来关闭informer和controller；外部传入的informer不会被关闭
 }
 
 /*
-适用于传入cfg或者clientSet方式启动watcher对象的关闭
-外部传入informer方式启动的watcher对象关闭受外部informer的控制
+立即停止watcher的informer、controller和sender
+外部传入的informer不会被停止，只是不再处理其事件
 */
 func (w *K8sWatcher) Close() {
-	if w.informer != nil && w.informer.informerStopFn != nil { // 这个是context 的cancel方法，重复调用没问题
-		w.informer.informerStopFn() // 关闭informer和controller
+	w.stopSupervisor() // 先停止自动恢复，informer停止后不再重建
+	informer, _ := w.current()
+	if informer != nil && informer.informerStopFn != nil { // 这个是context 的cancel方法，重复调用没问题
+		informer.informerStopFn() // 关闭informer和controller
+		w.stopLeaderElection()
+		if w.senderCancel != nil {
+			w.senderCancel()
+		}
+		w.stopMetrics()
+	}
+}
+
+/*
+优雅停止watcher：
+1. 停止informer（外部传入的informer不停止）
+2. 停止controller并等待worker处理完手上的key
+3. 在ctx截止前把sender中剩余的事件推送给订阅者，并等待订阅者处理完
+返回值为丢弃的事件数，ctx超时会返回ctx的错误
+*/
+func (w *K8sWatcher) Shutdown(ctx context.Context) (dropped int, err error) {
+	w.stopSupervisor()
+	informer, runners := w.current()
+	if informer != nil && informer.informerStopFn != nil {
+		informer.informerStopFn()
+	}
+	// 尽早释放Lease，其他副本可以在本副本推送剩余事件的同时接替
+	w.stopLeaderElection()
+	w.runLock.RLock()
+	runCancel := w.runCancel
+	w.runLock.RUnlock()
+	if runCancel != nil {
+		runCancel()
 	}
+	if w.sender == nil {
+		return 0, nil
+	}
+	defer func() {
+		if w.senderCancel != nil {
+			w.senderCancel()
+		}
+		w.stopMetrics()
+	}()
+	for _, runner := range runners {
+		if err := runner.Wait(ctx); err != nil {
+			return w.sender.Dropped(), errors.Wrap(err, "等待controller退出超时")
+		}
+	}
+	dropped, err = w.sender.Stop(ctx)
+	if err != nil {
+		return dropped, errors.Wrap(err, "等待sender推送完成超时")
+	}
+	if dropped > 0 {
+		util.Warnw("k8s_watcher_shutdown", "dropped", dropped)
+	}
+	return dropped, nil
+}
+
+// 当前使用的informer和controller
+func (w *K8sWatcher) current() (*K8sWatcherInformer, []*controller.ControllerRunner) {
+	w.runLock.RLock()
+	defer w.runLock.RUnlock()
+	return w.informer, w.runners
+}
+
+// 集群名
+func (w *K8sWatcher) Platform() string {
+	return w.platform
 }
 
 func (w *K8sWatcher) Check() error {
+	if err := w.checkArgs(); err != nil {
+		return err
+	}
+	if w.informer.informerStartCtx == nil {
+		return errors.New("Informer InformerStartCtx can't be null")
+	}
+	return nil
+}
+
+// 检查构造参数，不包括启动informer所需的ctx，外部informer在派生子ctx之前先检查
+func (w *K8sWatcher) checkArgs() error {
 	if w == nil {
 		return errors.New("nil")
 	}
@@ -88,12 +262,12 @@ func (w *K8sWatcher) Check() error {
 	if w.informer == nil {
 		return errors.New("informer can't be null")
 	}
-	if w.informer.informerStartCtx == nil {
-		return errors.New("Informer InformerStartCtx can't be null")
-	}
 	if w.informer.DepInformer == nil {
 		return errors.New("DepInformer can't be null")
 	}
+	if !w.scope.watch(constant.PodKind) {
+		return nil
+	}
 	if w.informer.PodInformer == nil {
 		return errors.New("PodInformer can't be null")
 	}
@@ -107,7 +281,7 @@ func (w *K8sWatcher) fromClientSet() *K8sWatcher {
 	if w.err != nil {
 		return w
 	}
-	informer, err := BuildResInformerByClientSet(w.ctx, w.clientSet)
+	informer, err := w.buildInformer(w.ctx)
 	if err != nil {
 		w.err = err
 		return w
@@ -117,8 +291,46 @@ func (w *K8sWatcher) fromClientSet() *K8sWatcher {
 
 }
 
+/*
+使用clientSet构造informer，设置transform和上报错误的处理器，自动恢复时也用于重建
+*/
+func (w *K8sWatcher) buildInformer(ctx context.Context) (*K8sWatcherInformer, error) {
+	informer, err := buildResInformer(ctx, w.clientSet, w.scope, w.cfg.resync, w.cfg.syncTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if w.transform != nil {
+		if err := informer.SetTransform(w.transform); err != nil {
+			return nil, err
+		}
+	}
+	if err := informer.setWatchErrorHandler(w); err != nil {
+		return nil, err
+	}
+	return informer, nil
+}
+
+/*
+外部传入的informer：复制一份，不修改调用方的对象，多个watcher可以共用同一组informer
+watcher使用自己的子ctx，Close、Shutdown停止controller时不影响外部informer
+*/
 func (w *K8sWatcher) fromInformer() *K8sWatcher {
-	w.informer.informerStartCtx = w.ctx
+	if w.cfg.recovery != nil && w.err == nil {
+		w.err = errors.New("auto recovery is not supported for external informers")
+	}
+	// ctx为空时context.WithCancel会panic，参数有误时不派生子ctx，由start中的Check返回错误
+	if err := w.checkArgs(); err != nil {
+		w.err = err
+		return w
+	}
+	informer := *w.informer
+	ctx, cancel := context.WithCancel(w.ctx)
+	informer.informerStartCtx = ctx
+	informer.informerStopFn = cancel
+	informer.informerStartFn = func() error {
+		return waitForInformerSync(ctx, &informer, w.cfg.syncTimeout)
+	}
+	w.informer = &informer
 	return w
 }
 
@@ -134,51 +346,172 @@ func (w *K8sWatcher) AddDepCallback(fnList ...func(out sender.SendOut)) {
 	}
 }
 
+/*
+订阅事件，默认订阅所有资源类型的状态变化
+例如订阅pod的失败原因变化：watcher.Subscribe(fn, sender.WithKinds(constant.PodKind), sender.WithReasonChange())
+*/
+func (w *K8sWatcher) Subscribe(fn func(out sender.SendOut), opts ...sender.SubscribeOption) {
+	if w.sender != nil {
+		w.sender.Subscribe(fn, opts...)
+	}
+}
+
+/*
+添加推送目标，例如sender.NewWebhookSink创建的webhook，watcher停止时会关闭推送目标
+*/
+func (w *K8sWatcher) AddSink(sink sender.Sink, opts ...sender.SubscribeOption) {
+	if w.sender != nil {
+		w.sender.AddSink(sink, opts...)
+	}
+}
+
+/*
+批量订阅，累积到maxItems条或者等待maxWait后投递一次，watcher停止时投递剩余事件
+*/
+func (w *K8sWatcher) SubscribeBatch(fn func(outs []sender.SendOut), maxItems int, maxWait time.Duration, opts ...sender.SubscribeOption) error {
+	if w.sender == nil {
+		return errors.New("sender can't be null")
+	}
+	return w.sender.SubscribeBatch(fn, maxItems, maxWait, opts...)
+}
+
+/*
+设置推送事件中Meta携带的对象数据：完整对象、去掉managedFields、精简信息或者不携带
+缓存树中也只保存对应的数据，精简信息或者不携带时可以明显减少内存占用
+*/
+func (w *K8sWatcher) SetMetaProjection(p sender.MetaProjection) {
+	if w.sender != nil {
+		w.sender.SetMetaProjection(p)
+	}
+	w.keyCache.SetMetaProjection(p)
+}
+
+/*
+当前所有资源的状态快照，Meta按照SetMetaProjection的配置处理
+*/
+func (w *K8sWatcher) Snapshot() []sender.SendOut {
+	list := make([]sender.SendOut, 0, w.keyCache.Len())
+	w.keyCache.Range(func(rc *resource.ResourceCache) bool {
+		out := rc.GetSendOut()
+		out.Cluster = w.platform
+		if w.sender != nil {
+			out.Meta = sender.ProjectMeta(out.Meta, w.sender.MetaProjection())
+		}
+		list = append(list, out)
+		return false
+	})
+	return list
+}
+
+/*
+设置通知策略，用于failed状态的延迟确认和抖动抑制
+*/
+func (w *K8sWatcher) SetNotifyPolicy(p sender.NotifyPolicy) error {
+	if w.sender == nil {
+		return errors.New("sender can't be null")
+	}
+	return w.sender.SetNotifyPolicy(p)
+}
+
 /*
 使用示例：
 c.fromDCECfg().start()  或者 c.fromInformer().start()
 */
 func (w *K8sWatcher) start() (err error) {
+	w.started.Store(true)
+	recovering := false
 	defer func() {
-		if err != nil {
+		if err != nil && !recovering {
 			w.Close()
 		}
 	}()
 	if err = w.Check(); err != nil {
 		return err
 	}
-	w.startSender()          // 启动监听器的sender
-	w.startController()      // 启动controller
-	return w.startInformer() // 启动informer开始同步数据
+	if w.elector != nil {
+		w.sender.SetStandby(true) // 成为leader之前不推送
+	}
+	w.startMetrics()        // 注册监控指标
+	w.startSender()         // 启动监听器的sender
+	w.startController()     // 启动controller
+	err = w.startInformer() // 启动informer开始同步数据
+	if err != nil && w.cfg.recovery == nil {
+		return err
+	}
+	// 开启自动恢复时同步超时不停止watcher，由supervisor在后台重建
+	recovering = err != nil
+	w.startSupervisor()
+	w.startLeaderElection() // 缓存同步完成后再参与选主，成为leader时补发的状态才是完整的
+	return err
+}
+
+/*
+把资源缓存和sender注册到监控指标
+*/
+func (w *K8sWatcher) startMetrics() {
+	if w.metrics == nil {
+		return
+	}
+	w.metrics.RegisterCache(w.platform, w.keyCache)
+	w.metrics.RegisterSender(w.sender)
+}
+
+/*
+从监控指标中注销
+*/
+func (w *K8sWatcher) stopMetrics() {
+	if w.metrics == nil {
+		return
+	}
+	w.metrics.Unregister(w.keyCache, w.sender)
 }
 
 /*
 启动监听器的sender
 */
 func (w *K8sWatcher) startSender() {
-	w.sender.Start(w.informer.informerStartCtx) // 启动监听器的sender
+	// sender不跟随informer停止，Shutdown时先停informer再把剩余事件推送完
+	ctx, cancel := context.WithCancel(w.ctx)
+	w.senderCancel = cancel
+	w.sender.Start(ctx) // 启动监听器的sender
 }
 
 /*
 启动watcher的使用的controller
 */
 func (w *K8sWatcher) startController() {
-	ctx := w.informer.informerStartCtx
-	podInformer := w.informer.PodInformer
-	depInformer := w.informer.DepInformer
-	rsInformer := w.informer.RSInformer
+	informer, _ := w.current()
+	ctx, cancel := context.WithCancel(informer.informerStartCtx)
+	podInformer := informer.PodInformer
+	depInformer := informer.DepInformer
+	rsInformer := informer.RSInformer
 
 	handAndSender := NewHandAndSender(w.sender)
-	controller.BuildDeploymentController(ctx, depInformer, handAndSender, w.keyCache)
-	controller.BuildPodController(ctx, podInformer, depInformer, rsInformer, handAndSender, w.keyCache)
+	runnerOpts := func(workers int) []controller.RunnerOption {
+		opts := w.cfg.runnerOptions(workers)
+		if w.metrics != nil {
+			opts = append(opts, controller.WithObserver(w.metrics.ForCluster(w.platform)))
+		}
+		return opts
+	}
+	runners := []*controller.ControllerRunner{
+		controller.BuildDeploymentController(ctx, w.platform, depInformer, handAndSender, w.keyCache, runnerOpts(w.cfg.depWorkers)...),
+	}
+	if w.scope.watch(constant.PodKind) {
+		runners = append(runners, controller.BuildPodController(ctx, w.platform, podInformer, depInformer, rsInformer, handAndSender, w.keyCache, runnerOpts(w.cfg.podWorkers)...))
+	}
+	w.runLock.Lock()
+	w.runners, w.runCancel = runners, cancel
+	w.runLock.Unlock()
 }
 
 /*
 在controller运行后，启动informer开始缓存数据
 */
 func (w *K8sWatcher) startInformer() error {
-	if w.informer.informerStartFn != nil {
-		return w.informer.informerStartFn()
+	informer, _ := w.current()
+	if informer.informerStartFn != nil {
+		return informer.informerStartFn()
 	}
 	return nil
 }
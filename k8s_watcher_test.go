@@ -0,0 +1,96 @@
+package kubewatcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+// InClusterConfig、kubeconfig的tokenFile都会同时设置BearerToken和BearerTokenFile
+func TestNewWatcherWithTokenFileConfig(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &rest.Config{
+		Host:            "https://10.96.0.1:443",
+		BearerToken:     "token",
+		BearerTokenFile: tokenFile,
+	}
+	w, err := NewWatcher(context.Background(), WithRestConfig(cfg))
+	if err != nil {
+		t.Fatalf("NewWatcher: %v", err)
+	}
+	if w.clientSet == nil {
+		t.Fatal("clientSet not built")
+	}
+}
+
+func TestNewWatcherSource(t *testing.T) {
+	if _, err := NewWatcher(context.Background()); err == nil {
+		t.Fatal("expected error without source")
+	}
+	if _, err := NewWatcher(context.Background(), WithRestConfig(&rest.Config{Host: "https://a"}), WithInformer(&K8sWatcherInformer{})); err == nil {
+		t.Fatal("expected error with two sources")
+	}
+}
+
+func TestNewWatcherOptions(t *testing.T) {
+	informer := &K8sWatcherInformer{}
+	cases := []struct {
+		name    string
+		opt     Option
+		wantErr bool
+	}{
+		{"workers", WithWorkers(4, 1), false},
+		{"zero workers", WithWorkers(0, 1), true},
+		{"pod workers over max", WithWorkers(1, 2), true},
+		{"negative resync", WithResync(-time.Second), true},
+		{"zero sync timeout", WithSyncTimeout(0), true},
+		{"negative retries", WithMaxRetries(-1), true},
+		{"zero sender buffer", WithSenderBuffer(0), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := NewWatcher(context.Background(), WithInformer(informer), c.opt)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+// 外部informer的参数有误时直接返回错误，不派生子ctx，ctx为空时也不会panic
+func TestStartWatcherByInformerCheck(t *testing.T) {
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	depOnly := &K8sWatcherInformer{DepInformer: factory.Apps().V1().Deployments().Informer()}
+
+	var nilCtx context.Context
+	if _, err := AsyncStartWatcherByInformer(nilCtx, "a", depOnly, WithKinds(constant.DeploymentKind)); err == nil {
+		t.Fatal("want error for nil ctx")
+	}
+	if _, err := AsyncStartWatcherByInformer(context.Background(), "a", depOnly); err == nil {
+		t.Fatal("want error for missing pod informer")
+	}
+	if depOnly.informerStartCtx != nil {
+		t.Fatal("caller's informer should not be modified")
+	}
+
+	w, err := NewWatcher(context.Background(), WithInformer(&K8sWatcherInformer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(); err == nil {
+		t.Fatal("want error for missing deployment informer")
+	}
+	if w.informer.informerStartCtx != nil {
+		t.Fatal("child ctx should not be created for invalid informer")
+	}
+}
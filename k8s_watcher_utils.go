@@ -2,15 +2,25 @@ package kubewatcher
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
 	"github.com/sunreaver/kubewatcher/util"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
+	appsinformers "k8s.io/client-go/informers/apps/v1"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/informers/internalinterfaces"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -19,12 +29,26 @@ const (
 	waitCacheSyncDoneTimeout = 3 * time.Minute // 等待缓存同步完成时间
 )
 
-func MakeRestConfigByBearerToken(host, bearerToken string) (*rest.Config, error) {
-	return &rest.Config{
-		Host:        host,
-		APIPath:     "/apis",
-		BearerToken: string(bearerToken),
-	}, nil
+/*
+等待informer首次同步超时，通过errors.As判断：
+
+	var timeoutErr *kubewatcher.InformerSyncTimeoutError
+	if errors.As(err, &timeoutErr) { ... }
+*/
+type InformerSyncTimeoutError struct {
+	Timeout  time.Duration         // 等待的时间
+	Unsynced []constant.K8sResKind // 超时时还未同步完成的informer
+}
+
+func (e *InformerSyncTimeoutError) Error() string {
+	return fmt.Sprintf("informer缓存超时: %s 后 %v 未同步完成", e.Timeout, e.Unsynced)
+}
+
+/*
+使用token认证，可以通过opts设置CA证书、代理等，见rest_config.go
+*/
+func MakeRestConfigByBearerToken(host, bearerToken string, opts ...RestConfigOption) (*rest.Config, error) {
+	return MakeRestConfig(host, append([]RestConfigOption{WithBearerToken(bearerToken)}, opts...)...)
 }
 
 func MakeRestConfigByKubeconfigPath(host, kubeconfigPath string) (*rest.Config, error) {
@@ -54,32 +78,144 @@ func BuildK8sClient(config rest.Config) (*kubernetes.Clientset, error) {
 	return clientset, nil
 }
 
+/*
+informer的监控范围，零值表示整个集群的所有资源
+只需要namespace级别的权限时设置Namespaces，每个namespace使用单独的factory，controller看到的是合并后的informer
+*/
+type InformerScope struct {
+	Kinds            []constant.K8sResKind                                       // 监控的资源类型，为空表示deployment和pod，pod依赖deployment
+	Namespaces       []string                                                    // 监控的namespace，为空表示整个集群
+	LabelSelector    string                                                      // 应用到pod、deployment、replicaset
+	FieldSelector    string                                                      // 应用到pod、deployment、replicaset，deployment和replicaset只支持metadata.name、metadata.namespace
+	TweakListOptions func(kind constant.K8sResKind, options *metav1.ListOptions) // 按资源类型修改list/watch参数，在LabelSelector、FieldSelector之后调用
+}
+
+func (s InformerScope) validate() error {
+	for _, kind := range s.Kinds {
+		if kind != constant.DeploymentKind && kind != constant.PodKind {
+			return errors.Errorf("unsupported kind %q", kind)
+		}
+	}
+	if s.watch(constant.PodKind) && !s.watch(constant.DeploymentKind) {
+		return errors.New("watching pods requires deployments, pods are attached to their deployment")
+	}
+	seen := map[string]struct{}{}
+	for _, ns := range s.Namespaces {
+		if ns == "" {
+			return errors.New("namespace can't be empty")
+		}
+		if _, exist := seen[ns]; exist {
+			return errors.Errorf("duplicate namespace %q", ns)
+		}
+		seen[ns] = struct{}{}
+	}
+	if _, err := labels.Parse(s.LabelSelector); err != nil {
+		return errors.Wrap(err, "label selector")
+	}
+	if _, err := fields.ParseSelector(s.FieldSelector); err != nil {
+		return errors.Wrap(err, "field selector")
+	}
+	return nil
+}
+
+// 是否监控该类型的资源
+func (s InformerScope) watch(kind constant.K8sResKind) bool {
+	if len(s.Kinds) == 0 {
+		return true
+	}
+	for _, k := range s.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (s InformerScope) tweak(kind constant.K8sResKind) internalinterfaces.TweakListOptionsFunc {
+	return func(options *metav1.ListOptions) {
+		if s.LabelSelector != "" {
+			options.LabelSelector = s.LabelSelector
+		}
+		if s.FieldSelector != "" {
+			options.FieldSelector = s.FieldSelector
+		}
+		if s.TweakListOptions != nil {
+			s.TweakListOptions(kind, options)
+		}
+	}
+}
+
 /*
 根据clientSet 构造 informer
 */
 func BuildResInformerByClientSet(ctx context.Context, clientSet *kubernetes.Clientset) (*K8sWatcherInformer, error) {
+	return BuildScopedResInformerByClientSet(ctx, clientSet, InformerScope{})
+}
+
+/*
+根据clientSet 构造只监控scope范围内资源的 informer
+*/
+func BuildScopedResInformerByClientSet(ctx context.Context, clientSet *kubernetes.Clientset, scope InformerScope) (*K8sWatcherInformer, error) {
+	if clientSet == nil {
+		return nil, errors.New("clientSet can't be null")
+	}
+	return buildResInformer(ctx, clientSet, scope, informerDefaultResync, waitCacheSyncDoneTimeout)
+}
+
+/*
+resync为informer的全量resync周期，0表示不resync；syncTimeout为等待首次同步完成的时间
+只监控deployment时不创建pod和replicaset的informer
+*/
+func buildResInformer(ctx context.Context, clientSet kubernetes.Interface, scope InformerScope, resync, syncTimeout time.Duration) (*K8sWatcherInformer, error) {
 	if clientSet == nil {
 		return nil, errors.New("clientSet can't be null")
 	}
+	if err := scope.validate(); err != nil {
+		return nil, err
+	}
+	namespaces := scope.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
 	// informer的关闭清理开关
 	informerCtx, informerCancelFn := context.WithCancel(ctx)
 
 	stopCh := informerCtx.Done()
 
-	// sharedInformers可以将多种资源的监听使用共享的cache
-	sharedInformers := informers.NewSharedInformerFactory(clientSet, informerDefaultResync)
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	var k8sInformer *K8sWatcherInformer
+	factories := make([]informers.SharedInformerFactory, 0, len(namespaces))
+	depInformers := make(map[string]cache.SharedIndexInformer, len(namespaces))
+	podInformers := make(map[string]cache.SharedIndexInformer, len(namespaces))
+	rsInformers := make(map[string]cache.SharedIndexInformer, len(namespaces))
+	for _, ns := range namespaces {
+		ns := ns
+		// sharedInformers可以将多种资源的监听使用共享的cache
+		sharedInformers := informers.NewSharedInformerFactoryWithOptions(clientSet, resync, informers.WithNamespace(ns))
+		factories = append(factories, sharedInformers)
 
-	// sharedInformers实现各种k8s内置资源的informer
-	// informer通过List-Watch机制监听资源的变化，然后将变化后的资源存储在LocalStore中
-	depInformer := sharedInformers.Apps().V1().Deployments()
-	podInformer := sharedInformers.Core().V1().Pods()
-	rsInformer := sharedInformers.Apps().V1().ReplicaSets()
+		// informer通过List-Watch机制监听资源的变化，然后将变化后的资源存储在LocalStore中
+		depInformers[ns] = sharedInformers.InformerFor(&appsv1.Deployment{}, func(cs kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return appsinformers.NewFilteredDeploymentInformer(cs, ns, resync, indexers, scope.tweak(constant.DeploymentKind))
+		})
+		if !scope.watch(constant.PodKind) {
+			continue
+		}
+		podInformers[ns] = sharedInformers.InformerFor(&corev1.Pod{}, func(cs kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return coreinformers.NewFilteredPodInformer(cs, ns, resync, indexers, scope.tweak(constant.PodKind))
+		})
+		rsInformers[ns] = sharedInformers.InformerFor(&appsv1.ReplicaSet{}, func(cs kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return appsinformers.NewFilteredReplicaSetInformer(cs, ns, resync, indexers, scope.tweak(constant.ReplicaSetKind))
+		})
+	}
 
 	sharedInformerStartFn := func() error {
 		// 启动informer开始缓存数据
-		sharedInformers.Start(stopCh)
+		for _, sharedInformers := range factories {
+			sharedInformers.Start(stopCh)
+		}
 		// 等待缓存同步完成
-		ctx, cancel := context.WithTimeout(context.Background(), waitCacheSyncDoneTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
 		go func() {
 			// 防止informer异常，一直阻塞在sharedInformers.WaitForCacheSync(stopCh)上，这里对缓存加载逻辑做超时处理
 			select {
@@ -89,18 +225,20 @@ func BuildResInformerByClientSet(ctx context.Context, clientSet *kubernetes.Clie
 				}
 			}
 		}()
-		sharedInformers.WaitForCacheSync(stopCh) // 正常缓存完成或者close(stopCh)就不再阻塞执行
+		for _, sharedInformers := range factories {
+			sharedInformers.WaitForCacheSync(stopCh) // 正常缓存完成或者close(stopCh)就不再阻塞执行
+		}
 		cancel()
 		if ctx.Err() == context.DeadlineExceeded {
-			return errors.Wrap(ctx.Err(), "informer缓存超时")
+			return &InformerSyncTimeoutError{Timeout: syncTimeout, Unsynced: k8sInformer.unsynced()}
 		}
 		return nil
 	}
 
-	k8sInformer := &K8sWatcherInformer{
-		DepInformer:      depInformer.Informer(),
-		PodInformer:      podInformer.Informer(),
-		RSInformer:       rsInformer.Informer(),
+	k8sInformer = &K8sWatcherInformer{
+		DepInformer:      mergeNamespaceInformers(depInformers),
+		PodInformer:      mergeNamespaceInformers(podInformers),
+		RSInformer:       mergeNamespaceInformers(rsInformers),
 		informerStartCtx: informerCtx,
 		informerStartFn:  sharedInformerStartFn,
 		informerStopFn:   informerCancelFn,
@@ -108,3 +246,56 @@ func BuildResInformerByClientSet(ctx context.Context, clientSet *kubernetes.Clie
 
 	return k8sInformer, nil
 }
+
+/*
+等待外部传入的informer同步完成，informer由外部启动；ctx结束时返回ctx的错误
+*/
+func waitForInformerSync(ctx context.Context, informer *K8sWatcherInformer, syncTimeout time.Duration) error {
+	syncCtx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+	synced := make([]cache.InformerSynced, 0, 3)
+	for _, i := range []cache.SharedIndexInformer{informer.DepInformer, informer.PodInformer, informer.RSInformer} {
+		if i != nil {
+			synced = append(synced, i.HasSynced)
+		}
+	}
+	if cache.WaitForCacheSync(syncCtx.Done(), synced...) {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return &InformerSyncTimeoutError{Timeout: syncTimeout, Unsynced: informer.unsynced()}
+}
+
+// 还未同步完成的informer
+func (i *K8sWatcherInformer) unsynced() []constant.K8sResKind {
+	kinds := make([]constant.K8sResKind, 0)
+	informers := []struct {
+		kind     constant.K8sResKind
+		informer cache.SharedIndexInformer
+	}{
+		{constant.DeploymentKind, i.DepInformer},
+		{constant.PodKind, i.PodInformer},
+		{constant.ReplicaSetKind, i.RSInformer},
+	}
+	for _, item := range informers {
+		if item.informer != nil && !item.informer.HasSynced() {
+			kinds = append(kinds, item.kind)
+		}
+	}
+	return kinds
+}
+
+// 只有一个namespace（或者整个集群）时直接使用该informer，没有informer时返回nil
+func mergeNamespaceInformers(byNamespace map[string]cache.SharedIndexInformer) cache.SharedIndexInformer {
+	if len(byNamespace) == 0 {
+		return nil
+	}
+	if len(byNamespace) == 1 {
+		for _, informer := range byNamespace {
+			return informer
+		}
+	}
+	return newMultiNamespaceInformer(byNamespace)
+}
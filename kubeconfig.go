@@ -0,0 +1,311 @@
+package kubewatcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/util"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	defaultKubeconfigInterval        = 30 * time.Second
+	defaultKubeconfigShutdownTimeout = 30 * time.Second
+)
+
+/*
+加载一个或多个kubeconfig文件，按顺序合并，同名的context以先出现的为准
+*/
+func LoadKubeconfig(paths ...string) (*clientcmdapi.Config, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("kubeconfig paths can't be empty")
+	}
+	for _, p := range paths {
+		// 合并加载时会跳过不存在的文件，这里要求都存在，避免文件被替换的瞬间误认为context已删除
+		if _, err := os.Stat(p); err != nil {
+			return nil, err
+		}
+	}
+	rules := &clientcmd.ClientConfigLoadingRules{Precedence: paths}
+	return rules.Load()
+}
+
+/*
+列出kubeconfig文件中所有的context，按名字排序
+*/
+func ListKubeconfigContexts(paths ...string) ([]string, error) {
+	cfg, err := LoadKubeconfig(paths...)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(cfg.Contexts))
+	for name := range cfg.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+/*
+使用kubeconfig中指定的context构造rest config
+*/
+func MakeRestConfigByKubeconfigContext(contextName string, paths ...string) (*rest.Config, error) {
+	cfg, err := LoadKubeconfig(paths...)
+	if err != nil {
+		return nil, err
+	}
+	return restConfigForContext(cfg, contextName)
+}
+
+func restConfigForContext(cfg *clientcmdapi.Config, contextName string) (*rest.Config, error) {
+	if _, exist := cfg.Contexts[contextName]; !exist {
+		return nil, errors.Errorf("context %q not found in kubeconfig", contextName)
+	}
+	return clientcmd.NewNonInteractiveClientConfig(*cfg, contextName, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+}
+
+/*
+rest config中影响连接的部分的摘要，包括引用的证书文件内容
+BearerTokenFile只记录路径，client-go会定期重新读取token文件，不需要重启watcher
+设置了BearerTokenFile时BearerToken只是读取时的快照，token轮换后会变化，不计入摘要
+*/
+func restConfigFingerprint(cfg *rest.Config) (string, error) {
+	readFile := func(p string) string {
+		if p == "" {
+			return ""
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return "error:" + err.Error()
+		}
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:])
+	}
+	token := cfg.BearerToken
+	if cfg.BearerTokenFile != "" {
+		token = ""
+	}
+	b, err := json.Marshal(struct {
+		Host            string
+		APIPath         string
+		BearerToken     string
+		BearerTokenFile string
+		Username        string
+		Password        string
+		Impersonate     rest.ImpersonationConfig
+		AuthProvider    interface{}
+		ExecProvider    interface{}
+		Insecure        bool
+		ServerName      string
+		CertData        []byte
+		KeyData         []byte
+		CAData          []byte
+		CertFile        string
+		KeyFile         string
+		CAFile          string
+	}{
+		Host:            cfg.Host,
+		APIPath:         cfg.APIPath,
+		BearerToken:     token,
+		BearerTokenFile: cfg.BearerTokenFile,
+		Username:        cfg.Username,
+		Password:        cfg.Password,
+		Impersonate:     cfg.Impersonate,
+		AuthProvider:    cfg.AuthProvider,
+		ExecProvider:    cfg.ExecProvider,
+		Insecure:        cfg.Insecure,
+		ServerName:      cfg.ServerName,
+		CertData:        cfg.CertData,
+		KeyData:         cfg.KeyData,
+		CAData:          cfg.CAData,
+		CertFile:        readFile(cfg.CertFile),
+		KeyFile:         readFile(cfg.KeyFile),
+		CAFile:          readFile(cfg.CAFile),
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type KubeconfigLoaderConfig struct {
+	Paths           []string      // kubeconfig文件，按顺序合并
+	Contexts        []string      // 需要监控的context，支持path.Match通配符，为空表示所有context
+	Interval        time.Duration // 轮询文件变化的间隔 默认30s
+	ShutdownTimeout time.Duration // 重启、移除集群时等待watcher优雅停止的时间 默认30s
+}
+
+/*
+从kubeconfig发现context，为每个选中的context在Manager中启动一个watcher，集群名为context名
+按Interval轮询重新加载文件（不使用fsnotify：以ConfigMap、Secret挂载的文件通过替换符号链接更新，监听文件事件并不可靠），
+只重启连接信息（地址、证书、token等）发生变化的集群，context被删除时移除对应集群
+启动失败（Failed）且没有开启自动恢复的集群，在每次加载时重新添加
+文件加载失败时保持现有集群不变
+*/
+type KubeconfigLoader struct {
+	cfg     KubeconfigLoaderConfig
+	manager *Manager
+
+	lock         sync.Mutex
+	fingerprints map[string]string // 由loader管理的集群 key为context名
+}
+
+func NewKubeconfigLoader(m *Manager, cfg KubeconfigLoaderConfig) (*KubeconfigLoader, error) {
+	if m == nil {
+		return nil, errors.New("manager can't be null")
+	}
+	if len(cfg.Paths) == 0 {
+		return nil, errors.New("kubeconfig paths can't be empty")
+	}
+	for _, pattern := range cfg.Contexts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid context pattern %q", pattern)
+		}
+	}
+	if cfg.Interval < 0 || cfg.ShutdownTimeout < 0 {
+		return nil, errors.New("kubeconfig loader config can't be negative")
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultKubeconfigInterval
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = defaultKubeconfigShutdownTimeout
+	}
+	return &KubeconfigLoader{
+		cfg:          cfg,
+		manager:      m,
+		fingerprints: map[string]string{},
+	}, nil
+}
+
+/*
+加载一次并启动集群，之后每隔Interval轮询一次，直到ctx结束
+首次加载失败时直接返回错误
+*/
+func (l *KubeconfigLoader) Run(ctx context.Context) error {
+	if err := l.Reload(ctx); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(l.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Reload(ctx); err != nil {
+				util.Warnw("kubeconfig_reload", "paths", l.cfg.Paths, "error", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+/*
+重新加载kubeconfig，按变化添加、重启、移除集群
+单个context的错误不影响其他context，所有错误合并返回
+*/
+func (l *KubeconfigLoader) Reload(ctx context.Context) error {
+	cfg, err := LoadKubeconfig(l.cfg.Paths...)
+	if err != nil {
+		return errors.Wrap(err, "load kubeconfig")
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var errs []string
+	desired := map[string]*rest.Config{}
+	for name := range cfg.Contexts {
+		if !l.selected(name) {
+			continue
+		}
+		restConfig, err := restConfigForContext(cfg, name)
+		if err != nil {
+			errs = append(errs, name+": "+err.Error())
+			continue
+		}
+		desired[name] = restConfig
+	}
+
+	// 已删除或者不再选中的context
+	for name := range l.fingerprints {
+		if _, exist := cfg.Contexts[name]; exist && l.selected(name) {
+			continue
+		}
+		l.removeCluster(ctx, name)
+	}
+
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fp, err := restConfigFingerprint(desired[name])
+		if err != nil {
+			errs = append(errs, name+": "+err.Error())
+			continue
+		}
+		old, exist := l.fingerprints[name]
+		switch {
+		case !exist:
+		case old != fp:
+			util.Infow("kubeconfig_context_changed", "context", name)
+			l.removeCluster(ctx, name)
+		case l.manager.failedWithoutRecovery(name):
+			util.Infow("kubeconfig_context_retry", "context", name)
+			l.removeCluster(ctx, name)
+		default:
+			continue
+		}
+		if err := l.addCluster(name, desired[name]); err != nil {
+			errs = append(errs, name+": "+err.Error())
+			continue
+		}
+		l.fingerprints[name] = fp
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.Errorf("kubeconfig contexts failed: %v", errs)
+	}
+	return nil
+}
+
+func (l *KubeconfigLoader) selected(name string) bool {
+	if len(l.cfg.Contexts) == 0 {
+		return true
+	}
+	for _, pattern := range l.cfg.Contexts {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *KubeconfigLoader) addCluster(name string, restConfig *rest.Config) error {
+	clientSet, err := BuildK8sClient(*restConfig)
+	if err != nil {
+		return err
+	}
+	return l.manager.AddClusterByClientSet(name, clientSet)
+}
+
+func (l *KubeconfigLoader) removeCluster(ctx context.Context, name string) {
+	delete(l.fingerprints, name)
+	ctx, cancel := context.WithTimeout(ctx, l.cfg.ShutdownTimeout)
+	defer cancel()
+	if dropped, err := l.manager.RemoveCluster(ctx, name); err != nil {
+		util.Warnw("kubeconfig_remove_cluster", "context", name, "dropped", dropped, "error", err)
+	}
+}
@@ -0,0 +1,143 @@
+package kubewatcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestRestConfigFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	caFile := filepath.Join(dir, "ca.crt")
+	for _, f := range []string{tokenFile, caFile} {
+		if err := os.WriteFile(f, []byte("v1"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := func() *rest.Config {
+		return &rest.Config{
+			Host:            "https://10.96.0.1:443",
+			BearerToken:     "token-v1",
+			BearerTokenFile: tokenFile,
+			TLSClientConfig: rest.TLSClientConfig{CAFile: caFile},
+		}
+	}
+	fingerprint := func(cfg *rest.Config) string {
+		t.Helper()
+		fp, err := restConfigFingerprint(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+	want := fingerprint(base())
+
+	cases := []struct {
+		name   string
+		change func(cfg *rest.Config)
+		same   bool
+	}{
+		// token文件轮换后BearerToken是新的快照，client-go会自己重新读取，不需要重建watcher
+		{"rotated token with token file", func(cfg *rest.Config) { cfg.BearerToken = "token-v2" }, true},
+		{"token file content", func(cfg *rest.Config) {
+			if err := os.WriteFile(tokenFile, []byte("v2"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"token file path", func(cfg *rest.Config) { cfg.BearerTokenFile = filepath.Join(dir, "other") }, false},
+		{"token without file", func(cfg *rest.Config) { cfg.BearerTokenFile = ""; cfg.BearerToken = "token-v2" }, false},
+		{"host", func(cfg *rest.Config) { cfg.Host = "https://10.96.0.2:443" }, false},
+		{"ca file content", func(cfg *rest.Config) {
+			if err := os.WriteFile(caFile, []byte("v2"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := base()
+			c.change(cfg)
+			if got := fingerprint(cfg); (got == want) != c.same {
+				t.Fatalf("fingerprint changed = %v, want %v", got != want, !c.same)
+			}
+		})
+	}
+
+	// 没有token文件时BearerToken就是凭据本身，变化需要重建watcher
+	a, b := base(), base()
+	a.BearerTokenFile, b.BearerTokenFile = "", ""
+	b.BearerToken = "token-v2"
+	if fingerprint(a) == fingerprint(b) {
+		t.Fatal("bearer token change without token file should change the fingerprint")
+	}
+}
+
+// 写一个只有一个context的kubeconfig，server为apiserver地址
+func writeKubeconfig(t *testing.T, p, contextName, server string) {
+	t.Helper()
+	cfg := clientcmdapi.NewConfig()
+	cfg.Clusters[contextName] = &clientcmdapi.Cluster{Server: server}
+	cfg.AuthInfos[contextName] = &clientcmdapi.AuthInfo{Token: "token"}
+	cfg.Contexts[contextName] = &clientcmdapi.Context{Cluster: contextName, AuthInfo: contextName}
+	if err := clientcmd.WriteToFile(*cfg, p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 启动失败且没有开启自动恢复的集群，文件没有变化也会在下次加载时重新添加
+func TestKubeconfigLoaderRetriesFailed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	p := filepath.Join(t.TempDir(), "kubeconfig")
+	writeKubeconfig(t, p, "prod", srv.URL)
+
+	cases := []struct {
+		name    string
+		opts    []Option
+		restart bool
+	}{
+		{"without recovery", nil, true},
+		{"with recovery", []Option{WithAutoRecovery(RecoveryConfig{InitialBackoff: time.Hour})}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			opts := append([]Option{WithKinds(constant.DeploymentKind), WithSyncTimeout(200 * time.Millisecond)}, c.opts...)
+			m := NewManager(ctx, opts...)
+			defer m.Shutdown(context.Background())
+			loader, err := NewKubeconfigLoader(m, KubeconfigLoaderConfig{Paths: []string{p}, ShutdownTimeout: 5 * time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := loader.Reload(ctx); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, func() bool { s, _ := clusterState(m, "prod"); return s == ClusterFailed })
+			first, _ := m.Watcher("prod")
+
+			if err := loader.Reload(ctx); err != nil {
+				t.Fatal(err)
+			}
+			second, ok := m.Watcher("prod")
+			if !ok {
+				t.Fatal("cluster prod was removed")
+			}
+			if restarted := second != first; restarted != c.restart {
+				t.Fatalf("restarted = %v, want %v", restarted, c.restart)
+			}
+		})
+	}
+}
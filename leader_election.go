@@ -0,0 +1,185 @@
+package kubewatcher
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/resource"
+	"github.com/sunreaver/kubewatcher/sender"
+	"github.com/sunreaver/kubewatcher/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 2 * time.Second
+)
+
+type LeaderElectionConfig struct {
+	Namespace     string        // Lease所在的namespace
+	Name          string        // Lease名，同一组副本使用相同的名字
+	Identity      string        // 本副本的标识 默认为 hostname_随机串
+	LeaseDuration time.Duration // 非leader等待多久后尝试抢占 默认15s
+	RenewDeadline time.Duration // leader续约的超时时间，超时后放弃leader 默认10s
+	RetryPeriod   time.Duration // 抢占和续约的重试间隔 默认2s
+}
+
+func (c *LeaderElectionConfig) setDefaults() error {
+	if c.Namespace == "" || c.Name == "" {
+		return errors.New("lease namespace and name can't be empty")
+	}
+	if c.LeaseDuration < 0 || c.RenewDeadline < 0 || c.RetryPeriod < 0 {
+		return errors.New("leader election config can't be negative")
+	}
+	if c.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "leader election identity")
+		}
+		c.Identity = hostname + "_" + string(uuid.NewUUID())
+	}
+	if c.LeaseDuration == 0 {
+		c.LeaseDuration = defaultLeaseDuration
+	}
+	if c.RenewDeadline == 0 {
+		c.RenewDeadline = defaultRenewDeadline
+	}
+	if c.RetryPeriod == 0 {
+		c.RetryPeriod = defaultRetryPeriod
+	}
+	return nil
+}
+
+// 选主的配置，通过WithLeaderElection设置
+type leaderElection struct {
+	client kubernetes.Interface
+	cfg    LeaderElectionConfig
+}
+
+/*
+开启基于Lease的选主，多副本部署时只有leader推送事件，避免重复通知
+所有副本都会同步informer、运行状态机，非leader只是不推送；成为leader时补发当前所有失败资源的状态
+client只用于读写Lease，可以与监控的集群不同
+*/
+func WithLeaderElection(client kubernetes.Interface, cfg LeaderElectionConfig) Option {
+	return func(w *K8sWatcher) {
+		w.election = &leaderElection{client: client, cfg: cfg}
+	}
+}
+
+// 构造选主器，配置错误在构造watcher时返回
+func (w *K8sWatcher) newLeaderElector() (*leaderelection.LeaderElector, error) {
+	if w.election.client == nil {
+		return nil, errors.New("leader election client can't be null")
+	}
+	cfg := &w.election.cfg
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: cfg.Namespace, Name: cfg.Name},
+		Client:     w.election.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: cfg.Identity},
+	}
+	return leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   cfg.LeaseDuration,
+		RenewDeadline:   cfg.RenewDeadline,
+		RetryPeriod:     cfg.RetryPeriod,
+		ReleaseOnCancel: true, // 停止时释放Lease，其他副本可以立即接替
+		Name:            cfg.Namespace + "/" + cfg.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				w.sender.SetStandby(false)
+				n := w.replayFailing()
+				util.Infow("leader_election_started_leading", "lease", cfg.Namespace+"/"+cfg.Name, "identity", cfg.Identity, "replayed", n)
+			},
+			OnStoppedLeading: func() {
+				w.sender.SetStandby(true)
+				util.Infow("leader_election_stopped_leading", "lease", cfg.Namespace+"/"+cfg.Name, "identity", cfg.Identity)
+			},
+			OnNewLeader: func(identity string) {
+				util.Debugw("leader_election_new_leader", "lease", cfg.Namespace+"/"+cfg.Name, "leader", identity)
+			},
+		},
+	})
+}
+
+/*
+informer同步完成且controller处理完首次同步的数据后开始选主，失去leader后继续参与选举，直到watcher停止
+*/
+func (w *K8sWatcher) startLeaderElection() {
+	if w.elector == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(w.ctx)
+	w.electionCancel = cancel
+	go func() {
+		// 缓存树完整后成为leader，补发的失败资源才是完整的
+		err := wait.PollUntilContextCancel(ctx, 100*time.Millisecond, true, func(context.Context) (bool, error) {
+			return w.initialSyncDone(), nil
+		})
+		if err != nil {
+			return
+		}
+		for ctx.Err() == nil {
+			w.elector.Run(ctx) // 失去leader或者ctx结束时返回
+		}
+	}()
+}
+
+func (w *K8sWatcher) initialSyncDone() bool {
+	if w.Recovering() {
+		return false
+	}
+	for _, i := range w.informers() {
+		if i.informer != nil && !i.informer.HasSynced() {
+			return false
+		}
+	}
+	_, runners := w.current()
+	for _, runner := range runners {
+		if !runner.Idle() {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *K8sWatcher) stopLeaderElection() {
+	if w.electionCancel != nil {
+		w.electionCancel()
+	}
+}
+
+// 补发当前所有失败的资源，返回补发的数量
+func (w *K8sWatcher) replayFailing() int {
+	list := make([]sender.SendOut, 0)
+	w.keyCache.Range(func(rc *resource.ResourceCache) bool {
+		if rc.GetStatus() == constant.K8sResStatusFail {
+			list = append(list, rc.GetSendOut())
+		}
+		return false
+	})
+	w.sender.Replay(list...)
+	return len(list)
+}
+
+/*
+是否为leader，没有开启选主时总是true
+*/
+func (w *K8sWatcher) IsLeader() bool {
+	if w.elector == nil {
+		return true
+	}
+	return w.elector.IsLeader() && !w.sender.Standby()
+}
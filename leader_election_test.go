@@ -0,0 +1,294 @@
+package kubewatcher
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/sender"
+	appv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testLeaseNamespace = "kube-system"
+	testLeaseName      = "kubewatcher"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// available为false时deployment没有可用副本，状态为failed
+func testDeployment(name string, available bool) *appv1.Deployment {
+	replicas := int32(1)
+	d := &appv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       appv1.DeploymentSpec{Replicas: &replicas},
+	}
+	if available {
+		d.Status = appv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	}
+	return d
+}
+
+// 由测试启动的外部informer，所有副本共用
+func startDepInformer(t *testing.T, ctx context.Context, cs kubernetes.Interface) *K8sWatcherInformer {
+	factory := informers.NewSharedInformerFactory(cs, 0)
+	informer := &K8sWatcherInformer{DepInformer: factory.Apps().V1().Deployments().Informer()}
+	factory.Start(ctx.Done())
+	return informer
+}
+
+type outRecorder struct {
+	lock sync.Mutex
+	list []sender.SendOut
+}
+
+func (r *outRecorder) add(out sender.SendOut) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.list = append(r.list, out)
+}
+
+// 收到的事件的key，按收到的顺序
+func (r *outRecorder) keys() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	keys := make([]string, 0, len(r.list))
+	for _, out := range r.list {
+		keys = append(keys, out.Key)
+	}
+	return keys
+}
+
+func (r *outRecorder) last() sender.SendOut {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.list[len(r.list)-1]
+}
+
+func (r *outRecorder) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.list = nil
+}
+
+func startReplica(t *testing.T, ctx context.Context, informer *K8sWatcherInformer, leaseClient kubernetes.Interface, identity string) (*K8sWatcher, *outRecorder) {
+	t.Helper()
+	w, err := NewWatcher(ctx,
+		WithInformer(informer),
+		WithKinds(constant.DeploymentKind),
+		WithLeaderElection(leaseClient, LeaderElectionConfig{
+			Namespace:     testLeaseNamespace,
+			Name:          testLeaseName,
+			Identity:      identity,
+			LeaseDuration: time.Second,
+			RenewDeadline: 500 * time.Millisecond,
+			RetryPeriod:   100 * time.Millisecond,
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &outRecorder{}
+	w.Subscribe(rec.add)
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.Close)
+	return w, rec
+}
+
+func leaseHolder(t *testing.T, cs kubernetes.Interface) string {
+	t.Helper()
+	lease, err := cs.CoordinationV1().Leases(testLeaseNamespace).Get(context.Background(), testLeaseName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+// watcher的缓存树中资源的状态，用于确认standby的副本也处理了事件
+func snapshotStatus(w *K8sWatcher, key string) constant.K8sResStatus {
+	for _, out := range w.Snapshot() {
+		if out.Key == key {
+			return out.Status
+		}
+	}
+	return ""
+}
+
+func sortedKeys(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLeaderElectionStandbyAndTakeover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := fake.NewSimpleClientset(testDeployment("web", false), testDeployment("api", true))
+	informer := startDepInformer(t, ctx, cs)
+
+	a, recA := startReplica(t, ctx, informer, cs, "a")
+	waitFor(t, a.IsLeader)
+	// 成为leader时只补发失败的资源，首次同步产生的事件在standby期间不推送
+	waitFor(t, func() bool { return len(recA.keys()) > 0 })
+	if keys := recA.keys(); !equalKeys(keys, []string{"default/web"}) {
+		t.Fatalf("replica a received %v on takeover, want [default/web]", keys)
+	}
+	if holder := leaseHolder(t, cs); holder != "a" {
+		t.Fatalf("lease holder = %q, want a", holder)
+	}
+
+	b, recB := startReplica(t, ctx, informer, cs, "b")
+	waitFor(t, func() bool { return b.Ready() == nil })
+	// 没有pod的deployment每次更新都重新建立缓存节点，删除事件才会推送，这里用删除验证leader的实时推送
+	deps := cs.AppsV1().Deployments("default")
+	if err := deps.Delete(ctx, "api", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deps.Create(ctx, testDeployment("db", false), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(recA.keys()) == 2 })
+	if keys := recA.keys(); keys[1] != "default/api" {
+		t.Fatalf("replica a received %v, want delete of default/api", keys)
+	}
+	// standby的副本同样处理事件，只是不推送
+	waitFor(t, func() bool { return snapshotStatus(b, "default/db") == constant.K8sResStatusFail })
+	if st := snapshotStatus(b, "default/api"); st != "" {
+		t.Fatalf("replica b still caches default/api as %q", st)
+	}
+	time.Sleep(300 * time.Millisecond) // 几个RetryPeriod，b不应抢到Lease
+	if b.IsLeader() {
+		t.Fatal("replica b should be standby while a holds the lease")
+	}
+	if keys := recB.keys(); len(keys) != 0 {
+		t.Fatalf("standby replica b pushed %v", keys)
+	}
+
+	// a停止时释放Lease，b立即接替并补发当前所有失败的资源
+	if _, err := a.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, b.IsLeader)
+	waitFor(t, func() bool { return len(recB.keys()) >= 2 })
+	if keys := sortedKeys(recB.keys()); !equalKeys(keys, []string{"default/db", "default/web"}) {
+		t.Fatalf("replica b replayed %v, want [default/db default/web]", keys)
+	}
+	if holder := leaseHolder(t, cs); holder != "b" {
+		t.Fatalf("lease holder = %q, want b", holder)
+	}
+
+	// 接替后正常推送新的事件
+	if err := deps.Delete(ctx, "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(recB.keys()) == 3 })
+	if out := recB.last(); out.Key != "default/web" || out.Status != constant.K8sResStatusDelete {
+		t.Fatalf("replica b pushed %+v, want delete of default/web", out)
+	}
+}
+
+// 续约失败（Lease被其他副本持有）时退回standby，不再推送；重新抢到Lease后补发
+func TestLeaderElectionStepsDown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := fake.NewSimpleClientset(testDeployment("web", false), testDeployment("api", true))
+	informer := startDepInformer(t, ctx, cs)
+	a, recA := startReplica(t, ctx, informer, cs, "a")
+	waitFor(t, a.IsLeader)
+	waitFor(t, func() bool { return len(recA.keys()) == 1 })
+
+	setHolder := func(holder string, duration int32) {
+		t.Helper()
+		leases := cs.CoordinationV1().Leases(testLeaseNamespace)
+		lease, err := leases.Get(ctx, testLeaseName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := metav1.NewMicroTime(time.Now())
+		lease.Spec.HolderIdentity = &holder
+		lease.Spec.LeaseDurationSeconds = &duration
+		lease.Spec.AcquireTime = &now
+		lease.Spec.RenewTime = &now
+		if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setHolder("other", 60)
+	waitFor(t, func() bool { return !a.IsLeader() && a.sender.Standby() })
+
+	recA.reset()
+	if _, err := cs.AppsV1().Deployments("default").Update(ctx, testDeployment("api", false), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return snapshotStatus(a, "default/api") == constant.K8sResStatusFail })
+	time.Sleep(100 * time.Millisecond)
+	if keys := recA.keys(); len(keys) != 0 {
+		t.Fatalf("replica a pushed %v after stepping down", keys)
+	}
+
+	// 其他副本释放Lease后a重新成为leader，补发standby期间的失败资源
+	setHolder("", 1)
+	waitFor(t, a.IsLeader)
+	waitFor(t, func() bool { return len(recA.keys()) >= 2 })
+	if keys := sortedKeys(recA.keys()); !equalKeys(keys, []string{"default/api", "default/web"}) {
+		t.Fatalf("replica a replayed %v, want [default/api default/web]", keys)
+	}
+}
+
+func TestLeaderElectionConfig(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	cases := []struct {
+		name string
+		opt  Option
+	}{
+		{"nil client", WithLeaderElection(nil, LeaderElectionConfig{Namespace: "ns", Name: "lease"})},
+		{"empty name", WithLeaderElection(cs, LeaderElectionConfig{Namespace: "ns"})},
+		{"negative duration", WithLeaderElection(cs, LeaderElectionConfig{Namespace: "ns", Name: "lease", RetryPeriod: -1})},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := NewWatcher(context.Background(), WithInformer(&K8sWatcherInformer{}), c.opt); err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+	w, err := NewWatcher(context.Background(), WithInformer(&K8sWatcherInformer{}),
+		WithLeaderElection(cs, LeaderElectionConfig{Namespace: "ns", Name: "lease"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg := w.election.cfg; cfg.Identity == "" || cfg.LeaseDuration != defaultLeaseDuration || cfg.RenewDeadline != defaultRenewDeadline || cfg.RetryPeriod != defaultRetryPeriod {
+		t.Fatalf("defaults = %+v", cfg)
+	}
+}
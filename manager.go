@@ -0,0 +1,300 @@
+package kubewatcher
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/sender"
+	"github.com/sunreaver/kubewatcher/util"
+	"k8s.io/client-go/kubernetes"
+)
+
+type ClusterState string
+
+const (
+	ClusterStarting ClusterState = "Starting" // 等待informer同步
+	ClusterRunning  ClusterState = "Running"
+	ClusterFailed   ClusterState = "Failed" // 启动失败（例如informer同步超时），已停止并被隔离，不影响其他集群；开启自动恢复时在后台重建，成功后变为Running
+)
+
+type ClusterStatus struct {
+	Name  string
+	State ClusterState
+	Err   error     // Failed时的原因
+	Since time.Time // 进入当前状态的时间
+}
+
+type managedCluster struct {
+	watcher *K8sWatcher
+	cancel  context.CancelFunc
+	state   ClusterState
+	err     error
+	since   time.Time
+	started chan struct{} // 启动流程结束（成功或失败）
+}
+
+type managerSubscriber struct {
+	fn   func(out sender.SendOut)
+	opts []sender.SubscribeOption
+}
+
+/*
+管理多个集群的watcher，key为集群名（即platform），每个推送事件的Cluster为集群名
+集群可以在运行时添加、移除；每个集群独立启动，某个集群informer同步超时只会把该集群标记为Failed
+通过Manager订阅的回调会收到所有集群的事件，回调会被不同集群的推送协程并发调用
+*/
+type Manager struct {
+	ctx  context.Context
+	opts []Option // 应用到每个集群的watcher上
+
+	lock        sync.RWMutex
+	clusters    map[string]*managedCluster
+	subscribers []managerSubscriber
+	sinks       []sender.Sink
+	closed      bool
+}
+
+/*
+opts会应用到每个集群的watcher，例如多个集群共用一个Metrics：NewManager(ctx, WithMetrics(m))
+*/
+func NewManager(ctx context.Context, opts ...Option) *Manager {
+	return &Manager{
+		ctx:      ctx,
+		opts:     opts,
+		clusters: map[string]*managedCluster{},
+	}
+}
+
+/*
+添加集群，使用clientSet创建informer，异步等待informer同步，通过Clusters查看启动状态
+*/
+func (m *Manager) AddClusterByClientSet(name string, clientSet *kubernetes.Clientset, opts ...Option) error {
+	if clientSet == nil {
+		return errors.New("clientSet can't be null")
+	}
+	return m.addCluster(name, opts, func(w *K8sWatcher) error {
+		w.clientSet = clientSet
+		return w.fromClientSet().start()
+	})
+}
+
+/*
+添加集群，使用外部的informer，informer的启动和停止由外部控制，移除集群时只停止该集群的controller和sender
+*/
+func (m *Manager) AddClusterByInformer(name string, informer *K8sWatcherInformer, opts ...Option) error {
+	if informer == nil {
+		return errors.New("informer can't be null")
+	}
+	return m.addCluster(name, opts, func(w *K8sWatcher) error {
+		w.informer = informer
+		return w.fromInformer().start()
+	})
+}
+
+func (m *Manager) addCluster(name string, opts []Option, start func(w *K8sWatcher) error) error {
+	if name == "" {
+		return errors.New("cluster name can't be empty")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return errors.New("manager is shut down")
+	}
+	if _, exist := m.clusters[name]; exist {
+		return errors.Errorf("cluster %q already exists", name)
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	allOpts := append(append([]Option{}, m.opts...), opts...)
+	allOpts = append(allOpts, WithPlatform(name))
+	w := newK8sWatcher(ctx, name, allOpts...)
+	// 在启动前订阅，不会漏掉informer首次同步产生的事件
+	for _, sub := range m.subscribers {
+		w.Subscribe(sub.fn, sub.opts...)
+	}
+	mc := &managedCluster{
+		watcher: w,
+		cancel:  cancel,
+		state:   ClusterStarting,
+		since:   time.Now(),
+		started: make(chan struct{}),
+	}
+	m.clusters[name] = mc
+	w.recoverHook = func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if m.clusters[name] != mc || mc.state != ClusterFailed {
+			return
+		}
+		mc.state, mc.err, mc.since = ClusterRunning, nil, time.Now()
+		util.Infow("manager_cluster_recovered", "cluster", name)
+	}
+
+	go func() {
+		defer close(mc.started)
+		err := start(w)
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if m.clusters[name] != mc {
+			return // 启动过程中已被移除
+		}
+		mc.since = time.Now()
+		if err != nil {
+			mc.state, mc.err = ClusterFailed, err
+			util.Errorw("manager_cluster_failed", "cluster", name, "error", err)
+			return
+		}
+		mc.state = ClusterRunning
+		util.Infow("manager_cluster_running", "cluster", name)
+	}()
+	return nil
+}
+
+/*
+移除集群并优雅停止其watcher，返回值同K8sWatcher.Shutdown
+*/
+func (m *Manager) RemoveCluster(ctx context.Context, name string) (dropped int, err error) {
+	m.lock.Lock()
+	mc, exist := m.clusters[name]
+	if exist {
+		delete(m.clusters, name)
+	}
+	m.lock.Unlock()
+	if !exist {
+		return 0, errors.Errorf("cluster %q not found", name)
+	}
+	return m.stopCluster(ctx, mc)
+}
+
+func (m *Manager) stopCluster(ctx context.Context, mc *managedCluster) (int, error) {
+	defer mc.cancel()
+	select {
+	case <-mc.started:
+	default:
+		// 还在等待informer同步，直接取消
+		mc.cancel()
+		select {
+		case <-mc.started:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	return mc.watcher.Shutdown(ctx)
+}
+
+/*
+订阅所有集群（包括之后添加的集群）的事件，选项同K8sWatcher.Subscribe
+*/
+func (m *Manager) Subscribe(fn func(out sender.SendOut), opts ...sender.SubscribeOption) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.subscribers = append(m.subscribers, managerSubscriber{fn: fn, opts: opts})
+	for _, mc := range m.clusters {
+		mc.watcher.Subscribe(fn, opts...)
+	}
+}
+
+/*
+添加所有集群共用的推送目标，移除集群时不会关闭，Manager停止时关闭
+*/
+func (m *Manager) AddSink(sink sender.Sink, opts ...sender.SubscribeOption) {
+	m.lock.Lock()
+	m.sinks = append(m.sinks, sink)
+	m.lock.Unlock()
+	m.Subscribe(sink.Send, opts...)
+}
+
+// 集群的watcher，Failed的集群也会返回，没有开启自动恢复时其watcher已停止
+func (m *Manager) Watcher(name string) (*K8sWatcher, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	mc, exist := m.clusters[name]
+	if !exist {
+		return nil, false
+	}
+	return mc.watcher, true
+}
+
+/*
+集群启动失败并且没有开启自动恢复，其watcher已停止，只能移除后重新添加
+开启自动恢复的Failed集群在后台重建，不需要重新添加
+*/
+func (m *Manager) failedWithoutRecovery(name string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	mc, exist := m.clusters[name]
+	return exist && mc.state == ClusterFailed && mc.watcher.cfg.recovery == nil
+}
+
+// 所有集群的状态，按集群名排序
+func (m *Manager) Clusters() []ClusterStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	list := make([]ClusterStatus, 0, len(m.clusters))
+	for name, mc := range m.clusters {
+		list = append(list, ClusterStatus{Name: name, State: mc.state, Err: mc.err, Since: mc.since})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+/*
+所有Running集群的资源状态快照
+*/
+func (m *Manager) Snapshot() []sender.SendOut {
+	m.lock.RLock()
+	watchers := make([]*K8sWatcher, 0, len(m.clusters))
+	for _, mc := range m.clusters {
+		if mc.state == ClusterRunning {
+			watchers = append(watchers, mc.watcher)
+		}
+	}
+	m.lock.RUnlock()
+	list := make([]sender.SendOut, 0)
+	for _, w := range watchers {
+		list = append(list, w.Snapshot()...)
+	}
+	return list
+}
+
+/*
+停止所有集群，之后关闭通过AddSink添加的推送目标
+返回值为所有集群丢弃的事件数之和
+*/
+func (m *Manager) Shutdown(ctx context.Context) (int, error) {
+	m.lock.Lock()
+	m.closed = true
+	clusters := m.clusters
+	m.clusters = map[string]*managedCluster{}
+	sinks := m.sinks
+	m.lock.Unlock()
+
+	var (
+		wg       sync.WaitGroup
+		resLock  sync.Mutex
+		dropped  int
+		firstErr error
+	)
+	for name, mc := range clusters {
+		wg.Add(1)
+		go func(name string, mc *managedCluster) {
+			defer wg.Done()
+			n, err := m.stopCluster(ctx, mc)
+			resLock.Lock()
+			defer resLock.Unlock()
+			dropped += n
+			if err != nil && firstErr == nil {
+				firstErr = errors.Wrapf(err, "cluster %q", name)
+			}
+		}(name, mc)
+	}
+	wg.Wait()
+	for _, sink := range sinks {
+		if err := sink.Close(ctx); err != nil && firstErr == nil {
+			firstErr = errors.Wrap(err, "close sink")
+		}
+	}
+	return dropped, firstErr
+}
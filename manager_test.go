@@ -0,0 +1,238 @@
+package kubewatcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/sender"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+// 没有启动的informer，等待同步时一定超时
+func unstartedDepInformer(cs kubernetes.Interface) *K8sWatcherInformer {
+	factory := informers.NewSharedInformerFactory(cs, 0)
+	return &K8sWatcherInformer{DepInformer: factory.Apps().V1().Deployments().Informer()}
+}
+
+// 删除deployment，没有pod的deployment只在删除时推送事件
+func deleteDeployment(t *testing.T, cs kubernetes.Interface, name string) {
+	t.Helper()
+	if err := cs.AppsV1().Deployments("default").Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func clusterState(m *Manager, name string) (ClusterState, error) {
+	for _, c := range m.Clusters() {
+		if c.Name == name {
+			return c.State, c.Err
+		}
+	}
+	return "", nil
+}
+
+// 记录关闭的sink
+type closeRecorder struct {
+	outRecorder
+	closed bool
+}
+
+func (s *closeRecorder) Send(out sender.SendOut) {
+	s.add(out)
+}
+
+func (s *closeRecorder) Close(context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestManagerAddRemoveCluster(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := NewManager(ctx, WithKinds(constant.DeploymentKind))
+	rec := &outRecorder{}
+	m.Subscribe(rec.add)
+
+	csA := fake.NewSimpleClientset(testDeployment("web", false))
+	if err := m.AddClusterByInformer("a", startDepInformer(t, ctx, csA)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { s, _ := clusterState(m, "a"); return s == ClusterRunning })
+	waitFor(t, func() bool { return len(m.Snapshot()) == 1 })
+	deleteDeployment(t, csA, "web")
+	waitFor(t, func() bool { return len(rec.keys()) == 1 })
+	if out := rec.last(); out.Cluster != "a" || out.Key != "default/web" || out.Status != constant.K8sResStatusDelete {
+		t.Fatalf("event = %+v, want default/web deleted in cluster a", out)
+	}
+
+	// 集群名重复、为空以及informer为空都返回错误
+	if err := m.AddClusterByInformer("a", startDepInformer(t, ctx, csA)); err == nil {
+		t.Fatal("want error for duplicate cluster name")
+	}
+	if err := m.AddClusterByInformer("", startDepInformer(t, ctx, csA)); err == nil {
+		t.Fatal("want error for empty cluster name")
+	}
+	if err := m.AddClusterByInformer("x", nil); err == nil {
+		t.Fatal("want error for nil informer")
+	}
+	if err := m.AddClusterByClientSet("x", nil); err == nil {
+		t.Fatal("want error for nil clientSet")
+	}
+
+	// 之后添加的集群同样推送给已有的订阅者，Cluster为集群名
+	csB := fake.NewSimpleClientset(testDeployment("api", false), testDeployment("tmp", false))
+	if err := m.AddClusterByInformer("b", startDepInformer(t, ctx, csB)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(m.Snapshot()) == 2 })
+	deleteDeployment(t, csB, "tmp")
+	waitFor(t, func() bool { return len(rec.keys()) == 2 })
+	if out := rec.last(); out.Cluster != "b" || out.Key != "default/tmp" {
+		t.Fatalf("event = %+v, want default/tmp in cluster b", out)
+	}
+	if w, ok := m.Watcher("b"); !ok || w.Platform() != "b" {
+		t.Fatal("watcher of cluster b not found")
+	}
+
+	if _, err := m.RemoveCluster(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Watcher("b"); ok {
+		t.Fatal("removed cluster is still returned")
+	}
+	if _, err := m.RemoveCluster(context.Background(), "b"); err == nil {
+		t.Fatal("want error for unknown cluster")
+	}
+	if list := m.Clusters(); len(list) != 1 || list[0].Name != "a" {
+		t.Fatalf("clusters = %+v, want only a", list)
+	}
+	if snapshot := m.Snapshot(); len(snapshot) != 0 {
+		t.Fatalf("snapshot = %+v, want nothing from the removed cluster", snapshot)
+	}
+
+	// 移除后同名集群可以重新添加
+	if err := m.AddClusterByInformer("b", startDepInformer(t, ctx, csB)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { s, _ := clusterState(m, "b"); return s == ClusterRunning })
+}
+
+// 某个集群同步失败只会把它标记为Failed，不影响其他集群
+func TestManagerClusterFailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := NewManager(ctx, WithKinds(constant.DeploymentKind), WithSyncTimeout(300*time.Millisecond))
+	rec := &outRecorder{}
+	m.Subscribe(rec.add)
+
+	if err := m.AddClusterByInformer("broken", unstartedDepInformer(fake.NewSimpleClientset())); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := clusterState(m, "broken"); s != ClusterStarting {
+		t.Fatalf("state = %s, want Starting while waiting for sync", s)
+	}
+	// apiserver不可用的clientSet
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	cs, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddClusterByClientSet("unreachable", cs); err != nil {
+		t.Fatal(err)
+	}
+	healthy := fake.NewSimpleClientset(testDeployment("web", false), testDeployment("tmp", false))
+	if err := m.AddClusterByInformer("healthy", startDepInformer(t, ctx, healthy)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		a, _ := clusterState(m, "broken")
+		b, _ := clusterState(m, "unreachable")
+		c, _ := clusterState(m, "healthy")
+		return a == ClusterFailed && b == ClusterFailed && c == ClusterRunning
+	})
+	for _, name := range []string{"broken", "unreachable"} {
+		if _, err := clusterState(m, name); err == nil {
+			t.Fatalf("cluster %s is Failed without an error", name)
+		}
+	}
+	waitFor(t, func() bool { return len(m.Snapshot()) == 2 })
+	deleteDeployment(t, healthy, "tmp")
+	waitFor(t, func() bool { return len(rec.keys()) == 1 })
+	if out := rec.last(); out.Cluster != "healthy" {
+		t.Fatalf("event from cluster %q, want healthy", out.Cluster)
+	}
+	if snapshot := m.Snapshot(); len(snapshot) != 1 || snapshot[0].Cluster != "healthy" || snapshot[0].Key != "default/web" {
+		t.Fatalf("snapshot = %+v, want only the healthy cluster", snapshot)
+	}
+	// Failed的集群可以移除
+	if _, err := m.RemoveCluster(context.Background(), "broken"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 还在等待同步的集群被移除时直接取消，不用等到同步超时
+func TestManagerRemoveStartingCluster(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := NewManager(ctx, WithKinds(constant.DeploymentKind), WithSyncTimeout(time.Hour))
+	if err := m.AddClusterByInformer("slow", unstartedDepInformer(fake.NewSimpleClientset())); err != nil {
+		t.Fatal(err)
+	}
+	removeCtx, removeCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer removeCancel()
+	if _, err := m.RemoveCluster(removeCtx, "slow"); err != nil {
+		t.Fatal(err)
+	}
+	if list := m.Clusters(); len(list) != 0 {
+		t.Fatalf("clusters = %+v, want none", list)
+	}
+}
+
+func TestManagerShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := NewManager(ctx, WithKinds(constant.DeploymentKind))
+	sink := &closeRecorder{}
+	m.AddSink(sink)
+	for _, name := range []string{"a", "b"} {
+		cs := fake.NewSimpleClientset(testDeployment("web", false))
+		if err := m.AddClusterByInformer(name, startDepInformer(t, ctx, cs)); err != nil {
+			t.Fatal(err)
+		}
+		w, _ := m.Watcher(name)
+		waitFor(t, func() bool { return len(w.Snapshot()) == 1 })
+		deleteDeployment(t, cs, "web")
+	}
+	waitFor(t, func() bool { return len(sink.keys()) == 2 })
+
+	if _, err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sink.lock.Lock()
+	closed := sink.closed
+	sink.lock.Unlock()
+	if !closed {
+		t.Fatal("sink should be closed on shutdown")
+	}
+	if list := m.Clusters(); len(list) != 0 {
+		t.Fatalf("clusters = %+v, want none after shutdown", list)
+	}
+	cs := fake.NewSimpleClientset()
+	if err := m.AddClusterByInformer("c", startDepInformer(t, ctx, cs)); err == nil {
+		t.Fatal("want error after shutdown")
+	}
+}
@@ -0,0 +1,299 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/resource"
+	"github.com/sunreaver/kubewatcher/sender"
+	"github.com/sunreaver/kubewatcher/util"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// KeyConsume耗时的分桶 单位秒
+var consumeBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// 资源状态gauge中输出的状态，当前状态为1其余为0
+var resourceStatuses = []constant.K8sResStatus{constant.K8sResStatusSucceed, constant.K8sResStatusFail}
+
+type transitionKey struct {
+	cluster  string
+	kind     constant.K8sResKind
+	typ      constant.EventType
+	status   constant.K8sResStatus
+	category string
+}
+
+// 按集群和资源类型统计的指标的key
+type kindKey struct {
+	cluster string
+	kind    constant.K8sResKind
+}
+
+// 注册的资源缓存及其所属集群
+type clusterCache struct {
+	cluster string
+	cache   *resource.ResourceKeyCache
+}
+
+type histogram struct {
+	buckets []uint64 // 与consumeBuckets一一对应，非累计值
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range consumeBuckets {
+		if v <= b {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+/*
+watcher的监控指标，以prometheus text format输出
+资源状态在抓取时从ResourceKeyCache计算，其余指标在运行过程中累计
+所有指标都带cluster标签（watcher的platform），多个集群可以共用一个Metrics
+*/
+type Metrics struct {
+	lock          sync.Mutex
+	transitions   map[transitionKey]uint64
+	consume       map[kindKey]*histogram
+	consumeErrors map[kindKey]uint64
+	retries       map[kindKey]uint64
+	drops         map[kindKey]uint64
+	queues        map[workqueue.RateLimitingInterface]kindKey
+	caches        []clusterCache
+	senders       []*sender.Sender
+	retiredDrops  map[string]int // 已注销的sender丢弃的事件数，key为集群，保持counter单调递增
+}
+
+func New() *Metrics {
+	return &Metrics{
+		transitions:   map[transitionKey]uint64{},
+		consume:       map[kindKey]*histogram{},
+		consumeErrors: map[kindKey]uint64{},
+		retries:       map[kindKey]uint64{},
+		drops:         map[kindKey]uint64{},
+		queues:        map[workqueue.RateLimitingInterface]kindKey{},
+		retiredDrops:  map[string]int{},
+	}
+}
+
+// 注册资源缓存，用于输出资源当前状态，cluster为所属集群
+func (m *Metrics) RegisterCache(cluster string, c *resource.ResourceKeyCache) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.caches = append(m.caches, clusterCache{cluster: cluster, cache: c})
+}
+
+// 注册sender，统计原始状态变化以及缓冲占用
+func (m *Metrics) RegisterSender(s *sender.Sender) {
+	m.lock.Lock()
+	m.senders = append(m.senders, s)
+	m.lock.Unlock()
+	s.AddObserver(m.ObserveSendOut)
+}
+
+/*
+注销资源缓存和sender，watcher停止后调用，避免已移除集群的资源状态残留
+*/
+func (m *Metrics) Unregister(c *resource.ResourceKeyCache, s *sender.Sender) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, v := range m.caches {
+		if v.cache == c {
+			m.caches = append(m.caches[:i], m.caches[i+1:]...)
+			break
+		}
+	}
+	for i, v := range m.senders {
+		if v == s {
+			m.retiredDrops[s.Cluster()] += s.Dropped()
+			m.senders = append(m.senders[:i], m.senders[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *Metrics) ObserveSendOut(out sender.SendOut) {
+	key := transitionKey{cluster: out.Cluster, kind: out.Kind, typ: out.Type, status: out.Status, category: util.ReasonCategory(out.Reason)}
+	if out.Status != constant.K8sResStatusFail {
+		key.category = "None"
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.transitions[key]++
+}
+
+/*
+controller运行过程的观察者，统计的指标带上cluster标签
+通过controller.WithObserver(m.ForCluster(platform))设置
+*/
+type ClusterObserver struct {
+	m       *Metrics
+	cluster string
+}
+
+func (m *Metrics) ForCluster(cluster string) *ClusterObserver {
+	return &ClusterObserver{m: m, cluster: cluster}
+}
+
+func (o *ClusterObserver) key(kind constant.K8sResKind) kindKey {
+	return kindKey{cluster: o.cluster, kind: kind}
+}
+
+func (o *ClusterObserver) ObserveQueue(kind constant.K8sResKind, queue workqueue.RateLimitingInterface) {
+	o.m.lock.Lock()
+	defer o.m.lock.Unlock()
+	o.m.queues[queue] = o.key(kind)
+}
+
+func (o *ClusterObserver) ObserveConsume(kind constant.K8sResKind, duration time.Duration, err error) {
+	o.m.lock.Lock()
+	defer o.m.lock.Unlock()
+	h, ok := o.m.consume[o.key(kind)]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(consumeBuckets))}
+		o.m.consume[o.key(kind)] = h
+	}
+	h.observe(duration.Seconds())
+	if err != nil {
+		o.m.consumeErrors[o.key(kind)]++
+	}
+}
+
+func (o *ClusterObserver) ObserveRetry(kind constant.K8sResKind) {
+	o.m.lock.Lock()
+	defer o.m.lock.Unlock()
+	o.m.retries[o.key(kind)]++
+}
+
+func (o *ClusterObserver) ObserveDrop(kind constant.K8sResKind) {
+	o.m.lock.Lock()
+	defer o.m.lock.Unlock()
+	o.m.drops[o.key(kind)]++
+}
+
+// 以prometheus text format输出所有指标
+func (m *Metrics) Write(w io.Writer) error {
+	return writeFamilies(w, m.collect())
+}
+
+// 可以直接挂到 /metrics 上
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		if err := m.Write(w); err != nil {
+			util.Warnw("metrics_write", "error", err)
+		}
+	})
+}
+
+func (m *Metrics) collect() []*family {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	resourceStatus := &family{name: "kubewatcher_resource_status", help: "Current status of each watched resource, 1 for the current status.", typ: typeGauge}
+	for _, c := range m.caches {
+		c.cache.Range(func(rc *resource.ResourceCache) bool {
+			nameSpace, _ := util.SplitResourceCacheKey(rc.GetKey())
+			for _, status := range resourceStatuses {
+				v := 0.0
+				if rc.GetStatus() == status {
+					v = 1
+				}
+				resourceStatus.add(v, label{"cluster", c.cluster}, label{"kind", string(rc.GetKind())}, label{"namespace", nameSpace}, label{"name", rc.GetName()}, label{"status", string(status)})
+			}
+			return false
+		})
+	}
+
+	transitions := &family{name: "kubewatcher_transitions_total", help: "Status transitions produced by the watcher state machine.", typ: typeCounter}
+	for k, v := range m.transitions {
+		transitions.add(float64(v), label{"cluster", k.cluster}, label{"kind", string(k.kind)}, label{"type", string(k.typ)}, label{"status", string(k.status)}, label{"reason_category", k.category})
+	}
+
+	depth := &family{name: "kubewatcher_workqueue_depth", help: "Current depth of the controller workqueue.", typ: typeGauge}
+	depthByKind := map[kindKey]int{}
+	for q, key := range m.queues {
+		if q.ShuttingDown() {
+			delete(m.queues, q) // controller已停止
+			continue
+		}
+		depthByKind[key] += q.Len()
+	}
+	for key, v := range depthByKind {
+		depth.add(float64(v), key.labels()...)
+	}
+
+	consume := &family{name: "kubewatcher_key_consume_duration_seconds", help: "Latency of KeyConsume in the controller workers.", typ: typeHistogram}
+	keys := make([]kindKey, 0, len(m.consume))
+	for key := range m.consume {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].cluster != keys[j].cluster {
+			return keys[i].cluster < keys[j].cluster
+		}
+		return keys[i].kind < keys[j].kind
+	})
+	for _, key := range keys {
+		h := m.consume[key]
+		var cumulative uint64
+		for i, b := range consumeBuckets {
+			cumulative += h.buckets[i]
+			consume.samples = append(consume.samples, sample{suffix: "_bucket", labels: append(key.labels(), label{"le", formatValue(b)}), value: float64(cumulative)})
+		}
+		consume.samples = append(consume.samples,
+			sample{suffix: "_bucket", labels: append(key.labels(), label{"le", "+Inf"}), value: float64(h.count)},
+			sample{suffix: "_sum", labels: key.labels(), value: h.sum},
+			sample{suffix: "_count", labels: key.labels(), value: float64(h.count)},
+		)
+	}
+
+	consumeErrors := kindCounter("kubewatcher_key_consume_errors_total", "KeyConsume calls that returned an error.", m.consumeErrors)
+	retries := kindCounter("kubewatcher_workqueue_retries_total", "Keys requeued after a failed KeyConsume.", m.retries)
+	drops := kindCounter("kubewatcher_workqueue_drops_total", "Keys dropped after exceeding the retry limit.", m.drops)
+
+	pending := &family{name: "kubewatcher_sender_pending", help: "Events buffered in the sender waiting for dispatch.", typ: typeGauge}
+	capacity := &family{name: "kubewatcher_sender_capacity", help: "Buffer capacity of the sender.", typ: typeGauge}
+	dropped := &family{name: "kubewatcher_sender_dropped_total", help: "Events dropped by the sender.", typ: typeCounter}
+	p, c, d := map[string]int{}, map[string]int{}, map[string]int{}
+	for cluster, n := range m.retiredDrops {
+		d[cluster] += n
+	}
+	for _, s := range m.senders {
+		p[s.Cluster()] += s.Pending()
+		c[s.Cluster()] += s.Capacity()
+		d[s.Cluster()] += s.Dropped()
+	}
+	for cluster := range c {
+		pending.add(float64(p[cluster]), label{"cluster", cluster})
+		capacity.add(float64(c[cluster]), label{"cluster", cluster})
+	}
+	for cluster, n := range d {
+		dropped.add(float64(n), label{"cluster", cluster})
+	}
+
+	return []*family{resourceStatus, transitions, depth, consume, consumeErrors, retries, drops, pending, capacity, dropped}
+}
+
+func kindCounter(name, help string, values map[kindKey]uint64) *family {
+	f := &family{name: name, help: help, typ: typeCounter}
+	for key, v := range values {
+		f.add(float64(v), key.labels()...)
+	}
+	return f
+}
+
+func (k kindKey) labels() []label {
+	return []label{{"cluster", k.cluster}, {"kind", string(k.kind)}}
+}
@@ -0,0 +1,209 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/resource"
+	"github.com/sunreaver/kubewatcher/sender"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newCacheWithDeployment(t *testing.T) *resource.ResourceKeyCache {
+	c := resource.NewResourceKeyCache()
+	replicas := int32(1)
+	dep := &resource.MyDep{Deployment: &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+	}}
+	if _, err := dep.AddRel(c, nil); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// 同一namespace/name在两个集群中时输出两条不同的series
+func TestMetricsClusterLabel(t *testing.T) {
+	m := New()
+	m.RegisterCache("a", newCacheWithDeployment(t))
+	m.RegisterCache("b", newCacheWithDeployment(t))
+	for _, cluster := range []string{"a", "b"} {
+		s := sender.NewSender()
+		s.SetCluster(cluster)
+		m.RegisterSender(s)
+		s.AddSendOut(sender.SendOut{Kind: constant.DeploymentKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusFail, Reason: "x"})
+		o := m.ForCluster(cluster)
+		o.ObserveConsume(constant.PodKind, time.Millisecond, nil)
+		o.ObserveRetry(constant.PodKind)
+		o.ObserveDrop(constant.PodKind)
+	}
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		series := line[:strings.LastIndex(line, " ")]
+		if seen[series] {
+			t.Fatalf("duplicate series %s", series)
+		}
+		seen[series] = true
+	}
+	for _, want := range []string{
+		`kubewatcher_resource_status{cluster="a",kind="Deployment",namespace="default",name="web",status="failed"}`,
+		`kubewatcher_resource_status{cluster="b",kind="Deployment",namespace="default",name="web",status="failed"}`,
+		`kubewatcher_workqueue_retries_total{cluster="a",kind="Pod"}`,
+		`kubewatcher_workqueue_drops_total{cluster="b",kind="Pod"}`,
+		`kubewatcher_key_consume_duration_seconds_count{cluster="a",kind="Pod"}`,
+		`kubewatcher_sender_pending{cluster="b"}`,
+	} {
+		if !seen[want] {
+			t.Errorf("missing series %s\n%s", want, buf.String())
+		}
+	}
+	if !strings.Contains(buf.String(), `kubewatcher_transitions_total{cluster="a",kind="Deployment"`) {
+		t.Errorf("missing cluster label on transitions\n%s", buf.String())
+	}
+}
+
+// 解析prometheus text format，返回series到值的映射以及每个指标的TYPE
+func scrape(t *testing.T, m *Metrics) (map[string]string, map[string]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	values, types := map[string]string{}, map[string]string{}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			types[fields[2]] = fields[3]
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		values[line[:i]] = line[i+1:]
+	}
+	return values, types
+}
+
+func TestMetricsResourceStatus(t *testing.T) {
+	m := New()
+	m.RegisterCache("a", newCacheWithDeployment(t))
+	values, types := scrape(t, m)
+	if types["kubewatcher_resource_status"] != "gauge" {
+		t.Fatalf("type = %q, want gauge", types["kubewatcher_resource_status"])
+	}
+	// 没有就绪pod的deployment为failed，其余状态输出0
+	want := map[string]string{
+		`kubewatcher_resource_status{cluster="a",kind="Deployment",namespace="default",name="web",status="failed"}`:  "1",
+		`kubewatcher_resource_status{cluster="a",kind="Deployment",namespace="default",name="web",status="succeed"}`: "0",
+	}
+	for series, v := range want {
+		if values[series] != v {
+			t.Errorf("%s = %q, want %s", series, values[series], v)
+		}
+	}
+
+	// 注销后不再输出该缓存中的资源
+	c := newCacheWithDeployment(t)
+	m.RegisterCache("b", c)
+	m.Unregister(c, nil)
+	values, _ = scrape(t, m)
+	for series := range values {
+		if strings.Contains(series, `cluster="b"`) {
+			t.Fatalf("unregistered cache still exported: %s", series)
+		}
+	}
+}
+
+func TestMetricsTransitions(t *testing.T) {
+	m := New()
+	s := sender.NewSender()
+	s.SetCluster("a")
+	m.RegisterSender(s)
+	fail := sender.SendOut{Kind: constant.PodKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusFail, Reason: "web/CrashLoopBackOff"}
+	s.AddSendOut(fail)
+	s.AddSendOut(fail)
+	s.AddSendOut(sender.SendOut{Kind: constant.PodKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusFail, Reason: "something unusual"})
+	// 非失败状态的原因分类固定为None
+	s.AddSendOut(sender.SendOut{Kind: constant.PodKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusSucceed, Reason: "web/CrashLoopBackOff"})
+	s.AddSendOut(sender.SendOut{Kind: constant.DeploymentKind, Type: constant.EventFlapping, Status: constant.K8sResStatusFail})
+
+	values, types := scrape(t, m)
+	if types["kubewatcher_transitions_total"] != "counter" {
+		t.Fatalf("type = %q, want counter", types["kubewatcher_transitions_total"])
+	}
+	want := map[string]string{
+		`kubewatcher_transitions_total{cluster="a",kind="Pod",type="StatusChange",status="failed",reason_category="CrashLoopBackOff"}`: "2",
+		`kubewatcher_transitions_total{cluster="a",kind="Pod",type="StatusChange",status="failed",reason_category="Other"}`:            "1",
+		`kubewatcher_transitions_total{cluster="a",kind="Pod",type="StatusChange",status="succeed",reason_category="None"}`:            "1",
+		`kubewatcher_transitions_total{cluster="a",kind="Deployment",type="Flapping",status="failed",reason_category="None"}`:          "1",
+	}
+	n := 0
+	for series := range values {
+		if strings.HasPrefix(series, "kubewatcher_transitions_total{") {
+			n++
+		}
+	}
+	if n != len(want) {
+		t.Errorf("%d transition series, want %d", n, len(want))
+	}
+	for series, v := range want {
+		if values[series] != v {
+			t.Errorf("%s = %q, want %s", series, values[series], v)
+		}
+	}
+}
+
+func TestMetricsSenderDropped(t *testing.T) {
+	m := New()
+	s := sender.NewSenderWithBuffer(4)
+	s.SetCluster("a")
+	m.RegisterSender(s)
+	s.AddSendOut(sender.SendOut{Kind: constant.PodKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusFail})
+
+	values, types := scrape(t, m)
+	if types["kubewatcher_sender_dropped_total"] != "counter" || types["kubewatcher_sender_pending"] != "gauge" {
+		t.Fatalf("types = %v", types)
+	}
+	for series, v := range map[string]string{
+		`kubewatcher_sender_pending{cluster="a"}`:       "1",
+		`kubewatcher_sender_capacity{cluster="a"}`:      "4",
+		`kubewatcher_sender_dropped_total{cluster="a"}`: "0",
+	} {
+		if values[series] != v {
+			t.Errorf("%s = %q, want %s", series, values[series], v)
+		}
+	}
+
+	// 未启动的sender停止时丢弃缓冲中的事件，之后的事件也直接丢弃
+	if dropped, err := s.Stop(context.Background()); err != nil || dropped != 1 {
+		t.Fatalf("stop = %d, %v", dropped, err)
+	}
+	s.AddSendOut(sender.SendOut{Kind: constant.PodKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusFail})
+	values, _ = scrape(t, m)
+	if v := values[`kubewatcher_sender_dropped_total{cluster="a"}`]; v != "2" {
+		t.Fatalf("dropped = %q, want 2", v)
+	}
+
+	// 注销后counter保持不变，不会回退
+	m.Unregister(nil, s)
+	values, _ = scrape(t, m)
+	if v := values[`kubewatcher_sender_dropped_total{cluster="a"}`]; v != "2" {
+		t.Fatalf("dropped after unregister = %q, want 2", v)
+	}
+	if _, ok := values[`kubewatcher_sender_pending{cluster="a"}`]; ok {
+		t.Fatal("pending of an unregistered sender is still exported")
+	}
+}
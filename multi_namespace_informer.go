@@ -0,0 +1,376 @@
+package kubewatcher
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/cache"
+)
+
+/*
+把多个namespace各自的informer合并成一个SharedIndexInformer，controller不需要感知namespace的划分
+每个子informer由各自namespace的factory启动，事件处理器会注册到所有子informer上
+*/
+type multiNamespaceInformer struct {
+	informers map[string]cache.SharedIndexInformer // key为namespace
+	indexer   *multiNamespaceIndexer
+}
+
+func newMultiNamespaceInformer(informers map[string]cache.SharedIndexInformer) *multiNamespaceInformer {
+	indexers := make(map[string]cache.Indexer, len(informers))
+	for ns, informer := range informers {
+		indexers[ns] = informer.GetIndexer()
+	}
+	return &multiNamespaceInformer{
+		informers: informers,
+		indexer:   &multiNamespaceIndexer{indexers: indexers},
+	}
+}
+
+// 事件处理器在每个子informer上的注册信息
+type multiNamespaceRegistration struct {
+	regs map[string]cache.ResourceEventHandlerRegistration
+}
+
+func (r *multiNamespaceRegistration) HasSynced() bool {
+	for _, reg := range r.regs {
+		if !reg.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *multiNamespaceInformer) AddEventHandler(handler cache.ResourceEventHandler) (cache.ResourceEventHandlerRegistration, error) {
+	return i.addEventHandler(func(informer cache.SharedIndexInformer) (cache.ResourceEventHandlerRegistration, error) {
+		return informer.AddEventHandler(handler)
+	})
+}
+
+func (i *multiNamespaceInformer) AddEventHandlerWithResyncPeriod(handler cache.ResourceEventHandler, resyncPeriod time.Duration) (cache.ResourceEventHandlerRegistration, error) {
+	return i.addEventHandler(func(informer cache.SharedIndexInformer) (cache.ResourceEventHandlerRegistration, error) {
+		return informer.AddEventHandlerWithResyncPeriod(handler, resyncPeriod)
+	})
+}
+
+// 任意一个子informer注册失败时，撤销已经完成的注册
+func (i *multiNamespaceInformer) addEventHandler(add func(informer cache.SharedIndexInformer) (cache.ResourceEventHandlerRegistration, error)) (cache.ResourceEventHandlerRegistration, error) {
+	reg := &multiNamespaceRegistration{regs: make(map[string]cache.ResourceEventHandlerRegistration, len(i.informers))}
+	for ns, informer := range i.informers {
+		r, err := add(informer)
+		if err != nil {
+			_ = i.RemoveEventHandler(reg)
+			return nil, errors.Wrapf(err, "namespace %s", ns)
+		}
+		reg.regs[ns] = r
+	}
+	return reg, nil
+}
+
+func (i *multiNamespaceInformer) RemoveEventHandler(handle cache.ResourceEventHandlerRegistration) error {
+	reg, ok := handle.(*multiNamespaceRegistration)
+	if !ok {
+		return errors.Errorf("registration %T does not belong to this informer", handle)
+	}
+	var firstErr error
+	for ns, r := range reg.regs {
+		if err := i.informers[ns].RemoveEventHandler(r); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "namespace %s", ns)
+		}
+	}
+	return firstErr
+}
+
+func (i *multiNamespaceInformer) GetStore() cache.Store {
+	return i.indexer
+}
+
+func (i *multiNamespaceInformer) GetIndexer() cache.Indexer {
+	return i.indexer
+}
+
+// 合并后的informer本身实现了cache.Controller
+func (i *multiNamespaceInformer) GetController() cache.Controller {
+	return i
+}
+
+/*
+运行所有子informer，直到stopCh关闭
+通过factory启动时不需要调用
+*/
+func (i *multiNamespaceInformer) Run(stopCh <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, informer := range i.informers {
+		wg.Add(1)
+		go func(informer cache.SharedIndexInformer) {
+			defer wg.Done()
+			informer.Run(stopCh)
+		}(informer)
+	}
+	wg.Wait()
+}
+
+func (i *multiNamespaceInformer) HasSynced() bool {
+	for _, informer := range i.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// 各namespace的watch相互独立，resourceVersion之间没有可比性，返回空
+func (i *multiNamespaceInformer) LastSyncResourceVersion() string {
+	return ""
+}
+
+func (i *multiNamespaceInformer) SetWatchErrorHandler(handler cache.WatchErrorHandler) error {
+	for ns, informer := range i.informers {
+		if err := informer.SetWatchErrorHandler(handler); err != nil {
+			return errors.Wrapf(err, "namespace %s", ns)
+		}
+	}
+	return nil
+}
+
+func (i *multiNamespaceInformer) SetTransform(handler cache.TransformFunc) error {
+	for ns, informer := range i.informers {
+		if err := informer.SetTransform(handler); err != nil {
+			return errors.Wrapf(err, "namespace %s", ns)
+		}
+	}
+	return nil
+}
+
+func (i *multiNamespaceInformer) IsStopped() bool {
+	for _, informer := range i.informers {
+		if !informer.IsStopped() {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *multiNamespaceInformer) AddIndexers(indexers cache.Indexers) error {
+	return i.indexer.AddIndexers(indexers)
+}
+
+/*
+按namespace把读写分发到各子informer的indexer
+按key、对象、namespace索引的操作只访问对应namespace，其他操作合并所有namespace的结果
+*/
+type multiNamespaceIndexer struct {
+	indexers map[string]cache.Indexer // key为namespace
+}
+
+func (m *multiNamespaceIndexer) byNamespace(ns string) (cache.Indexer, error) {
+	indexer, exist := m.indexers[ns]
+	if !exist {
+		return nil, errors.Errorf("namespace %q is not watched", ns)
+	}
+	return indexer, nil
+}
+
+func (m *multiNamespaceIndexer) byObject(obj interface{}) (cache.Indexer, error) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	return m.byNamespace(accessor.GetNamespace())
+}
+
+func (m *multiNamespaceIndexer) byKey(key string) (cache.Indexer, error) {
+	ns, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return m.byNamespace(ns)
+}
+
+func (m *multiNamespaceIndexer) Add(obj interface{}) error {
+	indexer, err := m.byObject(obj)
+	if err != nil {
+		return err
+	}
+	return indexer.Add(obj)
+}
+
+func (m *multiNamespaceIndexer) Update(obj interface{}) error {
+	indexer, err := m.byObject(obj)
+	if err != nil {
+		return err
+	}
+	return indexer.Update(obj)
+}
+
+func (m *multiNamespaceIndexer) Delete(obj interface{}) error {
+	indexer, err := m.byObject(obj)
+	if err != nil {
+		return err
+	}
+	return indexer.Delete(obj)
+}
+
+func (m *multiNamespaceIndexer) List() []interface{} {
+	list := make([]interface{}, 0)
+	for _, indexer := range m.indexers {
+		list = append(list, indexer.List()...)
+	}
+	return list
+}
+
+func (m *multiNamespaceIndexer) ListKeys() []string {
+	keys := make([]string, 0)
+	for _, indexer := range m.indexers {
+		keys = append(keys, indexer.ListKeys()...)
+	}
+	return keys
+}
+
+func (m *multiNamespaceIndexer) Get(obj interface{}) (interface{}, bool, error) {
+	indexer, err := m.byObject(obj)
+	if err != nil {
+		return nil, false, nil // 不在监控范围内的namespace视为不存在
+	}
+	return indexer.Get(obj)
+}
+
+func (m *multiNamespaceIndexer) GetByKey(key string) (interface{}, bool, error) {
+	indexer, err := m.byKey(key)
+	if err != nil {
+		return nil, false, nil // 不在监控范围内的namespace视为不存在
+	}
+	return indexer.GetByKey(key)
+}
+
+/*
+按namespace拆分后替换各自的数据
+不在监控范围内的namespace的对象忽略，与Get一致视为不存在，不影响其他对象的替换
+*/
+func (m *multiNamespaceIndexer) Replace(list []interface{}, resourceVersion string) error {
+	split := make(map[string][]interface{}, len(m.indexers))
+	for ns := range m.indexers {
+		split[ns] = []interface{}{}
+	}
+	for _, obj := range list {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return err
+		}
+		ns := accessor.GetNamespace()
+		if _, exist := split[ns]; !exist {
+			continue
+		}
+		split[ns] = append(split[ns], obj)
+	}
+	for ns, items := range split {
+		if err := m.indexers[ns].Replace(items, resourceVersion); err != nil {
+			return errors.Wrapf(err, "namespace %s", ns)
+		}
+	}
+	return nil
+}
+
+func (m *multiNamespaceIndexer) Resync() error {
+	for ns, indexer := range m.indexers {
+		if err := indexer.Resync(); err != nil {
+			return errors.Wrapf(err, "namespace %s", ns)
+		}
+	}
+	return nil
+}
+
+func (m *multiNamespaceIndexer) Index(indexName string, obj interface{}) ([]interface{}, error) {
+	if indexName == cache.NamespaceIndex {
+		indexer, err := m.byObject(obj)
+		if err != nil {
+			return []interface{}{}, nil
+		}
+		return indexer.Index(indexName, obj)
+	}
+	list := make([]interface{}, 0)
+	for _, indexer := range m.indexers {
+		items, err := indexer.Index(indexName, obj)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, items...)
+	}
+	return list, nil
+}
+
+func (m *multiNamespaceIndexer) IndexKeys(indexName, indexedValue string) ([]string, error) {
+	if indexName == cache.NamespaceIndex {
+		indexer, err := m.byNamespace(indexedValue)
+		if err != nil {
+			return []string{}, nil
+		}
+		return indexer.IndexKeys(indexName, indexedValue)
+	}
+	keys := make([]string, 0)
+	for _, indexer := range m.indexers {
+		items, err := indexer.IndexKeys(indexName, indexedValue)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, items...)
+	}
+	return keys, nil
+}
+
+func (m *multiNamespaceIndexer) ListIndexFuncValues(indexName string) []string {
+	set := map[string]struct{}{}
+	for _, indexer := range m.indexers {
+		for _, v := range indexer.ListIndexFuncValues(indexName) {
+			set[v] = struct{}{}
+		}
+	}
+	values := make([]string, 0, len(set))
+	for v := range set {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
+
+func (m *multiNamespaceIndexer) ByIndex(indexName, indexedValue string) ([]interface{}, error) {
+	if indexName == cache.NamespaceIndex {
+		indexer, err := m.byNamespace(indexedValue)
+		if err != nil {
+			return []interface{}{}, nil
+		}
+		return indexer.ByIndex(indexName, indexedValue)
+	}
+	list := make([]interface{}, 0)
+	for _, indexer := range m.indexers {
+		items, err := indexer.ByIndex(indexName, indexedValue)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, items...)
+	}
+	return list, nil
+}
+
+// 所有子indexer的索引相同，返回任意一个
+func (m *multiNamespaceIndexer) GetIndexers() cache.Indexers {
+	for _, indexer := range m.indexers {
+		return indexer.GetIndexers()
+	}
+	return cache.Indexers{}
+}
+
+func (m *multiNamespaceIndexer) AddIndexers(indexers cache.Indexers) error {
+	for ns, indexer := range m.indexers {
+		if err := indexer.AddIndexers(indexers); err != nil {
+			return errors.Wrapf(err, "namespace %s", ns)
+		}
+	}
+	return nil
+}
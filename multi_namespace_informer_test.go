@@ -0,0 +1,277 @@
+package kubewatcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
+	appv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appsinformers "k8s.io/client-go/informers/apps/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func nsDeployment(ns, name string) *appv1.Deployment {
+	d := testDeployment(name, false)
+	d.Namespace = ns
+	return d
+}
+
+func namespaceIndexers() cache.Indexers {
+	return cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+}
+
+// 每个namespace一个deployment informer，合并后还未启动
+func newNamespaceDepInformer(cs kubernetes.Interface, namespaces ...string) *multiNamespaceInformer {
+	informers := make(map[string]cache.SharedIndexInformer, len(namespaces))
+	for _, ns := range namespaces {
+		informers[ns] = appsinformers.NewDeploymentInformer(cs, ns, 0, namespaceIndexers())
+	}
+	return newMultiNamespaceInformer(informers)
+}
+
+// 记录事件处理器收到的新增
+type addRecorder struct {
+	lock sync.Mutex
+	keys map[string]struct{}
+}
+
+func (r *addRecorder) handler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{AddFunc: func(obj interface{}) {
+		key, _ := cache.MetaNamespaceKeyFunc(obj)
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.keys[key] = struct{}{}
+	}}
+}
+
+func (r *addRecorder) has(key string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.keys[key]
+	return ok
+}
+
+func (r *addRecorder) len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.keys)
+}
+
+func TestMultiNamespaceInformerRead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := fake.NewSimpleClientset(nsDeployment("a", "web"), nsDeployment("b", "web"), nsDeployment("b", "api"), nsDeployment("c", "web"))
+	informer := newNamespaceDepInformer(cs, "a", "b")
+	if informer.HasSynced() {
+		t.Fatal("synced before run")
+	}
+	go informer.Run(ctx.Done())
+	waitFor(t, informer.HasSynced)
+
+	indexer := informer.GetIndexer()
+	if list := indexer.List(); len(list) != 3 {
+		t.Fatalf("list = %d objects, want 3 from namespaces a and b", len(list))
+	}
+	if keys := sortedKeys(indexer.ListKeys()); !equalKeys(keys, []string{"a/web", "b/api", "b/web"}) {
+		t.Fatalf("keys = %v", keys)
+	}
+	if _, exist, err := indexer.GetByKey("b/web"); err != nil || !exist {
+		t.Fatalf("b/web exist = %v, err = %v", exist, err)
+	}
+	// 不在监控范围内的namespace视为不存在，不返回错误
+	if _, exist, err := indexer.GetByKey("c/web"); err != nil || exist {
+		t.Fatalf("c/web exist = %v, err = %v", exist, err)
+	}
+	if _, exist, err := indexer.Get(nsDeployment("c", "web")); err != nil || exist {
+		t.Fatalf("get c/web exist = %v, err = %v", exist, err)
+	}
+
+	if items, err := indexer.ByIndex(cache.NamespaceIndex, "b"); err != nil || len(items) != 2 {
+		t.Fatalf("ByIndex(b) = %d items, err = %v, want 2", len(items), err)
+	}
+	if items, err := indexer.ByIndex(cache.NamespaceIndex, "c"); err != nil || len(items) != 0 {
+		t.Fatalf("ByIndex(c) = %d items, err = %v, want none", len(items), err)
+	}
+	if items, err := indexer.Index(cache.NamespaceIndex, nsDeployment("a", "other")); err != nil || len(items) != 1 {
+		t.Fatalf("Index(a) = %d items, err = %v, want 1", len(items), err)
+	}
+	if keys, err := indexer.IndexKeys(cache.NamespaceIndex, "a"); err != nil || !equalKeys(keys, []string{"a/web"}) {
+		t.Fatalf("IndexKeys(a) = %v, err = %v", keys, err)
+	}
+	if keys, err := indexer.IndexKeys(cache.NamespaceIndex, "c"); err != nil || len(keys) != 0 {
+		t.Fatalf("IndexKeys(c) = %v, err = %v, want none", keys, err)
+	}
+	if values := indexer.ListIndexFuncValues(cache.NamespaceIndex); !equalKeys(values, []string{"a", "b"}) {
+		t.Fatalf("index values = %v, want [a b]", values)
+	}
+}
+
+// 重新list时不在监控范围内的对象被忽略，不影响其他namespace的替换
+func TestMultiNamespaceIndexerReplace(t *testing.T) {
+	m := &multiNamespaceIndexer{indexers: map[string]cache.Indexer{
+		"a": cache.NewIndexer(cache.MetaNamespaceKeyFunc, namespaceIndexers()),
+		"b": cache.NewIndexer(cache.MetaNamespaceKeyFunc, namespaceIndexers()),
+	}}
+	if err := m.Add(nsDeployment("b", "old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(nsDeployment("c", "web")); err == nil {
+		t.Fatal("want error when adding an object of an unwatched namespace")
+	}
+	list := []interface{}{nsDeployment("a", "web"), nsDeployment("c", "web"), nsDeployment("b", "api")}
+	if err := m.Replace(list, "1"); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if keys := sortedKeys(m.ListKeys()); !equalKeys(keys, []string{"a/web", "b/api"}) {
+		t.Fatalf("keys = %v, want a/web and b/api", keys)
+	}
+	if err := m.Replace(nil, "2"); err != nil || len(m.List()) != 0 {
+		t.Fatalf("replace with empty list: %d objects left, err = %v", len(m.List()), err)
+	}
+}
+
+func TestMultiNamespaceInformerEventHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := fake.NewSimpleClientset(nsDeployment("a", "web"), nsDeployment("b", "web"), nsDeployment("c", "web"))
+	informer := newNamespaceDepInformer(cs, "a", "b")
+	go informer.Run(ctx.Done())
+
+	rec := &addRecorder{keys: map[string]struct{}{}}
+	reg, err := informer.AddEventHandler(rec.handler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, reg.HasSynced)
+	waitFor(t, func() bool { return rec.len() == 2 })
+	if !rec.has("a/web") || !rec.has("b/web") {
+		t.Fatalf("initial adds = %v, want a/web and b/web", rec.keys)
+	}
+
+	create := func(ns, name string) {
+		t.Helper()
+		if _, err := cs.AppsV1().Deployments(ns).Create(ctx, nsDeployment(ns, name), metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	create("b", "api")
+	create("c", "api")
+	waitFor(t, func() bool { return rec.has("b/api") })
+	// 不在监控范围内的namespace不产生事件
+	if rec.has("c/api") {
+		t.Fatal("got event of an unwatched namespace")
+	}
+
+	// 移除后所有namespace都不再收到事件
+	if err := informer.RemoveEventHandler(reg); err != nil {
+		t.Fatal(err)
+	}
+	create("a", "api")
+	waitFor(t, func() bool { _, exist, _ := informer.GetIndexer().GetByKey("a/api"); return exist })
+	time.Sleep(50 * time.Millisecond)
+	if rec.has("a/api") {
+		t.Fatal("removed handler still receives events")
+	}
+	if err := informer.RemoveEventHandler(nil); err == nil {
+		t.Fatal("want error for a registration of another informer")
+	}
+}
+
+// 记录事件处理器的注册和移除，addErr不为空时注册失败
+type stubInformer struct {
+	cache.SharedIndexInformer
+	lock    sync.Mutex
+	addErr  error
+	added   int
+	removed int
+}
+
+type stubRegistration struct{}
+
+func (stubRegistration) HasSynced() bool { return true }
+
+func (s *stubInformer) AddEventHandler(cache.ResourceEventHandler) (cache.ResourceEventHandlerRegistration, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.addErr != nil {
+		return nil, s.addErr
+	}
+	s.added++
+	return stubRegistration{}, nil
+}
+
+func (s *stubInformer) RemoveEventHandler(cache.ResourceEventHandlerRegistration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.removed++
+	return nil
+}
+
+// 任意一个namespace注册失败时，撤销其他namespace已经完成的注册
+func TestMultiNamespaceInformerAddEventHandlerRollback(t *testing.T) {
+	newStub := func(addErr error) *stubInformer {
+		base := cache.NewSharedIndexInformer(&cache.ListWatch{}, &appv1.Deployment{}, 0, namespaceIndexers())
+		return &stubInformer{SharedIndexInformer: base, addErr: addErr}
+	}
+	ok1, ok2, broken := newStub(nil), newStub(nil), newStub(errors.New("stopped"))
+	informer := newMultiNamespaceInformer(map[string]cache.SharedIndexInformer{"a": ok1, "b": ok2, "c": broken})
+	// map的遍历顺序随机，多次注册覆盖失败发生在不同位置的情况
+	for i := 0; i < 10; i++ {
+		if reg, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{}); err == nil || reg != nil {
+			t.Fatalf("reg = %v, err = %v, want error", reg, err)
+		}
+	}
+	for name, s := range map[string]*stubInformer{"a": ok1, "b": ok2} {
+		if s.added != s.removed {
+			t.Fatalf("namespace %s: added %d, removed %d, want every registration rolled back", name, s.added, s.removed)
+		}
+	}
+	if broken.removed != 0 {
+		t.Fatalf("failed registration removed %d times", broken.removed)
+	}
+}
+
+func TestWatcherWithNamespaces(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := fake.NewSimpleClientset(nsDeployment("a", "web"), nsDeployment("b", "web"), nsDeployment("b", "tmp"), nsDeployment("c", "web"))
+	w := newK8sWatcher(ctx, "", WithNamespaces("a", "b"), WithKinds(constant.DeploymentKind))
+	w.clientSet = cs
+	rec := &outRecorder{}
+	w.Subscribe(rec.add)
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if informer, _ := w.current(); informer == nil {
+		t.Fatal("informer not built")
+	} else if _, ok := informer.DepInformer.(*multiNamespaceInformer); !ok {
+		t.Fatalf("deployment informer is %T, want one informer per namespace", informer.DepInformer)
+	}
+
+	waitFor(t, func() bool { return len(w.Snapshot()) == 3 })
+	keys := make([]string, 0)
+	for _, out := range w.Snapshot() {
+		keys = append(keys, out.Key)
+	}
+	if keys = sortedKeys(keys); !equalKeys(keys, []string{"a/web", "b/tmp", "b/web"}) {
+		t.Fatalf("snapshot = %v, want only namespaces a and b", keys)
+	}
+
+	if err := cs.AppsV1().Deployments("c").Delete(ctx, "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.AppsV1().Deployments("b").Delete(ctx, "tmp", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(rec.keys()) == 1 })
+	if out := rec.last(); out.Key != "b/tmp" || out.Status != constant.K8sResStatusDelete {
+		t.Fatalf("event = %+v, want b/tmp deleted", out)
+	}
+}
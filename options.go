@@ -0,0 +1,245 @@
+package kubewatcher
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/controller"
+	"github.com/sunreaver/kubewatcher/metrics"
+	"github.com/sunreaver/kubewatcher/sender"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// watcher的可选配置
+type Option func(*K8sWatcher)
+
+// watcher的运行参数，通过Option设置，在启动前校验
+type watcherConfig struct {
+	resync      time.Duration                // informer全量resync周期 默认30m，0表示不resync
+	syncTimeout time.Duration                // 等待informer首次同步完成的时间 默认3m
+	depWorkers  int                          // deployment controller的worker数 默认1
+	podWorkers  int                          // pod controller的worker数 默认1，最多controller.MaxPodWorkers
+	maxRetries  int                          // key处理失败后的重试次数 默认5
+	rateLimiter func() workqueue.RateLimiter // controller queue的限速器 默认workqueue.DefaultControllerRateLimiter
+	senderBuf   int                          // sender等待推送的事件队列长度 默认10
+	restConfig  *rest.Config                 // NewWatcher使用的连接配置
+	recovery    *RecoveryConfig              // 自动恢复的配置 为nil表示不恢复
+}
+
+func defaultWatcherConfig() watcherConfig {
+	return watcherConfig{
+		resync:      informerDefaultResync,
+		syncTimeout: waitCacheSyncDoneTimeout,
+		depWorkers:  1,
+		podWorkers:  1,
+		maxRetries:  controller.DefaultMaxRetries,
+		rateLimiter: workqueue.DefaultControllerRateLimiter,
+		senderBuf:   sender.DefaultSenderBuffer,
+	}
+}
+
+func (c watcherConfig) validate() error {
+	if c.resync < 0 {
+		return errors.New("resync can't be negative")
+	}
+	if c.syncTimeout <= 0 {
+		return errors.New("sync timeout must be positive")
+	}
+	if c.depWorkers < 1 || c.podWorkers < 1 {
+		return errors.New("workers must be at least 1")
+	}
+	if c.podWorkers > controller.MaxPodWorkers {
+		return errors.Errorf("pod workers can't exceed %d", controller.MaxPodWorkers)
+	}
+	if c.maxRetries < 0 {
+		return errors.New("max retries can't be negative")
+	}
+	if c.rateLimiter == nil {
+		return errors.New("rate limiter can't be null")
+	}
+	if c.senderBuf < 1 {
+		return errors.New("sender buffer must be at least 1")
+	}
+	if c.recovery != nil {
+		return c.recovery.setDefaults()
+	}
+	return nil
+}
+
+// 应用到controller上的配置
+func (c watcherConfig) runnerOptions(workers int) []controller.RunnerOption {
+	return []controller.RunnerOption{
+		controller.WithWorkers(workers),
+		controller.WithMaxRetries(c.maxRetries),
+		controller.WithRateLimiter(c.rateLimiter),
+	}
+}
+
+/*
+开启监控指标，多个watcher可以共用一个Metrics
+通过m.Handler()以prometheus text format对外提供
+*/
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(w *K8sWatcher) {
+		w.metrics = m
+	}
+}
+
+/*
+设置集群名，写入推送事件的Cluster，多集群时用于区分事件来源
+*/
+func WithPlatform(platform string) Option {
+	return func(w *K8sWatcher) {
+		w.platform = platform
+	}
+}
+
+/*
+只监控指定的namespace，只需要这些namespace的list/watch权限
+只对通过clientSet启动的watcher生效，外部传入的informer由外部决定监控范围
+*/
+func WithNamespaces(namespaces ...string) Option {
+	return func(w *K8sWatcher) {
+		w.scope.Namespaces = namespaces
+	}
+}
+
+/*
+只监控符合label selector的资源，例如 "team=payment"
+注意pod的上级replicaset、deployment也需要符合，否则pod找不到所属的deployment
+*/
+func WithLabelSelector(selector string) Option {
+	return func(w *K8sWatcher) {
+		w.scope.LabelSelector = selector
+	}
+}
+
+/*
+只监控符合field selector的资源，deployment和replicaset只支持metadata.name、metadata.namespace
+只需要过滤pod时使用WithTweakListOptions
+*/
+func WithFieldSelector(selector string) Option {
+	return func(w *K8sWatcher) {
+		w.scope.FieldSelector = selector
+	}
+}
+
+/*
+按资源类型修改informer的list/watch参数，例如只监控某个节点上的pod：
+
+	WithTweakListOptions(func(kind constant.K8sResKind, o *metav1.ListOptions) {
+		if kind == constant.PodKind {
+			o.FieldSelector = "spec.nodeName=node-1"
+		}
+	})
+*/
+func WithTweakListOptions(fn func(kind constant.K8sResKind, options *metav1.ListOptions)) Option {
+	return func(w *K8sWatcher) {
+		w.scope.TweakListOptions = fn
+	}
+}
+
+/*
+对象进入informer缓存前去掉managedFields、大的annotation和用不到的spec，减少内存占用
+只对通过clientSet启动的watcher生效，外部传入的informer使用K8sWatcherInformer.SetTransform
+*/
+func WithTransform(cfg TransformConfig) Option {
+	return func(w *K8sWatcher) {
+		w.transform = NewTransform(cfg)
+	}
+}
+
+// 使用clientSet连接集群，用于NewWatcher
+func WithClientSet(clientSet *kubernetes.Clientset) Option {
+	return func(w *K8sWatcher) {
+		if clientSet != nil { // 避免把nil指针存成非nil的接口
+			w.clientSet = clientSet
+		}
+	}
+}
+
+// 使用rest config连接集群，用于NewWatcher，可以通过MakeRestConfig系列函数构造
+func WithRestConfig(cfg *rest.Config) Option {
+	return func(w *K8sWatcher) {
+		w.cfg.restConfig = cfg
+	}
+}
+
+// 使用外部的informer，informer的启动和停止由外部控制，用于NewWatcher
+func WithInformer(informer *K8sWatcherInformer) Option {
+	return func(w *K8sWatcher) {
+		w.informer = informer
+	}
+}
+
+/*
+informer全量resync的周期，默认30m，0表示不resync
+只对通过clientSet启动的watcher生效
+*/
+func WithResync(resync time.Duration) Option {
+	return func(w *K8sWatcher) {
+		w.cfg.resync = resync
+	}
+}
+
+/*
+等待informer首次同步完成的时间，默认3m，超时后watcher启动失败，返回*InformerSyncTimeoutError
+外部传入的informer也按该时间等待同步
+*/
+func WithSyncTimeout(timeout time.Duration) Option {
+	return func(w *K8sWatcher) {
+		w.cfg.syncTimeout = timeout
+	}
+}
+
+/*
+deployment、pod controller消费queue的协程数，默认都为1
+同一个key不会被并发处理
+pod controller最多1个worker，超过时NewWatcher返回错误：同一deployment的pod会更新同一个deployment的状态，
+dealUp先读取再写入deployment的状态，多个worker并发会重复或者漏掉deployment的通知
+*/
+func WithWorkers(depWorkers, podWorkers int) Option {
+	return func(w *K8sWatcher) {
+		w.cfg.depWorkers = depWorkers
+		w.cfg.podWorkers = podWorkers
+	}
+}
+
+// key处理失败（例如pod所属的deployment还未同步）后的重试次数，默认5，0表示不重试
+func WithMaxRetries(n int) Option {
+	return func(w *K8sWatcher) {
+		w.cfg.maxRetries = n
+	}
+}
+
+/*
+controller queue的限速器，决定重试的等待时间，每个controller调用一次fn
+默认workqueue.DefaultControllerRateLimiter
+*/
+func WithRateLimiter(fn func() workqueue.RateLimiter) Option {
+	return func(w *K8sWatcher) {
+		w.cfg.rateLimiter = fn
+	}
+}
+
+// sender等待推送的事件队列长度，默认10，订阅者处理慢时调大可以减少状态机的阻塞
+func WithSenderBuffer(size int) Option {
+	return func(w *K8sWatcher) {
+		w.cfg.senderBuf = size
+	}
+}
+
+/*
+监控的资源类型，默认deployment和pod
+pod的状态会汇总到所属的deployment，所以监控pod时必须同时监控deployment
+只监控deployment时不创建pod和replicaset的informer
+*/
+func WithKinds(kinds ...constant.K8sResKind) Option {
+	return func(w *K8sWatcher) {
+		w.scope.Kinds = kinds
+	}
+}
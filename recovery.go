@@ -0,0 +1,275 @@
+package kubewatcher
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/controller"
+	"github.com/sunreaver/kubewatcher/resource"
+	"github.com/sunreaver/kubewatcher/util"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	defaultRecoveryInitialBackoff = time.Second
+	defaultRecoveryMaxBackoff     = 5 * time.Minute
+
+	watchErrorBuffer = 64 // Errors()的缓冲长度，读取不及时时丢弃新的错误
+)
+
+/*
+informer的错误，通过K8sWatcher.Errors读取
+Fatal为false是list/watch的错误，informer会自己重连；为true表示informer已停止，开启自动恢复时会重建
+*/
+type WatchError struct {
+	Kind  constant.K8sResKind // 出错的informer，informer整体失效时为空
+	Err   error
+	Fatal bool
+}
+
+func (e *WatchError) Error() string {
+	if e.Kind == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err.Error())
+}
+
+func (e *WatchError) Unwrap() error {
+	return e.Err
+}
+
+// 自动恢复的配置，零值为默认配置
+type RecoveryConfig struct {
+	InitialBackoff time.Duration // 第一次重建前的等待时间 默认1s
+	MaxBackoff     time.Duration // 重建失败后等待时间翻倍，最长等待时间 默认5m
+}
+
+func (c *RecoveryConfig) setDefaults() error {
+	if c.InitialBackoff < 0 || c.MaxBackoff < 0 {
+		return errors.New("recovery backoff can't be negative")
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = defaultRecoveryInitialBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = defaultRecoveryMaxBackoff
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		return errors.New("recovery max backoff can't be less than initial backoff")
+	}
+	return nil
+}
+
+func (c RecoveryConfig) backoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: c.InitialBackoff,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    math.MaxInt32,
+		Cap:      c.MaxBackoff,
+	}
+}
+
+/*
+开启自动恢复：informer首次同步超时或者之后停止时，保留缓存树和sender，按退避时间重建informer和controller
+重建完成后informer重新list的资源与缓存树中状态相同时不会推送，重建期间被删除的资源会推送删除事件
+首次同步超时时Start仍然返回错误，但watcher不会停止，在后台继续重建，直到Close、Shutdown或者ctx结束
+只对通过clientSet启动的watcher生效，外部传入的informer由外部负责恢复
+*/
+func WithAutoRecovery(cfg RecoveryConfig) Option {
+	return func(w *K8sWatcher) {
+		w.cfg.recovery = &cfg
+	}
+}
+
+/*
+informer的错误，包括list/watch的错误和informer失效，channel不会关闭
+只有通过clientSet启动的watcher会自动上报list/watch的错误，外部传入的informer可以通过WatchErrorHandler接入
+*/
+func (w *K8sWatcher) Errors() <-chan error {
+	return w.errs
+}
+
+/*
+上报list/watch错误的处理器，同时保留client-go默认的日志，需要在informer启动前设置：
+informer.PodInformer.SetWatchErrorHandler(w.WatchErrorHandler(constant.PodKind))
+*/
+func (w *K8sWatcher) WatchErrorHandler(kind constant.K8sResKind) cache.WatchErrorHandler {
+	return func(r *cache.Reflector, err error) {
+		cache.DefaultWatchErrorHandler(r, err)
+		w.reportError(&WatchError{Kind: kind, Err: err})
+	}
+}
+
+// 不阻塞上报错误，channel满时丢弃
+func (w *K8sWatcher) reportError(err *WatchError) {
+	select {
+	case w.errs <- err:
+	default:
+		util.Warnw("k8s_watcher_error_dropped", "cluster", w.platform, "error", err)
+	}
+}
+
+/*
+为informer设置上报错误的处理器，需要在informer启动前调用
+*/
+func (i *K8sWatcherInformer) setWatchErrorHandler(w *K8sWatcher) error {
+	informers := map[constant.K8sResKind]cache.SharedIndexInformer{
+		constant.DeploymentKind: i.DepInformer,
+		constant.PodKind:        i.PodInformer,
+		constant.ReplicaSetKind: i.RSInformer,
+	}
+	for kind, informer := range informers {
+		if informer == nil {
+			continue
+		}
+		if err := informer.SetWatchErrorHandler(w.WatchErrorHandler(kind)); err != nil {
+			return errors.Wrapf(err, "%s informer", kind)
+		}
+	}
+	return nil
+}
+
+// 是否正在重建informer
+func (w *K8sWatcher) Recovering() bool {
+	return w.recovering.Load()
+}
+
+/*
+监控当前informer，informer停止（不是因为Close、Shutdown）后重建
+*/
+func (w *K8sWatcher) startSupervisor() {
+	if w.cfg.recovery == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(w.ctx)
+	w.superviseCancel = cancel
+	go func() {
+		for {
+			informer, _ := w.current()
+			select {
+			case <-ctx.Done():
+				return
+			case <-informer.informerStartCtx.Done():
+			}
+			if ctx.Err() != nil {
+				return // Close、Shutdown先停止supervisor再停止informer
+			}
+			w.reportError(&WatchError{Err: errors.New("informer stopped"), Fatal: true})
+			w.recover(ctx)
+		}
+	}()
+}
+
+func (w *K8sWatcher) stopSupervisor() {
+	if w.superviseCancel != nil {
+		w.superviseCancel()
+	}
+}
+
+/*
+按退避时间重建informer和controller，直到成功或者ctx结束
+*/
+func (w *K8sWatcher) recover(ctx context.Context) {
+	w.recovering.Store(true)
+	defer w.recovering.Store(false)
+	backoff := w.cfg.recovery.backoff()
+	for attempt := 1; ; attempt++ {
+		delay := backoff.Step()
+		util.Warnw("k8s_watcher_recover_wait", "cluster", w.platform, "attempt", attempt, "delay", delay.String())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		// 等待旧的controller退出，避免新旧controller同时修改缓存树
+		_, runners := w.current()
+		for _, runner := range runners {
+			if err := runner.Wait(ctx); err != nil {
+				return
+			}
+		}
+		err := w.rebuild(ctx)
+		if err == nil {
+			util.Infow("k8s_watcher_recovered", "cluster", w.platform, "attempt", attempt)
+			if w.recoverHook != nil {
+				w.recoverHook()
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		w.reportError(&WatchError{Err: errors.Wrap(err, "rebuild informer"), Fatal: true})
+	}
+}
+
+/*
+使用新的informer和controller替换旧的，缓存树和sender保持不变
+controller需要在informer启动前注册，所以先替换再同步；同步失败时停止新的informer和controller，恢复为旧的
+informer的ctx来自supervisor，Close、Shutdown时会停止正在重建的informer
+*/
+func (w *K8sWatcher) rebuild(ctx context.Context) error {
+	informer, err := w.buildInformer(ctx)
+	if err != nil {
+		return err
+	}
+	w.runLock.Lock()
+	oldInformer, oldRunners, oldCancel := w.informer, w.runners, w.runCancel
+	w.informer = informer
+	w.runLock.Unlock()
+	w.startController()
+	err = w.startInformer()
+	if err == nil {
+		err = ctx.Err() // Close、Shutdown停止了informer，同步等待也会返回
+	}
+	if err != nil {
+		informer.informerStopFn()
+		w.runLock.Lock()
+		w.runCancel()
+		runners := w.runners
+		w.informer, w.runners, w.runCancel = oldInformer, oldRunners, oldCancel
+		w.runLock.Unlock()
+		// 下次重建前等待的是旧的controller，这里等待新的controller退出
+		for _, runner := range runners {
+			if err := runner.Wait(ctx); err != nil {
+				break
+			}
+		}
+		return err
+	}
+	n := w.enqueueStale()
+	util.Infow("k8s_watcher_rebuild_synced", "cluster", w.platform, "stale", n)
+	return nil
+}
+
+/*
+缓存树中存在但是重建后的informer中不存在的资源，在重建期间被删除了，放入queue按删除处理
+返回放入queue的数量
+*/
+func (w *K8sWatcher) enqueueStale() int {
+	_, runners := w.current()
+	byKind := make(map[constant.K8sResKind]*controller.ControllerRunner, len(runners))
+	for _, runner := range runners {
+		byKind[runner.Controller.GetKind()] = runner
+	}
+	n := 0
+	w.keyCache.Range(func(rc *resource.ResourceCache) bool {
+		runner, exist := byKind[rc.GetKind()]
+		if !exist {
+			return false
+		}
+		indexer := runner.Controller.GetIndexer()[rc.GetKind()]
+		if _, exist, err := indexer.GetByKey(rc.GetKey()); err == nil && !exist {
+			runner.Controller.GetQueue().Add(rc.GetKey())
+			n++
+		}
+		return false
+	})
+	return n
+}
@@ -0,0 +1,207 @@
+package kubewatcher
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fail为true时list deployment返回错误，informer无法完成同步
+type flakyClientSet struct {
+	*fake.Clientset
+	fail  atomic.Bool
+	lists atomic.Int32
+}
+
+func newFlakyClientSet(objects ...runtime.Object) *flakyClientSet {
+	cs := &flakyClientSet{Clientset: fake.NewSimpleClientset(objects...)}
+	cs.PrependReactor("list", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+		cs.lists.Add(1)
+		if cs.fail.Load() {
+			return true, nil, errors.New("apiserver unavailable")
+		}
+		return false, nil, nil
+	})
+	return cs
+}
+
+func startRecoveryWatcher(t *testing.T, ctx context.Context, cs *flakyClientSet, cfg RecoveryConfig, syncTimeout time.Duration) (*K8sWatcher, *outRecorder) {
+	t.Helper()
+	w := newK8sWatcher(ctx, "a", WithKinds(constant.DeploymentKind), WithAutoRecovery(cfg), WithSyncTimeout(syncTimeout))
+	if w.err != nil {
+		t.Fatal(w.err)
+	}
+	w.clientSet = cs.Clientset
+	rec := &outRecorder{}
+	w.Subscribe(rec.add)
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.Close)
+	return w, rec
+}
+
+// 停止当前informer，模拟informer异常退出
+func stopInformer(w *K8sWatcher) *K8sWatcherInformer {
+	informer, _ := w.current()
+	informer.informerStopFn()
+	return informer
+}
+
+// 读取下一个Fatal的错误
+func nextFatal(t *testing.T, w *K8sWatcher) *WatchError {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case err := <-w.Errors():
+			var werr *WatchError
+			if errors.As(err, &werr) && werr.Fatal {
+				return werr
+			}
+		case <-timeout:
+			t.Fatal("timeout waiting for a fatal error")
+		}
+	}
+}
+
+// informer停止后重建，重建期间被删除的资源按删除推送
+func TestRecoveryRebuildsStoppedInformer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := newFlakyClientSet(testDeployment("web", false), testDeployment("tmp", false))
+	w, rec := startRecoveryWatcher(t, ctx, cs, RecoveryConfig{InitialBackoff: 200 * time.Millisecond}, 5*time.Second)
+	var recovered atomic.Int32
+	w.recoverHook = func() { recovered.Add(1) }
+	waitFor(t, func() bool { return len(w.Snapshot()) == 2 })
+
+	old := stopInformer(w)
+	if werr := nextFatal(t, w); !strings.Contains(werr.Error(), "informer stopped") {
+		t.Fatalf("error = %v, want informer stopped", werr)
+	}
+	waitFor(t, w.Recovering)
+	if err := w.Ready(); err == nil {
+		t.Fatal("want not ready while recovering")
+	}
+	deleteDeployment(t, cs, "tmp")
+
+	waitFor(t, func() bool { return recovered.Load() == 1 })
+	if w.Recovering() {
+		t.Fatal("still recovering after rebuild")
+	}
+	if informer, _ := w.current(); informer == old {
+		t.Fatal("informer not replaced")
+	}
+	waitFor(t, func() bool { return len(rec.keys()) == 1 })
+	if out := rec.last(); out.Key != "default/tmp" || out.Status != constant.K8sResStatusDelete {
+		t.Fatalf("event = %+v, want default/tmp deleted", out)
+	}
+	if snapshot := w.Snapshot(); len(snapshot) != 1 || snapshot[0].Key != "default/web" {
+		t.Fatalf("snapshot = %+v, want only default/web", snapshot)
+	}
+	waitFor(t, func() bool { return w.Ready() == nil })
+
+	// 重建后的informer停止时再次重建
+	stopInformer(w)
+	waitFor(t, func() bool { return recovered.Load() == 2 })
+}
+
+func TestRecoveryBackoff(t *testing.T) {
+	cfg := RecoveryConfig{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 350 * time.Millisecond}
+	if err := cfg.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	// 每次翻倍，带10%的抖动，不超过MaxBackoff
+	backoff := cfg.backoff()
+	for i, want := range []time.Duration{100, 200, 350, 350} {
+		want *= time.Millisecond
+		if d := backoff.Step(); d < want || d > want+want/10 {
+			t.Fatalf("step %d = %v, want %v with jitter", i, d, want)
+		}
+	}
+
+	defaults := RecoveryConfig{}
+	if err := defaults.setDefaults(); err != nil || defaults.InitialBackoff != defaultRecoveryInitialBackoff || defaults.MaxBackoff != defaultRecoveryMaxBackoff {
+		t.Fatalf("defaults = %+v, err = %v", defaults, err)
+	}
+	for _, c := range []RecoveryConfig{{InitialBackoff: -1}, {InitialBackoff: time.Minute, MaxBackoff: time.Second}} {
+		if err := c.setDefaults(); err == nil {
+			t.Fatalf("config %+v: want error", c)
+		}
+	}
+}
+
+// 重建失败时恢复为旧的informer和controller，按退避时间继续重建
+func TestRecoveryRebuildFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := newFlakyClientSet(testDeployment("web", false))
+	w, _ := startRecoveryWatcher(t, ctx, cs, RecoveryConfig{InitialBackoff: 200 * time.Millisecond, MaxBackoff: 200 * time.Millisecond}, time.Second)
+	waitFor(t, func() bool { return len(w.Snapshot()) == 1 })
+
+	cs.fail.Store(true)
+	old := stopInformer(w)
+	_, oldRunners := w.current()
+	nextFatal(t, w) // informer stopped
+	for i := 0; i < 2; i++ {
+		if werr := nextFatal(t, w); !strings.Contains(werr.Error(), "rebuild informer") {
+			t.Fatalf("error = %v, want rebuild failure", werr)
+		}
+		if informer, runners := w.current(); informer != old || len(runners) != len(oldRunners) || runners[0] != oldRunners[0] {
+			t.Fatal("failed rebuild is not rolled back")
+		}
+	}
+	if !w.Recovering() {
+		t.Fatal("want Recovering between failed rebuilds")
+	}
+	if len(w.Snapshot()) != 1 {
+		t.Fatal("cache tree changed by a failed rebuild")
+	}
+
+	cs.fail.Store(false)
+	waitFor(t, func() bool { return !w.Recovering() })
+	if informer, _ := w.current(); informer == old {
+		t.Fatal("informer not replaced after recovery")
+	}
+	waitFor(t, func() bool { return w.Ready() == nil })
+}
+
+// Close停止正在同步的重建，不会等到同步超时
+func TestRecoveryCloseDuringRebuild(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := newFlakyClientSet(testDeployment("web", false))
+	w, rec := startRecoveryWatcher(t, ctx, cs, RecoveryConfig{InitialBackoff: 10 * time.Millisecond}, time.Hour)
+	var recovered atomic.Int32
+	w.recoverHook = func() { recovered.Add(1) }
+	waitFor(t, func() bool { return len(w.Snapshot()) == 1 })
+
+	cs.fail.Store(true)
+	lists := cs.lists.Load()
+	stopInformer(w)
+	waitFor(t, func() bool { return cs.lists.Load() > lists }) // 重建的informer开始list
+
+	w.Close()
+	waitFor(t, func() bool { return !w.Recovering() })
+	if n := recovered.Load(); n != 0 {
+		t.Fatalf("recover hook called %d times after Close", n)
+	}
+	informer, _ := w.current()
+	select {
+	case <-informer.informerStartCtx.Done():
+	default:
+		t.Fatal("informer still running after Close")
+	}
+	// 没有同步完成的informer不能把缓存树中的资源当作已删除
+	if keys := rec.keys(); len(keys) != 0 {
+		t.Fatalf("events = %v, want none", keys)
+	}
+}
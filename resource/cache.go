@@ -2,6 +2,7 @@ package resource
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/sunreaver/kubewatcher/constant"
 	"github.com/sunreaver/kubewatcher/sender"
@@ -11,6 +12,7 @@ import (
 
 type ResourceCache struct {
 	cacheTreeLock sync.RWMutex          // 操作父子关系节点树的锁
+	fieldLock     sync.RWMutex          // 保护status、reason、meta，状态机更新的同时快照、选主补发会读取
 	key           string                // 资源key 与queue中的key一致 都是租户/资源名
 	name          string                // 资源名
 	parent        *ResourceCache        // 父节点 一个子只能有一个父 当前设计中仅保存pod和deployment 例如一个pod资源的父节点为一个deployment节点 无父亲设置为nil
@@ -45,7 +47,7 @@ func (r *ResourceCache) RemoveChild(childKey string) {
 	}
 	r.cacheTreeLock.Lock()
 	defer r.cacheTreeLock.Unlock()
-	slices.DeleteFunc(r.child, func(rc *ResourceCache) bool { return rc.key == childKey })
+	r.child = slices.DeleteFunc(r.child, func(rc *ResourceCache) bool { return rc.key == childKey })
 }
 
 func (r *ResourceCache) AddChild(child *ResourceCache) {
@@ -73,26 +75,38 @@ func (r *ResourceCache) RangeWithoutDelete(fn func(rc *ResourceCache) (stop bool
 }
 
 func (r *ResourceCache) SetStatus(status constant.K8sResStatus) {
+	r.fieldLock.Lock()
+	defer r.fieldLock.Unlock()
 	r.status = status
 }
 
 func (r *ResourceCache) GetStatus() constant.K8sResStatus {
+	r.fieldLock.RLock()
+	defer r.fieldLock.RUnlock()
 	return r.status
 }
 
 func (r *ResourceCache) SetReason(reason string) {
+	r.fieldLock.Lock()
+	defer r.fieldLock.Unlock()
 	r.reason = reason
 }
 
 func (r *ResourceCache) GetReason() string {
+	r.fieldLock.RLock()
+	defer r.fieldLock.RUnlock()
 	return r.reason
 }
 
 func (r *ResourceCache) SetMeta(meta interface{}) {
+	r.fieldLock.Lock()
+	defer r.fieldLock.Unlock()
 	r.meta = meta
 }
 
 func (r *ResourceCache) GetMeta() interface{} {
+	r.fieldLock.RLock()
+	defer r.fieldLock.RUnlock()
 	return r.meta
 }
 
@@ -108,6 +122,10 @@ func (r *ResourceCache) GetKind() constant.K8sResKind {
 	return r.kind
 }
 
+func (r *ResourceCache) GetName() string {
+	return r.name
+}
+
 // 是否孤儿
 func (r *ResourceCache) IsSingle() bool {
 	r.cacheTreeLock.RLock()
@@ -121,10 +139,13 @@ func (r *ResourceCache) IsSingle() bool {
 func (r *ResourceCache) GetSendOut() sender.SendOut {
 	r.cacheTreeLock.RLock()
 	defer r.cacheTreeLock.RUnlock()
+	r.fieldLock.RLock()
+	defer r.fieldLock.RUnlock()
 	sendOutKey := util.ParseResourceCacheKey(r.key)
 	sendOut := sender.SendOut{
 		Key:    sendOutKey,
 		Kind:   r.kind,
+		Type:   constant.EventStatusChange,
 		Name:   r.name,
 		Status: r.status,
 		Reason: r.reason,
@@ -137,10 +158,31 @@ func (r *ResourceCache) GetSendOut() sender.SendOut {
 }
 
 type ResourceKeyCache struct {
-	kv map[string]*ResourceCache
+	kv         map[string]*ResourceCache
+	projection atomic.Int32 // ResourceCache.meta中保存的对象数据 见sender.MetaProjection
 	sync.RWMutex
 }
 
+/*
+设置ResourceCache中保存的对象数据，与推送时的MetaProjection一致即可
+不需要完整对象时保存精简信息，避免每个资源在缓存树中再保留一份完整对象
+*/
+func (r *ResourceKeyCache) SetMetaProjection(p sender.MetaProjection) {
+	r.projection.Store(int32(p))
+}
+
+func (r *ResourceKeyCache) MetaProjection() sender.MetaProjection {
+	return sender.MetaProjection(r.projection.Load())
+}
+
+// 按照缓存的MetaProjection转换要保存的对象数据
+func (r *ResourceKeyCache) ProjectMeta(meta interface{}) interface{} {
+	if meta == nil {
+		return nil
+	}
+	return sender.ProjectMeta(meta, r.MetaProjection())
+}
+
 func (r *ResourceKeyCache) setResourceCacheBYKey(key string, value *ResourceCache) {
 	r.Lock()
 	defer r.Unlock()
@@ -159,6 +201,23 @@ func (r *ResourceKeyCache) DeleteCacheByKey(key string) {
 	delete(r.kv, key)
 }
 
+// 遍历所有缓存的资源，fn返回true时停止遍历，不能在fn中修改ResourceKeyCache
+func (r *ResourceKeyCache) Range(fn func(rc *ResourceCache) (stop bool)) {
+	r.RLock()
+	defer r.RUnlock()
+	for _, v := range r.kv {
+		if fn(v) {
+			return
+		}
+	}
+}
+
+func (r *ResourceKeyCache) Len() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.kv)
+}
+
 func NewResourceKeyCache() *ResourceKeyCache {
 	return &ResourceKeyCache{
 		kv: map[string]*ResourceCache{},
@@ -42,7 +42,7 @@ func (m *MyDep) AddRel(keyCache *ResourceKeyCache, indexMap map[constant.K8sResK
 	// 处理自身
 	depResourceCacheKey := util.ConcatResourceCacheKey(nameSpace, name)
 	status, reason := m.GetStatus()
-	depResourceCache := newResourceCache(depResourceCacheKey, name, reason, nil, status, constant.DeploymentKind, m.Deployment)
+	depResourceCache := newResourceCache(depResourceCacheKey, name, reason, nil, status, constant.DeploymentKind, keyCache.ProjectMeta(m.Deployment))
 	keyCache.setResourceCacheBYKey(depResourceCacheKey, depResourceCache)
 	return depResourceCache, nil
 }
@@ -105,7 +105,7 @@ func (m *MyPod) AddRel(keyCache *ResourceKeyCache, indexerMap map[constant.K8sRe
 	name := m.GetName()
 	podResourceCacheKey := util.ConcatResourceCacheKey(nameSpace, name)
 	status, reason := m.GetStatus()
-	podResourceCache := newResourceCache(podResourceCacheKey, name, reason, depResourceCache, status, constant.PodKind, m.Pod)
+	podResourceCache := newResourceCache(podResourceCacheKey, name, reason, depResourceCache, status, constant.PodKind, keyCache.ProjectMeta(m.Pod))
 
 	depResourceCache.AddChild(podResourceCache)
 	keyCache.setResourceCacheBYKey(podResourceCacheKey, podResourceCache)
@@ -0,0 +1,276 @@
+package kubewatcher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// rest config的可选配置，参数错误时在构造时返回
+type RestConfigOption func(cfg *rest.Config) error
+
+/*
+使用Host和可选配置构造rest config，构造完成后统一校验
+*/
+func MakeRestConfig(host string, opts ...RestConfigOption) (*rest.Config, error) {
+	cfg := &rest.Config{Host: host}
+	return applyRestConfigOptions(cfg, opts)
+}
+
+/*
+在集群内以Pod方式运行时，使用挂载的ServiceAccount构造rest config
+*/
+func MakeRestConfigInCluster(opts ...RestConfigOption) (*rest.Config, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "in-cluster config")
+	}
+	return applyRestConfigOptions(cfg, opts)
+}
+
+/*
+使用客户端证书认证，certFile、keyFile为PEM文件
+*/
+func MakeRestConfigByClientCert(host, certFile, keyFile string, opts ...RestConfigOption) (*rest.Config, error) {
+	return MakeRestConfig(host, append([]RestConfigOption{WithClientCertFiles(certFile, keyFile)}, opts...)...)
+}
+
+func applyRestConfigOptions(cfg *rest.Config, opts []RestConfigOption) (*rest.Config, error) {
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := ValidateRestConfig(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+/*
+校验rest config，尽早发现配置错误，而不是在informer同步时才失败
+*/
+func ValidateRestConfig(cfg *rest.Config) error {
+	if cfg == nil {
+		return errors.New("rest config can't be null")
+	}
+	if cfg.Host == "" {
+		return errors.New("host can't be empty")
+	}
+	u, err := url.Parse(cfg.Host)
+	if err != nil {
+		return errors.Wrapf(err, "invalid host %q", cfg.Host)
+	}
+	if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("host %q must be http or https", cfg.Host)
+	}
+	if cfg.Insecure && (len(cfg.CAData) > 0 || cfg.CAFile != "") {
+		return errors.New("insecure skip verify can't be used together with a CA bundle")
+	}
+	// 与WithCAFile相同，CA文件必须存在且为PEM格式的证书
+	if cfg.CAFile != "" {
+		b, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return errors.Wrap(err, "CA file")
+		}
+		if err := checkCABundle(b); err != nil {
+			return errors.Wrapf(err, "CA file %s", cfg.CAFile)
+		}
+	}
+	hasCert := len(cfg.CertData) > 0 || cfg.CertFile != ""
+	hasKey := len(cfg.KeyData) > 0 || cfg.KeyFile != ""
+	if hasCert != hasKey {
+		return errors.New("client certificate and key must be set together")
+	}
+	if cfg.ExecProvider != nil && cfg.AuthProvider != nil {
+		return errors.New("exec plugin and auth provider can't be set together")
+	}
+	if cfg.QPS < 0 || cfg.Burst < 0 {
+		return errors.New("qps and burst can't be negative")
+	}
+	if cfg.QPS > 0 && cfg.Burst == 0 {
+		return errors.New("burst must be set when qps is set")
+	}
+	return nil
+}
+
+func WithBearerToken(token string) RestConfigOption {
+	return func(cfg *rest.Config) error {
+		if token == "" {
+			return errors.New("bearer token can't be empty")
+		}
+		cfg.BearerToken = token
+		return nil
+	}
+}
+
+/*
+token文件会被client-go定期重新读取，适用于会轮换的token
+可以与BearerToken同时设置（InClusterConfig和kubeconfig的tokenFile都是如此），此时以文件的内容为准
+*/
+func WithBearerTokenFile(path string) RestConfigOption {
+	return func(cfg *rest.Config) error {
+		if _, err := os.Stat(path); err != nil {
+			return errors.Wrap(err, "bearer token file")
+		}
+		cfg.BearerTokenFile = path
+		return nil
+	}
+}
+
+func WithClientCertFiles(certFile, keyFile string) RestConfigOption {
+	return func(cfg *rest.Config) error {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return errors.Wrap(err, "client certificate")
+		}
+		cfg.CertFile, cfg.KeyFile = certFile, keyFile
+		cfg.CertData, cfg.KeyData = nil, nil
+		return nil
+	}
+}
+
+func WithClientCertData(certPEM, keyPEM []byte) RestConfigOption {
+	return func(cfg *rest.Config) error {
+		if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			return errors.Wrap(err, "client certificate")
+		}
+		cfg.CertData, cfg.KeyData = certPEM, keyPEM
+		cfg.CertFile, cfg.KeyFile = "", ""
+		return nil
+	}
+}
+
+// CA证书文件，PEM格式，可以包含多个证书
+func WithCAFile(path string) RestConfigOption {
+	return func(cfg *rest.Config) error {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "CA file")
+		}
+		if err := checkCABundle(b); err != nil {
+			return errors.Wrapf(err, "CA file %s", path)
+		}
+		cfg.CAFile, cfg.CAData = path, nil
+		return nil
+	}
+}
+
+func WithCAData(caPEM []byte) RestConfigOption {
+	return func(cfg *rest.Config) error {
+		if err := checkCABundle(caPEM); err != nil {
+			return errors.Wrap(err, "CA data")
+		}
+		cfg.CAData, cfg.CAFile = caPEM, ""
+		return nil
+	}
+}
+
+func checkCABundle(b []byte) error {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return errors.New("no PEM data found")
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(b) {
+		return errors.New("no valid certificate found")
+	}
+	return nil
+}
+
+// 跳过服务端证书校验，只用于测试环境
+func WithInsecureSkipVerify() RestConfigOption {
+	return func(cfg *rest.Config) error {
+		cfg.Insecure = true
+		return nil
+	}
+}
+
+// 校验服务端证书时使用的域名，用于通过IP或者代理访问apiserver
+func WithServerName(name string) RestConfigOption {
+	return func(cfg *rest.Config) error {
+		cfg.ServerName = name
+		return nil
+	}
+}
+
+/*
+使用exec凭证插件获取凭证，例如 aws eks get-token、gke-gcloud-auth-plugin
+apiVersion为空时使用 client.authentication.k8s.io/v1
+*/
+func WithExecPlugin(command string, args []string, env map[string]string, apiVersion string) RestConfigOption {
+	return func(cfg *rest.Config) error {
+		if command == "" {
+			return errors.New("exec plugin command can't be empty")
+		}
+		if apiVersion == "" {
+			apiVersion = "client.authentication.k8s.io/v1"
+		}
+		exec := &clientcmdapi.ExecConfig{
+			Command:         command,
+			Args:            args,
+			APIVersion:      apiVersion,
+			InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
+		}
+		for k, v := range env {
+			exec.Env = append(exec.Env, clientcmdapi.ExecEnvVar{Name: k, Value: v})
+		}
+		cfg.ExecProvider = exec
+		return nil
+	}
+}
+
+// 通过http、https或者socks5代理访问apiserver
+func WithProxyURL(proxy string) RestConfigOption {
+	return func(cfg *rest.Config) error {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return errors.Wrapf(err, "invalid proxy url %q", proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return errors.Errorf("proxy url %q must be http, https or socks5", proxy)
+		}
+		if u.Host == "" {
+			return errors.Errorf("proxy url %q has no host", proxy)
+		}
+		cfg.Proxy = http.ProxyURL(u)
+		return nil
+	}
+}
+
+// 客户端限流，client-go默认为QPS 5、Burst 10，集群较大时需要调大
+func WithQPS(qps float32, burst int) RestConfigOption {
+	return func(cfg *rest.Config) error {
+		if qps <= 0 || burst <= 0 {
+			return errors.New("qps and burst must be positive")
+		}
+		cfg.QPS, cfg.Burst = qps, burst
+		return nil
+	}
+}
+
+func WithUserAgent(userAgent string) RestConfigOption {
+	return func(cfg *rest.Config) error {
+		cfg.UserAgent = userAgent
+		return nil
+	}
+}
+
+// 单次请求超时，不影响watch长连接
+func WithRequestTimeout(timeout time.Duration) RestConfigOption {
+	return func(cfg *rest.Config) error {
+		if timeout < 0 {
+			return errors.New("timeout can't be negative")
+		}
+		cfg.Timeout = timeout
+		return nil
+	}
+}
@@ -0,0 +1,99 @@
+package kubewatcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+// 生成自签名的CA证书并写入dir/ca.crt
+func writeTestCA(t *testing.T, dir string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// 与rest.InClusterConfig()构造的config相同：同时设置了BearerToken和BearerTokenFile
+func TestValidateRestConfigInClusterShape(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &rest.Config{
+		Host:            "https://10.96.0.1:443",
+		TLSClientConfig: rest.TLSClientConfig{CAFile: writeTestCA(t, dir)},
+		BearerToken:     "token",
+		BearerTokenFile: tokenFile,
+	}
+	if err := ValidateRestConfig(cfg); err != nil {
+		t.Fatalf("in-cluster config rejected: %v", err)
+	}
+	if _, err := applyRestConfigOptions(cfg, []RestConfigOption{WithQPS(50, 100)}); err != nil {
+		t.Fatalf("in-cluster config with options rejected: %v", err)
+	}
+}
+
+func TestValidateRestConfig(t *testing.T) {
+	dir := t.TempDir()
+	caFile := writeTestCA(t, dir)
+	notPEM := filepath.Join(dir, "not-pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		cfg     *rest.Config
+		wantErr bool
+	}{
+		{"nil", nil, true},
+		{"empty host", &rest.Config{}, true},
+		{"bad scheme", &rest.Config{Host: "ftp://a"}, true},
+		{"token", &rest.Config{Host: "https://a", BearerToken: "t"}, false},
+		{"token file", &rest.Config{Host: "https://a", BearerTokenFile: "/t"}, false},
+		{"insecure with ca", &rest.Config{Host: "https://a", TLSClientConfig: rest.TLSClientConfig{Insecure: true, CAFile: "/ca"}}, true},
+		{"ca file", &rest.Config{Host: "https://a", TLSClientConfig: rest.TLSClientConfig{CAFile: caFile}}, false},
+		{"missing ca file", &rest.Config{Host: "https://a", TLSClientConfig: rest.TLSClientConfig{CAFile: filepath.Join(dir, "missing")}}, true},
+		{"ca file not pem", &rest.Config{Host: "https://a", TLSClientConfig: rest.TLSClientConfig{CAFile: notPEM}}, true},
+		{"cert without key", &rest.Config{Host: "https://a", TLSClientConfig: rest.TLSClientConfig{CertFile: "/c"}}, true},
+		{"qps without burst", &rest.Config{Host: "https://a", QPS: 10}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := ValidateRestConfig(c.cfg)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package rpc
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/rpc/pb"
+	"google.golang.org/grpc"
+)
+
+/*
+KubeWatcher服务的Go客户端
+使用示例：
+conn, err := grpc.Dial("kubewatcher:9090", grpc.WithTransportCredentials(insecure.NewCredentials()))
+c := rpc.NewClient(conn)
+list, err := c.ListAll(ctx, &pb.ResourceFilter{Statuses: []string{"failed"}})
+*/
+type Client struct {
+	api pb.KubeWatcherClient
+}
+
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{api: pb.NewKubeWatcherClient(conn)}
+}
+
+func (c *Client) Get(ctx context.Context, kind, nameSpace, name string) (*pb.Resource, error) {
+	return c.api.GetResource(ctx, &pb.GetResourceRequest{Kind: kind, Namespace: nameSpace, Name: name})
+}
+
+// 查询一页，pageToken为空表示第一页
+func (c *Client) List(ctx context.Context, filter *pb.ResourceFilter, pageSize int32, pageToken string) (*pb.ListResourcesResponse, error) {
+	return c.api.ListResources(ctx, &pb.ListResourcesRequest{Filter: filter, PageSize: pageSize, PageToken: pageToken})
+}
+
+// 自动翻页，返回所有符合条件的资源
+func (c *Client) ListAll(ctx context.Context, filter *pb.ResourceFilter) ([]*pb.Resource, error) {
+	list := make([]*pb.Resource, 0)
+	token := ""
+	for {
+		resp, err := c.List(ctx, filter, maxPageSize, token)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, resp.GetResources()...)
+		if token = resp.GetNextPageToken(); token == "" {
+			return list, nil
+		}
+	}
+}
+
+/*
+订阅事件，每个事件回调一次fn，直到ctx结束、服务端结束调用或者fn返回错误
+ctx结束时返回nil
+*/
+func (c *Client) Watch(ctx context.Context, req *pb.WatchRequest, fn func(ev *pb.WatchEvent) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.api.Watch(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		ev, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := fn(ev); err != nil {
+			return errors.Wrap(err, "watch callback")
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: kubewatcher.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	KubeWatcher_GetResource_FullMethodName   = "/kubewatcher.v1.KubeWatcher/GetResource"
+	KubeWatcher_ListResources_FullMethodName = "/kubewatcher.v1.KubeWatcher/ListResources"
+	KubeWatcher_Watch_FullMethodName         = "/kubewatcher.v1.KubeWatcher/Watch"
+)
+
+// KubeWatcherClient is the client API for KubeWatcher service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type KubeWatcherClient interface {
+	// 查询单个资源，不存在时返回NotFound
+	GetResource(ctx context.Context, in *GetResourceRequest, opts ...grpc.CallOption) (*Resource, error)
+	// 按条件分页查询资源，结果按kind、key排序
+	ListResources(ctx context.Context, in *ListResourcesRequest, opts ...grpc.CallOption) (*ListResourcesResponse, error)
+	// 订阅状态变化，可选先推送当前状态
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (KubeWatcher_WatchClient, error)
+}
+
+type kubeWatcherClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKubeWatcherClient(cc grpc.ClientConnInterface) KubeWatcherClient {
+	return &kubeWatcherClient{cc}
+}
+
+func (c *kubeWatcherClient) GetResource(ctx context.Context, in *GetResourceRequest, opts ...grpc.CallOption) (*Resource, error) {
+	out := new(Resource)
+	err := c.cc.Invoke(ctx, KubeWatcher_GetResource_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kubeWatcherClient) ListResources(ctx context.Context, in *ListResourcesRequest, opts ...grpc.CallOption) (*ListResourcesResponse, error) {
+	out := new(ListResourcesResponse)
+	err := c.cc.Invoke(ctx, KubeWatcher_ListResources_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kubeWatcherClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (KubeWatcher_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &KubeWatcher_ServiceDesc.Streams[0], KubeWatcher_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kubeWatcherWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type KubeWatcher_WatchClient interface {
+	Recv() (*WatchEvent, error)
+	grpc.ClientStream
+}
+
+type kubeWatcherWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *kubeWatcherWatchClient) Recv() (*WatchEvent, error) {
+	m := new(WatchEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// KubeWatcherServer is the server API for KubeWatcher service.
+// All implementations must embed UnimplementedKubeWatcherServer
+// for forward compatibility
+type KubeWatcherServer interface {
+	// 查询单个资源，不存在时返回NotFound
+	GetResource(context.Context, *GetResourceRequest) (*Resource, error)
+	// 按条件分页查询资源，结果按kind、key排序
+	ListResources(context.Context, *ListResourcesRequest) (*ListResourcesResponse, error)
+	// 订阅状态变化，可选先推送当前状态
+	Watch(*WatchRequest, KubeWatcher_WatchServer) error
+	mustEmbedUnimplementedKubeWatcherServer()
+}
+
+// UnimplementedKubeWatcherServer must be embedded to have forward compatible implementations.
+type UnimplementedKubeWatcherServer struct {
+}
+
+func (UnimplementedKubeWatcherServer) GetResource(context.Context, *GetResourceRequest) (*Resource, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetResource not implemented")
+}
+func (UnimplementedKubeWatcherServer) ListResources(context.Context, *ListResourcesRequest) (*ListResourcesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListResources not implemented")
+}
+func (UnimplementedKubeWatcherServer) Watch(*WatchRequest, KubeWatcher_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedKubeWatcherServer) mustEmbedUnimplementedKubeWatcherServer() {}
+
+// UnsafeKubeWatcherServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KubeWatcherServer will
+// result in compilation errors.
+type UnsafeKubeWatcherServer interface {
+	mustEmbedUnimplementedKubeWatcherServer()
+}
+
+func RegisterKubeWatcherServer(s grpc.ServiceRegistrar, srv KubeWatcherServer) {
+	s.RegisterService(&KubeWatcher_ServiceDesc, srv)
+}
+
+func _KubeWatcher_GetResource_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetResourceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KubeWatcherServer).GetResource(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KubeWatcher_GetResource_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KubeWatcherServer).GetResource(ctx, req.(*GetResourceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KubeWatcher_ListResources_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListResourcesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KubeWatcherServer).ListResources(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KubeWatcher_ListResources_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KubeWatcherServer).ListResources(ctx, req.(*ListResourcesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KubeWatcher_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KubeWatcherServer).Watch(m, &kubeWatcherWatchServer{stream})
+}
+
+type KubeWatcher_WatchServer interface {
+	Send(*WatchEvent) error
+	grpc.ServerStream
+}
+
+type kubeWatcherWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *kubeWatcherWatchServer) Send(m *WatchEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// KubeWatcher_ServiceDesc is the grpc.ServiceDesc for KubeWatcher service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var KubeWatcher_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kubewatcher.v1.KubeWatcher",
+	HandlerType: (*KubeWatcherServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetResource",
+			Handler:    _KubeWatcher_GetResource_Handler,
+		},
+		{
+			MethodName: "ListResources",
+			Handler:    _KubeWatcher_ListResources_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _KubeWatcher_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "kubewatcher.proto",
+}
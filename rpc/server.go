@@ -0,0 +1,309 @@
+package rpc
+
+import (
+	"context"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/rpc/pb"
+	"github.com/sunreaver/kubewatcher/sender"
+	"github.com/sunreaver/kubewatcher/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	defaultPageSize    = 100
+	maxPageSize        = 1000
+	defaultWatchBuffer = 256
+)
+
+// 事件来源，*kubewatcher.K8sWatcher实现了该接口
+type Source interface {
+	Snapshot() []sender.SendOut
+	Subscribe(fn func(out sender.SendOut), opts ...sender.SubscribeOption)
+}
+
+type ServerOption func(*Server)
+
+// 每个Watch调用的发送缓冲，缓冲满说明客户端太慢，以ResourceExhausted结束调用
+func WithWatchBuffer(n int) ServerOption {
+	return func(s *Server) {
+		if n > 0 {
+			s.watchBuffer = n
+		}
+	}
+}
+
+type watcher struct {
+	filter *filter
+	ch     chan *pb.WatchEvent
+	once   sync.Once
+	closed chan struct{} // 客户端太慢被踢掉
+}
+
+func (w *watcher) kick() {
+	w.once.Do(func() { close(w.closed) })
+}
+
+/*
+gRPC服务端，通过 Register 注册到 grpc.Server 上
+查询直接读取watcher的当前状态，Watch由sender推送的事件驱动
+*/
+type Server struct {
+	pb.UnimplementedKubeWatcherServer
+	src         Source
+	watchBuffer int
+
+	lock     sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+func NewServer(src Source, opts ...ServerOption) *Server {
+	s := &Server{
+		src:         src,
+		watchBuffer: defaultWatchBuffer,
+		watchers:    map[*watcher]struct{}{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	src.Subscribe(s.publish, sender.WithEventTypes(constant.EventStatusChange, constant.EventFlapping, constant.EventReasonChange))
+	return s
+}
+
+func (s *Server) Register(gs *grpc.Server) {
+	pb.RegisterKubeWatcherServer(gs, s)
+}
+
+func (s *Server) publish(out sender.SendOut) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var ev *pb.WatchEvent
+	for w := range s.watchers {
+		if !w.filter.matchType(out.Type) || !w.filter.match(out) {
+			continue
+		}
+		if ev == nil {
+			ev = &pb.WatchEvent{Kind: pb.WatchEvent_EVENT, Type: string(out.Type), Resource: toResource(out)}
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			w.kick()
+		}
+	}
+}
+
+func (s *Server) GetResource(ctx context.Context, req *pb.GetResourceRequest) (*pb.Resource, error) {
+	if req.GetKind() == "" || req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "kind and name are required")
+	}
+	key := util.ConcatResourceCacheKey(req.GetNamespace(), req.GetName())
+	for _, out := range s.src.Snapshot() {
+		if string(out.Kind) == req.GetKind() && out.Key == key {
+			return toResource(out), nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "%s %s not found", req.GetKind(), key)
+}
+
+func (s *Server) ListResources(ctx context.Context, req *pb.ListResourcesRequest) (*pb.ListResourcesResponse, error) {
+	f, err := newFilter(req.GetFilter(), nil)
+	if err != nil {
+		return nil, err
+	}
+	pageSize := int(req.GetPageSize())
+	switch {
+	case pageSize < 0:
+		return nil, status.Error(codes.InvalidArgument, "page_size can't be negative")
+	case pageSize == 0:
+		pageSize = defaultPageSize
+	case pageSize > maxPageSize:
+		pageSize = maxPageSize
+	}
+	after, err := decodePageToken(req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*pb.Resource, 0)
+	for _, out := range s.src.Snapshot() {
+		if f.match(out) {
+			list = append(list, toResource(out))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return sortKey(list[i]) < sortKey(list[j]) })
+	// 翻页位置按排序键定位而不是下标，翻页过程中资源增删不会导致重复或遗漏
+	start := sort.Search(len(list), func(i int) bool { return sortKey(list[i]) > after })
+	end := start + pageSize
+	resp := &pb.ListResourcesResponse{}
+	if end < len(list) {
+		resp.NextPageToken = encodePageToken(sortKey(list[end-1]))
+	} else {
+		end = len(list)
+	}
+	resp.Resources = list[start:end]
+	return resp, nil
+}
+
+func (s *Server) Watch(req *pb.WatchRequest, stream pb.KubeWatcher_WatchServer) error {
+	f, err := newFilter(req.GetFilter(), req.GetTypes())
+	if err != nil {
+		return err
+	}
+	w := &watcher{filter: f, ch: make(chan *pb.WatchEvent, s.watchBuffer), closed: make(chan struct{})}
+
+	// 注册和取快照在同一把锁内，保证快照和增量之间不丢事件
+	var initial []sender.SendOut
+	s.lock.Lock()
+	s.watchers[w] = struct{}{}
+	if req.GetSendInitial() {
+		initial = s.src.Snapshot()
+	}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.watchers, w)
+		s.lock.Unlock()
+	}()
+
+	if req.GetSendInitial() {
+		for _, out := range initial {
+			if !f.match(out) {
+				continue
+			}
+			if err := stream.Send(&pb.WatchEvent{Kind: pb.WatchEvent_SNAPSHOT, Type: string(out.Type), Resource: toResource(out)}); err != nil {
+				return err
+			}
+		}
+		if err := stream.Send(&pb.WatchEvent{Kind: pb.WatchEvent_SNAPSHOT_END}); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case ev := <-w.ch:
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		case <-w.closed:
+			util.Warnw("grpc_watch_too_slow")
+			return status.Error(codes.ResourceExhausted, "watch client is too slow")
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// 同一字段多个值为或，不同字段之间为与
+type filter struct {
+	kinds      map[string]struct{}
+	namespaces map[string]struct{}
+	statuses   map[string]struct{}
+	types      map[string]struct{}
+	selector   labels.Selector // 为空表示不按标签过滤
+}
+
+func newFilter(f *pb.ResourceFilter, types []string) (*filter, error) {
+	out := &filter{
+		kinds:      toSet(f.GetKinds()),
+		namespaces: toSet(f.GetNamespaces()),
+		statuses:   toSet(f.GetStatuses()),
+		types:      toSet(types),
+	}
+	if len(out.types) == 0 {
+		// 与Subscribe一致，ReasonChange需要主动开启
+		out.types = toSet([]string{string(constant.EventStatusChange), string(constant.EventFlapping)})
+	}
+	if sel := strings.TrimSpace(f.GetLabelSelector()); sel != "" {
+		selector, err := labels.Parse(sel)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid label selector: %v", err)
+		}
+		out.selector = selector
+	}
+	return out, nil
+}
+
+func toSet(values []string) map[string]struct{} {
+	set := map[string]struct{}{}
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = struct{}{}
+		}
+	}
+	return set
+}
+
+func inSet(set map[string]struct{}, v string) bool {
+	if len(set) == 0 {
+		return true
+	}
+	_, ok := set[v]
+	return ok
+}
+
+func (f *filter) match(out sender.SendOut) bool {
+	nameSpace, _ := util.SplitResourceCacheKey(out.Key)
+	if !inSet(f.kinds, string(out.Kind)) || !inSet(f.namespaces, nameSpace) || !inSet(f.statuses, string(out.Status)) {
+		return false
+	}
+	return f.selector == nil || f.selector.Matches(labels.Set(labelsOf(out)))
+}
+
+func (f *filter) matchType(t constant.EventType) bool {
+	return inSet(f.types, string(t))
+}
+
+// 从meta中取出标签，meta投影为None时没有标签
+func labelsOf(out sender.SendOut) map[string]string {
+	if p, ok := out.AsPod(); ok {
+		return p.Labels
+	}
+	if d, ok := out.AsDeployment(); ok {
+		return d.Labels
+	}
+	if summary, ok := out.AsSummary(); ok {
+		return summary.Labels
+	}
+	return nil
+}
+
+func toResource(out sender.SendOut) *pb.Resource {
+	nameSpace, _ := util.SplitResourceCacheKey(out.Key)
+	return &pb.Resource{
+		Key:           out.Key,
+		Kind:          string(out.Kind),
+		Namespace:     nameSpace,
+		Name:          out.Name,
+		Status:        string(out.Status),
+		Reason:        out.Reason,
+		ControllerKey: out.ControllerKey,
+		Labels:        labelsOf(out),
+	}
+}
+
+func sortKey(r *pb.Resource) string {
+	return r.GetKind() + "\x00" + r.GetKey()
+}
+
+func encodePageToken(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodePageToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, "invalid page token")
+	}
+	return string(b), nil
+}
@@ -0,0 +1,365 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/rpc/pb"
+	"github.com/sunreaver/kubewatcher/sender"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// 代替K8sWatcher的事件来源，快照由测试设置，事件通过真实的sender推送
+type fakeSource struct {
+	*sender.Sender
+	lock     sync.Mutex
+	snapshot map[string]sender.SendOut
+}
+
+func newFakeSource(t *testing.T, list ...sender.SendOut) *fakeSource {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	src := &fakeSource{Sender: sender.NewSender(), snapshot: map[string]sender.SendOut{}}
+	src.Start(ctx)
+	for _, out := range list {
+		src.set(out)
+	}
+	return src
+}
+
+func (f *fakeSource) Snapshot() []sender.SendOut {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	list := make([]sender.SendOut, 0, len(f.snapshot))
+	for _, out := range f.snapshot {
+		list = append(list, out)
+	}
+	return list
+}
+
+func (f *fakeSource) set(out sender.SendOut) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.snapshot[string(out.Kind)+"/"+out.Key] = out
+}
+
+// 更新快照并推送事件，与watcher处理状态变化的顺序一致
+func (f *fakeSource) emit(out sender.SendOut) {
+	f.set(out)
+	f.AddSendOut(out)
+}
+
+func pod(key, name string, status constant.K8sResStatus, labels map[string]string) sender.SendOut {
+	return sender.SendOut{
+		Key:    key,
+		Kind:   constant.PodKind,
+		Type:   constant.EventStatusChange,
+		Name:   name,
+		Status: status,
+		Meta:   &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}},
+	}
+}
+
+// bufconn上的gRPC服务，stop后可以在新的listener上重新启动，客户端连接保持不变
+type testServer struct {
+	t        *testing.T
+	server   *Server
+	lock     sync.Mutex
+	listener *bufconn.Listener
+	gs       *grpc.Server
+}
+
+func newTestServer(t *testing.T, src Source, opts ...ServerOption) *testServer {
+	ts := &testServer{t: t, server: NewServer(src, opts...)}
+	ts.start()
+	t.Cleanup(ts.stop)
+	return ts
+}
+
+func (ts *testServer) start() {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.listener = bufconn.Listen(1 << 20)
+	ts.gs = grpc.NewServer()
+	ts.server.Register(ts.gs)
+	go ts.gs.Serve(ts.listener)
+}
+
+func (ts *testServer) stop() {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.gs.Stop()
+}
+
+func (ts *testServer) dial(ctx context.Context, _ string) (net.Conn, error) {
+	ts.lock.Lock()
+	listener := ts.listener
+	ts.lock.Unlock()
+	return listener.DialContext(ctx)
+}
+
+func (ts *testServer) client() *Client {
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(ts.dial),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.t.Cleanup(func() { conn.Close() })
+	return NewClient(conn)
+}
+
+// 在后台Watch，收到的事件写入channel，Watch返回后关闭channel
+func watchEvents(ctx context.Context, c *Client, req *pb.WatchRequest) (<-chan *pb.WatchEvent, <-chan error) {
+	events := make(chan *pb.WatchEvent, 100)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(events)
+		errs <- c.Watch(ctx, req, func(ev *pb.WatchEvent) error {
+			events <- ev
+			return nil
+		})
+	}()
+	return events, errs
+}
+
+func recvEvent(t *testing.T, events <-chan *pb.WatchEvent) *pb.WatchEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("watch stopped")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for watch event")
+	}
+	return nil
+}
+
+// 读取快照直到SNAPSHOT_END，返回快照中的key
+func recvSnapshot(t *testing.T, events <-chan *pb.WatchEvent) map[string]string {
+	t.Helper()
+	keys := map[string]string{}
+	for {
+		ev := recvEvent(t, events)
+		switch ev.GetKind() {
+		case pb.WatchEvent_SNAPSHOT_END:
+			return keys
+		case pb.WatchEvent_SNAPSHOT:
+			keys[ev.GetResource().GetKey()] = ev.GetResource().GetStatus()
+		default:
+			t.Fatalf("unexpected %s before snapshot end", ev.GetKind())
+		}
+	}
+}
+
+func TestWatchSnapshotThenEvents(t *testing.T) {
+	src := newFakeSource(t,
+		pod("default/a", "a", constant.K8sResStatusSucceed, nil),
+		pod("default/b", "b", constant.K8sResStatusFail, nil),
+	)
+	ts := newTestServer(t, src)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, errs := watchEvents(ctx, ts.client(), &pb.WatchRequest{SendInitial: true})
+
+	snapshot := recvSnapshot(t, events)
+	if len(snapshot) != 2 || snapshot["default/a"] != string(constant.K8sResStatusSucceed) || snapshot["default/b"] != string(constant.K8sResStatusFail) {
+		t.Fatalf("snapshot = %v", snapshot)
+	}
+	for _, st := range []constant.K8sResStatus{constant.K8sResStatusFail, constant.K8sResStatusSucceed} {
+		src.emit(pod("default/a", "a", st, nil))
+		ev := recvEvent(t, events)
+		if ev.GetKind() != pb.WatchEvent_EVENT || ev.GetResource().GetKey() != "default/a" || ev.GetResource().GetStatus() != string(st) {
+			t.Fatalf("event = %v, want default/a %s", ev, st)
+		}
+	}
+
+	cancel()
+	if err := <-errs; err != nil {
+		t.Fatalf("watch returned %v after ctx cancel, want nil", err)
+	}
+}
+
+func TestWatchFilters(t *testing.T) {
+	src := newFakeSource(t,
+		pod("default/web-1", "web-1", constant.K8sResStatusFail, map[string]string{"app": "web"}),
+		pod("default/db-1", "db-1", constant.K8sResStatusFail, map[string]string{"app": "db"}),
+		pod("other/web-1", "web-1", constant.K8sResStatusFail, map[string]string{"app": "web"}),
+	)
+	ts := newTestServer(t, src)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, _ := watchEvents(ctx, ts.client(), &pb.WatchRequest{
+		SendInitial: true,
+		Filter: &pb.ResourceFilter{
+			Kinds:         []string{string(constant.PodKind)},
+			Namespaces:    []string{"default"},
+			LabelSelector: "app=web",
+		},
+	})
+	if snapshot := recvSnapshot(t, events); len(snapshot) != 1 || snapshot["default/web-1"] == "" {
+		t.Fatalf("snapshot = %v, want only default/web-1", snapshot)
+	}
+
+	reasonChange := pod("default/web-1", "web-1", constant.K8sResStatusFail, map[string]string{"app": "web"})
+	reasonChange.Type = constant.EventReasonChange
+	src.emit(reasonChange)                                                                               // 默认不订阅原因变化
+	src.emit(pod("default/db-1", "db-1", constant.K8sResStatusSucceed, map[string]string{"app": "db"}))  // 标签不匹配
+	src.emit(pod("other/web-1", "web-1", constant.K8sResStatusSucceed, map[string]string{"app": "web"})) // namespace不匹配
+	dep := sender.SendOut{Key: "default/web", Kind: constant.DeploymentKind, Type: constant.EventStatusChange, Name: "web", Status: constant.K8sResStatusFail}
+	src.emit(dep) // kind不匹配
+	src.emit(pod("default/web-1", "web-1", constant.K8sResStatusSucceed, map[string]string{"app": "web"}))
+
+	ev := recvEvent(t, events)
+	if ev.GetResource().GetKey() != "default/web-1" || ev.GetType() != string(constant.EventStatusChange) || ev.GetResource().GetStatus() != string(constant.K8sResStatusSucceed) {
+		t.Fatalf("first event = %v, want default/web-1 succeed", ev)
+	}
+	if ev.GetResource().GetLabels()["app"] != "web" {
+		t.Fatalf("labels = %v", ev.GetResource().GetLabels())
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatchInvalidFilter(t *testing.T) {
+	ts := newTestServer(t, newFakeSource(t))
+	err := ts.client().Watch(context.Background(), &pb.WatchRequest{Filter: &pb.ResourceFilter{LabelSelector: "app in ("}},
+		func(*pb.WatchEvent) error { return nil })
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("watch error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestListResourcesFiltersAndPages(t *testing.T) {
+	list := make([]sender.SendOut, 0)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		list = append(list, pod("default/"+name, name, constant.K8sResStatusFail, nil))
+	}
+	list = append(list, pod("default/ok", "ok", constant.K8sResStatusSucceed, nil))
+	src := newFakeSource(t, list...)
+	c := newTestServer(t, src).client()
+	ctx := context.Background()
+	filter := &pb.ResourceFilter{Statuses: []string{string(constant.K8sResStatusFail)}}
+
+	keys := make([]string, 0)
+	token := ""
+	pages := 0
+	for {
+		resp, err := c.List(ctx, filter, 2, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, r := range resp.GetResources() {
+			keys = append(keys, r.GetKey())
+		}
+		if token = resp.GetNextPageToken(); token == "" {
+			break
+		}
+		if pages == 1 {
+			// 翻页过程中删除已返回的资源不影响后面的页
+			src.lock.Lock()
+			delete(src.snapshot, string(constant.PodKind)+"/default/a")
+			src.lock.Unlock()
+		}
+	}
+	want := []string{"default/a", "default/b", "default/c", "default/d", "default/e"}
+	if pages != 3 || len(keys) != len(want) {
+		t.Fatalf("pages = %d, keys = %v, want 3 pages of %v", pages, keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("keys = %v, want %v", keys, want)
+		}
+	}
+
+	all, err := c.ListAll(ctx, &pb.ResourceFilter{Statuses: []string{string(constant.K8sResStatusSucceed)}})
+	if err != nil || len(all) != 1 || all[0].GetKey() != "default/ok" {
+		t.Fatalf("list all = %v, %v", all, err)
+	}
+	if _, err := c.List(ctx, nil, 0, "!invalid"); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("invalid page token error = %v, want InvalidArgument", err)
+	}
+	if _, err := c.Get(ctx, string(constant.PodKind), "default", "missing"); status.Code(err) != codes.NotFound {
+		t.Fatalf("get missing error = %v, want NotFound", err)
+	}
+}
+
+// 服务重启后客户端重新Watch，通过快照拿到重启期间的状态变化
+func TestWatchReconnect(t *testing.T) {
+	src := newFakeSource(t, pod("default/a", "a", constant.K8sResStatusSucceed, nil))
+	ts := newTestServer(t, src)
+	c := ts.client()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, errs := watchEvents(ctx, c, &pb.WatchRequest{SendInitial: true})
+	if snapshot := recvSnapshot(t, events); snapshot["default/a"] != string(constant.K8sResStatusSucceed) {
+		t.Fatalf("snapshot = %v", snapshot)
+	}
+
+	ts.stop()
+	select {
+	case err := <-errs:
+		if code := status.Code(err); code != codes.Unavailable && code != codes.Canceled {
+			t.Fatalf("watch error after server stop = %v, want Unavailable", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch didn't return after server stop")
+	}
+	src.set(pod("default/a", "a", constant.K8sResStatusFail, nil)) // 断开期间的变化
+	ts.start()
+
+	events = rewatch(t, ctx, c, &pb.WatchRequest{SendInitial: true})
+	if snapshot := recvSnapshot(t, events); snapshot["default/a"] != string(constant.K8sResStatusFail) {
+		t.Fatalf("snapshot after reconnect = %v, want default/a failed", snapshot)
+	}
+	src.emit(pod("default/a", "a", constant.K8sResStatusSucceed, nil))
+	if ev := recvEvent(t, events); ev.GetKind() != pb.WatchEvent_EVENT || ev.GetResource().GetStatus() != string(constant.K8sResStatusSucceed) {
+		t.Fatalf("event after reconnect = %v", ev)
+	}
+}
+
+/*
+连接恢复前Watch会以Unavailable失败，按间隔重试直到收到第一个事件
+返回的channel中包含第一个事件
+*/
+func rewatch(t *testing.T, ctx context.Context, c *Client, req *pb.WatchRequest) <-chan *pb.WatchEvent {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		events, errs := watchEvents(ctx, c, req)
+		first, ok := <-events
+		if ok {
+			out := make(chan *pb.WatchEvent, 100)
+			out <- first
+			go func() {
+				defer close(out)
+				for ev := range events {
+					out <- ev
+				}
+			}()
+			return out
+		}
+		if err := <-errs; status.Code(err) != codes.Unavailable {
+			t.Fatalf("rewatch error = %v, want Unavailable", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for reconnect")
+	return nil
+}
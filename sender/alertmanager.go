@@ -0,0 +1,327 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/util"
+)
+
+const (
+	defaultAlertName                 = "KubewatcherResourceFailed"
+	defaultAlertmanagerResend        = time.Minute
+	defaultAlertmanagerTimeout       = 10 * time.Second
+	defaultAlertmanagerQueueSize     = 1000
+	alertmanagerEndsAtResendMultiple = 4 // firing告警的endsAt为 now + 4*ResendInterval，watcher异常退出后告警会自动过期
+)
+
+type AlertmanagerConfig struct {
+	URL            string            // alertmanager地址 例如 http://alertmanager:9093
+	Cluster        string            // 事件没有Cluster时使用的集群名，作为cluster标签
+	AlertName      string            // alertname标签 默认KubewatcherResourceFailed
+	ExtraLabels    map[string]string // 附加到所有告警上的标签
+	Headers        map[string]string // 附加的请求头，例如Authorization
+	ResendInterval time.Duration     // firing告警重复推送的间隔 默认1m
+	Timeout        time.Duration     // 单次请求超时 默认10s
+	Client         *http.Client      // 为空时使用默认client
+	QueueSize      int               // 待处理事件队列长度，同时限制推送失败后待重推的resolve数量 默认1000
+}
+
+func (c *AlertmanagerConfig) setDefaults() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return errors.Wrapf(err, "invalid alertmanager url %q", c.URL)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("alertmanager url %q must be http or https", c.URL)
+	}
+	if c.ResendInterval < 0 || c.Timeout < 0 || c.QueueSize < 0 {
+		return errors.New("alertmanager config can't be negative")
+	}
+	if c.AlertName == "" {
+		c.AlertName = defaultAlertName
+	}
+	if c.ResendInterval == 0 {
+		c.ResendInterval = defaultAlertmanagerResend
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultAlertmanagerTimeout
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = defaultAlertmanagerQueueSize
+	}
+	if c.Client == nil {
+		c.Client = &http.Client{}
+	}
+	return nil
+}
+
+// alertmanager v2 api中的告警
+type Alert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt,omitempty"`
+	EndsAt       time.Time         `json:"endsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+/*
+资源变为failed时向alertmanager推送firing告警，并按ResendInterval重复推送
+资源恢复或者被删除时推送带endsAt的告警使其resolved
+sink关闭时不会主动resolve，未恢复的告警依靠endsAt自动过期
+*/
+type AlertmanagerSink struct {
+	cfg       AlertmanagerConfig
+	endpoint  string
+	queue     chan SendOut
+	firing    map[string]*Alert // key为集群+资源key，只在worker协程中访问
+	resolving []*Alert          // 推送失败的resolve，下次重推
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeLock sync.RWMutex
+	closed    bool
+	done      chan struct{}
+}
+
+func NewAlertmanagerSink(cfg AlertmanagerConfig) (*AlertmanagerSink, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &AlertmanagerSink{
+		cfg:      cfg,
+		endpoint: strings.TrimRight(cfg.URL, "/") + "/api/v2/alerts",
+		queue:    make(chan SendOut, cfg.QueueSize),
+		firing:   map[string]*Alert{},
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+func (a *AlertmanagerSink) Send(out SendOut) {
+	a.closeLock.RLock()
+	defer a.closeLock.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.queue <- out:
+	default:
+		util.Warnw("alertmanager_queue_full", "key", out.Key, "status", out.Status)
+	}
+}
+
+func (a *AlertmanagerSink) Close(ctx context.Context) error {
+	a.closeLock.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.closeLock.Unlock()
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		a.cancel()
+		<-a.done
+		return ctx.Err()
+	}
+}
+
+func (a *AlertmanagerSink) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.cfg.ResendInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case out, ok := <-a.queue:
+			if !ok {
+				a.flush() // 把队列中产生的最后一批变化推送出去
+				return
+			}
+			a.apply(out)
+			a.drainQueue()
+			a.flush()
+		case <-ticker.C:
+			a.resendFiring()
+		}
+	}
+}
+
+// 合并队列中已经到达的事件，减少请求次数
+func (a *AlertmanagerSink) drainQueue() {
+	for {
+		select {
+		case out, ok := <-a.queue:
+			if !ok {
+				return
+			}
+			a.apply(out)
+		default:
+			return
+		}
+	}
+}
+
+/*
+根据事件更新告警状态，不发请求，由flush统一推送
+EndsAt为零值表示新产生或者内容有变化、需要立即推送的firing告警
+*/
+func (a *AlertmanagerSink) apply(out SendOut) {
+	now := time.Now()
+	id := resourceID(out)
+	old, isFiring := a.firing[id]
+	if out.Status != constant.K8sResStatusFail {
+		if isFiring {
+			a.resolve(old, now)
+			delete(a.firing, id)
+		}
+		return
+	}
+	alert := a.buildAlert(out)
+	if isFiring {
+		if sameLabels(old.Labels, alert.Labels) {
+			old.Annotations = alert.Annotations
+			old.EndsAt = time.Time{} // 标记需要推送
+			return
+		}
+		// 原因分类变化导致标签变化，旧告警resolve，新告警firing
+		a.resolve(old, now)
+	}
+	alert.StartsAt = now
+	a.firing[id] = alert
+}
+
+/*
+加入待resolve列表，超过QueueSize时丢弃最早的
+被丢弃的告警如果推送过，依靠上次推送的endsAt自动过期
+*/
+func (a *AlertmanagerSink) resolve(alert *Alert, now time.Time) {
+	alert.EndsAt = now
+	if len(a.resolving) >= a.cfg.QueueSize {
+		util.Warnw("alertmanager_resolving_full", "alertname", a.resolving[0].Labels["alertname"], "name", a.resolving[0].Labels["name"])
+		a.resolving = append(a.resolving[:0], a.resolving[1:]...)
+	}
+	a.resolving = append(a.resolving, alert)
+}
+
+func (a *AlertmanagerSink) buildAlert(out SendOut) *Alert {
+	nameSpace, _ := util.SplitResourceCacheKey(out.Key)
+	labels := map[string]string{}
+	for k, v := range a.cfg.ExtraLabels {
+		labels[k] = v
+	}
+	labels["alertname"] = a.cfg.AlertName
+	labels["cluster"] = eventCluster(out, a.cfg.Cluster)
+	labels["namespace"] = nameSpace
+	labels["kind"] = string(out.Kind)
+	labels["name"] = out.Name
+	labels["reason_category"] = util.ReasonCategory(out.Reason)
+	return &Alert{
+		Labels: labels,
+		Annotations: map[string]string{
+			"summary": fmt.Sprintf("%s %s failed", out.Kind, out.Key),
+			"reason":  out.Reason,
+		},
+	}
+}
+
+// 推送新的firing告警以及所有待resolve的告警
+func (a *AlertmanagerSink) flush() {
+	alerts := make([]*Alert, 0)
+	for _, alert := range a.firing {
+		if alert.EndsAt.IsZero() {
+			alerts = append(alerts, alert)
+		}
+	}
+	a.post(alerts)
+}
+
+// 定时重推所有firing告警
+func (a *AlertmanagerSink) resendFiring() {
+	alerts := make([]*Alert, 0, len(a.firing))
+	for _, alert := range a.firing {
+		alerts = append(alerts, alert)
+	}
+	a.post(alerts)
+}
+
+/*
+推送成功后才设置firing告警的EndsAt
+推送失败时新告警的EndsAt保持零值，下次flush时和resolving一起重推
+*/
+func (a *AlertmanagerSink) post(firing []*Alert) {
+	if len(firing) == 0 && len(a.resolving) == 0 {
+		return
+	}
+	endsAt := time.Now().Add(alertmanagerEndsAtResendMultiple * a.cfg.ResendInterval)
+	alerts := make([]Alert, 0, len(firing)+len(a.resolving))
+	for _, alert := range firing {
+		v := *alert
+		v.EndsAt = endsAt
+		alerts = append(alerts, v)
+	}
+	for _, alert := range a.resolving {
+		alerts = append(alerts, *alert)
+	}
+	if err := a.postAlerts(alerts); err != nil {
+		util.Warnw("alertmanager_post", "url", a.endpoint, "alerts", len(alerts), "error", err)
+		return
+	}
+	for _, alert := range firing {
+		alert.EndsAt = endsAt
+	}
+	a.resolving = a.resolving[:0]
+}
+
+func (a *AlertmanagerSink) postAlerts(alerts []Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, a.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range a.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := a.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("alertmanager response status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
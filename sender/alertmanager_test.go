@@ -0,0 +1,221 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+)
+
+// 记录收到的告警，fail大于0时前fail次请求返回500
+type alertRecorder struct {
+	lock     sync.Mutex
+	alerts   []Alert
+	fail     int
+	requests int
+}
+
+func (r *alertRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	r.requests++
+	if r.fail > 0 {
+		r.fail--
+		r.lock.Unlock()
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	r.lock.Unlock()
+	var alerts []Alert
+	if err := json.NewDecoder(req.Body).Decode(&alerts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.lock.Lock()
+	r.alerts = append(r.alerts, alerts...)
+	r.lock.Unlock()
+}
+
+func (r *alertRecorder) snapshot() []Alert {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Alert{}, r.alerts...)
+}
+
+// Manager.AddSink共用一个sink时，不同集群的同名资源是不同的告警
+func TestAlertmanagerSinkSeparatesClusters(t *testing.T) {
+	rec := &alertRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	sink, err := NewAlertmanagerSink(AlertmanagerConfig{URL: srv.URL, Cluster: "fallback", ResendInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := func(cluster string) SendOut {
+		return SendOut{Cluster: cluster, Key: "default/web", Kind: constant.DeploymentKind, Name: "web", Status: constant.K8sResStatusFail, Reason: "CrashLoopBackOff"}
+	}
+	sink.Send(failed("a"))
+	sink.Send(failed("b"))
+	sink.Send(failed(""))
+	waitFor(t, func() bool { return len(rec.snapshot()) >= 3 })
+	resolved := failed("a")
+	resolved.Status = constant.K8sResStatusSucceed
+	sink.Send(resolved)
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	firing := map[string]bool{}
+	resolvedAt := map[string]bool{}
+	for _, alert := range rec.snapshot() {
+		cluster := alert.Labels["cluster"]
+		if alert.EndsAt.Before(time.Now()) {
+			resolvedAt[cluster] = true
+		} else {
+			firing[cluster] = true
+		}
+	}
+	if !firing["a"] || !firing["b"] || !firing["fallback"] {
+		t.Fatalf("firing clusters = %v, want a, b and fallback", firing)
+	}
+	if !resolvedAt["a"] || resolvedAt["b"] {
+		t.Fatalf("resolved clusters = %v, want only a", resolvedAt)
+	}
+	if len(sink.firing) != 2 { // b和fallback
+		t.Fatalf("firing state = %d, want 2", len(sink.firing))
+	}
+}
+
+func (r *alertRecorder) requestCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requests
+}
+
+func failedOut(name string) SendOut {
+	return SendOut{Key: "default/" + name, Kind: constant.DeploymentKind, Name: name, Status: constant.K8sResStatusFail, Reason: "CrashLoopBackOff"}
+}
+
+// 推送失败的新告警保持待推送状态，下次flush时重推，不需要等到ResendInterval
+func TestAlertmanagerSinkRetryFailedPost(t *testing.T) {
+	rec := &alertRecorder{fail: 1}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	sink, err := NewAlertmanagerSink(AlertmanagerConfig{URL: srv.URL, ResendInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Send(failedOut("web"))
+	waitFor(t, func() bool { return rec.requestCount() == 1 })
+	sink.Send(failedOut("api"))
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	for _, alert := range rec.snapshot() {
+		if !alert.EndsAt.After(time.Now()) {
+			t.Fatalf("alert %s endsAt = %v, want firing", alert.Labels["name"], alert.EndsAt)
+		}
+		names[alert.Labels["name"]] = true
+	}
+	if !names["web"] || !names["api"] {
+		t.Fatalf("pushed = %v, want web retried together with api", names)
+	}
+	for id, alert := range sink.firing {
+		if alert.EndsAt.IsZero() {
+			t.Fatalf("alert %s still marked as not pushed", id)
+		}
+	}
+}
+
+func TestAlertmanagerSinkResolve(t *testing.T) {
+	rec := &alertRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	sink, err := NewAlertmanagerSink(AlertmanagerConfig{URL: srv.URL, Cluster: "a", ResendInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Send(failedOut("web"))
+	waitFor(t, func() bool { return len(rec.snapshot()) == 1 })
+	firing := rec.snapshot()[0]
+
+	// resolve推送失败时保留，和下一次推送一起重推
+	rec.lock.Lock()
+	rec.fail = 1
+	rec.lock.Unlock()
+	deleted := failedOut("web")
+	deleted.Status = constant.K8sResStatusDelete
+	sink.Send(deleted)
+	waitFor(t, func() bool { return rec.requestCount() == 2 })
+	sink.Send(failedOut("api"))
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	alerts := rec.snapshot()
+	if len(alerts) != 3 {
+		t.Fatalf("received %d alerts, want firing web, then api with resolved web", len(alerts))
+	}
+	var resolved *Alert
+	for i := range alerts[1:] {
+		if alerts[1+i].Labels["name"] == "web" {
+			resolved = &alerts[1+i]
+		}
+	}
+	if resolved == nil || !sameLabels(resolved.Labels, firing.Labels) {
+		t.Fatalf("alerts = %+v, want web resolved with the same labels", alerts)
+	}
+	if !resolved.StartsAt.Equal(firing.StartsAt) || resolved.EndsAt.After(time.Now()) || !resolved.EndsAt.After(resolved.StartsAt) {
+		t.Fatalf("resolved startsAt = %v, endsAt = %v", resolved.StartsAt, resolved.EndsAt)
+	}
+	if len(sink.firing) != 1 || len(sink.resolving) != 0 {
+		t.Fatalf("firing = %d, resolving = %d, want 1, 0", len(sink.firing), len(sink.resolving))
+	}
+}
+
+// alertmanager一直不可用时待resolve的告警不超过QueueSize
+func TestAlertmanagerSinkResolvingCap(t *testing.T) {
+	rec := &alertRecorder{fail: 1 << 20}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	sink, err := NewAlertmanagerSink(AlertmanagerConfig{URL: srv.URL, ResendInterval: time.Hour, QueueSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		name := "web-" + string(rune('a'+i))
+		sink.Send(failedOut(name))
+		waitFor(t, func() bool { return rec.requestCount() == 2*i+1 })
+		resolved := failedOut(name)
+		resolved.Status = constant.K8sResStatusSucceed
+		sink.Send(resolved)
+		waitFor(t, func() bool { return rec.requestCount() == 2*i+2 })
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.resolving) != 2 {
+		t.Fatalf("resolving = %d, want capped at 2", len(sink.resolving))
+	}
+	// 保留最新的resolve
+	if name := sink.resolving[1].Labels["name"]; name != "web-e" {
+		t.Fatalf("last resolving = %s, want web-e", name)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
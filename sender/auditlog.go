@@ -0,0 +1,389 @@
+package sender
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/util"
+)
+
+const (
+	defaultAuditMaxBytes     = 100 << 20
+	defaultAuditGenerations  = 7
+	defaultAuditSyncInterval = time.Second
+
+	auditTimeLayout = "20060102-150405" // 轮转文件名中的时间
+)
+
+type AuditLogConfig struct {
+	Path         string        // 当前写入的文件，轮转后的文件为 Path.<时间>.gz
+	MaxBytes     int64         // 单个文件的大小上限 默认100MB
+	Generations  int           // 保留的轮转文件数 默认7
+	SyncInterval time.Duration // fsync间隔 默认1s，负数表示每条记录都fsync
+	IncludeMeta  bool          // 是否记录SendOut.Meta，默认不记录以控制文件大小
+}
+
+func (c *AuditLogConfig) setDefaults() error {
+	if c.Path == "" {
+		return errors.New("audit log path can't be empty")
+	}
+	if c.MaxBytes < 0 || c.Generations < 0 {
+		return errors.New("audit log config can't be negative")
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = defaultAuditMaxBytes
+	}
+	if c.Generations == 0 {
+		c.Generations = defaultAuditGenerations
+	}
+	if c.SyncInterval == 0 {
+		c.SyncInterval = defaultAuditSyncInterval
+	}
+	return nil
+}
+
+// 审计日志中的一行
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	SendOut
+}
+
+/*
+以JSON Lines格式追加记录每一次状态变化的审计日志
+文件超过MaxBytes或者跨天时轮转，轮转出去的文件在后台gzip压缩，只保留最近Generations个
+写入在Send中同步完成，按SyncInterval定时fsync
+*/
+type AuditLog struct {
+	cfg      AuditLogConfig
+	lock     sync.Mutex
+	file     *os.File
+	buf      *bufio.Writer
+	size     int64
+	day      string // 当前文件对应的日期
+	dirty    bool   // 有未fsync的数据
+	closed   bool
+	stopCh   chan struct{}
+	done     chan struct{}
+	compress sync.WaitGroup
+
+	compressing map[string]struct{} // 正在压缩的轮转文件，prune不会删除
+}
+
+func NewAuditLog(cfg AuditLogConfig) (*AuditLog, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o755); err != nil {
+		return nil, err
+	}
+	a := &AuditLog{
+		cfg:         cfg,
+		stopCh:      make(chan struct{}),
+		done:        make(chan struct{}),
+		compressing: map[string]struct{}{},
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err := a.open(time.Now()); err != nil {
+		return nil, err
+	}
+	// 上次退出前未压缩完的文件
+	for _, p := range a.rotatedFiles() {
+		if _, ok := a.compressing[p]; !ok && !strings.HasSuffix(p, ".gz") {
+			a.compressLater(p)
+		}
+	}
+	go a.syncLoop()
+	return a, nil
+}
+
+// 打开当前文件，已有的文件不是今天的则先轮转
+func (a *AuditLog) open(now time.Time) error {
+	today := now.Format("20060102")
+	if info, err := os.Stat(a.cfg.Path); err == nil && info.ModTime().Format("20060102") != today && info.Size() > 0 {
+		if err := a.rename(info.ModTime()); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(a.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.buf = bufio.NewWriter(f)
+	a.size = info.Size()
+	a.day = today
+	return nil
+}
+
+func (a *AuditLog) Send(out SendOut) {
+	if err := a.Write(AuditRecord{Time: time.Now(), SendOut: out}); err != nil {
+		util.Errorw("audit_log_write", "key", out.Key, "error", err)
+	}
+}
+
+func (a *AuditLog) Write(rec AuditRecord) error {
+	if !a.cfg.IncludeMeta {
+		rec.Meta = nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return errors.New("audit log is closed")
+	}
+	now := time.Now()
+	if a.size > 0 && (a.size+int64(len(line)) > a.cfg.MaxBytes || now.Format("20060102") != a.day) {
+		if err := a.rotate(now); err != nil {
+			return errors.Wrap(err, "rotate audit log")
+		}
+	}
+	n, err := a.buf.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if a.cfg.SyncInterval < 0 {
+		return a.sync()
+	}
+	a.dirty = true
+	return nil
+}
+
+// 调用方持有lock
+func (a *AuditLog) sync() error {
+	if err := a.buf.Flush(); err != nil {
+		return err
+	}
+	a.dirty = false
+	return a.file.Sync()
+}
+
+func (a *AuditLog) syncLoop() {
+	defer close(a.done)
+	if a.cfg.SyncInterval < 0 {
+		<-a.stopCh
+		return
+	}
+	ticker := time.NewTicker(a.cfg.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.lock.Lock()
+			if a.dirty && !a.closed {
+				if err := a.sync(); err != nil {
+					util.Errorw("audit_log_sync", "error", err)
+				}
+			}
+			a.lock.Unlock()
+		case <-a.stopCh:
+			return
+		}
+	}
+}
+
+// 调用方持有lock
+func (a *AuditLog) rotate(now time.Time) error {
+	if err := a.sync(); err != nil {
+		return err
+	}
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if err := a.rename(now); err != nil {
+		return err
+	}
+	return a.open(now)
+}
+
+func (a *AuditLog) rename(t time.Time) error {
+	target := a.cfg.Path + "." + t.Format(auditTimeLayout)
+	for i := 1; fileExists(target) || fileExists(target+".gz"); i++ {
+		target = a.cfg.Path + "." + t.Format(auditTimeLayout) + "-" + strconv.Itoa(i)
+	}
+	if err := os.Rename(a.cfg.Path, target); err != nil {
+		return err
+	}
+	a.compressLater(target)
+	return nil
+}
+
+// 后台压缩轮转出去的文件，压缩完成后再清理，调用方持有lock
+func (a *AuditLog) compressLater(p string) {
+	a.compressing[p] = struct{}{}
+	a.compress.Add(1)
+	go func() {
+		defer a.compress.Done()
+		if err := gzipFile(p); err != nil {
+			util.Errorw("audit_log_compress", "file", p, "error", err)
+		}
+		a.lock.Lock()
+		delete(a.compressing, p)
+		a.lock.Unlock()
+		a.prune()
+	}()
+}
+
+/*
+删除超出保留数的轮转文件
+最旧的文件还在压缩时停止清理，由它压缩完成后的prune继续，避免删除正在压缩的文件
+*/
+func (a *AuditLog) prune() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	files := make([]string, 0)
+	for _, p := range a.rotatedFiles() {
+		if !strings.HasSuffix(p, ".gz") && fileExists(p+".gz") {
+			continue // 压缩完成、还没有删除原文件，只计一次
+		}
+		files = append(files, p)
+	}
+	for len(files) > a.cfg.Generations {
+		if _, ok := a.compressing[strings.TrimSuffix(files[0], ".gz")]; ok {
+			return
+		}
+		if err := os.Remove(files[0]); err != nil && !os.IsNotExist(err) {
+			util.Errorw("audit_log_prune", "file", files[0], "error", err)
+		}
+		files = files[1:]
+	}
+}
+
+// 所有轮转出去的文件，按时间从旧到新
+func (a *AuditLog) rotatedFiles() []string {
+	return auditRotatedFiles(a.cfg.Path)
+}
+
+func auditRotatedFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	files := make([]string, 0, len(matches))
+	for _, p := range matches {
+		if _, ok := auditFileOrder(p, path); ok {
+			files = append(files, p)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		a, _ := auditFileOrder(files[i], path)
+		b, _ := auditFileOrder(files[j], path)
+		return a < b
+	})
+	return files
+}
+
+/*
+轮转文件名为 path.<时间>[-序号][.gz]，返回用于排序的时间和序号
+不符合格式的文件（例如压缩中的.tmp文件）返回false
+*/
+func auditFileOrder(p, path string) (string, bool) {
+	name := strings.TrimSuffix(strings.TrimPrefix(p, path+"."), ".gz")
+	if len(name) < len(auditTimeLayout) {
+		return "", false
+	}
+	if _, err := time.Parse(auditTimeLayout, name[:len(auditTimeLayout)]); err != nil {
+		return "", false
+	}
+	seq := 0
+	if rest := name[len(auditTimeLayout):]; rest != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(rest, "-"))
+		if err != nil || !strings.HasPrefix(rest, "-") {
+			return "", false
+		}
+		seq = n
+	}
+	return fmt.Sprintf("%s#%010d", name[:len(auditTimeLayout)], seq), true
+}
+
+func (a *AuditLog) Close(ctx context.Context) error {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return nil
+	}
+	a.closed = true
+	err := a.sync()
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	a.lock.Unlock()
+	close(a.stopCh)
+	<-a.done
+
+	compressed := make(chan struct{})
+	go func() {
+		a.compress.Wait()
+		close(compressed)
+	}()
+	select {
+	case <-compressed:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err() // 未压缩完的文件下次启动时继续压缩
+		}
+	}
+	return err
+}
+
+func gzipFile(p string) error {
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := p + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, p+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
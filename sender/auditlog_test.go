@@ -0,0 +1,270 @@
+package sender
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+)
+
+func auditOut(i int) SendOut {
+	return SendOut{Key: "default/web-" + strconv.Itoa(i), Kind: constant.PodKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusFail, Reason: "CrashLoopBackOff"}
+}
+
+func newTestAuditLog(t *testing.T, cfg AuditLogConfig) *AuditLog {
+	t.Helper()
+	if cfg.Path == "" {
+		cfg.Path = filepath.Join(t.TempDir(), "audit.log")
+	}
+	a, err := NewAuditLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// 读取一个审计日志文件中的所有key，.gz文件先解压
+func auditFileKeys(t *testing.T, p string) []string {
+	t.Helper()
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(p, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%s is not gzip: %v", p, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	keys := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("%s has invalid line %q", p, scanner.Text())
+		}
+		keys = append(keys, rec.Key)
+	}
+	return keys
+}
+
+func TestAuditLogSizeRotation(t *testing.T) {
+	line, _ := json.Marshal(AuditRecord{Time: time.Now(), SendOut: auditOut(0)})
+	maxBytes := int64(3*(len(line)+1) + 10) // 每个文件3条
+	a := newTestAuditLog(t, AuditLogConfig{MaxBytes: maxBytes, Generations: 10, SyncInterval: -1})
+	for i := 0; i < 10; i++ {
+		if err := a.Write(AuditRecord{Time: time.Now(), SendOut: auditOut(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	files := auditRotatedFiles(a.cfg.Path)
+	if len(files) != 3 {
+		t.Fatalf("rotated files = %v, want 3", files)
+	}
+	keys := make([]string, 0)
+	for _, p := range append(files, a.cfg.Path) {
+		if p != a.cfg.Path && !strings.HasSuffix(p, ".gz") {
+			t.Fatalf("rotated file %s is not compressed", p)
+		}
+		fileKeys := auditFileKeys(t, p)
+		if len(fileKeys) > 3 {
+			t.Fatalf("%s has %d records, want at most 3", p, len(fileKeys))
+		}
+		keys = append(keys, fileKeys...)
+	}
+	// 按时间从旧到新，不丢不重
+	for i, key := range keys {
+		if key != auditOut(i).Key {
+			t.Fatalf("record %d = %s, want %s", i, key, auditOut(i).Key)
+		}
+	}
+	if len(keys) != 10 {
+		t.Fatalf("records = %d, want 10", len(keys))
+	}
+	if matches, _ := filepath.Glob(a.cfg.Path + ".*.tmp"); len(matches) != 0 {
+		t.Fatalf("temporary files left: %v", matches)
+	}
+}
+
+func TestAuditLogDayRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// 启动时已有的文件不是今天的，先轮转，文件名使用其最后修改时间
+	if err := os.WriteFile(path, []byte(`{"key":"default/old"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(path, yesterday, yesterday); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAuditLog(t, AuditLogConfig{Path: path, SyncInterval: -1})
+	if err := a.Write(AuditRecord{Time: time.Now(), SendOut: auditOut(0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 写入时跨天
+	a.lock.Lock()
+	a.day = yesterday.Format("20060102")
+	a.lock.Unlock()
+	if err := a.Write(AuditRecord{Time: time.Now(), SendOut: auditOut(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	files := auditRotatedFiles(path)
+	if len(files) != 2 {
+		t.Fatalf("rotated files = %v, want 2", files)
+	}
+	if want := path + "." + yesterday.Format(auditTimeLayout) + ".gz"; files[0] != want {
+		t.Fatalf("first rotated file = %s, want %s", files[0], want)
+	}
+	for i, want := range [][]string{{"default/old"}, {auditOut(0).Key}} {
+		if keys := auditFileKeys(t, files[i]); len(keys) != 1 || keys[0] != want[0] {
+			t.Fatalf("%s = %v, want %v", files[i], keys, want)
+		}
+	}
+	if keys := auditFileKeys(t, path); len(keys) != 1 || keys[0] != auditOut(1).Key {
+		t.Fatalf("current file = %v", keys)
+	}
+}
+
+func TestAuditLogGenerations(t *testing.T) {
+	a := newTestAuditLog(t, AuditLogConfig{MaxBytes: 1, Generations: 2, SyncInterval: -1})
+	for i := 0; i < 6; i++ {
+		if err := a.Write(AuditRecord{Time: time.Now(), SendOut: auditOut(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 每条记录一个文件，保留最近2个轮转文件和当前文件
+	files := auditRotatedFiles(a.cfg.Path)
+	if len(files) != 2 {
+		t.Fatalf("rotated files = %v, want 2", files)
+	}
+	for i, p := range files {
+		if keys := auditFileKeys(t, p); len(keys) != 1 || keys[0] != auditOut(3+i).Key {
+			t.Fatalf("%s = %v, want %s", p, keys, auditOut(3+i).Key)
+		}
+	}
+}
+
+// 最旧的文件还在压缩时prune不删除它，也不越过它删除更新的文件
+func TestAuditLogPruneSkipsCompressing(t *testing.T) {
+	a := newTestAuditLog(t, AuditLogConfig{Generations: 1, SyncInterval: -1})
+	defer a.Close(context.Background())
+	names := []string{"20240101-000000", "20240102-000000.gz", "20240103-000000.gz"}
+	for _, name := range names {
+		if err := os.WriteFile(a.cfg.Path+"."+name, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldest := a.cfg.Path + "." + names[0]
+	a.lock.Lock()
+	a.compressing[oldest] = struct{}{}
+	a.lock.Unlock()
+	a.prune()
+	if files := auditRotatedFiles(a.cfg.Path); len(files) != 3 {
+		t.Fatalf("rotated files = %v, want nothing pruned while compressing", files)
+	}
+
+	// 压缩完成后的prune继续清理
+	a.lock.Lock()
+	delete(a.compressing, oldest)
+	a.lock.Unlock()
+	a.prune()
+	if files := auditRotatedFiles(a.cfg.Path); len(files) != 1 || files[0] != a.cfg.Path+"."+names[2] {
+		t.Fatalf("rotated files = %v, want only the newest", files)
+	}
+}
+
+func writeGzip(t *testing.T, p string, data string) {
+	t.Helper()
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func auditLine(t *testing.T, at time.Time, out SendOut) string {
+	t.Helper()
+	b, err := json.Marshal(AuditRecord{Time: at, SendOut: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b) + "\n"
+}
+
+func TestReadAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 12, 0, 0, 0, time.Local) }
+	dep := SendOut{Key: "kube-system/dns", Kind: constant.DeploymentKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusSucceed}
+	// 最旧的文件已压缩，中间的文件压缩前进程退出，当前文件最后一行写了一半
+	writeGzip(t, path+"."+day(1).Format(auditTimeLayout)+".gz", auditLine(t, day(1), auditOut(1))+auditLine(t, day(1), dep))
+	if err := os.WriteFile(path+"."+day(2).Format(auditTimeLayout), []byte(auditLine(t, day(2), auditOut(2))), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(auditLine(t, day(3), auditOut(3))+`{"time":"2024-01-03T12:`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(filter AuditFilter, limit int) []string {
+		keys := make([]string, 0)
+		err := ReadAuditLog(path, filter, func(rec AuditRecord) bool {
+			keys = append(keys, rec.Key)
+			return len(keys) == limit
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	cases := []struct {
+		name   string
+		filter AuditFilter
+		limit  int
+		want   []string
+	}{
+		{"all", AuditFilter{}, 0, []string{auditOut(1).Key, dep.Key, auditOut(2).Key, auditOut(3).Key}},
+		{"stop", AuditFilter{}, 2, []string{auditOut(1).Key, dep.Key}},
+		{"kind", AuditFilter{Kinds: []constant.K8sResKind{constant.DeploymentKind}}, 0, []string{dep.Key}},
+		{"namespace and status", AuditFilter{Namespaces: []string{"default"}, Statuses: []constant.K8sResStatus{constant.K8sResStatusFail}}, 0, []string{auditOut(1).Key, auditOut(2).Key, auditOut(3).Key}},
+		{"since skips old files", AuditFilter{Since: day(2)}, 0, []string{auditOut(2).Key, auditOut(3).Key}},
+		{"until", AuditFilter{Until: day(2)}, 0, []string{auditOut(1).Key, dep.Key}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := read(c.filter, c.limit)
+			if strings.Join(got, ",") != strings.Join(c.want, ",") {
+				t.Fatalf("keys = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package sender
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/util"
+)
+
+// 审计日志的过滤条件，同一字段多个值为或，不同字段之间为与，为空表示不过滤
+type AuditFilter struct {
+	Since      time.Time // 包含
+	Until      time.Time // 不包含
+	Kinds      []constant.K8sResKind
+	Namespaces []string
+	Keys       []string
+	Statuses   []constant.K8sResStatus
+	Types      []constant.EventType
+}
+
+func (f AuditFilter) Match(rec AuditRecord) bool {
+	if !f.Since.IsZero() && rec.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !rec.Time.Before(f.Until) {
+		return false
+	}
+	nameSpace, _ := util.SplitResourceCacheKey(rec.Key)
+	return matchAny(f.Kinds, rec.Kind) &&
+		matchAny(f.Namespaces, nameSpace) &&
+		matchAny(f.Keys, rec.Key) &&
+		matchAny(f.Statuses, rec.Status) &&
+		matchAny(f.Types, rec.Type)
+}
+
+func matchAny[T comparable](list []T, v T) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+按时间从旧到新遍历path对应的所有审计日志（包括轮转和压缩过的文件），对符合条件的记录调用fn，fn返回true时停止
+写了一半的行会被跳过
+*/
+func ReadAuditLog(path string, filter AuditFilter, fn func(rec AuditRecord) (stop bool)) error {
+	files := auditRotatedFiles(path)
+	files = append(files, path)
+	for _, p := range files {
+		if p != path && !filter.Since.IsZero() && rotatedBefore(p, path, filter.Since) {
+			continue // 轮转时间早于Since，文件中所有记录都不符合
+		}
+		stop, err := readAuditFile(p, p != path, filter, fn)
+		if err != nil {
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+	return nil
+}
+
+// 轮转文件名中的时间是文件最后写入的时间
+func rotatedBefore(p, path string, t time.Time) bool {
+	name := strings.TrimPrefix(p, path+".")
+	rotated, err := time.ParseInLocation(auditTimeLayout, name[:len(auditTimeLayout)], time.Local)
+	if err != nil {
+		return false
+	}
+	// 文件名中的时间精度为秒
+	return rotated.Add(time.Second).Before(t)
+}
+
+func readAuditFile(p string, rotated bool, filter AuditFilter, fn func(rec AuditRecord) (stop bool)) (bool, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) && rotated && !strings.HasSuffix(p, ".gz") {
+		p += ".gz" // 遍历过程中被压缩
+		f, err = os.Open(p)
+	}
+	if os.IsNotExist(err) {
+		return false, nil // 遍历过程中被清理
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(p, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return false, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if filter.Match(rec) && fn(rec) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
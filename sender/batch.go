@@ -0,0 +1,104 @@
+package sender
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+批量投递，累积到maxItems条或者距第一条事件超过maxWait就投递一次
+投递期间持有锁，保证批次按顺序投递且同一时刻只有一个批次在回调中
+*/
+type batcher struct {
+	lock     sync.Mutex
+	fn       func([]SendOut)
+	maxItems int
+	maxWait  time.Duration
+	buf      []SendOut
+	timer    *time.Timer
+	gen      uint64 // 批次序号，每次投递后加1，用于识别过期的定时器
+}
+
+func newBatcher(fn func([]SendOut), maxItems int, maxWait time.Duration) *batcher {
+	return &batcher{
+		fn:       fn,
+		maxItems: maxItems,
+		maxWait:  maxWait,
+		buf:      make([]SendOut, 0, maxItems),
+	}
+}
+
+func (b *batcher) add(out SendOut) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.buf = append(b.buf, out)
+	if len(b.buf) >= b.maxItems {
+		b.flushLocked()
+		return
+	}
+	if b.timer == nil {
+		gen := b.gen
+		b.timer = time.AfterFunc(b.maxWait, func() { b.flushGen(gen) })
+	}
+}
+
+/*
+定时器触发的投递，只投递定时器所属的批次
+按数量投递时Stop不能取消已经触发、正在等待锁的定时器，不检查批次会把下一批提前投递
+*/
+func (b *batcher) flushGen(gen uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.gen != gen {
+		return
+	}
+	b.flushLocked()
+}
+
+func (b *batcher) flush() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.flushLocked()
+}
+
+func (b *batcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.buf) == 0 {
+		return
+	}
+	b.gen++
+	batch := b.buf
+	b.buf = make([]SendOut, 0, b.maxItems)
+	b.fn(batch)
+}
+
+/*
+批量订阅，适合转发到数据管道等按请求计费的下游
+maxItems: 每批最多多少条 maxWait: 一批最多等待多久
+sender停止时会投递剩余的事件
+*/
+func (s *Sender) SubscribeBatch(fn func(outs []SendOut), maxItems int, maxWait time.Duration, opts ...SubscribeOption) error {
+	if fn == nil {
+		return errors.New("batch handler can't be null")
+	}
+	if maxItems <= 0 {
+		return errors.New("maxItems must be positive")
+	}
+	if maxWait <= 0 {
+		return errors.New("maxWait must be positive")
+	}
+	b := newBatcher(fn, maxItems, maxWait)
+	sub := newSubscriber(b.add, opts...)
+	sub.close = func(ctx context.Context) error {
+		b.flush()
+		return nil
+	}
+	s.addSubscriber(sub)
+	return nil
+}
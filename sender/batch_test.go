@@ -0,0 +1,200 @@
+package sender
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+)
+
+// 记录每个批次及其投递时间
+type batchRecorder struct {
+	lock    sync.Mutex
+	batches [][]SendOut
+	times   []time.Time
+}
+
+func (r *batchRecorder) fn(outs []SendOut) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.batches = append(r.batches, outs)
+	r.times = append(r.times, time.Now())
+}
+
+func (r *batchRecorder) sizes() []int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sizes := make([]int, 0, len(r.batches))
+	for _, b := range r.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func (r *batchRecorder) batch(i int) ([]SendOut, time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.batches[i], r.times[i]
+}
+
+func numberedOut(i int) SendOut {
+	return SendOut{Key: "default/web-" + strconv.Itoa(i), Kind: constant.PodKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusFail}
+}
+
+func equalSizes(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBatcherFlushOnSize(t *testing.T) {
+	rec := &batchRecorder{}
+	b := newBatcher(rec.fn, 3, time.Hour)
+	for i := 0; i < 7; i++ {
+		b.add(numberedOut(i))
+	}
+	if sizes := rec.sizes(); !equalSizes(sizes, []int{3, 3}) {
+		t.Fatalf("batch sizes = %v, want [3 3]", sizes)
+	}
+	b.flush()
+	if sizes := rec.sizes(); !equalSizes(sizes, []int{3, 3, 1}) {
+		t.Fatalf("batch sizes = %v, want [3 3 1]", sizes)
+	}
+	// 批次按顺序投递，事件在批次内保持顺序
+	n := 0
+	for i := range rec.sizes() {
+		batch, _ := rec.batch(i)
+		for _, out := range batch {
+			if out.Key != numberedOut(n).Key {
+				t.Fatalf("batch %d has %s, want %s", i, out.Key, numberedOut(n).Key)
+			}
+			n++
+		}
+	}
+	// 缓冲为空时flush不投递空批次
+	b.flush()
+	if sizes := rec.sizes(); len(sizes) != 3 {
+		t.Fatalf("batch sizes = %v, want no empty batch", sizes)
+	}
+}
+
+func TestBatcherFlushOnInterval(t *testing.T) {
+	rec := &batchRecorder{}
+	maxWait := 30 * time.Millisecond
+	b := newBatcher(rec.fn, 100, maxWait)
+
+	start := time.Now()
+	b.add(numberedOut(0))
+	b.add(numberedOut(1))
+	waitFor(t, func() bool { return len(rec.sizes()) == 1 })
+	batch, at := rec.batch(0)
+	if len(batch) != 2 {
+		t.Fatalf("batch size = %d, want 2", len(batch))
+	}
+	if wait := at.Sub(start); wait < maxWait {
+		t.Fatalf("batch flushed after %v, want >= %v", wait, maxWait)
+	}
+
+	// 投递后重新计时，下一批从它的第一条事件开始等待
+	time.Sleep(2 * maxWait)
+	start = time.Now()
+	b.add(numberedOut(2))
+	waitFor(t, func() bool { return len(rec.sizes()) == 2 })
+	if _, at := rec.batch(1); at.Sub(start) < maxWait {
+		t.Fatalf("second batch flushed after %v, want >= %v", at.Sub(start), maxWait)
+	}
+
+	// 按数量投递时停止定时器，不会再投递一个空批次或者提前投递下一批
+	b = newBatcher(rec.fn, 2, maxWait)
+	b.add(numberedOut(3))
+	b.add(numberedOut(4))
+	time.Sleep(2 * maxWait)
+	if sizes := rec.sizes(); !equalSizes(sizes, []int{2, 1, 2}) {
+		t.Fatalf("batch sizes = %v, want [2 1 2]", sizes)
+	}
+}
+
+func TestSubscribeBatchValidate(t *testing.T) {
+	s := NewSender()
+	fn := func([]SendOut) {}
+	cases := []struct {
+		name     string
+		fn       func([]SendOut)
+		maxItems int
+		maxWait  time.Duration
+	}{
+		{"nil handler", nil, 10, time.Second},
+		{"zero items", fn, 0, time.Second},
+		{"zero wait", fn, 10, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := s.SubscribeBatch(c.fn, c.maxItems, c.maxWait); err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+}
+
+func TestSubscribeBatchFlushOnStop(t *testing.T) {
+	s := NewSender()
+	rec := &batchRecorder{}
+	if err := s.SubscribeBatch(rec.fn, 10, time.Hour, WithKinds(constant.PodKind)); err != nil {
+		t.Fatal(err)
+	}
+	s.Start(context.Background())
+	for i := 0; i < 3; i++ {
+		s.AddSendOut(numberedOut(i))
+	}
+	s.AddSendOut(SendOut{Key: "default/web", Kind: constant.DeploymentKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusFail})
+	if sizes := rec.sizes(); len(sizes) != 0 {
+		t.Fatalf("batch sizes = %v, want nothing before stop", sizes)
+	}
+
+	// 停止时先推送缓冲中的事件，再投递批量订阅者中剩余的数据
+	if dropped, err := s.Stop(context.Background()); err != nil || dropped != 0 {
+		t.Fatalf("stop = %d, %v", dropped, err)
+	}
+	if sizes := rec.sizes(); !equalSizes(sizes, []int{3}) {
+		t.Fatalf("batch sizes = %v, want [3]", sizes)
+	}
+	batch, _ := rec.batch(0)
+	for i, out := range batch {
+		if out.Key != numberedOut(i).Key {
+			t.Fatalf("batch[%d] = %s, want %s", i, out.Key, numberedOut(i).Key)
+		}
+	}
+}
+
+// 定时器已经触发、正在等待锁时发生了按数量投递，过期的定时器不能把下一批提前投递
+func TestBatcherStaleTimer(t *testing.T) {
+	rec := &batchRecorder{}
+	maxWait := 20 * time.Millisecond
+	b := newBatcher(rec.fn, 2, maxWait)
+	b.add(numberedOut(0))
+
+	b.lock.Lock()
+	time.Sleep(3 * maxWait) // 定时器触发，阻塞在锁上
+	b.buf = append(b.buf, numberedOut(1))
+	b.flushLocked() // 与add中达到maxItems时相同
+	b.buf = append(b.buf, numberedOut(2))
+	b.lock.Unlock()
+
+	time.Sleep(3 * maxWait)
+	if sizes := rec.sizes(); !equalSizes(sizes, []int{2}) {
+		t.Fatalf("batch sizes = %v, want only the size flush", sizes)
+	}
+	b.flush()
+	if sizes := rec.sizes(); !equalSizes(sizes, []int{2, 1}) {
+		t.Fatalf("batch sizes = %v, want [2 1]", sizes)
+	}
+}
@@ -0,0 +1,383 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/util"
+	"golang.org/x/exp/slices"
+	"golang.org/x/time/rate"
+)
+
+type ChatPlatform string
+
+const (
+	ChatSlack    ChatPlatform = "slack"
+	ChatDingTalk ChatPlatform = "dingtalk"
+	ChatFeishu   ChatPlatform = "feishu" // 飞书/Lark
+	ChatWeCom    ChatPlatform = "wecom"  // 企业微信群机器人
+
+	DefaultChatTemplate = `[{{.Status}}] {{.Kind}} {{.Key}}{{if .Reason}}
+{{.Reason}}{{end}}`
+
+	defaultChatTimeout   = 10 * time.Second
+	defaultChatQueueSize = 1000
+	defaultChatPerMinute = 20 // 钉钉机器人每分钟最多20条
+	defaultChatBurst     = 5
+)
+
+type ChatChannel struct {
+	Name       string // channel名，路由中引用
+	Platform   ChatPlatform
+	WebhookURL string // 机器人的webhook地址
+	Secret     string // 钉钉、飞书的签名密钥，为空则不签名
+	Template   string // text/template模板，数据为ChatTemplateData，为空使用DefaultChatTemplate
+	PerMinute  int    // 每分钟最多推送几条，超出的丢弃 默认20
+	Burst      int    // 突发条数 默认5
+}
+
+// 路由规则，namespace支持path.Match的通配符，例如 "team-a-*"；各条件同时满足才算命中
+type ChatRoute struct {
+	Namespaces []string                // 为空匹配所有namespace
+	Kinds      []constant.K8sResKind   // 为空匹配所有资源类型
+	Statuses   []constant.K8sResStatus // 为空匹配所有状态
+	Channels   []string                // 命中后推送到的channel名
+}
+
+func (r ChatRoute) match(out SendOut, nameSpace string) bool {
+	if !matchNamespace(r.Namespaces, nameSpace) {
+		return false
+	}
+	if len(r.Kinds) > 0 && !slices.Contains(r.Kinds, out.Kind) {
+		return false
+	}
+	return len(r.Statuses) == 0 || slices.Contains(r.Statuses, out.Status)
+}
+
+type ChatConfig struct {
+	Channels  []ChatChannel
+	Routes    []ChatRoute   // 按顺序匹配，使用第一条命中的路由；为空时推送到所有channel
+	Cluster   string        // 事件没有Cluster时使用的集群名，可以在模板中通过.Cluster使用
+	Client    *http.Client  // 为空时使用默认client
+	Timeout   time.Duration // 单次请求超时 默认10s
+	QueueSize int           // 待推送队列长度 默认1000
+}
+
+// 模板中可以使用的数据
+type ChatTemplateData struct {
+	SendOut
+	Cluster   string // 事件的Cluster，为空时为ChatConfig.Cluster
+	Namespace string
+}
+
+type chatChannel struct {
+	ChatChannel
+	tmpl    *template.Template
+	limiter *rate.Limiter
+}
+
+func (c *ChatConfig) setDefaults() error {
+	if len(c.Channels) == 0 {
+		return errors.New("chat channels can't be empty")
+	}
+	if c.Timeout < 0 || c.QueueSize < 0 {
+		return errors.New("chat config can't be negative")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultChatTimeout
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = defaultChatQueueSize
+	}
+	if c.Client == nil {
+		c.Client = &http.Client{}
+	}
+	return nil
+}
+
+/*
+把事件渲染为文本消息推送到聊天工具的机器人webhook
+支持Slack、钉钉（加签）、飞书（加签）、企业微信，按namespace、资源类型和状态路由，每个channel单独限流
+*/
+type ChatSink struct {
+	cfg       ChatConfig
+	channels  map[string]*chatChannel
+	queue     chan SendOut
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeLock sync.RWMutex
+	closed    bool
+	done      chan struct{}
+}
+
+func NewChatSink(cfg ChatConfig) (*ChatSink, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	channels := make(map[string]*chatChannel, len(cfg.Channels))
+	for _, ch := range cfg.Channels {
+		c, err := newChatChannel(ch)
+		if err != nil {
+			return nil, err
+		}
+		if _, exist := channels[ch.Name]; exist {
+			return nil, errors.Errorf("duplicate chat channel %q", ch.Name)
+		}
+		channels[ch.Name] = c
+	}
+	for _, route := range cfg.Routes {
+		for _, ns := range route.Namespaces {
+			if _, err := path.Match(ns, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid namespace pattern %q", ns)
+			}
+		}
+		for _, name := range route.Channels {
+			if _, exist := channels[name]; !exist {
+				return nil, errors.Errorf("route references unknown chat channel %q", name)
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &ChatSink{
+		cfg:      cfg,
+		channels: channels,
+		queue:    make(chan SendOut, cfg.QueueSize),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func newChatChannel(ch ChatChannel) (*chatChannel, error) {
+	if ch.Name == "" {
+		return nil, errors.New("chat channel name can't be empty")
+	}
+	switch ch.Platform {
+	case ChatSlack, ChatDingTalk, ChatFeishu, ChatWeCom:
+	default:
+		return nil, errors.Errorf("chat channel %q has unknown platform %q", ch.Name, ch.Platform)
+	}
+	if u, err := url.Parse(ch.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.Errorf("chat channel %q has invalid webhook url %q", ch.Name, ch.WebhookURL)
+	}
+	if ch.PerMinute < 0 || ch.Burst < 0 {
+		return nil, errors.Errorf("chat channel %q rate limit can't be negative", ch.Name)
+	}
+	if ch.Template == "" {
+		ch.Template = DefaultChatTemplate
+	}
+	if ch.PerMinute == 0 {
+		ch.PerMinute = defaultChatPerMinute
+	}
+	if ch.Burst == 0 {
+		ch.Burst = defaultChatBurst
+	}
+	tmpl, err := template.New(ch.Name).Parse(ch.Template)
+	if err != nil {
+		return nil, errors.Wrapf(err, "chat channel %q template", ch.Name)
+	}
+	return &chatChannel{
+		ChatChannel: ch,
+		tmpl:        tmpl,
+		limiter:     rate.NewLimiter(rate.Limit(float64(ch.PerMinute)/60), ch.Burst),
+	}, nil
+}
+
+func (s *ChatSink) Send(out SendOut) {
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- out:
+	default:
+		util.Warnw("chat_queue_full", "key", out.Key, "status", out.Status)
+	}
+}
+
+func (s *ChatSink) Close(ctx context.Context) error {
+	s.closeLock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.closeLock.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		<-s.done
+		return ctx.Err()
+	}
+}
+
+func (s *ChatSink) run() {
+	defer close(s.done)
+	for out := range s.queue {
+		nameSpace, _ := util.SplitResourceCacheKey(out.Key)
+		data := ChatTemplateData{SendOut: out, Cluster: eventCluster(out, s.cfg.Cluster), Namespace: nameSpace}
+		for _, ch := range s.route(out, nameSpace) {
+			if !ch.limiter.Allow() {
+				util.Warnw("chat_rate_limited", "channel", ch.Name, "key", out.Key)
+				continue
+			}
+			if err := s.post(ch, data); err != nil {
+				util.Warnw("chat_failed", "channel", ch.Name, "key", out.Key, "error", err)
+			}
+		}
+	}
+}
+
+// 按namespace、资源类型和状态选出要推送的channel
+func (s *ChatSink) route(out SendOut, nameSpace string) []*chatChannel {
+	if len(s.cfg.Routes) == 0 {
+		all := make([]*chatChannel, 0, len(s.channels))
+		for _, ch := range s.cfg.Channels {
+			all = append(all, s.channels[ch.Name])
+		}
+		return all
+	}
+	for _, route := range s.cfg.Routes {
+		if !route.match(out, nameSpace) {
+			continue
+		}
+		list := make([]*chatChannel, 0, len(route.Channels))
+		for _, name := range route.Channels {
+			list = append(list, s.channels[name])
+		}
+		return list
+	}
+	return nil
+}
+
+func matchNamespace(patterns []string, nameSpace string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, nameSpace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ChatSink) post(ch *chatChannel, data ChatTemplateData) error {
+	text := &strings.Builder{}
+	if err := ch.tmpl.Execute(text, data); err != nil {
+		return errors.Wrap(err, "render template")
+	}
+	target, body, err := buildChatRequest(ch.ChatChannel, text.String(), time.Now())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("response status %d: %s", resp.StatusCode, respBody)
+	}
+	return checkChatResponse(ch.Platform, respBody)
+}
+
+// 按平台生成请求地址和请求体
+func buildChatRequest(ch ChatChannel, text string, now time.Time) (string, []byte, error) {
+	var payload interface{}
+	target := ch.WebhookURL
+	switch ch.Platform {
+	case ChatSlack:
+		payload = map[string]interface{}{"text": text}
+	case ChatDingTalk:
+		payload = map[string]interface{}{"msgtype": "text", "text": map[string]string{"content": text}}
+		if ch.Secret != "" {
+			// 钉钉加签：timestamp和sign放在url参数中
+			ts := strconv.FormatInt(now.UnixMilli(), 10)
+			u, err := url.Parse(target)
+			if err != nil {
+				return "", nil, err
+			}
+			q := u.Query()
+			q.Set("timestamp", ts)
+			q.Set("sign", signHmacBase64(ch.Secret, ts+"\n"+ch.Secret))
+			u.RawQuery = q.Encode()
+			target = u.String()
+		}
+	case ChatFeishu:
+		msg := map[string]interface{}{"msg_type": "text", "content": map[string]string{"text": text}}
+		if ch.Secret != "" {
+			// 飞书加签：以 timestamp + "\n" + secret 为key对空串签名，timestamp和sign放在请求体中
+			ts := strconv.FormatInt(now.Unix(), 10)
+			msg["timestamp"] = ts
+			msg["sign"] = signHmacBase64(ts+"\n"+ch.Secret, "")
+		}
+		payload = msg
+	case ChatWeCom:
+		payload = map[string]interface{}{"msgtype": "text", "text": map[string]string{"content": text}}
+	default:
+		return "", nil, errors.Errorf("unknown chat platform %q", ch.Platform)
+	}
+	body, err := json.Marshal(payload)
+	return target, body, err
+}
+
+// 钉钉、飞书、企业微信在http 200中通过错误码返回失败
+func checkChatResponse(platform ChatPlatform, body []byte) error {
+	if platform == ChatSlack || len(body) == 0 {
+		return nil
+	}
+	var resp struct {
+		ErrCode    *int   `json:"errcode"` // 钉钉、企业微信
+		ErrMsg     string `json:"errmsg"`
+		Code       *int   `json:"code"` // 飞书
+		Msg        string `json:"msg"`
+		StatusCode *int   `json:"StatusCode"` // 飞书旧版接口
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil
+	}
+	switch {
+	case resp.ErrCode != nil && *resp.ErrCode != 0:
+		return errors.Errorf("errcode %d: %s", *resp.ErrCode, resp.ErrMsg)
+	case resp.Code != nil && *resp.Code != 0:
+		return errors.Errorf("code %d: %s", *resp.Code, resp.Msg)
+	case resp.StatusCode != nil && *resp.StatusCode != 0:
+		return errors.Errorf("status code %d", *resp.StatusCode)
+	}
+	return nil
+}
+
+func signHmacBase64(key, data string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,224 @@
+package sender
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+)
+
+// 模板中的.Cluster为事件的Cluster，事件没有Cluster时为配置的集群名
+func TestChatSinkTemplateCluster(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		texts []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Text string `json:"text"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		lock.Lock()
+		texts = append(texts, body.Text)
+		lock.Unlock()
+	}))
+	defer srv.Close()
+	sink, err := NewChatSink(ChatConfig{
+		Cluster:  "fallback",
+		Channels: []ChatChannel{{Name: "ops", Platform: ChatSlack, WebhookURL: srv.URL, Template: "{{.Cluster}} {{.Key}}"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cluster := range []string{"a", ""} {
+		sink.Send(SendOut{Cluster: cluster, Key: "default/web", Kind: constant.PodKind, Status: constant.K8sResStatusFail})
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(texts)
+	if len(texts) != 2 || texts[0] != "a default/web" || texts[1] != "fallback default/web" {
+		t.Fatalf("texts = %q", texts)
+	}
+}
+
+// 记录收到的聊天机器人请求
+type chatRecorder struct {
+	lock     sync.Mutex
+	requests []chatRequest
+}
+
+type chatRequest struct {
+	path  string
+	query url.Values
+	body  map[string]interface{}
+	at    time.Time
+}
+
+func (r *chatRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body map[string]interface{}
+	_ = json.NewDecoder(req.Body).Decode(&body)
+	r.lock.Lock()
+	r.requests = append(r.requests, chatRequest{path: req.URL.Path, query: req.URL.Query(), body: body, at: time.Now()})
+	r.lock.Unlock()
+	_, _ = w.Write([]byte(`{"errcode":0,"errmsg":"ok"}`))
+}
+
+func (r *chatRecorder) snapshot() []chatRequest {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]chatRequest{}, r.requests...)
+}
+
+func testHmac(key, data string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func sendChat(t *testing.T, cfg ChatConfig, outs ...SendOut) {
+	t.Helper()
+	sink, err := NewChatSink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, out := range outs {
+		sink.Send(out)
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChatSinkDingTalkSign(t *testing.T) {
+	rec := &chatRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	secret := "SECtest"
+	start := time.Now()
+	sendChat(t, ChatConfig{Channels: []ChatChannel{{Name: "dt", Platform: ChatDingTalk, WebhookURL: srv.URL + "/robot/send?access_token=abc", Secret: secret}}}, failedOut("web"))
+
+	reqs := rec.snapshot()
+	if len(reqs) != 1 {
+		t.Fatalf("received %d requests, want 1", len(reqs))
+	}
+	q := reqs[0].query
+	if q.Get("access_token") != "abc" {
+		t.Fatalf("query = %v, want access_token kept", q)
+	}
+	ts, err := strconv.ParseInt(q.Get("timestamp"), 10, 64)
+	if err != nil || ts < start.UnixMilli() || ts > reqs[0].at.UnixMilli() {
+		t.Fatalf("timestamp = %q, want the send time in milliseconds", q.Get("timestamp"))
+	}
+	if sign := q.Get("sign"); sign != testHmac(secret, q.Get("timestamp")+"\n"+secret) {
+		t.Fatalf("sign = %q, want HmacSHA256(secret, timestamp+\"\\n\"+secret)", sign)
+	}
+	text, _ := reqs[0].body["text"].(map[string]interface{})
+	if reqs[0].body["msgtype"] != "text" || text["content"] != "[failed] Deployment default/web\nCrashLoopBackOff" {
+		t.Fatalf("body = %v", reqs[0].body)
+	}
+}
+
+func TestChatSinkFeishuSign(t *testing.T) {
+	rec := &chatRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	secret := "feishu-secret"
+	start := time.Now()
+	sendChat(t, ChatConfig{Channels: []ChatChannel{{Name: "fs", Platform: ChatFeishu, WebhookURL: srv.URL, Secret: secret, Template: "{{.Key}}"}}}, failedOut("web"))
+
+	reqs := rec.snapshot()
+	if len(reqs) != 1 {
+		t.Fatalf("received %d requests, want 1", len(reqs))
+	}
+	body := reqs[0].body
+	tsText, _ := body["timestamp"].(string)
+	ts, err := strconv.ParseInt(tsText, 10, 64)
+	if err != nil || ts < start.Unix() || ts > reqs[0].at.Unix() {
+		t.Fatalf("timestamp = %v, want the send time in seconds", body["timestamp"])
+	}
+	// 飞书以 timestamp + "\n" + secret 为key对空串签名
+	if sign := body["sign"]; sign != testHmac(tsText+"\n"+secret, "") {
+		t.Fatalf("sign = %v", sign)
+	}
+	content, _ := body["content"].(map[string]interface{})
+	if body["msg_type"] != "text" || content["text"] != "default/web" || len(reqs[0].query) != 0 {
+		t.Fatalf("request = %+v", reqs[0])
+	}
+}
+
+func TestChatSinkRoute(t *testing.T) {
+	rec := &chatRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	channel := func(name string) ChatChannel {
+		return ChatChannel{Name: name, Platform: ChatWeCom, WebhookURL: srv.URL + "/" + name, Template: "{{.Key}}"}
+	}
+	cfg := ChatConfig{
+		Channels: []ChatChannel{channel("team-a"), channel("deploy-failed"), channel("ops"), channel("audit")},
+		Routes: []ChatRoute{
+			{Namespaces: []string{"team-a-*"}, Channels: []string{"team-a"}},
+			{Kinds: []constant.K8sResKind{constant.DeploymentKind}, Statuses: []constant.K8sResStatus{constant.K8sResStatusFail}, Channels: []string{"deploy-failed", "ops"}},
+			{Statuses: []constant.K8sResStatus{constant.K8sResStatusDelete}, Channels: []string{"audit"}},
+		},
+	}
+	out := func(key string, kind constant.K8sResKind, status constant.K8sResStatus) SendOut {
+		return SendOut{Key: key, Kind: kind, Status: status}
+	}
+	sendChat(t, cfg,
+		out("team-a-prod/web", constant.DeploymentKind, constant.K8sResStatusFail), // 第一条路由命中，不再匹配后面的路由
+		out("default/web", constant.DeploymentKind, constant.K8sResStatusFail),
+		out("default/web-x", constant.PodKind, constant.K8sResStatusFail),         // 没有路由命中
+		out("default/web", constant.DeploymentKind, constant.K8sResStatusSucceed), // 没有路由命中
+		out("default/web", constant.DeploymentKind, constant.K8sResStatusDelete),
+	)
+
+	got := map[string][]string{}
+	for _, req := range rec.snapshot() {
+		got[req.path] = append(got[req.path], req.body["text"].(map[string]interface{})["content"].(string))
+	}
+	want := map[string][]string{
+		"/team-a":        {"team-a-prod/web"},
+		"/deploy-failed": {"default/web"},
+		"/ops":           {"default/web"},
+		"/audit":         {"default/web"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("routed = %v, want %v", got, want)
+	}
+	for path, keys := range want {
+		if len(got[path]) != len(keys) || got[path][0] != keys[0] {
+			t.Fatalf("routed = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestChatSinkRateLimit(t *testing.T) {
+	rec := &chatRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	// 每个channel单独限流，超出突发的消息直接丢弃
+	sendChat(t, ChatConfig{Channels: []ChatChannel{
+		{Name: "limited", Platform: ChatSlack, WebhookURL: srv.URL + "/limited", PerMinute: 1, Burst: 2},
+		{Name: "default", Platform: ChatSlack, WebhookURL: srv.URL + "/default"},
+	}}, failedOut("a"), failedOut("b"), failedOut("c"), failedOut("d"))
+
+	count := map[string]int{}
+	for _, req := range rec.snapshot() {
+		count[req.path]++
+	}
+	if count["/limited"] != 2 || count["/default"] != 4 {
+		t.Fatalf("requests = %v, want 2 limited and 4 default", count)
+	}
+}
@@ -0,0 +1,130 @@
+package sender
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/util"
+)
+
+const (
+	CloudEventsSpecVersion = "1.0"
+	CloudEventsTypePrefix  = "io.kubewatcher"
+	cloudEventsContentType = "application/cloudevents+json"
+)
+
+type CloudEventsMode int // CloudEvents http协议绑定的内容模式
+
+const (
+	CloudEventsStructured CloudEventsMode = iota // 整个事件作为json请求体 Content-Type为application/cloudevents+json
+	CloudEventsBinary                            // 属性放在ce-*请求头中 请求体只有data
+)
+
+// CloudEvents 1.0 事件
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            SendOut   `json:"data"`
+}
+
+/*
+把事件编码为CloudEvents 1.0
+type: io.kubewatcher.<kind>.<status>，例如io.kubewatcher.pod.failed、io.kubewatcher.deployment.flapping
+source: /kubewatcher/<cluster>/<namespace>，cluster为空时省略
+subject: 资源key
+*/
+type CloudEventsEncoder struct {
+	Cluster string // 事件没有Cluster时使用的集群名
+	Mode    CloudEventsMode
+}
+
+func NewCloudEventsEncoder(cluster string, mode CloudEventsMode) *CloudEventsEncoder {
+	return &CloudEventsEncoder{Cluster: cluster, Mode: mode}
+}
+
+func (e *CloudEventsEncoder) Event(out SendOut) CloudEvent {
+	nameSpace, _ := util.SplitResourceCacheKey(out.Key)
+	source := "/kubewatcher"
+	if cluster := eventCluster(out, e.Cluster); cluster != "" {
+		source += "/" + cluster
+	}
+	if nameSpace != "" {
+		source += "/" + nameSpace
+	}
+	return CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              newEventID(),
+		Source:          source,
+		Type:            CloudEventsType(out),
+		Subject:         out.Key,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            out,
+	}
+}
+
+func (e *CloudEventsEncoder) Encode(out SendOut) (http.Header, []byte, error) {
+	ce := e.Event(out)
+	header := http.Header{}
+	if e.Mode == CloudEventsStructured {
+		body, err := json.Marshal(ce)
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Set("Content-Type", cloudEventsContentType)
+		return header, body, nil
+	}
+	body, err := json.Marshal(ce.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	header.Set("Content-Type", ce.DataContentType)
+	header.Set("ce-specversion", ce.SpecVersion)
+	header.Set("ce-id", ce.ID)
+	header.Set("ce-source", ce.Source)
+	header.Set("ce-type", ce.Type)
+	header.Set("ce-subject", ce.Subject)
+	header.Set("ce-time", ce.Time.Format(time.RFC3339Nano))
+	return header, body, nil
+}
+
+// 事件的CloudEvents type
+func CloudEventsType(out SendOut) string {
+	var action string
+	switch out.Type {
+	case constant.EventFlapping:
+		action = "flapping"
+	case constant.EventReasonChange:
+		action = "reasonchanged"
+	default:
+		switch out.Status {
+		case constant.K8sResStatusFail:
+			action = "failed"
+		case constant.K8sResStatusSucceed:
+			action = "succeeded"
+		case constant.K8sResStatusDelete:
+			action = "deleted"
+		default:
+			action = strings.ToLower(string(out.Status))
+		}
+	}
+	return CloudEventsTypePrefix + "." + strings.ToLower(string(out.Kind)) + "." + action
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,142 @@
+package sender
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+)
+
+func TestCloudEventsSource(t *testing.T) {
+	cases := []struct {
+		encoder string
+		cluster string
+		key     string
+		want    string
+	}{
+		{"", "", "default/web", "/kubewatcher/default"},
+		{"fallback", "", "default/web", "/kubewatcher/fallback/default"},
+		{"fallback", "prod", "default/web", "/kubewatcher/prod/default"},
+		{"", "prod", "web", "/kubewatcher/prod"},
+	}
+	for _, c := range cases {
+		e := NewCloudEventsEncoder(c.encoder, CloudEventsStructured)
+		got := e.Event(SendOut{Cluster: c.cluster, Key: c.key, Kind: constant.PodKind, Status: constant.K8sResStatusFail}).Source
+		if got != c.want {
+			t.Errorf("source(%q, %q, %q) = %q, want %q", c.encoder, c.cluster, c.key, got, c.want)
+		}
+	}
+}
+
+func TestCloudEventsType(t *testing.T) {
+	cases := []struct {
+		out  SendOut
+		want string
+	}{
+		{SendOut{Kind: constant.PodKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusFail}, "io.kubewatcher.pod.failed"},
+		{SendOut{Kind: constant.PodKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusSucceed}, "io.kubewatcher.pod.succeeded"},
+		{SendOut{Kind: constant.DeploymentKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusDelete}, "io.kubewatcher.deployment.deleted"},
+		{SendOut{Kind: constant.DeploymentKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusDefault}, "io.kubewatcher.deployment.default"},
+		{SendOut{Kind: constant.DeploymentKind, Type: constant.EventFlapping, Status: constant.K8sResStatusFail}, "io.kubewatcher.deployment.flapping"},
+		{SendOut{Kind: constant.PodKind, Type: constant.EventReasonChange, Status: constant.K8sResStatusFail}, "io.kubewatcher.pod.reasonchanged"},
+	}
+	for _, c := range cases {
+		if got := CloudEventsType(c.out); got != c.want {
+			t.Errorf("type(%s, %s, %s) = %q, want %q", c.out.Kind, c.out.Type, c.out.Status, got, c.want)
+		}
+	}
+}
+
+func TestCloudEventsBinary(t *testing.T) {
+	e := NewCloudEventsEncoder("prod", CloudEventsBinary)
+	out := SendOut{Key: "default/web", Kind: constant.PodKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusFail, Reason: "CrashLoopBackOff"}
+	before := time.Now().UTC()
+	header, body, err := e.Encode(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Content-Type":   "application/json",
+		"ce-specversion": CloudEventsSpecVersion,
+		"ce-type":        "io.kubewatcher.pod.failed",
+		"ce-source":      "/kubewatcher/prod/default",
+		"ce-subject":     "default/web",
+	}
+	for k, v := range want {
+		if got := header.Get(k); got != v {
+			t.Errorf("header %s = %q, want %q", k, got, v)
+		}
+	}
+	if id := header.Get("ce-id"); len(id) != 32 {
+		t.Errorf("ce-id = %q, want 16 random bytes in hex", id)
+	}
+	ts, err := time.Parse(time.RFC3339Nano, header.Get("ce-time"))
+	if err != nil || ts.Before(before.Add(-time.Second)) || ts.After(time.Now().Add(time.Second)) {
+		t.Errorf("ce-time = %q, %v, want the encode time", header.Get("ce-time"), err)
+	}
+
+	// 二进制模式的请求体只有data
+	var data SendOut
+	if err := json.Unmarshal(body, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Key != out.Key || data.Status != out.Status || data.Reason != out.Reason {
+		t.Fatalf("body = %+v, want the event", data)
+	}
+
+	// 每次编码生成新的id
+	header2, _, err := e.Encode(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header2.Get("ce-id") == header.Get("ce-id") {
+		t.Fatal("ce-id should be unique per event")
+	}
+}
+
+func TestCloudEventsStructured(t *testing.T) {
+	e := NewCloudEventsEncoder("", CloudEventsStructured)
+	out := SendOut{Cluster: "prod", Key: "default/web", Kind: constant.DeploymentKind, Type: constant.EventFlapping, Status: constant.K8sResStatusFail}
+	header, body, err := e.Encode(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := header.Get("Content-Type"); ct != "application/cloudevents+json" {
+		t.Fatalf("content type = %q", ct)
+	}
+	if header.Get("ce-id") != "" || header.Get("ce-type") != "" {
+		t.Fatalf("structured mode should not set ce-* headers: %v", header)
+	}
+
+	// 按json字段名检查信封，不依赖CloudEvent结构体
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"specversion":     CloudEventsSpecVersion,
+		"type":            "io.kubewatcher.deployment.flapping",
+		"source":          "/kubewatcher/prod/default",
+		"subject":         "default/web",
+		"datacontenttype": "application/json",
+	}
+	for k, v := range want {
+		var got string
+		if err := json.Unmarshal(envelope[k], &got); err != nil || got != v {
+			t.Errorf("envelope %s = %s, want %q", k, envelope[k], v)
+		}
+	}
+	var id string
+	if err := json.Unmarshal(envelope["id"], &id); err != nil || id == "" {
+		t.Errorf("envelope id = %s", envelope["id"])
+	}
+	var ts time.Time
+	if err := json.Unmarshal(envelope["time"], &ts); err != nil || ts.IsZero() {
+		t.Errorf("envelope time = %s", envelope["time"])
+	}
+	var data SendOut
+	if err := json.Unmarshal(envelope["data"], &data); err != nil || data.Key != out.Key || data.Type != out.Type || data.Cluster != out.Cluster {
+		t.Fatalf("envelope data = %s, %v", envelope["data"], err)
+	}
+}
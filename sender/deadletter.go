@@ -0,0 +1,150 @@
+package sender
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDeadLetterMaxBytes = 10 << 20
+
+	deadLetterDone = '#' // 重放完成的死信，行首的'{'被替换为它，读取时跳过
+)
+
+// 死信记录，最终推送失败的请求
+type DeadLetter struct {
+	Time     time.Time   `json:"time"`
+	Endpoint string      `json:"endpoint"`         // 推送目标
+	Error    string      `json:"error"`            // 最后一次失败的原因
+	Header   http.Header `json:"header,omitempty"` // 编码产生的请求头，不包含鉴权和签名
+	Body     []byte      `json:"body"`
+}
+
+/*
+有大小上限的死信文件，每行一条json
+超过上限后当前文件改名为 path.1（覆盖旧的），所以磁盘占用最多为两倍上限
+*/
+type deadLetterLog struct {
+	lock       sync.Mutex // 保护死信文件的写入和轮转
+	replayLock sync.Mutex // 同一时间只有一个重放
+	path       string
+	maxBytes   int64
+}
+
+func newDeadLetterLog(path string, maxBytes int64) *deadLetterLog {
+	if maxBytes <= 0 {
+		maxBytes = defaultDeadLetterMaxBytes
+	}
+	return &deadLetterLog{path: path, maxBytes: maxBytes}
+}
+
+func (d *deadLetterLog) write(dl DeadLetter) error {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if info, err := os.Stat(d.path); err == nil && info.Size()+int64(len(line)) > d.maxBytes {
+		if err := os.Rename(d.path, d.path+".1"); err != nil {
+			return errors.Wrap(err, "rotate dead letter")
+		}
+	}
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+/*
+重放所有死信（包括轮转出去的旧文件），fn返回错误时停止重放
+开始前把死信文件移到 path.replay，每条死信重放完成（推送成功，或者失败后已重新写入死信文件）后才在 path.replay 中标记删除
+停止重放或者进程退出时未完成的死信保留在 path.replay 中，下次重放时继续，可能重复推送
+*/
+func (d *deadLetterLog) replay(fn func(DeadLetter) error) error {
+	d.replayLock.Lock()
+	defer d.replayLock.Unlock()
+	if err := d.moveToReplay(); err != nil {
+		return errors.Wrap(err, "move dead letter")
+	}
+	f, err := os.OpenFile(d.replayPath(), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, rerr := reader.ReadBytes('\n')
+		var dl DeadLetter
+		if len(line) > 0 && line[0] != deadLetterDone && json.Unmarshal(line, &dl) == nil {
+			if err := fn(dl); err != nil {
+				return err
+			}
+			if _, err := f.WriteAt([]byte{deadLetterDone}, offset); err != nil {
+				return errors.Wrap(err, "mark dead letter")
+			}
+		}
+		offset += int64(len(line))
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	f.Close()
+	return os.Remove(d.replayPath())
+}
+
+func (d *deadLetterLog) replayPath() string {
+	return d.path + ".replay"
+}
+
+// 把死信文件追加到 path.replay 后删除，上次未完成的重放排在前面
+func (d *deadLetterLog) moveToReplay() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, p := range []string{d.path + ".1", d.path} {
+		src, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dst, err := os.OpenFile(d.replayPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			src.Close()
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package sender
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+/*
+把事件编码为http请求的请求头和请求体，供webhook等推送目标使用
+*/
+type Encoder interface {
+	Encode(out SendOut) (http.Header, []byte, error)
+}
+
+// 默认编码，请求体为SendOut的json
+type JSONEncoder struct{}
+
+func (JSONEncoder) Encode(out SendOut) (http.Header, []byte, error) {
+	body, err := json.Marshal(out)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return header, body, nil
+}
@@ -0,0 +1,77 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/pkg/errors"
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/sunreaver/kubewatcher/sender"
+)
+
+const defaultBatchTimeout = 10 * time.Millisecond
+
+type Config struct {
+	Brokers                []string
+	TLS                    *tls.Config          // 为空时不使用TLS
+	SASL                   sasl.Mechanism       // 为空时不认证，例如plain.Mechanism、scram.Mechanism
+	Balancer               kafkago.Balancer     // 分区策略 默认按key哈希（kafkago.Hash），与Java客户端一致可以使用kafkago.Murmur2Balancer
+	RequiredAcks           kafkago.RequiredAcks // 默认RequireAll，RequireNone无法感知投递失败所以不支持
+	Compression            kafkago.Compression
+	BatchTimeout           time.Duration // 默认10ms，消息按顺序逐条确认，不需要太大的批次等待
+	AllowAutoTopicCreation bool
+}
+
+/*
+发布到kafka，消息key为资源key，同一资源的消息落在同一分区，保证有序
+*/
+type Publisher struct {
+	w *kafkago.Writer
+}
+
+func NewPublisher(cfg Config) (*Publisher, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("kafka brokers can't be empty")
+	}
+	if cfg.Balancer == nil {
+		cfg.Balancer = &kafkago.Hash{}
+	}
+	if cfg.RequiredAcks == kafkago.RequireNone {
+		cfg.RequiredAcks = kafkago.RequireAll
+	}
+	if cfg.BatchTimeout <= 0 {
+		cfg.BatchTimeout = defaultBatchTimeout
+	}
+	w := &kafkago.Writer{
+		Addr:                   kafkago.TCP(cfg.Brokers...),
+		Balancer:               cfg.Balancer,
+		RequiredAcks:           cfg.RequiredAcks,
+		Compression:            cfg.Compression,
+		BatchTimeout:           cfg.BatchTimeout,
+		MaxAttempts:            1, // 重试由sender.PublisherSink负责
+		AllowAutoTopicCreation: cfg.AllowAutoTopicCreation,
+	}
+	if cfg.TLS != nil || cfg.SASL != nil {
+		w.Transport = &kafkago.Transport{TLS: cfg.TLS, SASL: cfg.SASL}
+	}
+	return &Publisher{w: w}, nil
+}
+
+func (p *Publisher) Publish(ctx context.Context, msg sender.Message) error {
+	headers := make([]kafkago.Header, 0, len(msg.Headers))
+	for k, v := range msg.Headers {
+		headers = append(headers, kafkago.Header{Key: k, Value: []byte(v)})
+	}
+	return p.w.WriteMessages(ctx, kafkago.Message{
+		Topic:   msg.Topic,
+		Key:     []byte(msg.Key),
+		Value:   msg.Body,
+		Headers: headers,
+	})
+}
+
+func (p *Publisher) Close() error {
+	return p.w.Close()
+}
@@ -0,0 +1,48 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+func TestNewPublisherDefaults(t *testing.T) {
+	if _, err := NewPublisher(Config{}); err == nil {
+		t.Fatal("want error for empty brokers")
+	}
+	p, err := NewPublisher(Config{Brokers: []string{"127.0.0.1:9092"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := p.w
+	if _, ok := w.Balancer.(*kafkago.Hash); !ok {
+		t.Fatalf("balancer = %T, want *kafka.Hash so that one resource stays in one partition", w.Balancer)
+	}
+	if w.RequiredAcks != kafkago.RequireAll {
+		t.Fatalf("required acks = %v, want RequireAll", w.RequiredAcks)
+	}
+	if w.MaxAttempts != 1 {
+		t.Fatalf("max attempts = %d, want 1, retries belong to PublisherSink", w.MaxAttempts)
+	}
+	if w.BatchTimeout != defaultBatchTimeout || w.Transport != nil {
+		t.Fatalf("batch timeout = %v, transport = %v", w.BatchTimeout, w.Transport)
+	}
+
+	p, err = NewPublisher(Config{
+		Brokers:      []string{"127.0.0.1:9092"},
+		SASL:         plain.Mechanism{Username: "u", Password: "p"},
+		RequiredAcks: kafkago.RequireOne,
+		BatchTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.w.RequiredAcks != kafkago.RequireOne || p.w.BatchTimeout != time.Second {
+		t.Fatalf("acks = %v, batch timeout = %v", p.w.RequiredAcks, p.w.BatchTimeout)
+	}
+	if transport, ok := p.w.Transport.(*kafkago.Transport); !ok || transport.SASL == nil {
+		t.Fatalf("transport = %#v, want SASL transport", p.w.Transport)
+	}
+}
@@ -0,0 +1,166 @@
+package sender
+
+import (
+	"maps"
+	"unicode/utf8"
+
+	appv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type MetaProjection int // 控制SendOut.Meta中携带的k8s对象数据
+
+const (
+	MetaProjectionFull     MetaProjection = iota // 默认 完整的k8s对象
+	MetaProjectionStripped                       // 完整的k8s对象，但去掉managedFields
+	MetaProjectionSummary                        // 只携带ResourceSummary
+	MetaProjectionNone                           // 不携带任何对象数据
+)
+
+// 资源的精简信息，annotation的处理见summaryAnnotations
+type ResourceSummary struct {
+	Labels        map[string]string `json:"labels,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+	Images        []string          `json:"images,omitempty"`        // 所有容器的镜像
+	Owner         string            `json:"owner,omitempty"`         // 控制者 格式为 kind/name
+	Node          string            `json:"node,omitempty"`          // pod所在节点
+	RestartCounts map[string]int32  `json:"restartCounts,omitempty"` // pod中各容器的重启次数 key为容器名
+}
+
+func (s SendOut) AsPod() (*corev1.Pod, bool) {
+	p, ok := s.Meta.(*corev1.Pod)
+	return p, ok && p != nil
+}
+
+func (s SendOut) AsDeployment() (*appv1.Deployment, bool) {
+	d, ok := s.Meta.(*appv1.Deployment)
+	return d, ok && d != nil
+}
+
+func (s SendOut) AsSummary() (*ResourceSummary, bool) {
+	r, ok := s.Meta.(*ResourceSummary)
+	return r, ok && r != nil
+}
+
+/*
+按照projection转换meta，不会修改传入的对象
+*/
+func ProjectMeta(meta interface{}, projection MetaProjection) interface{} {
+	switch projection {
+	case MetaProjectionNone:
+		return nil
+	case MetaProjectionStripped:
+		return stripManagedFields(meta)
+	case MetaProjectionSummary:
+		if s := Summarize(meta); s != nil {
+			return s
+		}
+		return nil
+	default:
+		return meta
+	}
+}
+
+// 浅拷贝对象并去掉managedFields
+func stripManagedFields(meta interface{}) interface{} {
+	switch m := meta.(type) {
+	case *corev1.Pod:
+		if m == nil {
+			return meta
+		}
+		p := *m
+		p.ManagedFields = nil
+		return &p
+	case *appv1.Deployment:
+		if m == nil {
+			return meta
+		}
+		d := *m
+		d.ManagedFields = nil
+		return &d
+	}
+	return meta
+}
+
+/*
+从pod或者deployment生成精简信息，其他类型返回nil
+*/
+func Summarize(meta interface{}) *ResourceSummary {
+	switch m := meta.(type) {
+	case *ResourceSummary:
+		return m
+	case *corev1.Pod:
+		if m == nil {
+			return nil
+		}
+		s := newResourceSummary(m.ObjectMeta, m.Spec.Containers)
+		s.Node = m.Spec.NodeName
+		if len(m.Status.ContainerStatuses) > 0 {
+			s.RestartCounts = make(map[string]int32, len(m.Status.ContainerStatuses))
+			for _, c := range m.Status.ContainerStatuses {
+				s.RestartCounts[c.Name] = c.RestartCount
+			}
+		}
+		return s
+	case *appv1.Deployment:
+		if m == nil {
+			return nil
+		}
+		return newResourceSummary(m.ObjectMeta, m.Spec.Template.Spec.Containers)
+	}
+	return nil
+}
+
+const (
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration" // 完整对象的json，精简信息中不保留
+	maxSummaryValueLen    = 256                                                // 精简信息中annotation值的最大字节数，超出截断
+)
+
+/*
+精简信息中的annotation：去掉last-applied-configuration，过长的值截断并以...结尾
+label的值由k8s限制在63个字符以内，全部保留
+*/
+func summaryAnnotations(annotations map[string]string) map[string]string {
+	if len(annotations) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		if k == lastAppliedAnnotation {
+			continue
+		}
+		out[k] = truncateValue(v, maxSummaryValueLen)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// 截断到最多n个字节，不拆分utf8字符
+func truncateValue(v string, n int) string {
+	if len(v) <= n {
+		return v
+	}
+	cut := n - len("...")
+	for cut > 0 && !utf8.RuneStart(v[cut]) {
+		cut--
+	}
+	return v[:cut] + "..."
+}
+
+func newResourceSummary(om metav1.ObjectMeta, containers []corev1.Container) *ResourceSummary {
+	// 复制map，精简信息可能直接从informer缓存中的对象生成
+	s := &ResourceSummary{
+		Labels:      maps.Clone(om.Labels),
+		Annotations: summaryAnnotations(om.Annotations),
+	}
+	for _, c := range containers {
+		s.Images = append(s.Images, c.Image)
+	}
+	if owner := metav1.GetControllerOfNoCopy(&om); owner != nil {
+		s.Owner = owner.Kind + "/" + owner.Name
+	}
+	return s
+}
@@ -0,0 +1,190 @@
+package sender
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	appv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testPod() *corev1.Pod {
+	controller := true
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "web-7d4b9c8f6-x2x9z",
+			Labels:    map[string]string{"app": "web", "pod-template-hash": "7d4b9c8f6"},
+			Annotations: map[string]string{
+				"prometheus.io/scrape":  "true",
+				lastAppliedAnnotation:   `{"apiVersion":"v1","kind":"Pod"}`,
+				"example.com/long-note": strings.Repeat("x", 1000),
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "web-7d4b9c8f6", Controller: &controller},
+				{Kind: "ConfigMap", Name: "web-config"},
+			},
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Name: "web", Image: "nginx:1.25"}, {Name: "sidecar", Image: "envoy:1.28"}},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "web", RestartCount: 3}, {Name: "sidecar"}},
+		},
+	}
+}
+
+func TestSummarizePod(t *testing.T) {
+	pod := testPod()
+	s := Summarize(pod)
+	if s == nil {
+		t.Fatal("summary is nil")
+	}
+	if len(s.Labels) != 2 || s.Labels["app"] != "web" || s.Labels["pod-template-hash"] != "7d4b9c8f6" {
+		t.Fatalf("labels = %v, want all labels kept", s.Labels)
+	}
+	if _, ok := s.Annotations[lastAppliedAnnotation]; ok || s.Annotations["prometheus.io/scrape"] != "true" || len(s.Annotations["example.com/long-note"]) != maxSummaryValueLen {
+		t.Fatalf("annotations = %v, want last-applied dropped and long value truncated", s.Annotations)
+	}
+	if s.Owner != "ReplicaSet/web-7d4b9c8f6" || s.Node != "node-1" {
+		t.Fatalf("owner = %s, node = %s", s.Owner, s.Node)
+	}
+	if len(s.Images) != 2 || s.Images[0] != "nginx:1.25" || s.Images[1] != "envoy:1.28" {
+		t.Fatalf("images = %v", s.Images)
+	}
+	if s.RestartCounts["web"] != 3 || len(s.RestartCounts) != 2 {
+		t.Fatalf("restart counts = %v", s.RestartCounts)
+	}
+	// 精简信息复制了map，修改不会影响informer缓存中的对象
+	s.Labels["app"] = "changed"
+	if pod.Labels["app"] != "web" {
+		t.Fatal("summary shares labels with the object")
+	}
+}
+
+func TestSummaryAnnotations(t *testing.T) {
+	long := strings.Repeat("x", 1000)
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string
+	}{
+		{"none", nil, nil},
+		{"short values kept", map[string]string{"prometheus.io/scrape": "true"}, map[string]string{"prometheus.io/scrape": "true"}},
+		{"last applied dropped", map[string]string{lastAppliedAnnotation: "{}", "a": "b"}, map[string]string{"a": "b"}},
+		{"only last applied", map[string]string{lastAppliedAnnotation: "{}"}, nil},
+		{"value at limit kept", map[string]string{"a": long[:maxSummaryValueLen]}, map[string]string{"a": long[:maxSummaryValueLen]}},
+		{"long value truncated", map[string]string{"a": long}, map[string]string{"a": long[:maxSummaryValueLen-3] + "..."}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := summaryAnnotations(c.annotations)
+			if len(got) != len(c.want) || (got == nil) != (c.want == nil) {
+				t.Fatalf("annotations = %v, want %v", got, c.want)
+			}
+			for k, v := range c.want {
+				if got[k] != v {
+					t.Fatalf("annotation %s = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+
+	// 截断不拆分多字节字符
+	v := truncateValue(strings.Repeat("日", 200), maxSummaryValueLen)
+	if len(v) > maxSummaryValueLen || !utf8.ValidString(v) || !strings.HasSuffix(v, "...") {
+		t.Fatalf("truncated value has %d bytes, valid utf8 %v", len(v), utf8.ValidString(v))
+	}
+}
+
+func TestProjectMeta(t *testing.T) {
+	pod := testPod()
+	dep := &appv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", ManagedFields: pod.ManagedFields}}
+	cases := []struct {
+		name       string
+		meta       interface{}
+		projection MetaProjection
+		check      func(t *testing.T, got interface{})
+	}{
+		{"full keeps object", pod, MetaProjectionFull, func(t *testing.T, got interface{}) {
+			if got != pod {
+				t.Fatalf("got %T, want the same pod", got)
+			}
+		}},
+		{"none", pod, MetaProjectionNone, func(t *testing.T, got interface{}) {
+			if got != nil {
+				t.Fatalf("got %T, want nil", got)
+			}
+		}},
+		{"stripped pod", pod, MetaProjectionStripped, func(t *testing.T, got interface{}) {
+			p, ok := got.(*corev1.Pod)
+			if !ok || p == pod || len(p.ManagedFields) != 0 || p.Name != pod.Name {
+				t.Fatalf("got %+v, want a copy without managedFields", got)
+			}
+		}},
+		{"stripped deployment", dep, MetaProjectionStripped, func(t *testing.T, got interface{}) {
+			d, ok := got.(*appv1.Deployment)
+			if !ok || d == dep || len(d.ManagedFields) != 0 {
+				t.Fatalf("got %+v, want a copy without managedFields", got)
+			}
+		}},
+		{"summary of deployment", dep, MetaProjectionSummary, func(t *testing.T, got interface{}) {
+			if _, ok := got.(*ResourceSummary); !ok {
+				t.Fatalf("got %T, want *ResourceSummary", got)
+			}
+		}},
+		{"summary of other type", "text", MetaProjectionSummary, func(t *testing.T, got interface{}) {
+			if got != nil {
+				t.Fatalf("got %v, want nil", got)
+			}
+		}},
+		{"summary is kept", &ResourceSummary{Node: "n"}, MetaProjectionSummary, func(t *testing.T, got interface{}) {
+			if s, ok := got.(*ResourceSummary); !ok || s.Node != "n" {
+				t.Fatalf("got %v", got)
+			}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.check(t, ProjectMeta(c.meta, c.projection))
+		})
+	}
+	if len(pod.ManagedFields) != 1 || len(dep.ManagedFields) != 1 {
+		t.Fatal("ProjectMeta modified the original object")
+	}
+}
+
+func TestSendOutAccessors(t *testing.T) {
+	var nilPod *corev1.Pod
+	pod := testPod()
+	dep := &appv1.Deployment{}
+	cases := []struct {
+		name                 string
+		meta                 interface{}
+		isPod, isDep, isSumm bool
+	}{
+		{"pod", pod, true, false, false},
+		{"deployment", dep, false, true, false},
+		{"summary", &ResourceSummary{}, false, false, true},
+		{"typed nil pod", nilPod, false, false, false},
+		{"nil", nil, false, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out := SendOut{Meta: c.meta}
+			if p, ok := out.AsPod(); ok != c.isPod || (ok && p != pod) {
+				t.Fatalf("AsPod() ok = %v, want %v", ok, c.isPod)
+			}
+			if _, ok := out.AsDeployment(); ok != c.isDep {
+				t.Fatalf("AsDeployment() ok = %v, want %v", ok, c.isDep)
+			}
+			if _, ok := out.AsSummary(); ok != c.isSumm {
+				t.Fatalf("AsSummary() ok = %v, want %v", ok, c.isSumm)
+			}
+		})
+	}
+}
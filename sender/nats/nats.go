@@ -0,0 +1,95 @@
+package nats
+
+import (
+	"context"
+	"strconv"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/sender"
+)
+
+const KeyHeader = "Kubewatcher-Key" // 消息头中的资源key
+
+type Config struct {
+	JetStream  bool // 通过JetStream发布并等待确认，subject需要已被某个stream收录
+	Partitions int  // 大于1时subject追加 .<分区号>，同一资源固定在同一个subject上，便于消费者按分区并行且保持有序
+}
+
+/*
+发布到nats，消息头Kubewatcher-Key为资源key
+core nats发布后会flush等待服务端确认收到，连接异常时返回错误
+*/
+type Publisher struct {
+	nc      *natsgo.Conn
+	js      natsgo.JetStreamContext
+	cfg     Config
+	ownConn bool // 由Connect创建的连接，Close时关闭
+}
+
+// 连接nats并创建Publisher，Close时关闭连接
+func Connect(url string, cfg Config, opts ...natsgo.Option) (*Publisher, error) {
+	nc, err := natsgo.Connect(url, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "connect nats")
+	}
+	p, err := NewPublisher(nc, cfg)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	p.ownConn = true
+	return p, nil
+}
+
+// 使用已有的连接，Close时不会关闭连接
+func NewPublisher(nc *natsgo.Conn, cfg Config) (*Publisher, error) {
+	if nc == nil {
+		return nil, errors.New("nats conn can't be null")
+	}
+	if cfg.Partitions < 0 {
+		return nil, errors.New("partitions can't be negative")
+	}
+	p := &Publisher{nc: nc, cfg: cfg}
+	if cfg.JetStream {
+		js, err := nc.JetStream()
+		if err != nil {
+			return nil, errors.Wrap(err, "jetstream")
+		}
+		p.js = js
+	}
+	return p, nil
+}
+
+func (p *Publisher) Publish(ctx context.Context, msg sender.Message) error {
+	subject := msg.Topic
+	if p.cfg.Partitions > 1 {
+		subject += "." + strconv.Itoa(sender.PartitionOf(msg.Key, p.cfg.Partitions))
+	}
+	m := natsgo.NewMsg(subject)
+	m.Data = msg.Body
+	for k, v := range msg.Headers {
+		m.Header.Set(k, v)
+	}
+	m.Header.Set(KeyHeader, msg.Key)
+	if p.js != nil {
+		_, err := p.js.PublishMsg(m, natsgo.Context(ctx))
+		return err
+	}
+	if err := p.nc.PublishMsg(m); err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		return p.nc.Flush() // FlushWithContext要求ctx有截止时间，没有时使用默认超时
+	}
+	return p.nc.FlushWithContext(ctx)
+}
+
+func (p *Publisher) Close() error {
+	if !p.ownConn {
+		return nil
+	}
+	err := p.nc.Flush()
+	p.nc.Close()
+	return err
+}
@@ -0,0 +1,191 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/sender"
+)
+
+// 进程内的nats服务，开启JetStream
+func runServer(t *testing.T) *server.Server {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func connect(t *testing.T, s *server.Server) *natsgo.Conn {
+	t.Helper()
+	nc, err := natsgo.Connect(s.ClientURL(), natsgo.MaxReconnects(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func nextMsg(t *testing.T, sub *natsgo.Subscription) *natsgo.Msg {
+	t.Helper()
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestPublisherSinkToCoreNats(t *testing.T) {
+	s := runServer(t)
+	sub, err := connect(t, s).SubscribeSync("kubewatcher.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Connect(s.ClientURL(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := sender.NewPublisherSink(p, sender.PublisherConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Send(sender.SendOut{Cluster: "a", Key: "default/web", Kind: constant.DeploymentKind, Name: "web", Status: constant.K8sResStatusFail})
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := sink.Stats(); stats.Published != 1 {
+		t.Fatalf("stats = %+v, want 1 published", stats)
+	}
+
+	msg := nextMsg(t, sub)
+	if want := "kubewatcher." + string(constant.DeploymentKind) + ".default"; msg.Subject != want {
+		t.Fatalf("subject = %s, want %s", msg.Subject, want)
+	}
+	if msg.Header.Get(KeyHeader) != "default/web" || msg.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("headers = %v", msg.Header)
+	}
+	var out sender.SendOut
+	if err := json.Unmarshal(msg.Data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Cluster != "a" || out.Status != constant.K8sResStatusFail {
+		t.Fatalf("body = %+v", out)
+	}
+	// Connect创建的连接在Close时关闭
+	if !p.nc.IsClosed() {
+		t.Fatal("own connection should be closed")
+	}
+}
+
+func TestPublisherPartitions(t *testing.T) {
+	s := runServer(t)
+	nc := connect(t, s)
+	sub, err := nc.SubscribeSync("events.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPublisher(nc, Config{Partitions: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"default/a", "default/b", "default/c", "default/d"}
+	for _, key := range keys {
+		if err := p.Publish(context.Background(), sender.Message{Topic: "events", Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys {
+		msg := nextMsg(t, sub)
+		if msg.Header.Get(KeyHeader) != key {
+			t.Fatalf("key = %s, want %s", msg.Header.Get(KeyHeader), key)
+		}
+		if want := "events." + strconv.Itoa(sender.PartitionOf(key, 3)); msg.Subject != want {
+			t.Fatalf("subject of %s = %s, want %s", key, msg.Subject, want)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if nc.IsClosed() {
+		t.Fatal("external connection should stay open")
+	}
+}
+
+func TestPublisherJetStream(t *testing.T) {
+	s := runServer(t)
+	nc := connect(t, s)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&natsgo.StreamConfig{Name: "KUBEWATCHER", Subjects: []string{"kubewatcher.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPublisher(nc, Config{JetStream: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := p.Publish(ctx, sender.Message{Topic: "kubewatcher.pod.default", Key: "default/web-" + strconv.Itoa(i), Body: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := js.StreamInfo("KUBEWATCHER")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 3 {
+		t.Fatalf("stream messages = %d, want 3", info.State.Msgs)
+	}
+	stored, err := js.GetMsg("KUBEWATCHER", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Header.Get(KeyHeader) != "default/web-0" {
+		t.Fatalf("stored key = %s", stored.Header.Get(KeyHeader))
+	}
+
+	// 没有stream收录的subject得不到确认，返回错误由PublisherSink重试
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := p.Publish(ctx, sender.Message{Topic: "other.subject", Key: "default/web"}); err == nil {
+		t.Fatal("want error for subject without stream")
+	}
+}
+
+func TestPublisherServerDown(t *testing.T) {
+	s := runServer(t)
+	p, err := NewPublisher(connect(t, s), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.Publish(ctx, sender.Message{Topic: "events", Key: "default/web"}); err == nil {
+		t.Fatal("want error when nats server is down")
+	}
+	if _, err := NewPublisher(nil, Config{}); err == nil {
+		t.Fatal("want error for nil conn")
+	}
+}
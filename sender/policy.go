@@ -0,0 +1,198 @@
+package sender
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
+)
+
+/*
+通知策略，作用在状态机产生事件之后、真正推送给回调之前
+1. PendingFor: failed状态需要持续一段时间才推送（类似prometheus告警的for），期间恢复则什么都不推送
+2. FlapThreshold/FlapWindow: 窗口期内状态变化超过阈值视为抖动，只推送一次Flapping事件，抖动平息后再推送最终状态
+*/
+type NotifyPolicy struct {
+	PendingFor    time.Duration // failed状态持续多久才推送，0表示立即推送
+	FlapThreshold int           // 窗口期内状态变化次数超过该值视为抖动，0表示不检测抖动
+	FlapWindow    time.Duration // 抖动检测的窗口期，同时也是判定抖动平息的静默时长
+}
+
+func (p NotifyPolicy) Validate() error {
+	if p.PendingFor < 0 {
+		return errors.New("PendingFor can't be negative")
+	}
+	if p.FlapThreshold < 0 {
+		return errors.New("FlapThreshold can't be negative")
+	}
+	if p.FlapThreshold > 0 && p.FlapWindow <= 0 {
+		return errors.New("FlapWindow must be positive when FlapThreshold is set")
+	}
+	return nil
+}
+
+// 单个资源在策略中的状态
+type policyState struct {
+	lastSent    constant.K8sResStatus // 最近一次真正推送出去的状态
+	pending     *time.Timer           // 等待确认的failed事件定时器
+	pendingOut  SendOut               // 等待确认的failed事件
+	transitions []time.Time           // 窗口期内的状态变化时间
+	flapping    bool                  // 是否处于抖动中
+	flapTimer   *time.Timer           // 抖动平息检测定时器
+	latest      SendOut               // 抖动期间最新的事件
+}
+
+func (st *policyState) stopTimers() {
+	if st.pending != nil {
+		st.pending.Stop()
+		st.pending = nil
+	}
+	if st.flapTimer != nil {
+		st.flapTimer.Stop()
+		st.flapTimer = nil
+	}
+}
+
+type notifyPolicy struct {
+	NotifyPolicy
+	lock    sync.Mutex
+	stopped bool                    // 停止后不再延迟任何事件
+	states  map[string]*policyState // key为资源key
+	emit    func(SendOut)           // 策略放行后的真正推送方法
+}
+
+func newNotifyPolicy(p NotifyPolicy, emit func(SendOut)) *notifyPolicy {
+	return &notifyPolicy{
+		NotifyPolicy: p,
+		states:       map[string]*policyState{},
+		emit:         emit,
+	}
+}
+
+// 事件经过策略过滤，放行的事件在释放锁之后再推送，避免推送阻塞时持有锁
+func (p *notifyPolicy) filter(out SendOut) {
+	for _, o := range p.decide(out, time.Now()) {
+		p.emit(o)
+	}
+}
+
+func (p *notifyPolicy) decide(out SendOut, now time.Time) []SendOut {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stopped {
+		return []SendOut{out}
+	}
+	if out.Type != constant.EventStatusChange {
+		if st, ok := p.states[out.Key]; ok && (st.pending != nil || st.flapping) {
+			// 等待确认或者抖动中的资源，只更新原因，不单独推送
+			st.pendingOut.Reason = out.Reason
+			st.latest.Reason = out.Reason
+			return nil
+		}
+		return []SendOut{out}
+	}
+	st, ok := p.states[out.Key]
+	if !ok {
+		st = &policyState{}
+		p.states[out.Key] = st
+	}
+	if out.Status.IsDelete() {
+		// 删除事件总是推送，并清理该资源的策略状态
+		st.stopTimers()
+		delete(p.states, out.Key)
+		return []SendOut{out}
+	}
+
+	if p.FlapThreshold > 0 {
+		st.transitions = append(pruneBefore(st.transitions, now.Add(-p.FlapWindow)), now)
+		if st.flapping {
+			st.latest = out
+			st.flapTimer.Reset(p.FlapWindow)
+			return nil
+		}
+		if len(st.transitions) > p.FlapThreshold {
+			if st.pending != nil {
+				st.pending.Stop()
+				st.pending = nil
+			}
+			st.flapping = true
+			st.latest = out
+			st.flapTimer = time.AfterFunc(p.FlapWindow, func() { p.flapDone(out.Key, st) })
+			flap := out
+			flap.Type = constant.EventFlapping
+			return []SendOut{flap}
+		}
+	}
+
+	if out.Status == constant.K8sResStatusFail && p.PendingFor > 0 && st.lastSent != constant.K8sResStatusFail {
+		st.pendingOut = out // 等待期间只保留最新的失败信息
+		if st.pending == nil {
+			st.pending = time.AfterFunc(p.PendingFor, func() { p.pendingDone(out.Key, st) })
+		}
+		return nil
+	}
+	if st.pending != nil {
+		// failed在确认前就恢复了，外部看到的状态没有变化，不推送
+		st.pending.Stop()
+		st.pending = nil
+		if out.Status == st.lastSent {
+			return nil
+		}
+	}
+	st.lastSent = out.Status
+	return []SendOut{out}
+}
+
+func (p *notifyPolicy) pendingDone(key string, st *policyState) {
+	p.lock.Lock()
+	if p.states[key] != st || st.pending == nil {
+		p.lock.Unlock()
+		return
+	}
+	st.pending = nil
+	st.lastSent = st.pendingOut.Status
+	out := st.pendingOut
+	p.lock.Unlock()
+	p.emit(out)
+}
+
+// 抖动平息，推送最终状态
+func (p *notifyPolicy) flapDone(key string, st *policyState) {
+	p.lock.Lock()
+	if p.states[key] != st || !st.flapping {
+		p.lock.Unlock()
+		return
+	}
+	st.flapping = false
+	st.flapTimer = nil
+	st.transitions = st.transitions[:0]
+	st.lastSent = st.latest.Status
+	out := st.latest
+	p.lock.Unlock()
+	p.emit(out)
+}
+
+// 停止所有定时器，返回被丢弃的等待中事件数量
+func (p *notifyPolicy) stop() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.stopped = true
+	dropped := 0
+	for key, st := range p.states {
+		if st.pending != nil || st.flapping {
+			dropped++
+		}
+		st.stopTimers()
+		delete(p.states, key)
+	}
+	return dropped
+}
+
+func pruneBefore(list []time.Time, t time.Time) []time.Time {
+	i := 0
+	for i < len(list) && list[i].Before(t) {
+		i++
+	}
+	return append(list[:0], list[i:]...)
+}
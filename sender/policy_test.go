@@ -0,0 +1,279 @@
+package sender
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+)
+
+// 记录策略放行的事件
+type policyRecorder struct {
+	lock sync.Mutex
+	list []SendOut
+}
+
+func (r *policyRecorder) emit(out SendOut) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.list = append(r.list, out)
+}
+
+func (r *policyRecorder) outs() []SendOut {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]SendOut{}, r.list...)
+}
+
+func statusOut(status constant.K8sResStatus, reason string) SendOut {
+	return SendOut{Key: "default/web", Kind: constant.DeploymentKind, Type: constant.EventStatusChange, Status: status, Reason: reason}
+}
+
+func reasonOut(reason string) SendOut {
+	out := statusOut(constant.K8sResStatusFail, reason)
+	out.Type = constant.EventReasonChange
+	return out
+}
+
+func policyStates(p *notifyPolicy) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.states)
+}
+
+func TestNotifyPolicyValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy NotifyPolicy
+		ok     bool
+	}{
+		{"zero", NotifyPolicy{}, true},
+		{"pending", NotifyPolicy{PendingFor: time.Minute}, true},
+		{"flap", NotifyPolicy{FlapThreshold: 3, FlapWindow: time.Minute}, true},
+		{"negative pending", NotifyPolicy{PendingFor: -1}, false},
+		{"negative threshold", NotifyPolicy{FlapThreshold: -1}, false},
+		{"threshold without window", NotifyPolicy{FlapThreshold: 3}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.policy.Validate(); (err == nil) != c.ok {
+				t.Fatalf("Validate() = %v, want ok %v", err, c.ok)
+			}
+		})
+	}
+}
+
+// 不触发定时器的情况下，每个事件是否立即放行
+func TestNotifyPolicyDecide(t *testing.T) {
+	fail := constant.K8sResStatusFail
+	succeed := constant.K8sResStatusSucceed
+	cases := []struct {
+		name   string
+		policy NotifyPolicy
+		events []SendOut
+		want   []int // 立即放行的事件下标
+	}{
+		{
+			name:   "no policy passes everything",
+			events: []SendOut{statusOut(fail, "a"), reasonOut("b"), statusOut(succeed, "")},
+			want:   []int{0, 1, 2},
+		},
+		{
+			name:   "failed waits for pending",
+			policy: NotifyPolicy{PendingFor: time.Hour},
+			events: []SendOut{statusOut(succeed, ""), statusOut(fail, "a")},
+			want:   []int{0},
+		},
+		{
+			name:   "recovery cancels pending",
+			policy: NotifyPolicy{PendingFor: time.Hour},
+			events: []SendOut{statusOut(succeed, ""), statusOut(fail, "a"), statusOut(succeed, "")},
+			want:   []int{0},
+		},
+		{
+			name:   "first recovery is sent when nothing was sent before",
+			policy: NotifyPolicy{PendingFor: time.Hour},
+			events: []SendOut{statusOut(fail, "a"), statusOut(succeed, "")},
+			want:   []int{1},
+		},
+		{
+			name:   "reason change is folded into pending",
+			policy: NotifyPolicy{PendingFor: time.Hour},
+			events: []SendOut{statusOut(fail, "a"), reasonOut("b")},
+			want:   nil,
+		},
+		{
+			name:   "reason change passes without pending",
+			policy: NotifyPolicy{PendingFor: time.Hour},
+			events: []SendOut{statusOut(succeed, ""), reasonOut("b")},
+			want:   []int{0, 1},
+		},
+		{
+			name:   "delete is always sent",
+			policy: NotifyPolicy{PendingFor: time.Hour},
+			events: []SendOut{statusOut(fail, "a"), statusOut(constant.K8sResStatusDelete, "delete")},
+			want:   []int{1},
+		},
+		{
+			name:   "changes below threshold pass",
+			policy: NotifyPolicy{FlapThreshold: 3, FlapWindow: time.Hour},
+			events: []SendOut{statusOut(fail, "a"), statusOut(succeed, ""), statusOut(fail, "a")},
+			want:   []int{0, 1, 2},
+		},
+		{
+			name:   "flapping is sent once",
+			policy: NotifyPolicy{FlapThreshold: 2, FlapWindow: time.Hour},
+			events: []SendOut{statusOut(fail, "a"), statusOut(succeed, ""), statusOut(fail, "a"), statusOut(succeed, ""), reasonOut("b")},
+			want:   []int{0, 1, 2},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newNotifyPolicy(c.policy, func(SendOut) {})
+			defer p.stop()
+			var got []int
+			for i, e := range c.events {
+				if len(p.decide(e, time.Now())) > 0 {
+					got = append(got, i)
+				}
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("passed %v, want %v", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Fatalf("passed %v, want %v", got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyPolicyPendingTimer(t *testing.T) {
+	rec := &policyRecorder{}
+	p := newNotifyPolicy(NotifyPolicy{PendingFor: 30 * time.Millisecond}, rec.emit)
+	defer p.stop()
+
+	// 在PendingFor内恢复，什么都不推送
+	p.filter(statusOut(constant.K8sResStatusSucceed, ""))
+	p.filter(statusOut(constant.K8sResStatusFail, "a"))
+	p.filter(statusOut(constant.K8sResStatusSucceed, ""))
+	time.Sleep(60 * time.Millisecond)
+	if outs := rec.outs(); len(outs) != 1 {
+		t.Fatalf("outs = %+v, want only the first succeed", outs)
+	}
+
+	// 持续failed，PendingFor之后推送一次，带最新的原因
+	p.filter(statusOut(constant.K8sResStatusFail, "a"))
+	p.filter(reasonOut("b"))
+	waitFor(t, func() bool { return len(rec.outs()) == 2 })
+	out := rec.outs()[1]
+	if out.Status != constant.K8sResStatusFail || out.Reason != "b" || out.Type != constant.EventStatusChange {
+		t.Fatalf("pending out = %+v, want failed with reason b", out)
+	}
+	// 已经推送过failed，再次failed不再等待
+	p.filter(statusOut(constant.K8sResStatusFail, "c"))
+	if outs := rec.outs(); len(outs) != 3 {
+		t.Fatalf("outs = %d, want failed sent immediately after confirmed", len(outs))
+	}
+	time.Sleep(60 * time.Millisecond)
+	if outs := rec.outs(); len(outs) != 3 {
+		t.Fatalf("outs = %+v, want no extra event", outs)
+	}
+}
+
+func TestNotifyPolicyFlapping(t *testing.T) {
+	rec := &policyRecorder{}
+	p := newNotifyPolicy(NotifyPolicy{FlapThreshold: 2, FlapWindow: 100 * time.Millisecond}, rec.emit)
+	defer p.stop()
+
+	for _, status := range []constant.K8sResStatus{constant.K8sResStatusFail, constant.K8sResStatusSucceed, constant.K8sResStatusFail} {
+		p.filter(statusOut(status, ""))
+	}
+	outs := rec.outs()
+	if len(outs) != 3 || outs[2].Type != constant.EventFlapping {
+		t.Fatalf("outs = %+v, want the third change reported as flapping", outs)
+	}
+	// 抖动期间的变化不推送，每次变化都重新计算静默时长
+	for i := 0; i < 3; i++ {
+		p.filter(statusOut(constant.K8sResStatusSucceed, ""))
+		time.Sleep(20 * time.Millisecond)
+		p.filter(statusOut(constant.K8sResStatusFail, "last"))
+		time.Sleep(20 * time.Millisecond)
+	}
+	if outs := rec.outs(); len(outs) != 3 {
+		t.Fatalf("outs = %+v, want nothing sent while flapping", outs)
+	}
+
+	// 平息后推送最终状态，之后恢复正常推送
+	waitFor(t, func() bool { return len(rec.outs()) == 4 })
+	out := rec.outs()[3]
+	if out.Type != constant.EventStatusChange || out.Status != constant.K8sResStatusFail || out.Reason != "last" {
+		t.Fatalf("settled out = %+v, want final failed status", out)
+	}
+	p.filter(statusOut(constant.K8sResStatusSucceed, ""))
+	if outs := rec.outs(); len(outs) != 5 || outs[4].Status != constant.K8sResStatusSucceed {
+		t.Fatalf("outs = %+v, want succeed sent after settling", outs)
+	}
+}
+
+func TestNotifyPolicyDeleteClearsState(t *testing.T) {
+	rec := &policyRecorder{}
+	p := newNotifyPolicy(NotifyPolicy{PendingFor: 30 * time.Millisecond, FlapThreshold: 2, FlapWindow: 30 * time.Millisecond}, rec.emit)
+	defer p.stop()
+
+	// 等待确认中的failed被删除，定时器不会再推送
+	p.filter(statusOut(constant.K8sResStatusFail, "a"))
+	p.filter(statusOut(constant.K8sResStatusDelete, "delete"))
+	if n := policyStates(p); n != 0 {
+		t.Fatalf("states = %d after delete, want 0", n)
+	}
+	// 抖动中的资源被删除，平息时不会推送最终状态
+	for _, status := range []constant.K8sResStatus{constant.K8sResStatusSucceed, constant.K8sResStatusFail, constant.K8sResStatusSucceed} {
+		p.filter(statusOut(status, ""))
+	}
+	p.filter(statusOut(constant.K8sResStatusDelete, "delete"))
+	time.Sleep(80 * time.Millisecond)
+
+	outs := rec.outs()
+	want := []SendOut{
+		statusOut(constant.K8sResStatusDelete, "delete"),
+		statusOut(constant.K8sResStatusSucceed, ""),
+		statusOut(constant.K8sResStatusSucceed, ""), // failed在等待确认中，第三次变化被判定为抖动
+		statusOut(constant.K8sResStatusDelete, "delete"),
+	}
+	want[2].Type = constant.EventFlapping
+	if len(outs) != len(want) {
+		t.Fatalf("outs = %+v, want %d events", outs, len(want))
+	}
+	for i := range want {
+		if outs[i].Status != want[i].Status || outs[i].Type != want[i].Type {
+			t.Fatalf("out %d = %s %s, want %s %s", i, outs[i].Type, outs[i].Status, want[i].Type, want[i].Status)
+		}
+	}
+	if n := policyStates(p); n != 0 {
+		t.Fatalf("states = %d after delete, want 0", n)
+	}
+
+	// 删除后重新出现的资源从头开始计算
+	p.filter(statusOut(constant.K8sResStatusFail, "b"))
+	waitFor(t, func() bool { return len(rec.outs()) == len(want)+1 })
+}
+
+func TestNotifyPolicyStop(t *testing.T) {
+	rec := &policyRecorder{}
+	p := newNotifyPolicy(NotifyPolicy{PendingFor: time.Hour}, rec.emit)
+	p.filter(statusOut(constant.K8sResStatusFail, "a"))
+	other := statusOut(constant.K8sResStatusSucceed, "")
+	other.Key = "default/api"
+	p.filter(other)
+	if dropped := p.stop(); dropped != 1 {
+		t.Fatalf("dropped = %d, want the pending failed", dropped)
+	}
+	// 停止后不再延迟
+	p.filter(statusOut(constant.K8sResStatusFail, "a"))
+	if outs := rec.outs(); len(outs) != 2 || outs[1].Status != constant.K8sResStatusFail {
+		t.Fatalf("outs = %+v, want failed passed through after stop", outs)
+	}
+}
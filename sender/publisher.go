@@ -0,0 +1,278 @@
+package sender
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/util"
+)
+
+const (
+	DefaultTopicTemplate   = "kubewatcher.{{.Kind}}.{{.Namespace}}"
+	ClusterScopedNamespace = "_cluster" // 集群级别的资源没有namespace，topic中使用该占位符
+
+	defaultPublishTimeout        = 10 * time.Second
+	defaultPublishMaxRetries     = 3
+	defaultPublishInitialBackoff = 200 * time.Millisecond
+	defaultPublishMaxBackoff     = 10 * time.Second
+	defaultPublishQueueSize      = 1000
+)
+
+// 发布到消息队列的一条消息
+type Message struct {
+	Topic   string            // kafka的topic、nats的subject、redis的stream
+	Key     string            // 资源key，用于分区，保证同一资源的消息有序
+	Headers map[string]string // 编码产生的头，例如Content-Type、CloudEvents binary模式的ce-*
+	Body    []byte
+}
+
+/*
+消息队列的发布接口，kafka、nats、redis的实现在对应的子包中
+Publish返回时消息应已被消息队列确认，返回错误时会按PublisherConfig重试
+*/
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+	Close() error
+}
+
+// topic模板中可以使用的数据
+type TopicData struct {
+	Kind      string // 与constant中一致，首字母大写，例如Pod、Deployment
+	Namespace string // 集群级别的资源为ClusterScopedNamespace
+	Name      string
+	Status    string
+	Type      string
+	Cluster   string
+}
+
+type PublisherConfig struct {
+	Topic          string        // text/template模板，数据为TopicData 默认 kubewatcher.{{.Kind}}.{{.Namespace}}，例如kubewatcher.Pod.default；渲染结果以.分隔的某一段为空时丢弃
+	Cluster        string        // 事件没有Cluster时使用的集群名，可以在模板中通过.Cluster使用
+	Encoder        Encoder       // 消息编码 默认JSONEncoder
+	Timeout        time.Duration // 单次发布超时 默认10s
+	MaxRetries     int           // 失败后最多重试几次 默认3次，小于0（NoRetry）表示不重试
+	InitialBackoff time.Duration // 第一次重试的等待时间，之后每次翻倍 默认200ms
+	MaxBackoff     time.Duration // 重试等待时间上限 默认10s
+	QueueSize      int           // 待发布队列长度 默认1000，队列满时丢弃
+}
+
+func (c *PublisherConfig) setDefaults() error {
+	if c.Timeout < 0 || c.InitialBackoff < 0 || c.MaxBackoff < 0 || c.QueueSize < 0 {
+		return errors.New("publisher config can't be negative")
+	}
+	if c.Topic == "" {
+		c.Topic = DefaultTopicTemplate
+	}
+	if c.Encoder == nil {
+		c.Encoder = JSONEncoder{}
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultPublishTimeout
+	}
+	switch {
+	case c.MaxRetries == 0:
+		c.MaxRetries = defaultPublishMaxRetries
+	case c.MaxRetries < 0:
+		c.MaxRetries = 0
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = defaultPublishInitialBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = defaultPublishMaxBackoff
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = defaultPublishQueueSize
+	}
+	return nil
+}
+
+// 发布统计
+type PublisherStats struct {
+	Published int64 // 发布成功
+	Failed    int64 // 重试后仍然失败
+	Dropped   int64 // 队列满或者编码失败而丢弃
+}
+
+/*
+把事件编码后通过Publisher发布到消息队列
+单协程按顺序发布，消息key为资源key，配合消息队列的按key分区保证同一资源的事件有序
+*/
+type PublisherSink struct {
+	cfg       PublisherConfig
+	pub       Publisher
+	topic     *template.Template
+	queue     chan SendOut
+	ctx       context.Context // Close超时后取消，中断正在进行的发布和重试
+	cancel    context.CancelFunc
+	closeLock sync.RWMutex
+	closed    bool
+	done      chan struct{}
+	published atomic.Int64
+	failed    atomic.Int64
+	dropped   atomic.Int64
+}
+
+func NewPublisherSink(pub Publisher, cfg PublisherConfig) (*PublisherSink, error) {
+	if pub == nil {
+		return nil, errors.New("publisher can't be null")
+	}
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	topic, err := template.New("topic").Option("missingkey=error").Parse(cfg.Topic)
+	if err != nil {
+		return nil, errors.Wrap(err, "topic template")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &PublisherSink{
+		cfg:    cfg,
+		pub:    pub,
+		topic:  topic,
+		queue:  make(chan SendOut, cfg.QueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *PublisherSink) Send(out SendOut) {
+	p.closeLock.RLock()
+	defer p.closeLock.RUnlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.queue <- out:
+	default:
+		p.dropped.Add(1)
+		util.Warnw("publisher_queue_full", "key", out.Key, "status", out.Status)
+	}
+}
+
+/*
+停止接收事件，在ctx截止前发布完队列中的事件，之后关闭Publisher
+*/
+func (p *PublisherSink) Close(ctx context.Context) error {
+	p.closeLock.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.closeLock.Unlock()
+	var err error
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		p.cancel()
+		<-p.done
+		err = ctx.Err()
+	}
+	if cerr := p.pub.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (p *PublisherSink) Stats() PublisherStats {
+	return PublisherStats{
+		Published: p.published.Load(),
+		Failed:    p.failed.Load(),
+		Dropped:   p.dropped.Load(),
+	}
+}
+
+func (p *PublisherSink) run() {
+	defer close(p.done)
+	for out := range p.queue {
+		msg, err := p.message(out)
+		if err != nil {
+			p.dropped.Add(1)
+			util.Errorw("publisher_encode", "key", out.Key, "error", err)
+			continue
+		}
+		if err := p.publish(msg); err != nil {
+			p.failed.Add(1)
+			util.Warnw("publisher_failed", "topic", msg.Topic, "key", msg.Key, "error", err)
+			continue
+		}
+		p.published.Add(1)
+	}
+}
+
+func (p *PublisherSink) message(out SendOut) (Message, error) {
+	nameSpace, _ := util.SplitResourceCacheKey(out.Key)
+	if nameSpace == "" {
+		nameSpace = ClusterScopedNamespace
+	}
+	topic := &strings.Builder{}
+	err := p.topic.Execute(topic, TopicData{
+		Kind:      string(out.Kind),
+		Namespace: nameSpace,
+		Name:      out.Name,
+		Status:    string(out.Status),
+		Type:      string(out.Type),
+		Cluster:   eventCluster(out, p.cfg.Cluster),
+	})
+	if err != nil {
+		return Message{}, errors.Wrap(err, "render topic")
+	}
+	// nats的subject不允许空的token，其他消息队列也不应出现这样的topic
+	for _, token := range strings.Split(topic.String(), ".") {
+		if token == "" {
+			return Message{}, errors.Errorf("topic %q has an empty segment", topic.String())
+		}
+	}
+	header, body, err := p.cfg.Encoder.Encode(out)
+	if err != nil {
+		return Message{}, err
+	}
+	headers := make(map[string]string, len(header))
+	for k := range header {
+		headers[k] = header.Get(k)
+	}
+	return Message{Topic: topic.String(), Key: out.Key, Headers: headers, Body: body}, nil
+}
+
+// 按指数退避重试
+func (p *PublisherSink) publish(msg Message) error {
+	backoff := p.cfg.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(p.ctx, p.cfg.Timeout)
+		err := p.pub.Publish(ctx, msg)
+		cancel()
+		if err == nil || attempt >= p.cfg.MaxRetries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-p.ctx.Done():
+			return errors.Wrap(p.ctx.Err(), err.Error())
+		}
+		backoff *= 2
+		if backoff > p.cfg.MaxBackoff {
+			backoff = p.cfg.MaxBackoff
+		}
+	}
+}
+
+/*
+按key计算分区，用于本身没有分区概念的消息队列（nats、redis streams）
+把同一资源的消息固定发到 n 个subject/stream中的一个
+*/
+func PartitionOf(key string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
@@ -0,0 +1,258 @@
+package sender
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
+)
+
+// 内存中的Publisher，fail返回非nil时本次发布失败
+type memPublisher struct {
+	lock   sync.Mutex
+	fail   func(attempt int, msg Message) error // attempt为总的发布次数，从1开始
+	block  chan struct{}                        // 不为空时发布阻塞到channel关闭或者ctx结束
+	calls  int
+	times  []time.Time
+	msgs   []Message
+	closed bool
+}
+
+func (p *memPublisher) Publish(ctx context.Context, msg Message) error {
+	if p.block != nil {
+		select {
+		case <-p.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.calls++
+	p.times = append(p.times, time.Now())
+	if p.fail != nil {
+		if err := p.fail(p.calls, msg); err != nil {
+			return err
+		}
+	}
+	p.msgs = append(p.msgs, msg)
+	return nil
+}
+
+func (p *memPublisher) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *memPublisher) isClosed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.closed
+}
+
+func (p *memPublisher) snapshot() (calls int, times []time.Time, msgs []Message) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.calls, append([]time.Time{}, p.times...), append([]Message{}, p.msgs...)
+}
+
+func TestPublisherSinkMessage(t *testing.T) {
+	pub := &memPublisher{}
+	sink, err := NewPublisherSink(pub, PublisherConfig{
+		Topic:   "{{.Cluster}}.{{.Kind}}.{{.Namespace}}.{{.Status}}",
+		Cluster: "fallback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Send(SendOut{Cluster: "a", Key: "default/web", Kind: constant.DeploymentKind, Name: "web", Status: constant.K8sResStatusFail})
+	sink.Send(SendOut{Key: "kube-system/dns", Kind: constant.PodKind, Name: "dns", Status: constant.K8sResStatusSucceed})
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, msgs := pub.snapshot()
+	if len(msgs) != 2 {
+		t.Fatalf("messages = %d, want 2", len(msgs))
+	}
+	want := []struct{ topic, key string }{
+		{"a." + string(constant.DeploymentKind) + ".default." + string(constant.K8sResStatusFail), "default/web"},
+		{"fallback." + string(constant.PodKind) + ".kube-system." + string(constant.K8sResStatusSucceed), "kube-system/dns"},
+	}
+	for i, w := range want {
+		if msgs[i].Topic != w.topic || msgs[i].Key != w.key {
+			t.Fatalf("message %d = %s %s, want %s %s", i, msgs[i].Topic, msgs[i].Key, w.topic, w.key)
+		}
+		if msgs[i].Headers["Content-Type"] != "application/json" || len(msgs[i].Body) == 0 {
+			t.Fatalf("message %d headers = %v, body = %q", i, msgs[i].Headers, msgs[i].Body)
+		}
+	}
+	if !pub.isClosed() {
+		t.Fatal("publisher should be closed")
+	}
+	if stats := sink.Stats(); stats.Published != 2 || stats.Failed != 0 || stats.Dropped != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestPublisherSinkInvalidTopic(t *testing.T) {
+	if _, err := NewPublisherSink(&memPublisher{}, PublisherConfig{Topic: "{{.Kind"}); err == nil {
+		t.Fatal("want error for invalid topic template")
+	}
+	// 模板中使用不存在的字段，渲染失败的事件计入丢弃
+	sink, err := NewPublisherSink(&memPublisher{}, PublisherConfig{Topic: "{{.Missing}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Send(SendOut{Key: "default/web", Kind: constant.DeploymentKind})
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := sink.Stats(); stats.Dropped != 1 {
+		t.Fatalf("stats = %+v, want 1 dropped", stats)
+	}
+}
+
+func TestPublisherSinkTopic(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		out      SendOut
+		want     string // 为空表示丢弃
+	}{
+		{"default", "", SendOut{Key: "default/web", Kind: constant.PodKind}, "kubewatcher.Pod.default"},
+		{"cluster scoped", "", SendOut{Key: "node-1", Kind: constant.PodKind}, "kubewatcher.Pod." + ClusterScopedNamespace},
+		{"empty segment", "{{.Cluster}}.{{.Kind}}", SendOut{Key: "default/web", Kind: constant.PodKind}, ""},
+		{"empty topic", "{{.Name}}", SendOut{Key: "default/web", Kind: constant.PodKind}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pub := &memPublisher{}
+			sink, err := NewPublisherSink(pub, PublisherConfig{Topic: c.template})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink.Send(c.out)
+			if err := sink.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			_, _, msgs := pub.snapshot()
+			if c.want == "" {
+				if stats := sink.Stats(); len(msgs) != 0 || stats.Dropped != 1 {
+					t.Fatalf("messages = %v, stats = %+v, want dropped", msgs, stats)
+				}
+				return
+			}
+			if len(msgs) != 1 || msgs[0].Topic != c.want {
+				t.Fatalf("messages = %v, want topic %s", msgs, c.want)
+			}
+		})
+	}
+}
+
+func TestPublisherSinkRetry(t *testing.T) {
+	cases := []struct {
+		name       string
+		maxRetries int
+		failures   int // 前几次发布失败
+		wantCalls  int
+		wantStats  PublisherStats
+	}{
+		{"recovers after retries", 3, 2, 3, PublisherStats{Published: 1}},
+		{"default retries", 0, 10, 4, PublisherStats{Failed: 1}},
+		{"no retry", NoRetry, 10, 1, PublisherStats{Failed: 1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pub := &memPublisher{fail: func(attempt int, _ Message) error {
+				if attempt <= c.failures {
+					return errors.New("broker unavailable")
+				}
+				return nil
+			}}
+			sink, err := NewPublisherSink(pub, PublisherConfig{
+				MaxRetries:     c.maxRetries,
+				InitialBackoff: 10 * time.Millisecond,
+				MaxBackoff:     15 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink.Send(SendOut{Key: "default/web", Kind: constant.DeploymentKind})
+			if err := sink.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			calls, times, _ := pub.snapshot()
+			if calls != c.wantCalls {
+				t.Fatalf("publish calls = %d, want %d", calls, c.wantCalls)
+			}
+			// 等待时间依次为10ms、15ms（20ms被MaxBackoff限制）
+			for i := 1; i < len(times); i++ {
+				want := 10 * time.Millisecond
+				if i > 1 {
+					want = 15 * time.Millisecond
+				}
+				if gap := times[i].Sub(times[i-1]); gap < want {
+					t.Fatalf("backoff before retry %d = %v, want >= %v", i, gap, want)
+				}
+			}
+			if stats := sink.Stats(); stats != c.wantStats {
+				t.Fatalf("stats = %+v, want %+v", stats, c.wantStats)
+			}
+		})
+	}
+}
+
+func TestPublisherSinkQueueFullAndCloseTimeout(t *testing.T) {
+	pub := &memPublisher{block: make(chan struct{})}
+	sink, err := NewPublisherSink(pub, PublisherConfig{QueueSize: 1, MaxRetries: NoRetry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Send(SendOut{Key: "default/a", Kind: constant.PodKind})
+	// 第一个事件被取出后阻塞在发布上，队列中最多再放一个
+	waitFor(t, func() bool { return len(sink.queue) == 0 })
+	sink.Send(SendOut{Key: "default/b", Kind: constant.PodKind})
+	sink.Send(SendOut{Key: "default/c", Kind: constant.PodKind})
+	if stats := sink.Stats(); stats.Dropped != 1 {
+		t.Fatalf("stats = %+v, want 1 dropped", stats)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sink.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("close error = %v, want DeadlineExceeded", err)
+	}
+	if !pub.isClosed() {
+		t.Fatal("publisher should be closed after timeout")
+	}
+	if stats := sink.Stats(); stats.Published != 0 || stats.Failed != 2 {
+		t.Fatalf("stats = %+v, want 2 failed after close timeout", stats)
+	}
+	sink.Send(SendOut{Key: "default/d", Kind: constant.PodKind}) // 关闭后直接忽略
+}
+
+func TestPartitionOf(t *testing.T) {
+	if PartitionOf("default/web", 1) != 0 || PartitionOf("default/web", 0) != 0 {
+		t.Fatal("single partition should be 0")
+	}
+	seen := map[int]bool{}
+	for _, key := range []string{"default/a", "default/b", "default/c", "default/d", "default/e", "default/f", "default/g", "default/h"} {
+		p := PartitionOf(key, 4)
+		if p < 0 || p >= 4 {
+			t.Fatalf("partition of %s = %d, out of range", key, p)
+		}
+		if PartitionOf(key, 4) != p {
+			t.Fatalf("partition of %s is not stable", key)
+		}
+		seen[p] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("keys should spread over partitions, got %v", seen)
+	}
+}
@@ -0,0 +1,86 @@
+package redisstream
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sunreaver/kubewatcher/sender"
+)
+
+const (
+	FieldKey  = "key"  // 资源key
+	FieldBody = "body" // 编码后的事件
+	// 编码产生的头以 header: 为前缀写入，例如 header:Content-Type
+	FieldHeaderPrefix = "header:"
+
+	defaultMaxLen = 100000
+)
+
+type Config struct {
+	MaxLen     int64 // stream的近似长度上限（XADD MAXLEN ~） 默认100000，负数表示不裁剪
+	Partitions int   // 大于1时stream名追加 :<分区号>，同一资源固定在同一个stream上
+}
+
+/*
+以XADD发布到redis streams，stream名由topic模板渲染
+单个stream内天然有序，开启分区时同一资源固定在一个stream上
+*/
+type Publisher struct {
+	client  redis.UniversalClient
+	cfg     Config
+	ownConn bool
+}
+
+// 创建redis客户端并创建Publisher，Close时关闭客户端
+func Connect(opts *redis.UniversalOptions, cfg Config) (*Publisher, error) {
+	if opts == nil {
+		return nil, errors.New("redis options can't be null")
+	}
+	p, err := NewPublisher(redis.NewUniversalClient(opts), cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.ownConn = true
+	return p, nil
+}
+
+// 使用已有的客户端，Close时不会关闭客户端
+func NewPublisher(client redis.UniversalClient, cfg Config) (*Publisher, error) {
+	if client == nil {
+		return nil, errors.New("redis client can't be null")
+	}
+	if cfg.Partitions < 0 {
+		return nil, errors.New("partitions can't be negative")
+	}
+	if cfg.MaxLen == 0 {
+		cfg.MaxLen = defaultMaxLen
+	}
+	return &Publisher{client: client, cfg: cfg}, nil
+}
+
+func (p *Publisher) Publish(ctx context.Context, msg sender.Message) error {
+	stream := msg.Topic
+	if p.cfg.Partitions > 1 {
+		stream += ":" + strconv.Itoa(sender.PartitionOf(msg.Key, p.cfg.Partitions))
+	}
+	values := make([]interface{}, 0, 4+2*len(msg.Headers))
+	values = append(values, FieldKey, msg.Key, FieldBody, msg.Body)
+	for k, v := range msg.Headers {
+		values = append(values, FieldHeaderPrefix+k, v)
+	}
+	args := &redis.XAddArgs{Stream: stream, Values: values}
+	if p.cfg.MaxLen > 0 {
+		args.MaxLen = p.cfg.MaxLen
+		args.Approx = true
+	}
+	return p.client.XAdd(ctx, args).Err()
+}
+
+func (p *Publisher) Close() error {
+	if !p.ownConn {
+		return nil
+	}
+	return p.client.Close()
+}
@@ -0,0 +1,150 @@
+package redisstream
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/sender"
+)
+
+func newTestPublisher(t *testing.T, cfg Config) (*miniredis.Miniredis, *redis.Client, *Publisher) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	p, err := NewPublisher(client, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mr, client, p
+}
+
+func TestPublisherSinkToStream(t *testing.T) {
+	_, client, p := newTestPublisher(t, Config{})
+	sink, err := sender.NewPublisherSink(p, sender.PublisherConfig{Cluster: "cluster-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []constant.K8sResStatus{constant.K8sResStatusFail, constant.K8sResStatusSucceed} {
+		sink.Send(sender.SendOut{Key: "default/web", Kind: constant.DeploymentKind, Name: "web", Status: status})
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := sink.Stats(); stats.Published != 2 {
+		t.Fatalf("stats = %+v, want 2 published", stats)
+	}
+
+	stream := "kubewatcher." + string(constant.DeploymentKind) + ".default"
+	entries, err := client.XRange(context.Background(), stream, "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("entries = %d, want 2", len(entries))
+	}
+	for i, status := range []constant.K8sResStatus{constant.K8sResStatusFail, constant.K8sResStatusSucceed} {
+		values := entries[i].Values
+		if values[FieldKey] != "default/web" || values[FieldHeaderPrefix+"Content-Type"] != "application/json" {
+			t.Fatalf("entry %d = %v", i, values)
+		}
+		var out sender.SendOut
+		if err := json.Unmarshal([]byte(values[FieldBody].(string)), &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Status != status || out.Key != "default/web" {
+			t.Fatalf("entry %d body = %+v, want status %s", i, out, status)
+		}
+	}
+	// 使用外部客户端时Close不会关闭客户端
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Fatalf("client should stay open: %v", err)
+	}
+}
+
+func TestPublisherPartitions(t *testing.T) {
+	_, client, p := newTestPublisher(t, Config{Partitions: 4})
+	ctx := context.Background()
+	keys := []string{"default/a", "default/b", "default/c", "default/d", "default/e", "default/f"}
+	for _, key := range keys {
+		for i := 0; i < 2; i++ {
+			if err := p.Publish(ctx, sender.Message{Topic: "events", Key: key, Body: []byte(key)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, key := range keys {
+		stream := "events:" + strconv.Itoa(sender.PartitionOf(key, 4))
+		entries, err := client.XRange(ctx, stream, "-", "+").Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, e := range entries {
+			if e.Values[FieldKey] == key {
+				n++
+			}
+		}
+		if n != 2 {
+			t.Fatalf("%s has %d entries in %s, want 2", key, n, stream)
+		}
+	}
+	if n, _ := client.Exists(ctx, "events").Result(); n != 0 {
+		t.Fatal("partitioned publisher should not write the unpartitioned stream")
+	}
+}
+
+func TestPublisherMaxLen(t *testing.T) {
+	_, client, p := newTestPublisher(t, Config{MaxLen: 5})
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		if err := p.Publish(ctx, sender.Message{Topic: "events", Key: "default/web", Body: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// MAXLEN ~ 是近似裁剪，只要求不会无限增长
+	n, err := client.XLen(ctx, "events").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 5 || n >= 20 {
+		t.Fatalf("stream length = %d, want trimmed to about 5", n)
+	}
+}
+
+// redis不可用时返回错误，由PublisherSink重试
+func TestPublisherRedisDown(t *testing.T) {
+	mr, _, p := newTestPublisher(t, Config{})
+	mr.Close()
+	if err := p.Publish(context.Background(), sender.Message{Topic: "events", Key: "default/web"}); err == nil {
+		t.Fatal("want error when redis is down")
+	}
+}
+
+func TestConnectOwnsClient(t *testing.T) {
+	mr := miniredis.RunT(t)
+	p, err := Connect(&redis.UniversalOptions{Addrs: []string{mr.Addr()}}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(context.Background(), sender.Message{Topic: "events", Key: "default/web"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.client.Ping(context.Background()).Err(); err != redis.ErrClosed {
+		t.Fatalf("ping after close = %v, want ErrClosed", err)
+	}
+	if _, err := Connect(nil, Config{}); err == nil {
+		t.Fatal("want error for nil options")
+	}
+	if _, err := NewPublisher(redis.NewClient(&redis.Options{Addr: mr.Addr()}), Config{Partitions: -1}); err == nil {
+		t.Fatal("want error for negative partitions")
+	}
+}
@@ -2,72 +2,379 @@ package sender
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 
 	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/util"
 )
 
 // 各字段与cache.go中基本一致
 type SendOut struct {
-	Key           string
-	Kind          constant.K8sResKind
-	Name          string
-	Status        constant.K8sResStatus
-	Reason        string
-	ControllerKey string
-	Meta          interface{}
+	Cluster       string                `json:"cluster,omitempty"` // 所属集群，即watcher的platform
+	Key           string                `json:"key"`
+	Kind          constant.K8sResKind   `json:"kind"`
+	Type          constant.EventType    `json:"type"` // 事件类型 默认为状态变化
+	Name          string                `json:"name"`
+	Status        constant.K8sResStatus `json:"status"`
+	Reason        string                `json:"reason,omitempty"`
+	ControllerKey string                `json:"controllerKey,omitempty"`
+	Meta          interface{}           `json:"meta,omitempty"` // 默认为*appv1.Deployment或*corev1.Pod，可以通过AsPod、AsDeployment获取，内容受MetaProjection控制
+}
+
+/*
+事件所属的集群，事件没有Cluster（watcher没有设置集群名）时使用sink配置的集群名
+通过Manager.AddSink共用的sink会收到多个集群的事件，需要以事件中的Cluster为准
+*/
+func eventCluster(out SendOut, fallback string) string {
+	if out.Cluster != "" {
+		return out.Cluster
+	}
+	return fallback
+}
+
+// 跨集群唯一的资源标识，共用的sink按它保存每个资源的状态
+func resourceID(out SendOut) string {
+	return out.Cluster + "/" + out.Key
 }
 
 type Sender struct {
-	podCallback []func(SendOut) // 存储pod类型回调方法
-	depCallback []func(SendOut) // 存储deployment类型回调方法
-	ch          chan SendOut    // 存储消息
+	subLock     sync.RWMutex
+	subscribers []*subscriber // 订阅者，按照资源类型和事件类型过滤后回调
+	ch          chan SendOut  // 存储消息
+	policyLock  sync.RWMutex
+	policy      *notifyPolicy   // 通知策略 nil表示直接推送
+	projection  atomic.Int32    // SendOut.Meta的投影方式 见MetaProjection
+	observers   []func(SendOut) // 在通知策略之前同步调用，用于统计原始的状态变化
+	cluster     string          // 写入每个事件的Cluster，在Start之前设置
+	standby     atomic.Bool     // 备用状态，事件不推送给订阅者，用于多副本选主
+
+	started   atomic.Bool
+	stopOnce  sync.Once
+	stopCh    chan struct{}   // 请求优雅停止
+	stopCtx   context.Context // 优雅停止的截止时间，在close(stopCh)之前设置
+	closeOnce sync.Once
+	closed    chan struct{} // 关闭后不再接收新事件，阻塞在AddSendOut上的调用会返回
+	finished  chan struct{} // 推送协程已退出且订阅者都已关闭
+	dropped   atomic.Int64  // 未能推送给订阅者的事件数
 }
 
+const DefaultSenderBuffer = 10 // 等待推送的事件队列长度
+
 func NewSender() *Sender {
+	return NewSenderWithBuffer(DefaultSenderBuffer)
+}
+
+/*
+指定等待推送的事件队列长度，队列满时状态机会阻塞等待订阅者
+size小于1时使用DefaultSenderBuffer
+*/
+func NewSenderWithBuffer(size int) *Sender {
+	if size < 1 {
+		size = DefaultSenderBuffer
+	}
 	return &Sender{
-		podCallback: []func(SendOut){},
-		depCallback: []func(SendOut){},
-		ch:          make(chan SendOut, 10),
+		subscribers: []*subscriber{},
+		ch:          make(chan SendOut, size),
+		stopCh:      make(chan struct{}),
+		closed:      make(chan struct{}),
+		finished:    make(chan struct{}),
 	}
 }
 
 func NewSenderWithCBFn(podCallback, depCallback []func(SendOut)) *Sender {
-	return &Sender{
-		podCallback: podCallback,
-		depCallback: depCallback,
-		ch:          make(chan SendOut, 10),
-	}
+	s := NewSender()
+	s.AddPodCallback(podCallback...)
+	s.AddDepCallback(depCallback...)
+	return s
 }
 
 func (s *Sender) AddPodCallback(fn ...func(out SendOut)) {
-	s.podCallback = append(s.podCallback, fn...)
+	for _, f := range fn {
+		s.Subscribe(f, WithKinds(constant.PodKind))
+	}
 }
 
 func (s *Sender) AddDepCallback(fn ...func(out SendOut)) {
-	s.depCallback = append(s.depCallback, fn...)
+	for _, f := range fn {
+		s.Subscribe(f, WithKinds(constant.DeploymentKind))
+	}
+}
+
+/*
+订阅事件，默认订阅所有资源类型的StatusChange、Flapping事件
+通过WithKinds、WithEventTypes、WithReasonChange调整订阅范围
+*/
+func (s *Sender) Subscribe(fn func(out SendOut), opts ...SubscribeOption) {
+	s.addSubscriber(newSubscriber(fn, opts...))
+}
+
+func (s *Sender) addSubscriber(sub *subscriber) {
+	s.subLock.Lock()
+	defer s.subLock.Unlock()
+	s.subscribers = append(s.subscribers, sub)
+}
+
+func (s *Sender) getSubscribers() []*subscriber {
+	s.subLock.RLock()
+	defer s.subLock.RUnlock()
+	return s.subscribers
+}
+
+// 设置通知策略，替换掉旧策略时旧策略中等待的事件会被丢弃
+func (s *Sender) SetNotifyPolicy(p NotifyPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	s.policyLock.Lock()
+	old := s.policy
+	s.policy = newNotifyPolicy(p, s.push)
+	s.policyLock.Unlock()
+	if old != nil {
+		s.dropped.Add(int64(old.stop()))
+	}
+	return nil
+}
+
+// 设置推送时SendOut.Meta携带的对象数据
+func (s *Sender) SetMetaProjection(p MetaProjection) {
+	s.projection.Store(int32(p))
+}
+
+/*
+添加观察者，每个状态机产生的事件在经过通知策略之前都会同步调用观察者
+观察者不能阻塞，适合做统计
+*/
+func (s *Sender) AddObserver(fn ...func(out SendOut)) {
+	s.subLock.Lock()
+	defer s.subLock.Unlock()
+	s.observers = append(s.observers, fn...)
+}
+
+func (s *Sender) MetaProjection() MetaProjection {
+	return MetaProjection(s.projection.Load())
+}
+
+/*
+设置事件所属的集群，之后的每个事件都会带上Cluster
+需要在Start之前调用
+*/
+func (s *Sender) SetCluster(cluster string) {
+	s.cluster = cluster
+}
+
+func (s *Sender) Cluster() string {
+	return s.cluster
+}
+
+/*
+设置备用状态：备用时观察者照常调用，事件不经过通知策略也不推送给订阅者
+多副本部署时只有leader推送，其他副本保持缓存是最新的，随时可以接替
+*/
+func (s *Sender) SetStandby(standby bool) {
+	s.standby.Store(standby)
+}
+
+func (s *Sender) Standby() bool {
+	return s.standby.Load()
+}
+
+/*
+补发事件，不调用观察者，也不经过通知策略，直接推送给订阅者
+用于成为leader后补发当前的失败资源
+*/
+func (s *Sender) Replay(list ...SendOut) {
+	for _, out := range list {
+		if s.cluster != "" {
+			out.Cluster = s.cluster
+		}
+		out.Meta = ProjectMeta(out.Meta, MetaProjection(s.projection.Load()))
+		s.push(out)
+	}
 }
 
 func (s *Sender) AddSendOut(cache SendOut) {
-	s.ch <- cache
+	if s.cluster != "" {
+		cache.Cluster = s.cluster
+	}
+	s.subLock.RLock()
+	observers := s.observers
+	s.subLock.RUnlock()
+	for _, fn := range observers {
+		fn(cache)
+	}
+	if s.standby.Load() {
+		return
+	}
+	cache.Meta = ProjectMeta(cache.Meta, MetaProjection(s.projection.Load()))
+	s.policyLock.RLock()
+	policy := s.policy
+	s.policyLock.RUnlock()
+	if policy != nil {
+		policy.filter(cache)
+		return
+	}
+	s.push(cache)
+}
+
+// sender关闭后事件直接丢弃，不会阻塞调用方
+func (s *Sender) push(cache SendOut) {
+	select {
+	case <-s.closed:
+		s.dropped.Add(1)
+		return
+	default:
+	}
+	select {
+	case s.ch <- cache:
+	case <-s.closed:
+		s.dropped.Add(1)
+	}
+}
+
+// 推送协程是否在运行
+func (s *Sender) Running() bool {
+	if !s.started.Load() {
+		return false
+	}
+	select {
+	case <-s.finished:
+		return false
+	default:
+		return true
+	}
+}
+
+// 未能推送给订阅者的事件数
+func (s *Sender) Dropped() int {
+	return int(s.dropped.Load())
+}
+
+// 当前缓冲中等待推送的事件数
+func (s *Sender) Pending() int {
+	return len(s.ch)
+}
+
+// 缓冲的容量
+func (s *Sender) Capacity() int {
+	return cap(s.ch)
+}
+
+func (s *Sender) dispatch(sendOut SendOut) {
+	for _, sub := range s.getSubscribers() {
+		if sub.match(sendOut) {
+			sub.fn(sendOut)
+		}
+	}
+}
+
+// 停止接收新事件，丢弃通知策略中等待的事件
+func (s *Sender) closeInput() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.policyLock.RLock()
+		policy := s.policy
+		s.policyLock.RUnlock()
+		if policy != nil {
+			s.dropped.Add(int64(policy.stop()))
+		}
+	})
+}
+
+/*
+推送缓冲中剩余的事件，直到缓冲为空或者ctx超时，超时后剩余的事件计入丢弃数
+*/
+func (s *Sender) drain(ctx context.Context) {
+	s.closeInput()
+	for {
+		if ctx.Err() != nil {
+			s.dropped.Add(int64(len(s.ch)))
+			return
+		}
+		select {
+		case sendOut := <-s.ch:
+			s.dispatch(sendOut)
+		default:
+			return
+		}
+	}
+}
+
+// 通知所有订阅者sender已停止，批量订阅者借此投递剩余数据
+func (s *Sender) closeSubscribers(ctx context.Context) {
+	for _, sub := range s.getSubscribers() {
+		if sub.close == nil {
+			continue
+		}
+		if err := sub.close(ctx); err != nil {
+			util.Warnw("sender_close_subscriber", "error", err)
+		}
+	}
 }
 
+/*
+启动推送协程
+ctx结束视为立即停止，缓冲中的事件计入丢弃数；需要把缓冲中的事件推送完请使用Stop
+*/
 func (s *Sender) Start(ctx context.Context) {
+	if !s.started.CompareAndSwap(false, true) {
+		return
+	}
 	go func() {
+		defer close(s.finished)
 		for {
+			// 停止优先于推送，缓冲中还有事件时select随机选择，会在停止后继续推送
+			if s.stopped(ctx) {
+				return
+			}
 			select {
 			case sendOut := <-s.ch:
-				var funcList []func(SendOut)
-				if sendOut.Kind == constant.PodKind {
-					funcList = s.podCallback
-				} else if sendOut.Kind == constant.DeploymentKind {
-					funcList = s.depCallback
-				}
-				for _, fn := range funcList {
-					fn(sendOut)
-				}
+				s.dispatch(sendOut)
 			case <-ctx.Done():
-				return
+			case <-s.stopCh:
 			}
 		}
 	}()
 }
+
+// 检查是否需要停止，需要时处理缓冲中剩余的事件并关闭订阅者
+func (s *Sender) stopped(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		s.closeInput()
+		s.dropped.Add(int64(len(s.ch)))
+		s.closeSubscribers(ctx)
+		return true
+	case <-s.stopCh:
+		s.drain(s.stopCtx)
+		s.closeSubscribers(s.stopCtx)
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+优雅停止：不再接收新事件，在ctx截止前把缓冲中的事件推送给订阅者，并等待订阅者处理完
+返回值为整个生命周期中丢弃的事件数
+*/
+func (s *Sender) Stop(ctx context.Context) (int, error) {
+	s.stopOnce.Do(func() {
+		s.stopCtx = ctx
+		if !s.started.CompareAndSwap(false, true) {
+			close(s.stopCh)
+			return
+		}
+		// 从未启动过，没有推送协程，直接关闭
+		s.closeInput()
+		s.dropped.Add(int64(len(s.ch)))
+		s.closeSubscribers(ctx)
+		close(s.finished)
+	})
+	select {
+	case <-s.finished:
+		return s.Dropped(), nil
+	case <-ctx.Done():
+		return s.Dropped(), ctx.Err()
+	}
+}
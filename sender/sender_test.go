@@ -0,0 +1,179 @@
+package sender
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+)
+
+// 订阅者，block不为空时每次回调阻塞到channel关闭
+type blockingSubscriber struct {
+	lock  sync.Mutex
+	block chan struct{}
+	outs  []SendOut
+}
+
+func (s *blockingSubscriber) fn(out SendOut) {
+	if s.block != nil {
+		<-s.block
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.outs = append(s.outs, out)
+}
+
+func (s *blockingSubscriber) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.outs)
+}
+
+func TestSenderStopDrains(t *testing.T) {
+	s := NewSenderWithBuffer(10)
+	sub := &blockingSubscriber{}
+	s.Subscribe(sub.fn)
+	closed := false
+	s.SubscribeBatch(func([]SendOut) { closed = true }, 100, time.Hour)
+	s.Start(context.Background())
+	for i := 0; i < 5; i++ {
+		s.AddSendOut(numberedOut(i))
+	}
+	dropped, err := s.Stop(context.Background())
+	if err != nil || dropped != 0 {
+		t.Fatalf("stop = %d, %v, want 0, nil", dropped, err)
+	}
+	if n := sub.count(); n != 5 {
+		t.Fatalf("received %d, want all 5 buffered events", n)
+	}
+	if !closed {
+		t.Fatal("batch subscriber should be flushed on stop")
+	}
+	if s.Running() {
+		t.Fatal("sender should not be running after stop")
+	}
+
+	// 停止后的事件直接丢弃，不会阻塞
+	s.AddSendOut(numberedOut(5))
+	s.Replay(numberedOut(6))
+	if dropped, err := s.Stop(context.Background()); err != nil || dropped != 2 {
+		t.Fatalf("second stop = %d, %v, want 2, nil", dropped, err)
+	}
+}
+
+func TestSenderStopTimeout(t *testing.T) {
+	s := NewSenderWithBuffer(3)
+	sub := &blockingSubscriber{block: make(chan struct{})}
+	s.Subscribe(sub.fn)
+	s.Start(context.Background())
+	s.AddSendOut(numberedOut(0))
+	// 第一个事件被取出后阻塞在订阅者中，缓冲中再放满3个
+	waitFor(t, func() bool { return s.Pending() == 0 })
+	for i := 1; i <= 3; i++ {
+		s.AddSendOut(numberedOut(i))
+	}
+	if s.Pending() != s.Capacity() {
+		t.Fatalf("pending = %d, want buffer full", s.Pending())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := s.Stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("stop error = %v, want DeadlineExceeded", err)
+	}
+	if wait := time.Since(start); wait > time.Second {
+		t.Fatalf("stop returned after %v, want about the ctx timeout", wait)
+	}
+	if !s.Running() {
+		t.Fatal("sender is still blocked in the subscriber")
+	}
+
+	// 订阅者恢复后，超时的ctx不再推送缓冲中的事件，全部计入丢弃
+	close(sub.block)
+	waitFor(t, func() bool { return !s.Running() })
+	if n := sub.count(); n != 1 {
+		t.Fatalf("received %d, want only the event taken before stop", n)
+	}
+	if dropped := s.Dropped(); dropped != 3 {
+		t.Fatalf("dropped = %d, want 3", dropped)
+	}
+}
+
+func TestSenderStartCtxCancel(t *testing.T) {
+	s := NewSenderWithBuffer(2)
+	sub := &blockingSubscriber{block: make(chan struct{})}
+	s.Subscribe(sub.fn)
+	closed := make(chan struct{})
+	s.SubscribeBatch(func([]SendOut) {}, 100, time.Hour)
+	s.subscribers[len(s.subscribers)-1].close = func(context.Context) error {
+		close(closed)
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	s.AddSendOut(numberedOut(0))
+	waitFor(t, func() bool { return s.Pending() == 0 })
+	s.AddSendOut(numberedOut(1))
+	s.AddSendOut(numberedOut(2))
+
+	// ctx结束视为立即停止，缓冲中的事件不再推送
+	cancel()
+	close(sub.block)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscribers should be closed after ctx is done")
+	}
+	waitFor(t, func() bool { return !s.Running() })
+	if n := sub.count(); n != 1 {
+		t.Fatalf("received %d, want 1", n)
+	}
+	if dropped, err := s.Stop(context.Background()); err != nil || dropped != 2 {
+		t.Fatalf("stop = %d, %v, want 2, nil", dropped, err)
+	}
+}
+
+func TestSenderStopNeverStarted(t *testing.T) {
+	s := NewSenderWithBuffer(5)
+	rec := &batchRecorder{}
+	if err := s.SubscribeBatch(rec.fn, 10, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	s.AddSendOut(numberedOut(0))
+	s.AddSendOut(numberedOut(1))
+	if dropped, err := s.Stop(context.Background()); err != nil || dropped != 2 {
+		t.Fatalf("stop = %d, %v, want 2, nil", dropped, err)
+	}
+	if s.Running() {
+		t.Fatal("sender was never started")
+	}
+	// 停止后Start不会再启动推送协程
+	s.Start(context.Background())
+	if s.Running() {
+		t.Fatal("sender should not start after stop")
+	}
+	if sizes := rec.sizes(); len(sizes) != 0 {
+		t.Fatalf("batch sizes = %v, buffered events were never dispatched", sizes)
+	}
+}
+
+func TestSenderStopDropsPendingPolicy(t *testing.T) {
+	s := NewSender()
+	sub := &blockingSubscriber{}
+	s.Subscribe(sub.fn)
+	if err := s.SetNotifyPolicy(NotifyPolicy{PendingFor: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	s.Start(context.Background())
+	s.AddSendOut(numberedOut(0))
+	s.AddSendOut(SendOut{Key: "default/web", Kind: constant.DeploymentKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusSucceed})
+	if dropped, err := s.Stop(context.Background()); err != nil || dropped != 1 {
+		t.Fatalf("stop = %d, %v, want the pending failed dropped", dropped, err)
+	}
+	if n := sub.count(); n != 1 {
+		t.Fatalf("received %d, want only the succeed event", n)
+	}
+}
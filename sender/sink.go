@@ -0,0 +1,20 @@
+package sender
+
+import "context"
+
+/*
+外部推送目标，例如webhook、消息队列、文件等
+Send在sender的推送协程中被调用，实现方不应长时间阻塞，耗时操作应放到自己的队列中处理
+Close在sender停止时调用，实现方应在ctx截止前尽量把剩余数据处理完
+*/
+type Sink interface {
+	Send(out SendOut)
+	Close(ctx context.Context) error
+}
+
+// 添加推送目标，订阅范围同Subscribe
+func (s *Sender) AddSink(sink Sink, opts ...SubscribeOption) {
+	sub := newSubscriber(sink.Send, opts...)
+	sub.close = sink.Close
+	s.addSubscriber(sub)
+}
@@ -0,0 +1,71 @@
+package sender
+
+import (
+	"context"
+
+	"github.com/sunreaver/kubewatcher/constant"
+)
+
+// 默认订阅的事件类型，ReasonChange等需要订阅者主动开启
+var defaultEventTypes = []constant.EventType{constant.EventStatusChange, constant.EventFlapping}
+
+type subscriber struct {
+	fn    func(SendOut)
+	close func(ctx context.Context) error  // sender停止时调用，用于投递剩余数据 可以为nil
+	kinds map[constant.K8sResKind]struct{} // 订阅的资源类型 空表示全部
+	types map[constant.EventType]struct{}  // 订阅的事件类型
+}
+
+type SubscribeOption func(*subscriber)
+
+// 只订阅指定类型的资源
+func WithKinds(kinds ...constant.K8sResKind) SubscribeOption {
+	return func(s *subscriber) {
+		for _, k := range kinds {
+			s.kinds[k] = struct{}{}
+		}
+	}
+}
+
+// 订阅指定的事件类型，会替换掉默认的StatusChange、Flapping
+func WithEventTypes(types ...constant.EventType) SubscribeOption {
+	return func(s *subscriber) {
+		s.types = map[constant.EventType]struct{}{}
+		for _, t := range types {
+			s.types[t] = struct{}{}
+		}
+	}
+}
+
+// 在默认事件类型之外额外订阅reason变化事件
+func WithReasonChange() SubscribeOption {
+	return func(s *subscriber) {
+		s.types[constant.EventReasonChange] = struct{}{}
+	}
+}
+
+func newSubscriber(fn func(SendOut), opts ...SubscribeOption) *subscriber {
+	s := &subscriber{
+		fn:    fn,
+		kinds: map[constant.K8sResKind]struct{}{},
+		types: map[constant.EventType]struct{}{},
+	}
+	for _, t := range defaultEventTypes {
+		s.types[t] = struct{}{}
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *subscriber) match(out SendOut) bool {
+	if _, ok := s.types[out.Type]; !ok {
+		return false
+	}
+	if len(s.kinds) == 0 {
+		return true
+	}
+	_, ok := s.kinds[out.Kind]
+	return ok
+}
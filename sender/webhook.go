@@ -0,0 +1,334 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/util"
+)
+
+const (
+	WebhookSignatureHeader = "X-Kubewatcher-Signature" // 签名 格式为 sha256=hex(hmac(secret, timestamp + "." + body))
+	WebhookTimestampHeader = "X-Kubewatcher-Timestamp" // 签名使用的unix秒级时间戳
+
+	defaultWebhookTimeout        = 10 * time.Second
+	defaultWebhookMaxRetries     = 3
+	defaultWebhookInitialBackoff = 500 * time.Millisecond
+	defaultWebhookMaxBackoff     = 30 * time.Second
+	defaultWebhookQueueSize      = 1000
+
+	NoRetry = -1 // WebhookConfig、PublisherConfig的MaxRetries设置为NoRetry时失败后不重试，0表示使用默认值
+)
+
+type WebhookEndpoint struct {
+	URL     string
+	Headers map[string]string // 附加的请求头，例如Authorization
+	Secret  string            // 非空时使用HMAC-SHA256对请求签名
+}
+
+type WebhookConfig struct {
+	Endpoints          []WebhookEndpoint
+	Encoder            Encoder       // 请求编码 默认JSONEncoder，可以使用CloudEventsEncoder
+	Client             *http.Client  // 为空时使用默认client
+	Timeout            time.Duration // 单次请求超时 默认10s
+	MaxRetries         int           // 失败后最多重试几次 默认3次，小于0（NoRetry）表示不重试
+	InitialBackoff     time.Duration // 第一次重试的等待时间，之后每次翻倍 默认500ms
+	MaxBackoff         time.Duration // 重试等待时间上限 默认30s
+	QueueSize          int           // 待推送队列长度 默认1000，队列满时直接写入死信
+	DeadLetterPath     string        // 死信文件路径，为空则最终失败的事件只记录日志
+	DeadLetterMaxBytes int64         // 死信文件大小上限 默认10MB
+}
+
+func (c *WebhookConfig) setDefaults() error {
+	if len(c.Endpoints) == 0 {
+		return errors.New("webhook endpoints can't be empty")
+	}
+	for _, ep := range c.Endpoints {
+		u, err := url.Parse(ep.URL)
+		if err != nil {
+			return errors.Wrapf(err, "invalid webhook url %q", ep.URL)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return errors.Errorf("webhook url %q must be http or https", ep.URL)
+		}
+	}
+	if c.Timeout < 0 || c.InitialBackoff < 0 || c.MaxBackoff < 0 || c.QueueSize < 0 {
+		return errors.New("webhook config can't be negative")
+	}
+	if c.Encoder == nil {
+		c.Encoder = JSONEncoder{}
+	}
+	if c.Client == nil {
+		c.Client = &http.Client{}
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultWebhookTimeout
+	}
+	switch {
+	case c.MaxRetries == 0:
+		c.MaxRetries = defaultWebhookMaxRetries
+	case c.MaxRetries < 0:
+		c.MaxRetries = 0
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = defaultWebhookInitialBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = defaultWebhookMaxBackoff
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = defaultWebhookQueueSize
+	}
+	return nil
+}
+
+/*
+把事件编码后POST到配置的url，每个endpoint有自己的队列和推送协程
+失败按指数退避重试，重试在endpoint自己的协程中进行，不会阻塞sender的推送协程和其他endpoint
+最终失败的写入死信文件，可以通过Replay重放
+*/
+type WebhookSink struct {
+	cfg        WebhookConfig
+	workers    []*webhookWorker
+	deadLetter *deadLetterLog
+	ctx        context.Context // Close超时后取消，中断正在进行的请求和重试
+	cancel     context.CancelFunc
+	closeLock  sync.RWMutex
+	closed     bool
+	wg         sync.WaitGroup
+	sent       atomic.Int64
+	failed     atomic.Int64
+}
+
+// 单个endpoint的待推送队列
+type webhookWorker struct {
+	ep    WebhookEndpoint
+	queue chan webhookRequest
+}
+
+// 编码后的请求，所有endpoint共用
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func NewWebhookSink(cfg WebhookConfig) (*WebhookSink, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &WebhookSink{
+		cfg:    cfg,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if cfg.DeadLetterPath != "" {
+		w.deadLetter = newDeadLetterLog(cfg.DeadLetterPath, cfg.DeadLetterMaxBytes)
+	}
+	for _, ep := range cfg.Endpoints {
+		worker := &webhookWorker{ep: ep, queue: make(chan webhookRequest, cfg.QueueSize)}
+		w.workers = append(w.workers, worker)
+		w.wg.Add(1)
+		go w.run(worker)
+	}
+	return w, nil
+}
+
+// 编码后放入每个endpoint的队列，某个endpoint的队列满时该endpoint的请求直接写入死信
+func (w *WebhookSink) Send(out SendOut) {
+	w.closeLock.RLock()
+	defer w.closeLock.RUnlock()
+	if w.closed {
+		return
+	}
+	header, body, err := w.cfg.Encoder.Encode(out)
+	if err != nil {
+		util.Errorw("webhook_encode", "key", out.Key, "error", err)
+		return
+	}
+	for _, worker := range w.workers {
+		select {
+		case worker.queue <- webhookRequest{header: header, body: body}:
+		default:
+			w.fail(worker.ep, header, body, errors.New("webhook queue full"))
+		}
+	}
+}
+
+/*
+停止接收事件，在ctx截止前推送完队列中的事件，超时后剩余的事件写入死信
+*/
+func (w *WebhookSink) Close(ctx context.Context) error {
+	w.closeLock.Lock()
+	if !w.closed {
+		w.closed = true
+		for _, worker := range w.workers {
+			close(worker.queue)
+		}
+	}
+	w.closeLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		w.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// 推送成功和最终失败的请求数
+func (w *WebhookSink) Stats() (sent, failed int64) {
+	return w.sent.Load(), w.failed.Load()
+}
+
+/*
+重放死信文件中的请求，仍然失败的会重新写入死信文件
+每条死信推送成功或者重新写入死信文件后才会从死信文件中删除，ctx结束时剩余的死信保留到下次重放
+返回重放成功的数量
+*/
+func (w *WebhookSink) Replay(ctx context.Context) (int, error) {
+	if w.deadLetter == nil {
+		return 0, errors.New("dead letter is not configured")
+	}
+	endpoints := make(map[string]WebhookEndpoint, len(w.cfg.Endpoints))
+	for _, ep := range w.cfg.Endpoints {
+		endpoints[ep.URL] = ep
+	}
+	ok := 0
+	err := w.deadLetter.replay(func(dl DeadLetter) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ep, exist := endpoints[dl.Endpoint]
+		if !exist {
+			ep = WebhookEndpoint{URL: dl.Endpoint} // endpoint已从配置中移除，不带鉴权信息重放
+		}
+		if err := w.deliver(ctx, ep, dl.Header, dl.Body); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err() // 被中断的不算失败，留到下次重放
+			}
+			dl.Time = time.Now()
+			dl.Error = err.Error()
+			return errors.Wrap(w.deadLetter.write(dl), "rewrite dead letter")
+		}
+		ok++
+		return nil
+	})
+	return ok, err
+}
+
+func (w *WebhookSink) run(worker *webhookWorker) {
+	defer w.wg.Done()
+	for req := range worker.queue {
+		if err := w.deliver(w.ctx, worker.ep, req.header, req.body); err != nil {
+			w.fail(worker.ep, req.header, req.body, err)
+			continue
+		}
+		w.sent.Add(1)
+	}
+}
+
+func (w *WebhookSink) fail(ep WebhookEndpoint, header http.Header, body []byte, err error) {
+	w.failed.Add(1)
+	util.Warnw("webhook_failed", "endpoint", ep.URL, "error", err)
+	if w.deadLetter == nil {
+		return
+	}
+	dl := DeadLetter{
+		Time:     time.Now(),
+		Endpoint: ep.URL,
+		Error:    err.Error(),
+		Header:   header,
+		Body:     body,
+	}
+	if werr := w.deadLetter.write(dl); werr != nil {
+		util.Errorw("webhook_dead_letter", "endpoint", ep.URL, "error", werr)
+	}
+}
+
+// 推送一次请求，按指数退避重试，不可重试的错误直接返回
+func (w *WebhookSink) deliver(ctx context.Context, ep WebhookEndpoint, header http.Header, body []byte) error {
+	backoff := w.cfg.InitialBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = w.post(ctx, ep, header, body)
+		if err == nil || !retry || attempt >= w.cfg.MaxRetries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), err.Error())
+		}
+		backoff *= 2
+		if backoff > w.cfg.MaxBackoff {
+			backoff = w.cfg.MaxBackoff
+		}
+	}
+}
+
+// 返回值retry表示失败是否可以重试：网络错误、429、5xx可以重试
+func (w *WebhookSink) post(ctx context.Context, ep WebhookEndpoint, header http.Header, body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, w.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range ep.Headers {
+		req.Header.Set(k, v)
+	}
+	if ep.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, ts)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(ep.Secret, ts, body))
+	}
+	resp, err := w.cfg.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook %s response status %d", ep.URL, resp.StatusCode)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+/*
+计算webhook签名，接收方可以用同样的方法校验
+hex(hmac_sha256(secret, timestamp + "." + body))
+*/
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,380 @@
+package sender
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+)
+
+// 记录收到的请求，status决定每个请求的返回码
+type webhookRecorder struct {
+	lock   sync.Mutex
+	status func(n int, out SendOut) int // n为第几个请求，从1开始
+	times  []time.Time
+	keys   []string
+}
+
+func (r *webhookRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var out SendOut
+	if err := json.NewDecoder(req.Body).Decode(&out); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.lock.Lock()
+	r.times = append(r.times, time.Now())
+	r.keys = append(r.keys, out.Key)
+	n := len(r.keys)
+	r.lock.Unlock()
+	code := http.StatusOK
+	if r.status != nil {
+		code = r.status(n, out)
+	}
+	w.WriteHeader(code)
+}
+
+func (r *webhookRecorder) requests() ([]time.Time, []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]time.Time{}, r.times...), append([]string{}, r.keys...)
+}
+
+func webhookEvent(key string) SendOut {
+	return SendOut{Key: key, Kind: constant.PodKind, Name: key, Status: constant.K8sResStatusFail}
+}
+
+func readDeadLetters(t *testing.T, path string) []DeadLetter {
+	t.Helper()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	list := make([]DeadLetter, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			t.Fatalf("invalid dead letter %q: %v", scanner.Text(), err)
+		}
+		list = append(list, dl)
+	}
+	return list
+}
+
+func deadLetterKeys(t *testing.T, list []DeadLetter) []string {
+	t.Helper()
+	keys := make([]string, 0, len(list))
+	for _, dl := range list {
+		var out SendOut
+		if err := json.Unmarshal(dl.Body, &out); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, out.Key)
+	}
+	return keys
+}
+
+func TestWebhookSinkRetryBackoff(t *testing.T) {
+	rec := &webhookRecorder{status: func(n int, _ SendOut) int {
+		if n <= 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	sink, err := NewWebhookSink(WebhookConfig{
+		Endpoints:      []WebhookEndpoint{{URL: srv.URL}},
+		MaxRetries:     3,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     30 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Send(webhookEvent("default/a"))
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	times, _ := rec.requests()
+	if len(times) != 4 {
+		t.Fatalf("requests = %d, want 4", len(times))
+	}
+	// 等待时间依次为20ms、40ms（被MaxBackoff限制为30ms）、30ms
+	for i, want := range []time.Duration{20 * time.Millisecond, 30 * time.Millisecond, 30 * time.Millisecond} {
+		if gap := times[i+1].Sub(times[i]); gap < want {
+			t.Fatalf("backoff before retry %d = %v, want >= %v", i+1, gap, want)
+		}
+	}
+	if sent, failed := sink.Stats(); sent != 1 || failed != 0 {
+		t.Fatalf("stats = %d/%d, want 1/0", sent, failed)
+	}
+}
+
+func TestWebhookSinkRetryLimit(t *testing.T) {
+	cases := []struct {
+		name       string
+		maxRetries int
+		status     int
+		want       int // 请求次数
+	}{
+		{"default retries", 0, http.StatusInternalServerError, 4},
+		{"no retry", NoRetry, http.StatusInternalServerError, 1},
+		{"retry 429", 1, http.StatusTooManyRequests, 2},
+		{"client error is not retried", 3, http.StatusBadRequest, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rec := &webhookRecorder{status: func(int, SendOut) int { return c.status }}
+			srv := httptest.NewServer(rec)
+			defer srv.Close()
+			sink, err := NewWebhookSink(WebhookConfig{
+				Endpoints:      []WebhookEndpoint{{URL: srv.URL}},
+				MaxRetries:     c.maxRetries,
+				InitialBackoff: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink.Send(webhookEvent("default/a"))
+			if err := sink.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if _, keys := rec.requests(); len(keys) != c.want {
+				t.Fatalf("requests = %d, want %d", len(keys), c.want)
+			}
+			if sent, failed := sink.Stats(); sent != 0 || failed != 1 {
+				t.Fatalf("stats = %d/%d, want 0/1", sent, failed)
+			}
+		})
+	}
+}
+
+func TestWebhookSinkDeadLetter(t *testing.T) {
+	rec := &webhookRecorder{status: func(int, SendOut) int { return http.StatusBadGateway }}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "webhook.deadletter")
+	sink, err := NewWebhookSink(WebhookConfig{
+		Endpoints: []WebhookEndpoint{
+			{URL: srv.URL + "/a", Secret: "secret", Headers: map[string]string{"Authorization": "Bearer xxx"}},
+			{URL: srv.URL + "/b"},
+		},
+		MaxRetries:     NoRetry,
+		DeadLetterPath: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Send(webhookEvent("default/a"))
+	sink.Send(webhookEvent("default/b"))
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	list := readDeadLetters(t, path)
+	if len(list) != 4 {
+		t.Fatalf("dead letters = %d, want 4", len(list))
+	}
+	// 每个endpoint独立推送，不同endpoint的死信交错写入，同一endpoint内保持顺序
+	byEndpoint := map[string][]DeadLetter{}
+	for i, dl := range list {
+		if dl.Error == "" || dl.Time.IsZero() {
+			t.Fatalf("dead letter %d missing error or time: %+v", i, dl)
+		}
+		if dl.Header.Get("Authorization") != "" || dl.Header.Get(WebhookSignatureHeader) != "" {
+			t.Fatalf("dead letter %d keeps credentials: %v", i, dl.Header)
+		}
+		byEndpoint[dl.Endpoint] = append(byEndpoint[dl.Endpoint], dl)
+	}
+	for _, ep := range []string{srv.URL + "/a", srv.URL + "/b"} {
+		if keys := deadLetterKeys(t, byEndpoint[ep]); len(keys) != 2 || keys[0] != "default/a" || keys[1] != "default/b" {
+			t.Fatalf("dead letter keys of %s = %v", ep, keys)
+		}
+	}
+}
+
+func TestWebhookSinkReplay(t *testing.T) {
+	var down sync.Map // 仍然失败的key
+	rec := &webhookRecorder{status: func(_ int, out SendOut) int {
+		if _, exist := down.Load(out.Key); exist {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "webhook.deadletter")
+	sink, err := NewWebhookSink(WebhookConfig{
+		Endpoints:      []WebhookEndpoint{{URL: srv.URL}},
+		MaxRetries:     NoRetry,
+		DeadLetterPath: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"default/a", "default/b", "default/c"} {
+		down.Store(key, true)
+		sink.Send(webhookEvent(key))
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if list := readDeadLetters(t, path); len(list) != 3 {
+		t.Fatalf("dead letters = %d, want 3", len(list))
+	}
+
+	down.Delete("default/a")
+	down.Delete("default/c")
+	ok, err := sink.Replay(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != 2 {
+		t.Fatalf("replayed = %d, want 2", ok)
+	}
+	list := readDeadLetters(t, path)
+	if keys := deadLetterKeys(t, list); len(keys) != 1 || keys[0] != "default/b" {
+		t.Fatalf("dead letters after replay = %v, want [default/b]", keys)
+	}
+	if _, err := os.Stat(path + ".replay"); !os.IsNotExist(err) {
+		t.Fatalf("replay file should be removed, stat error = %v", err)
+	}
+
+	down.Delete("default/b")
+	if ok, err := sink.Replay(context.Background()); err != nil || ok != 1 {
+		t.Fatalf("second replay = %d, %v, want 1, nil", ok, err)
+	}
+	if list := readDeadLetters(t, path); len(list) != 0 {
+		t.Fatalf("dead letters after second replay = %d, want 0", len(list))
+	}
+}
+
+// 在收到响应后取消ctx
+type cancelTransport struct {
+	cancel context.CancelFunc
+}
+
+func (t cancelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	t.cancel()
+	return resp, err
+}
+
+// 重放中断时已推送的死信不再重放，未推送的保留到下次
+func TestWebhookSinkReplayInterrupted(t *testing.T) {
+	var failing sync.Map
+	failing.Store("all", true)
+	rec := &webhookRecorder{status: func(int, SendOut) int {
+		if _, exist := failing.Load("all"); exist {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "webhook.deadletter")
+	sink, err := NewWebhookSink(WebhookConfig{
+		Endpoints:      []WebhookEndpoint{{URL: srv.URL}},
+		MaxRetries:     NoRetry,
+		DeadLetterPath: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"default/a", "default/b", "default/c"} {
+		sink.Send(webhookEvent(key))
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if list := readDeadLetters(t, path); len(list) != 3 {
+		t.Fatalf("dead letters = %d, want 3", len(list))
+	}
+
+	failing.Delete("all")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink.cfg.Client = &http.Client{Transport: cancelTransport{cancel: cancel}}
+	ok, err := sink.Replay(ctx)
+	if err != context.Canceled {
+		t.Fatalf("interrupted replay error = %v, want context.Canceled", err)
+	}
+	if ok != 1 {
+		t.Fatalf("interrupted replay = %d, want 1", ok)
+	}
+	if _, err := os.Stat(path + ".replay"); err != nil {
+		t.Fatalf("replay file should be kept: %v", err)
+	}
+
+	sink.cfg.Client = &http.Client{}
+	if ok, err := sink.Replay(context.Background()); err != nil || ok != 2 {
+		t.Fatalf("resumed replay = %d, %v, want 2, nil", ok, err)
+	}
+	_, keys := rec.requests()
+	want := []string{"default/a", "default/b", "default/c", "default/a", "default/b", "default/c"}
+	if len(keys) != len(want) {
+		t.Fatalf("requests = %v, want %v", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("requests = %v, want %v", keys, want)
+		}
+	}
+	if list := readDeadLetters(t, path); len(list) != 0 {
+		t.Fatalf("dead letters after replay = %d, want 0", len(list))
+	}
+}
+
+// 一个endpoint重试时不阻塞调用方，也不阻塞其他endpoint
+func TestWebhookSinkSlowEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := &webhookRecorder{}
+	fastSrv := httptest.NewServer(fast)
+	defer fastSrv.Close()
+	sink, err := NewWebhookSink(WebhookConfig{
+		Endpoints:      []WebhookEndpoint{{URL: slow.URL}, {URL: fastSrv.URL}},
+		InitialBackoff: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		sink.Send(webhookEvent("default/web-" + strconv.Itoa(i)))
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Send blocked for %v", d)
+	}
+	waitFor(t, func() bool { _, keys := fast.requests(); return len(keys) == 5 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sink.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("close error = %v, want DeadlineExceeded", err)
+	}
+	if sent, failed := sink.Stats(); sent != 5 || failed != 5 {
+		t.Fatalf("stats = %d/%d, want 5 sent to the fast endpoint and 5 failed on the slow one", sent, failed)
+	}
+}
@@ -0,0 +1,422 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/sender"
+	"github.com/sunreaver/kubewatcher/util"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	defaultHistorySize  = 1000
+	defaultClientBuffer = 256
+	defaultKeepAlive    = 15 * time.Second
+	defaultWriteTimeout = 10 * time.Second
+)
+
+// 事件来源，*kubewatcher.K8sWatcher实现了该接口
+type Source interface {
+	Snapshot() []sender.SendOut
+	Subscribe(fn func(out sender.SendOut), opts ...sender.SubscribeOption)
+}
+
+// 推送给浏览器的事件，ID为递增的序号，用于Last-Event-ID断点续传
+type Event struct {
+	ID uint64 `json:"id"`
+	sender.SendOut
+}
+
+// websocket中的消息
+type wsMessage struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"` // snapshot或者event
+	Data interface{} `json:"data"`
+}
+
+type Option func(*Handler)
+
+// 内存中保留的历史事件数，超出的断点续传会退化为重新发送快照
+func WithHistorySize(n int) Option {
+	return func(h *Handler) {
+		if n > 0 {
+			h.historySize = n
+		}
+	}
+}
+
+// 每个连接的发送缓冲，缓冲满说明客户端太慢，断开连接让其续传
+func WithClientBuffer(n int) Option {
+	return func(h *Handler) {
+		if n > 0 {
+			h.clientBuffer = n
+		}
+	}
+}
+
+// SSE心跳间隔
+func WithKeepAlive(d time.Duration) Option {
+	return func(h *Handler) {
+		if d > 0 {
+			h.keepAlive = d
+		}
+	}
+}
+
+// websocket单条消息的写超时，客户端不读取导致写阻塞时断开连接
+func WithWriteTimeout(d time.Duration) Option {
+	return func(h *Handler) {
+		if d > 0 {
+			h.writeTimeout = d
+		}
+	}
+}
+
+/*
+允许跨域连接websocket的Origin，例如https://dashboard.example.com，"*"表示允许所有Origin
+默认只允许与请求Host相同的Origin；没有Origin的非浏览器客户端总是允许
+*/
+func WithAllowedOrigins(origins ...string) Option {
+	return func(h *Handler) {
+		for _, o := range origins {
+			h.origins = append(h.origins, strings.TrimSuffix(o, "/"))
+		}
+	}
+}
+
+type client struct {
+	filter filter
+	ch     chan Event
+	once   sync.Once
+	closed chan struct{} // 客户端太慢被踢掉
+}
+
+func (c *client) kick() {
+	c.once.Do(func() { close(c.closed) })
+}
+
+/*
+以SSE（以及可选的websocket）向浏览器推送事件
+连接时先推送当前状态快照，之后推送增量事件；支持kind、namespace、status、type查询参数过滤（逗号分隔多个值）
+type默认为StatusChange,Flapping，需要ReasonChange时显式指定
+SSE断线重连时浏览器会带上Last-Event-ID，websocket可以通过lastEventId查询参数续传
+*/
+type Handler struct {
+	src          Source
+	historySize  int
+	clientBuffer int
+	keepAlive    time.Duration
+	writeTimeout time.Duration
+	origins      []string // 额外允许的websocket Origin
+	ws           http.Handler
+
+	lock    sync.Mutex
+	seq     uint64
+	history []Event // 最近的事件，环形缓冲，写满后从head开始覆盖
+	head    int     // 写满后最早的事件的下标
+	clients map[*client]struct{}
+}
+
+func NewHandler(src Source, opts ...Option) *Handler {
+	h := &Handler{
+		src:          src,
+		historySize:  defaultHistorySize,
+		clientBuffer: defaultClientBuffer,
+		keepAlive:    defaultKeepAlive,
+		writeTimeout: defaultWriteTimeout,
+		clients:      map[*client]struct{}{},
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	// websocket.Handler拒绝没有Origin的请求，改为按照Origin策略检查
+	h.ws = websocket.Server{Handler: h.serveWebSocket, Handshake: h.checkOrigin}
+	src.Subscribe(h.publish, sender.WithEventTypes(constant.EventStatusChange, constant.EventFlapping, constant.EventReasonChange))
+	return h
+}
+
+func (h *Handler) publish(out sender.SendOut) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.seq++
+	ev := Event{ID: h.seq, SendOut: out}
+	if len(h.history) < h.historySize {
+		h.history = append(h.history, ev)
+	} else {
+		h.history[h.head] = ev
+		h.head = (h.head + 1) % len(h.history)
+	}
+	for c := range h.clients {
+		if !c.filter.match(out) {
+			continue
+		}
+		select {
+		case c.ch <- ev:
+		default:
+			c.kick()
+		}
+	}
+}
+
+// 第i个历史事件，0为最早的
+func (h *Handler) historyAt(i int) Event {
+	return h.history[(h.head+i)%len(h.history)]
+}
+
+/*
+注册客户端，并在同一把锁内确定需要先补发的内容，保证补发和增量之间不丢事件
+lastID仍在历史范围内时resumed为true，返回lastID之后的历史事件；否则返回快照以及快照对应的序号
+快照在锁外获取，避免阻塞publish；注册之后、获取快照之前的事件可能已经体现在快照中，仍会作为增量再推送一次
+*/
+func (h *Handler) register(f filter, lastID uint64, hasLastID bool) (c *client, resumed bool, snapshot []sender.SendOut, snapshotID uint64, backlog []Event) {
+	c = &client{filter: f, ch: make(chan Event, h.clientBuffer), closed: make(chan struct{})}
+	h.lock.Lock()
+	h.clients[c] = struct{}{}
+	if hasLastID && h.canResume(lastID) {
+		for i := range h.history {
+			if ev := h.historyAt(i); ev.ID > lastID && f.match(ev.SendOut) {
+				backlog = append(backlog, ev)
+			}
+		}
+		h.lock.Unlock()
+		return c, true, nil, 0, backlog
+	}
+	snapshotID = h.seq
+	h.lock.Unlock()
+
+	snapshot = make([]sender.SendOut, 0)
+	for _, out := range h.src.Snapshot() {
+		if f.match(out) {
+			snapshot = append(snapshot, out)
+		}
+	}
+	return c, false, snapshot, snapshotID, nil
+}
+
+// lastID之后的事件都还在历史中
+func (h *Handler) canResume(lastID uint64) bool {
+	if lastID > h.seq {
+		return false // 序号比当前还大，说明是上一个进程的序号
+	}
+	if lastID == h.seq {
+		return true
+	}
+	return len(h.history) > 0 && lastID+1 >= h.historyAt(0).ID
+}
+
+func (h *Handler) unregister(c *client) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.clients, c)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		h.ws.ServeHTTP(w, r)
+		return
+	}
+	h.serveSSE(w, r)
+}
+
+func (h *Handler) serveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	lastID, hasLastID := parseLastEventID(r.Header.Get("Last-Event-ID"))
+	if !hasLastID {
+		lastID, hasLastID = parseLastEventID(r.URL.Query().Get("lastEventId"))
+	}
+	c, resumed, snapshot, snapshotID, backlog := h.register(parseFilter(r), lastID, hasLastID)
+	defer h.unregister(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if !resumed {
+		if err := writeSSE(w, snapshotID, "snapshot", snapshot); err != nil {
+			return
+		}
+	}
+	for _, ev := range backlog {
+		if err := writeSSE(w, ev.ID, "event", ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(h.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-c.ch:
+			if err := writeSSE(w, ev.ID, "event", ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-c.closed:
+			util.Warnw("stream_client_too_slow", "remote", r.RemoteAddr)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, id uint64, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, b)
+	return err
+}
+
+/*
+websocket握手时检查Origin，返回错误时握手以403失败
+浏览器总会带上Origin，跨站页面只有在WithAllowedOrigins中才允许连接
+*/
+func (h *Handler) checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	config.Origin = origin
+	if origin == nil || strings.EqualFold(origin.Host, r.Host) {
+		return nil
+	}
+	for _, allowed := range h.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin.Scheme+"://"+origin.Host) {
+			return nil
+		}
+	}
+	util.Warnw("stream_websocket_origin_rejected", "origin", origin.String(), "host", r.Host, "remote", r.RemoteAddr)
+	return errors.Errorf("origin %s not allowed", origin)
+}
+
+// 带写超时发送一条websocket消息
+func (h *Handler) sendWebSocket(conn *websocket.Conn, msg wsMessage) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(h.writeTimeout)); err != nil {
+		return err
+	}
+	return websocket.JSON.Send(conn, msg)
+}
+
+func (h *Handler) serveWebSocket(conn *websocket.Conn) {
+	defer conn.Close()
+	r := conn.Request()
+	lastID, hasLastID := parseLastEventID(r.URL.Query().Get("lastEventId"))
+	c, resumed, snapshot, snapshotID, backlog := h.register(parseFilter(r), lastID, hasLastID)
+	defer h.unregister(c)
+
+	if !resumed {
+		if err := h.sendWebSocket(conn, wsMessage{ID: snapshotID, Type: "snapshot", Data: snapshot}); err != nil {
+			return
+		}
+	}
+	for _, ev := range backlog {
+		if err := h.sendWebSocket(conn, wsMessage{ID: ev.ID, Type: "event", Data: ev.SendOut}); err != nil {
+			return
+		}
+	}
+	// 读取协程只用于感知客户端断开
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		var discard []byte
+		for websocket.Message.Receive(conn, &discard) == nil {
+		}
+	}()
+	for {
+		select {
+		case ev := <-c.ch:
+			if err := h.sendWebSocket(conn, wsMessage{ID: ev.ID, Type: "event", Data: ev.SendOut}); err != nil {
+				util.Warnw("stream_websocket_send", "remote", r.RemoteAddr, "error", err)
+				return
+			}
+		case <-c.closed:
+			util.Warnw("stream_client_too_slow", "remote", r.RemoteAddr)
+			return
+		case <-gone:
+			return
+		}
+	}
+}
+
+func parseLastEventID(s string) (uint64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// 查询参数过滤条件，同一参数多个值为或，不同参数之间为与
+type filter struct {
+	kinds      map[string]struct{}
+	namespaces map[string]struct{}
+	statuses   map[string]struct{}
+	types      map[string]struct{}
+}
+
+func parseFilter(r *http.Request) filter {
+	q := r.URL.Query()
+	f := filter{
+		kinds:      parseSet(q["kind"]),
+		namespaces: parseSet(q["namespace"]),
+		statuses:   parseSet(q["status"]),
+		types:      parseSet(q["type"]),
+	}
+	if len(f.types) == 0 {
+		// 与Subscribe一致，ReasonChange需要通过type参数主动开启
+		f.types = parseSet([]string{string(constant.EventStatusChange), string(constant.EventFlapping)})
+	}
+	return f
+}
+
+func parseSet(values []string) map[string]struct{} {
+	set := map[string]struct{}{}
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				set[item] = struct{}{}
+			}
+		}
+	}
+	return set
+}
+
+func (f filter) match(out sender.SendOut) bool {
+	nameSpace, _ := util.SplitResourceCacheKey(out.Key)
+	return matchSet(f.kinds, string(out.Kind)) &&
+		matchSet(f.namespaces, nameSpace) &&
+		matchSet(f.statuses, string(out.Status)) &&
+		matchSet(f.types, string(out.Type))
+}
+
+func matchSet(set map[string]struct{}, v string) bool {
+	if len(set) == 0 {
+		return true
+	}
+	_, ok := set[v]
+	return ok
+}
@@ -0,0 +1,234 @@
+package stream
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/sender"
+	"golang.org/x/net/websocket"
+)
+
+type fakeSource struct {
+	list       []sender.SendOut
+	onSnapshot func() // 获取快照时调用
+}
+
+func (s *fakeSource) Snapshot() []sender.SendOut {
+	if s.onSnapshot != nil {
+		s.onSnapshot()
+	}
+	return s.list
+}
+
+func (s *fakeSource) Subscribe(fn func(out sender.SendOut), opts ...sender.SubscribeOption) {}
+
+func newTestServer(t *testing.T, opts ...Option) *httptest.Server {
+	t.Helper()
+	src := &fakeSource{list: []sender.SendOut{{Key: "default/web", Kind: constant.DeploymentKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusFail}}}
+	srv := httptest.NewServer(NewHandler(src, opts...))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// 手动发送websocket握手请求，返回响应状态码，origin为空时不带Origin头
+func handshake(t *testing.T, srv *httptest.Server, origin string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	cases := []struct {
+		name   string
+		opts   []Option
+		origin func(srv *httptest.Server) string
+		want   int
+	}{
+		{"no origin", nil, func(*httptest.Server) string { return "" }, http.StatusSwitchingProtocols},
+		{"same origin", nil, func(srv *httptest.Server) string { return srv.URL }, http.StatusSwitchingProtocols},
+		{"cross origin", nil, func(*httptest.Server) string { return "https://evil.example.com" }, http.StatusForbidden},
+		{"allowed origin", []Option{WithAllowedOrigins("https://dashboard.example.com/")},
+			func(*httptest.Server) string { return "https://Dashboard.example.com" }, http.StatusSwitchingProtocols},
+		{"other origin with allow list", []Option{WithAllowedOrigins("https://dashboard.example.com")},
+			func(*httptest.Server) string { return "http://dashboard.example.com" }, http.StatusForbidden},
+		{"any origin", []Option{WithAllowedOrigins("*")}, func(*httptest.Server) string { return "https://evil.example.com" }, http.StatusSwitchingProtocols},
+		{"invalid origin", nil, func(*httptest.Server) string { return "::" }, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := newTestServer(t, c.opts...)
+			if code := handshake(t, srv, c.origin(srv)); code != c.want {
+				t.Fatalf("status = %d, want %d", code, c.want)
+			}
+		})
+	}
+}
+
+func TestWebSocketSnapshot(t *testing.T) {
+	srv := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/events?status=" + string(constant.K8sResStatusFail)
+	conn, err := websocket.Dial(wsURL, "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var msg struct {
+		Type string           `json:"type"`
+		Data []sender.SendOut `json:"data"`
+	}
+	if err := websocket.JSON.Receive(conn, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "snapshot" || len(msg.Data) != 1 || msg.Data[0].Key != "default/web" {
+		t.Fatalf("message = %+v, want snapshot of default/web", msg)
+	}
+}
+
+func failedEvent(name string) sender.SendOut {
+	return sender.SendOut{Key: "default/" + name, Kind: constant.PodKind, Type: constant.EventStatusChange, Status: constant.K8sResStatusFail}
+}
+
+func TestHistoryRing(t *testing.T) {
+	h := NewHandler(&fakeSource{}, WithHistorySize(3))
+	for i := 1; i <= 5; i++ {
+		h.publish(failedEvent("web-" + strconv.Itoa(i)))
+	}
+	if len(h.history) != 3 {
+		t.Fatalf("history = %d, want 3", len(h.history))
+	}
+	for i := 0; i < 3; i++ {
+		if id := h.historyAt(i).ID; id != uint64(i+3) {
+			t.Fatalf("history[%d] = %d, want %d", i, id, i+3)
+		}
+	}
+	cases := []struct {
+		lastID  uint64
+		resumed bool
+		backlog []uint64
+	}{
+		{2, true, []uint64{3, 4, 5}},
+		{4, true, []uint64{5}},
+		{5, true, nil},
+		{1, false, nil}, // 事件2已经被覆盖
+		{9, false, nil}, // 上一个进程的序号
+	}
+	for _, c := range cases {
+		cl, resumed, _, snapshotID, backlog := h.register(filter{}, c.lastID, true)
+		h.unregister(cl)
+		if resumed != c.resumed || len(backlog) != len(c.backlog) {
+			t.Fatalf("lastID %d: resumed = %v, backlog = %v", c.lastID, resumed, backlog)
+		}
+		for i, ev := range backlog {
+			if ev.ID != c.backlog[i] {
+				t.Fatalf("lastID %d: backlog[%d] = %d, want %d", c.lastID, i, ev.ID, c.backlog[i])
+			}
+		}
+		if !resumed && snapshotID != 5 {
+			t.Fatalf("lastID %d: snapshot id = %d, want 5", c.lastID, snapshotID)
+		}
+	}
+}
+
+// 获取快照时不持有锁，期间发布的事件作为增量推送给新客户端
+func TestRegisterSnapshotOutsideLock(t *testing.T) {
+	src := &fakeSource{list: []sender.SendOut{failedEvent("web")}}
+	h := NewHandler(src)
+	h.publish(failedEvent("web"))
+	src.onSnapshot = func() { h.publish(failedEvent("api")) }
+
+	done := make(chan struct{})
+	var (
+		cl         *client
+		snapshot   []sender.SendOut
+		snapshotID uint64
+	)
+	go func() {
+		defer close(done)
+		cl, _, snapshot, snapshotID, _ = h.register(filter{}, 0, false)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("register blocked publish while taking the snapshot")
+	}
+	defer h.unregister(cl)
+	if snapshotID != 1 || len(snapshot) != 1 {
+		t.Fatalf("snapshot id = %d, snapshot = %v", snapshotID, snapshot)
+	}
+	select {
+	case ev := <-cl.ch:
+		if ev.ID != 2 || ev.Key != "default/api" {
+			t.Fatalf("event = %d %s, want 2 default/api", ev.ID, ev.Key)
+		}
+	default:
+		t.Fatal("event published during the snapshot was lost")
+	}
+}
+
+// 客户端不读取时写超时，服务端断开连接并注销客户端
+func TestWebSocketWriteTimeout(t *testing.T) {
+	h := NewHandler(&fakeSource{}, WithWriteTimeout(50*time.Millisecond), WithClientBuffer(1000))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/events", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var msg wsMessage
+	if err := websocket.JSON.Receive(conn, &msg); err != nil || msg.Type != "snapshot" {
+		t.Fatalf("message = %+v, %v, want snapshot", msg, err)
+	}
+
+	// 大量事件填满tcp缓冲，服务端写阻塞
+	out := failedEvent("web")
+	out.Reason = strings.Repeat("x", 64<<10)
+	for i := 0; i < 500; i++ {
+		h.publish(out)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.lock.Lock()
+		n := len(h.clients)
+		h.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client is still registered, write did not time out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,115 @@
+package kubewatcher
+
+import (
+	"github.com/pkg/errors"
+	appv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	defaultMaxAnnotationSize = 4 << 10
+
+	lastAppliedConfigAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+/*
+对象进入informer缓存前的精简配置，零值为默认配置：
+去掉managedFields、last-applied-configuration和超过4KiB的annotation，
+pod、deployment只保留节点、容器名和镜像等状态判断和精简信息用到的spec，replicaset只保留ownerReferences用于查找deployment
+*/
+type TransformConfig struct {
+	MaxAnnotationSize int      // 超过该长度的annotation被去掉 默认4KiB，小于0表示不限制
+	DropAnnotations   []string // 额外去掉的annotation
+	KeepSpec          bool     // 保留完整的spec，只去掉managedFields和annotation
+}
+
+/*
+生成informer的TransformFunc，同一个函数可以用于pod、deployment、replicaset的informer
+对象会被原地修改，informer传入的对象是刚解码出来的，不会影响其他使用者
+*/
+func NewTransform(cfg TransformConfig) cache.TransformFunc {
+	maxSize := cfg.MaxAnnotationSize
+	if maxSize == 0 {
+		maxSize = defaultMaxAnnotationSize
+	}
+	drop := make(map[string]struct{}, len(cfg.DropAnnotations)+1)
+	drop[lastAppliedConfigAnnotation] = struct{}{}
+	for _, name := range cfg.DropAnnotations {
+		drop[name] = struct{}{}
+	}
+	stripMeta := func(om *metav1.ObjectMeta) {
+		om.ManagedFields = nil
+		for k, v := range om.Annotations {
+			if _, exist := drop[k]; exist || (maxSize > 0 && len(v) > maxSize) {
+				delete(om.Annotations, k)
+			}
+		}
+	}
+	return func(obj interface{}) (interface{}, error) {
+		switch o := obj.(type) {
+		case *corev1.Pod:
+			stripMeta(&o.ObjectMeta)
+			if !cfg.KeepSpec {
+				o.Spec = compactPodSpec(o.Spec)
+			}
+		case *appv1.Deployment:
+			stripMeta(&o.ObjectMeta)
+			if !cfg.KeepSpec {
+				stripMeta(&o.Spec.Template.ObjectMeta)
+				o.Spec.Template.Spec = compactPodSpec(o.Spec.Template.Spec)
+			}
+		case *appv1.ReplicaSet:
+			stripMeta(&o.ObjectMeta)
+			if !cfg.KeepSpec {
+				o.Spec.Template = corev1.PodTemplateSpec{}
+			}
+		}
+		// 其他类型（包括cache.DeletedFinalStateUnknown）原样返回
+		return obj, nil
+	}
+}
+
+// 只保留节点和容器的名字、镜像，可以重复调用
+func compactPodSpec(spec corev1.PodSpec) corev1.PodSpec {
+	compact := func(containers []corev1.Container) []corev1.Container {
+		if len(containers) == 0 {
+			return nil
+		}
+		list := make([]corev1.Container, len(containers))
+		for i, c := range containers {
+			list[i] = corev1.Container{Name: c.Name, Image: c.Image}
+		}
+		return list
+	}
+	return corev1.PodSpec{
+		NodeName:       spec.NodeName,
+		Containers:     compact(spec.Containers),
+		InitContainers: compact(spec.InitContainers),
+	}
+}
+
+/*
+为pod、deployment、replicaset的informer设置TransformFunc，需要在informer启动前调用
+*/
+func (i *K8sWatcherInformer) SetTransform(fn cache.TransformFunc) error {
+	if i.DepInformer == nil {
+		return errors.New("DepInformer can't be null")
+	}
+	if err := i.DepInformer.SetTransform(fn); err != nil {
+		return errors.Wrap(err, "deployment informer")
+	}
+	// 只监控deployment时没有pod和replicaset的informer
+	if i.PodInformer != nil {
+		if err := i.PodInformer.SetTransform(fn); err != nil {
+			return errors.Wrap(err, "pod informer")
+		}
+	}
+	if i.RSInformer != nil {
+		if err := i.RSInformer.SetTransform(fn); err != nil {
+			return errors.Wrap(err, "replicaset informer")
+		}
+	}
+	return nil
+}
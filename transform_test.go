@@ -0,0 +1,117 @@
+package kubewatcher
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/sunreaver/kubewatcher/resource"
+	"github.com/sunreaver/kubewatcher/sender"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const benchPods = 10000
+
+// 接近真实集群的pod：带managedFields、last-applied-configuration和较多的env
+func newBenchPod(i int) *corev1.Pod {
+	env := make([]corev1.EnvVar, 20)
+	for j := range env {
+		env[j] = corev1.EnvVar{Name: fmt.Sprintf("ENV_%d", j), Value: strings.Repeat("v", 64)}
+	}
+	container := corev1.Container{
+		Name:    "app",
+		Image:   "registry.example.com/team/app:v1.2.3",
+		Command: []string{"/app", "--config", "/etc/app/config.yaml"},
+		Env:     env,
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "config", MountPath: "/etc/app"},
+			{Name: "data", MountPath: "/data"},
+		},
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      fmt.Sprintf("app-7d9f8c6b5-%05d", i),
+			Labels:    map[string]string{"app": "app", "pod-template-hash": "7d9f8c6b5"},
+			Annotations: map[string]string{
+				lastAppliedConfigAnnotation: strings.Repeat("x", 3000),
+				"team":                      "payment",
+			},
+			ManagedFields: []metav1.ManagedFieldsEntry{
+				{Manager: "kube-controller-manager", Operation: metav1.ManagedFieldsOperationUpdate, FieldsV1: &metav1.FieldsV1{Raw: []byte(strings.Repeat("f", 2000))}},
+				{Manager: "kubelet", Operation: metav1.ManagedFieldsOperationUpdate, FieldsV1: &metav1.FieldsV1{Raw: []byte(strings.Repeat("f", 2000))}},
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:       fmt.Sprintf("node-%d", i%100),
+			Containers:     []corev1.Container{container, container},
+			InitContainers: []corev1.Container{container},
+			Volumes: []corev1.Volume{
+				{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}}},
+				{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+/*
+模拟informer缓存和缓存树中保存的10k个pod：
+full: 不设置transform，informer缓存完整对象，Handle中DeepCopy后完整保存到缓存树
+transform: 设置NewTransform，缓存树只保存精简信息（MetaProjectionSummary），不再DeepCopy
+heap-MiB为两份缓存常驻的堆内存
+*/
+func BenchmarkPodCacheMemory(b *testing.B) {
+	cases := []struct {
+		name       string
+		transform  cache.TransformFunc
+		projection sender.MetaProjection
+	}{
+		{"full", nil, sender.MetaProjectionFull},
+		{"transform", NewTransform(TransformConfig{}), sender.MetaProjectionSummary},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var heap float64
+			for n := 0; n < b.N; n++ {
+				runtime.GC()
+				var before runtime.MemStats
+				runtime.ReadMemStats(&before)
+
+				store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+				keyCache := resource.NewResourceKeyCache()
+				keyCache.SetMetaProjection(c.projection)
+				metas := make([]interface{}, 0, benchPods)
+				for i := 0; i < benchPods; i++ {
+					var obj interface{} = newBenchPod(i)
+					if c.transform != nil {
+						var err error
+						if obj, err = c.transform(obj); err != nil {
+							b.Fatal(err)
+						}
+					}
+					if err := store.Add(obj); err != nil {
+						b.Fatal(err)
+					}
+					pod := obj.(*corev1.Pod)
+					if needDeepCopy(c.projection) {
+						pod = pod.DeepCopy()
+					}
+					metas = append(metas, keyCache.ProjectMeta(pod))
+				}
+
+				runtime.GC()
+				var after runtime.MemStats
+				runtime.ReadMemStats(&after)
+				heap += float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)) / (1 << 20)
+				runtime.KeepAlive(store)
+				runtime.KeepAlive(metas)
+			}
+			b.ReportMetric(heap/float64(b.N), "heap-MiB/10kpods")
+		})
+	}
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 )
 
@@ -20,3 +21,55 @@ func ConcatResourceCacheKey(nameSpace, resourceName string) string {
 func ParseResourceCacheKey(resourceCacheKey string) string {
 	return resourceCacheKey
 }
+
+var (
+	reasonTimeRegexp      = regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?( ?(Z|[+-]\d{2}:?\d{2}))?( [A-Z]{3,4}\b)?`)
+	reasonUIDRegexp       = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+	reasonHexRegexp       = regexp.MustCompile(`\b[0-9a-f]{32,64}\b`)
+	reasonPodNameRegexp   = regexp.MustCompile(`\b([a-z0-9]([-a-z0-9]*[a-z0-9])?)-[bcdfghjklmnpqrstvwxz2456789]{6,10}-[bcdfghjklmnpqrstvwxz2456789]{5}(_|\b)`)
+	reasonLocalAddrRegexp = regexp.MustCompile(`\b(\d{1,3}\.){3}\d{1,3}:\d+->`)
+	reasonIPRegexp        = regexp.MustCompile(`\b(\d{1,3}\.){3}\d{1,3}\b`)
+	reasonDurationRegexp  = regexp.MustCompile(`\b(\d+(\.\d+)?(ns|us|µs|ms|h|m|s))+\b`)
+)
+
+/*
+归一化失败原因，去掉时间戳、uid、容器id、pod名称中的随机后缀、ip、本地端口、back-off时长等易变部分
+用于判断两次原因是否真的不同，避免 "back-off 10s" -> "back-off 20s" 或者pod重建后名称、ip变化这类变化产生噪音
+*/
+func NormalizeReason(reason string) string {
+	reason = reasonTimeRegexp.ReplaceAllString(reason, "<time>")
+	reason = reasonUIDRegexp.ReplaceAllString(reason, "<uid>")
+	reason = reasonHexRegexp.ReplaceAllString(reason, "<id>")
+	reason = reasonPodNameRegexp.ReplaceAllString(reason, "${1}-<pod>${3}")
+	reason = reasonLocalAddrRegexp.ReplaceAllString(reason, "<ip>:<port>->")
+	reason = reasonIPRegexp.ReplaceAllString(reason, "<ip>")
+	reason = reasonDurationRegexp.ReplaceAllString(reason, "<duration>")
+	return reason
+}
+
+// 把资源key拆分为namespace和name，集群级别的资源namespace为空
+func SplitResourceCacheKey(resourceCacheKey string) (nameSpace, resourceName string) {
+	if i := strings.Index(resourceCacheKey, "/"); i >= 0 {
+		return resourceCacheKey[:i], resourceCacheKey[i+1:]
+	}
+	return "", resourceCacheKey
+}
+
+var reasonCategoryRegexp = regexp.MustCompile(`^[A-Za-z]+$`)
+
+/*
+从失败原因中提取k8s的reason作为分类，例如CrashLoopBackOff、ImagePullBackOff、ProgressDeadlineExceeded
+原因由ConcatReason(message, reason)拼接，多个原因以换行分隔，取第一个可识别的reason
+*/
+func ReasonCategory(reason string) string {
+	if reason == "" {
+		return "None"
+	}
+	for _, line := range strings.Split(reason, "\n") {
+		category := line[strings.LastIndex(line, "/")+1:]
+		if reasonCategoryRegexp.MatchString(category) {
+			return category
+		}
+	}
+	return "Other"
+}
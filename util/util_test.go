@@ -0,0 +1,148 @@
+package util
+
+import "testing"
+
+func TestNormalizeReason(t *testing.T) {
+	cases := []struct {
+		name   string
+		reason string
+		want   string
+	}{
+		{
+			name:   "crash loop back-off",
+			reason: "back-off 5m0s restarting failed container=web pod=web-7d4b9c8f6-x2x9z_default(3f1c2a4e-9b7d-4c1e-8f2a-1b2c3d4e5f60)/CrashLoopBackOff",
+			want:   "back-off <duration> restarting failed container=web pod=web-<pod>_default(<uid>)/CrashLoopBackOff",
+		},
+		{
+			name:   "container id",
+			reason: "containerd://3b1f2a4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708 exited with code 137/OOMKilled",
+			want:   "containerd://<id> exited with code 137/OOMKilled",
+		},
+		{
+			name:   "image digest",
+			reason: `Failed to pull image "nginx@sha256:0d17b565c37bcbd895e9d92315a05c1c3c9a29f762b011a10c54a66cd53c9b31": rpc error: code = NotFound/ErrImagePull`,
+			want:   `Failed to pull image "nginx@sha256:<id>": rpc error: code = NotFound/ErrImagePull`,
+		},
+		{
+			name:   "rfc3339 timestamp",
+			reason: "Pod sandbox changed at 2024-03-01T08:15:30Z, it will be killed and re-created./SandboxChanged",
+			want:   "Pod sandbox changed at <time>, it will be killed and re-created./SandboxChanged",
+		},
+		{
+			name:   "go time format",
+			reason: "container started at 2024-03-01 08:15:30.123456789 +0000 UTC and exited/Error",
+			want:   "container started at <time> and exited/Error",
+		},
+		{
+			name:   "probe target address",
+			reason: `Liveness probe failed: Get "http://10.244.1.5:8080/healthz": dial tcp 10.244.1.5:8080: connect: connection refused/Unhealthy`,
+			want:   `Liveness probe failed: Get "http://<ip>:8080/healthz": dial tcp <ip>:8080: connect: connection refused/Unhealthy`,
+		},
+		{
+			name:   "ephemeral local port",
+			reason: "Readiness probe failed: read tcp 10.244.0.1:52344->10.244.1.5:8080: read: connection reset by peer/Unhealthy",
+			want:   "Readiness probe failed: read tcp <ip>:<port>-><ip>:8080: read: connection reset by peer/Unhealthy",
+		},
+		{
+			name:   "progress deadline keeps replica set name",
+			reason: `ReplicaSet "web-7d4b9c8f6" has timed out progressing./ProgressDeadlineExceeded`,
+			want:   `ReplicaSet "web-7d4b9c8f6" has timed out progressing./ProgressDeadlineExceeded`,
+		},
+		{
+			name:   "statefulset pod keeps ordinal",
+			reason: "0/3 nodes are available: 3 Insufficient memory. preemption: 0/3 nodes are available for pod db-0/FailedScheduling",
+			want:   "0/3 nodes are available: 3 Insufficient memory. preemption: 0/3 nodes are available for pod db-0/FailedScheduling",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := NormalizeReason(c.reason); got != c.want {
+				t.Fatalf("NormalizeReason() =\n%s\nwant\n%s", got, c.want)
+			}
+		})
+	}
+}
+
+// 同一个故障的两次原因归一化后应当相同，不同的故障应当不同
+func TestNormalizeReasonCompare(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{
+			name: "back-off grows",
+			a:    "back-off 10s restarting failed container=web pod=web-7d4b9c8f6-x2x9z_default(3f1c2a4e-9b7d-4c1e-8f2a-1b2c3d4e5f60)/CrashLoopBackOff",
+			b:    "back-off 20s restarting failed container=web pod=web-7d4b9c8f6-x2x9z_default(3f1c2a4e-9b7d-4c1e-8f2a-1b2c3d4e5f60)/CrashLoopBackOff",
+			same: true,
+		},
+		{
+			name: "pod recreated",
+			a:    "back-off 5m0s restarting failed container=web pod=web-7d4b9c8f6-x2x9z_default(3f1c2a4e-9b7d-4c1e-8f2a-1b2c3d4e5f60)/CrashLoopBackOff",
+			b:    "back-off 40s restarting failed container=web pod=web-5f6b8c9d47-q8lmn_default(7a2e4c6d-1b3f-4a5c-9d8e-0f1a2b3c4d5e)/CrashLoopBackOff",
+			same: true,
+		},
+		{
+			name: "probe on new pod ip",
+			a:    `Liveness probe failed: Get "http://10.244.1.5:8080/healthz": dial tcp 10.244.1.5:8080: connect: connection refused/Unhealthy`,
+			b:    `Liveness probe failed: Get "http://10.244.2.17:8080/healthz": dial tcp 10.244.2.17:8080: connect: connection refused/Unhealthy`,
+			same: true,
+		},
+		{
+			name: "connection reset from another local port",
+			a:    "Readiness probe failed: read tcp 10.244.0.1:52344->10.244.1.5:8080: read: connection reset by peer/Unhealthy",
+			b:    "Readiness probe failed: read tcp 10.244.0.1:40112->10.244.1.5:8080: read: connection reset by peer/Unhealthy",
+			same: true,
+		},
+		{
+			name: "probe on another port",
+			a:    `Liveness probe failed: Get "http://10.244.1.5:8080/healthz": dial tcp 10.244.1.5:8080: connect: connection refused/Unhealthy`,
+			b:    `Liveness probe failed: Get "http://10.244.1.5:9090/healthz": dial tcp 10.244.1.5:9090: connect: connection refused/Unhealthy`,
+			same: false,
+		},
+		{
+			name: "another container",
+			a:    "back-off 10s restarting failed container=web pod=web-7d4b9c8f6-x2x9z_default(3f1c2a4e-9b7d-4c1e-8f2a-1b2c3d4e5f60)/CrashLoopBackOff",
+			b:    "back-off 10s restarting failed container=sidecar pod=web-7d4b9c8f6-x2x9z_default(3f1c2a4e-9b7d-4c1e-8f2a-1b2c3d4e5f60)/CrashLoopBackOff",
+			same: false,
+		},
+		{
+			name: "another reason",
+			a:    `Back-off pulling image "nginx:1.25"/ImagePullBackOff`,
+			b:    `Back-off pulling image "nginx:1.25"/ErrImagePull`,
+			same: false,
+		},
+		{
+			name: "another deployment",
+			a:    "back-off 10s restarting failed container=web pod=web-7d4b9c8f6-x2x9z_default(3f1c2a4e-9b7d-4c1e-8f2a-1b2c3d4e5f60)/CrashLoopBackOff",
+			b:    "back-off 10s restarting failed container=web pod=api-7d4b9c8f6-x2x9z_default(3f1c2a4e-9b7d-4c1e-8f2a-1b2c3d4e5f60)/CrashLoopBackOff",
+			same: false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			na, nb := NormalizeReason(c.a), NormalizeReason(c.b)
+			if (na == nb) != c.same {
+				t.Fatalf("same = %v, want %v\n%s\n%s", na == nb, c.same, na, nb)
+			}
+		})
+	}
+}
+
+func TestReasonCategory(t *testing.T) {
+	cases := []struct {
+		reason string
+		want   string
+	}{
+		{"", "None"},
+		{"back-off 10s restarting failed container=web pod=web-7d4b9c8f6-x2x9z_default(uid)/CrashLoopBackOff", "CrashLoopBackOff"},
+		{`ReplicaSet "web-7d4b9c8f6" has timed out progressing./ProgressDeadlineExceeded`, "ProgressDeadlineExceeded"},
+		{"exit code 1\nBack-off pulling image/ImagePullBackOff", "ImagePullBackOff"},
+		{"exit code 1", "Other"},
+	}
+	for _, c := range cases {
+		if got := ReasonCategory(c.reason); got != c.want {
+			t.Fatalf("ReasonCategory(%q) = %s, want %s", c.reason, got, c.want)
+		}
+	}
+}
@@ -29,19 +29,27 @@ func (hs *HandAndSender) GetSender() *sender2.Sender {
 
 func (hs *HandAndSender) Handle(ctx context.Context, c controller.K8sController, key string, obj interface{}) error {
 	t := c.GetKind()
+	// 缓存树中只保存精简信息时，对象只被读取，不需要复制
+	needCopy := needDeepCopy(c.GetCacheMap().MetaProjection())
 	var value resource.ResourceInter
 	switch t {
 	case constant.DeploymentKind:
 		var d *appv1.Deployment
 		if obj != nil {
-			d = obj.(*appv1.Deployment).DeepCopy() // 避免修改到缓存数据
+			d = obj.(*appv1.Deployment)
+			if needCopy {
+				d = d.DeepCopy() // 避免修改到缓存数据
+			}
 			util.Debugw("Deployment Handle", "current", d.Status)
 		}
 		value = &resource.MyDep{Deployment: d}
 	case constant.PodKind:
 		var p *corev1.Pod
 		if obj != nil {
-			p = obj.(*corev1.Pod).DeepCopy() // 避免修改到缓存数据
+			p = obj.(*corev1.Pod)
+			if needCopy {
+				p = p.DeepCopy() // 避免修改到缓存数据
+			}
 			util.Debugw("Pod Handle", "current", p.Status)
 		}
 		value = &resource.MyPod{Pod: p}
@@ -50,3 +58,8 @@ func (hs *HandAndSender) Handle(ctx context.Context, c controller.K8sController,
 	// 处理新增\更新\删除
 	return handler(key, value, c, hs)
 }
+
+// 完整对象会保存在缓存树中并推送给订阅者，需要与informer缓存隔离
+func needDeepCopy(p sender2.MetaProjection) bool {
+	return p == sender2.MetaProjectionFull || p == sender2.MetaProjectionStripped
+}
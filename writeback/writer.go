@@ -0,0 +1,247 @@
+package writeback
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/sender"
+	"github.com/sunreaver/kubewatcher/util"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	HealthAnnotation = "kubewatcher.io/health" // 写回到Deployment上的注解
+
+	ReasonFailed        = "KubewatcherFailed"
+	ReasonRecovered     = "KubewatcherRecovered"
+	ReasonFlapping      = "KubewatcherFlapping"
+	ReasonReasonChanged = "KubewatcherReasonChanged"
+
+	defaultComponent       = "kubewatcher"
+	defaultWriterQPS       = 5
+	defaultWriterBurst     = 10
+	defaultWriterQueue     = 1000
+	defaultWriterTimeout   = 10 * time.Second
+	maxAnnotationReasonLen = 256 // 注解中原因的最大长度，完整原因在Event中
+)
+
+type Config struct {
+	Cluster   string               // clientSet所属集群，与watcher的platform（Manager中的集群名）一致；不为空时丢弃其他集群的事件，通过Manager.AddSink添加时必须设置
+	Component string               // Event的source.component 默认kubewatcher
+	Annotate  bool                 // 是否在Deployment上维护kubewatcher.io/health注解
+	QPS       float64              // 写apiserver的速率 默认5
+	Burst     int                  // 默认10
+	QueueSize int                  // 待写回的事件队列长度 默认1000
+	Timeout   time.Duration        // 单次patch超时 默认10s
+	Recorder  record.EventRecorder // 为空时通过clientSet创建，测试时可以使用record.NewFakeRecorder
+}
+
+func (c *Config) setDefaults() error {
+	if c.QPS < 0 || c.Burst < 0 || c.QueueSize < 0 || c.Timeout < 0 {
+		return errors.New("writeback config can't be negative")
+	}
+	if c.Component == "" {
+		c.Component = defaultComponent
+	}
+	if c.QPS == 0 {
+		c.QPS = defaultWriterQPS
+	}
+	if c.Burst == 0 {
+		c.Burst = defaultWriterBurst
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = defaultWriterQueue
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultWriterTimeout
+	}
+	return nil
+}
+
+// kubewatcher.io/health注解的内容
+type Health struct {
+	Status    constant.K8sResStatus `json:"status"`
+	Category  string                `json:"category,omitempty"` // 原因分类，例如CrashLoopBackOff
+	Reason    string                `json:"reason,omitempty"`   // 归一化并截断后的原因
+	UpdatedAt time.Time             `json:"updatedAt"`
+}
+
+/*
+把Deployment的聚合状态写回集群，作为sink通过AddSink添加
+状态变化时在Deployment上记录Event，可选维护kubewatcher.io/health注解，kubectl describe即可看到
+所有写操作共用一个限流器，队列满时丢弃
+Writer只绑定一个clientSet，设置Config.Cluster后只写回该集群的事件
+*/
+type Writer struct {
+	cs          kubernetes.Interface
+	cfg         Config
+	recorder    record.EventRecorder
+	broadcaster record.EventBroadcaster // 使用外部Recorder时为空
+	limiter     *rate.Limiter
+	queue       chan sender.SendOut
+	ctx         context.Context
+	cancel      context.CancelFunc
+	closeLock   sync.RWMutex
+	closed      bool
+	done        chan struct{}
+}
+
+func NewWriter(cs kubernetes.Interface, cfg Config) (*Writer, error) {
+	if cs == nil {
+		return nil, errors.New("clientSet can't be null")
+	}
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Writer{
+		cs:       cs,
+		cfg:      cfg,
+		recorder: cfg.Recorder,
+		limiter:  rate.NewLimiter(rate.Limit(cfg.QPS), cfg.Burst),
+		queue:    make(chan sender.SendOut, cfg.QueueSize),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	if w.recorder == nil {
+		w.broadcaster = record.NewBroadcaster()
+		w.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cs.CoreV1().Events("")})
+		w.recorder = w.broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: cfg.Component})
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *Writer) Send(out sender.SendOut) {
+	if out.Kind != constant.DeploymentKind || out.Status.IsDelete() {
+		return // 只写回Deployment的聚合状态，被删除的对象无需写回
+	}
+	if w.cfg.Cluster != "" && out.Cluster != w.cfg.Cluster {
+		return // 其他集群的事件，不能写到当前clientSet
+	}
+	w.closeLock.RLock()
+	defer w.closeLock.RUnlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.queue <- out:
+	default:
+		util.Warnw("writeback_queue_full", "key", out.Key, "status", out.Status)
+	}
+}
+
+func (w *Writer) Close(ctx context.Context) error {
+	w.closeLock.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.closeLock.Unlock()
+	var err error
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		w.cancel()
+		<-w.done
+		err = ctx.Err()
+	}
+	if w.broadcaster != nil {
+		w.broadcaster.Shutdown()
+	}
+	return err
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	for out := range w.queue {
+		if err := w.limiter.Wait(w.ctx); err != nil {
+			continue // 已超时关闭，丢弃剩余事件
+		}
+		w.write(out)
+	}
+}
+
+func (w *Writer) write(out sender.SendOut) {
+	nameSpace, name := util.SplitResourceCacheKey(out.Key)
+	ref := &corev1.ObjectReference{
+		Kind:       string(constant.DeploymentKind),
+		APIVersion: "apps/v1",
+		Namespace:  nameSpace,
+		Name:       name,
+	}
+	if d, ok := out.AsDeployment(); ok {
+		ref.UID = d.UID
+		ref.ResourceVersion = d.ResourceVersion
+	}
+	eventType, reason, message := eventOf(out)
+	w.recorder.Event(ref, eventType, reason, message)
+
+	if !w.cfg.Annotate {
+		return
+	}
+	if err := w.annotate(nameSpace, name, out); err != nil {
+		util.Warnw("writeback_annotate", "key", out.Key, "error", err)
+	}
+}
+
+func eventOf(out sender.SendOut) (eventType, reason, message string) {
+	switch {
+	case out.Type == constant.EventFlapping:
+		return corev1.EventTypeWarning, ReasonFlapping, "status is flapping: " + out.Reason
+	case out.Type == constant.EventReasonChange:
+		return corev1.EventTypeWarning, ReasonReasonChanged, out.Reason
+	case out.Status == constant.K8sResStatusFail:
+		return corev1.EventTypeWarning, ReasonFailed, out.Reason
+	default:
+		return corev1.EventTypeNormal, ReasonRecovered, "deployment is healthy"
+	}
+}
+
+func (w *Writer) annotate(nameSpace, name string, out sender.SendOut) error {
+	value, err := json.Marshal(healthOf(out, time.Now()))
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{HealthAnnotation: string(value)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(w.ctx, w.cfg.Timeout)
+	defer cancel()
+	// merge patch不带resourceVersion，apiserver不会返回冲突，无需重试
+	_, err = w.cs.AppsV1().Deployments(nameSpace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: w.cfg.Component})
+	if apierrors.IsNotFound(err) {
+		return nil // 推送过程中已被删除
+	}
+	return err
+}
+
+func healthOf(out sender.SendOut, now time.Time) Health {
+	h := Health{Status: out.Status, UpdatedAt: now.UTC().Truncate(time.Second)}
+	if out.Status == constant.K8sResStatusFail {
+		h.Category = util.ReasonCategory(out.Reason)
+		h.Reason = util.NormalizeReason(out.Reason)
+		if r := []rune(h.Reason); len(r) > maxAnnotationReasonLen {
+			h.Reason = string(r[:maxAnnotationReasonLen]) + "..."
+		}
+	}
+	return h
+}
@@ -0,0 +1,265 @@
+package writeback
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sunreaver/kubewatcher/constant"
+	"github.com/sunreaver/kubewatcher/sender"
+	appv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+const crashLoop = "back-off 5m0s restarting failed container=app pod=web-7d4b9c8f6-x2x9z_default(0b6f5c3e-8d1a-4f3b-9a7e-2c4d6e8f0a1b)/CrashLoopBackOff"
+
+func newDeployment(nameSpace, name string) *appv1.Deployment {
+	return &appv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: nameSpace, Name: name}}
+}
+
+func depEvent(key string, status constant.K8sResStatus, reason string) sender.SendOut {
+	return sender.SendOut{Key: key, Kind: constant.DeploymentKind, Type: constant.EventStatusChange, Status: status, Reason: reason}
+}
+
+func healthAnnotation(t *testing.T, cs *fake.Clientset, nameSpace, name string) Health {
+	t.Helper()
+	d, err := cs.AppsV1().Deployments(nameSpace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h Health
+	if err := json.Unmarshal([]byte(d.Annotations[HealthAnnotation]), &h); err != nil {
+		t.Fatalf("invalid health annotation %q: %v", d.Annotations[HealthAnnotation], err)
+	}
+	return h
+}
+
+func patchCount(cs *fake.Clientset) int {
+	n := 0
+	for _, action := range cs.Actions() {
+		if action.GetVerb() == "patch" && action.GetResource().Resource == "deployments" {
+			n++
+		}
+	}
+	return n
+}
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	list := make([]string, 0)
+	for {
+		select {
+		case ev := <-recorder.Events:
+			list = append(list, ev)
+		default:
+			return list
+		}
+	}
+}
+
+func TestWriterEventsAndAnnotation(t *testing.T) {
+	cs := fake.NewSimpleClientset(newDeployment("default", "web"))
+	recorder := record.NewFakeRecorder(100)
+	w, err := NewWriter(cs, Config{Annotate: true, QPS: 1000, Recorder: recorder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	w.Send(depEvent("default/web", constant.K8sResStatusFail, crashLoop))
+	w.Send(sender.SendOut{Key: "default/web-1", Kind: constant.PodKind, Status: constant.K8sResStatusFail}) // pod不写回
+	w.Send(depEvent("default/web", constant.K8sResStatusDelete, ""))                                        // 删除不写回
+	if err := w.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	h := healthAnnotation(t, cs, "default", "web")
+	if h.Status != constant.K8sResStatusFail || h.Category != "CrashLoopBackOff" || h.Reason == "" || h.UpdatedAt.IsZero() {
+		t.Fatalf("health after failure = %+v", h)
+	}
+
+	w, err = NewWriter(cs, Config{Annotate: true, QPS: 1000, Recorder: recorder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flapping := depEvent("default/web", constant.K8sResStatusFail, "flapped 3 times")
+	flapping.Type = constant.EventFlapping
+	changed := depEvent("default/web", constant.K8sResStatusFail, "container app: OOMKilled")
+	changed.Type = constant.EventReasonChange
+	w.Send(flapping)
+	w.Send(changed)
+	w.Send(depEvent("default/web", constant.K8sResStatusSucceed, ""))
+	if err := w.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	h = healthAnnotation(t, cs, "default", "web")
+	if h.Status != constant.K8sResStatusSucceed || h.Category != "" || h.Reason != "" {
+		t.Fatalf("health after recovery = %+v, want succeed without reason", h)
+	}
+
+	events := drainEvents(recorder)
+	want := []string{
+		"Warning " + ReasonFailed + " " + crashLoop,
+		"Warning " + ReasonFlapping + " status is flapping: flapped 3 times",
+		"Warning " + ReasonReasonChanged + " container app: OOMKilled",
+		"Normal " + ReasonRecovered + " deployment is healthy",
+	}
+	if len(events) != len(want) {
+		t.Fatalf("events = %q, want %d events", events, len(want))
+	}
+	for i := range want {
+		if !strings.HasPrefix(events[i], want[i]) {
+			t.Fatalf("event %d = %q, want prefix %q", i, events[i], want[i])
+		}
+	}
+	if n := patchCount(cs); n != 4 {
+		t.Fatalf("patches = %d, want 4", n)
+	}
+}
+
+func TestWriterWithoutAnnotate(t *testing.T) {
+	cs := fake.NewSimpleClientset(newDeployment("default", "web"))
+	recorder := record.NewFakeRecorder(10)
+	w, err := NewWriter(cs, Config{Recorder: recorder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Send(depEvent("default/web", constant.K8sResStatusFail, "ProgressDeadlineExceeded"))
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if events := drainEvents(recorder); len(events) != 1 {
+		t.Fatalf("events = %q, want 1", events)
+	}
+	if n := patchCount(cs); n != 0 {
+		t.Fatalf("patches = %d, want 0", n)
+	}
+}
+
+// 设置了Cluster时只写回该集群的事件
+func TestWriterCluster(t *testing.T) {
+	cs := fake.NewSimpleClientset(newDeployment("default", "web"))
+	recorder := record.NewFakeRecorder(10)
+	w, err := NewWriter(cs, Config{Cluster: "a", Annotate: true, QPS: 1000, Recorder: recorder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cluster := range []string{"b", "", "a"} {
+		out := depEvent("default/web", constant.K8sResStatusFail, "ImagePullBackOff")
+		out.Cluster = cluster
+		w.Send(out)
+	}
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if events := drainEvents(recorder); len(events) != 1 {
+		t.Fatalf("events = %q, want only cluster a", events)
+	}
+	if n := patchCount(cs); n != 1 {
+		t.Fatalf("patches = %d, want 1", n)
+	}
+	// patch中不带resourceVersion，不会因为并发修改而冲突
+	for _, action := range cs.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok && strings.Contains(string(patch.GetPatch()), "resourceVersion") {
+			t.Fatalf("patch = %s, want no resourceVersion", patch.GetPatch())
+		}
+	}
+}
+
+func TestWriterIgnoresMissingDeployment(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	w, err := NewWriter(cs, Config{Annotate: true, QPS: 1000, Recorder: record.NewFakeRecorder(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Send(depEvent("default/gone", constant.K8sResStatusFail, "ImagePullBackOff"))
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := patchCount(cs); n != 1 {
+		t.Fatalf("patches = %d, want 1 without retry", n)
+	}
+}
+
+func TestWriterRateLimit(t *testing.T) {
+	cs := fake.NewSimpleClientset(newDeployment("default", "web"))
+	w, err := NewWriter(cs, Config{Annotate: true, QPS: 20, Burst: 1, Recorder: record.NewFakeRecorder(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		w.Send(depEvent("default/web", constant.K8sResStatusFail, "ImagePullBackOff"))
+	}
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 第一个使用burst，之后每个间隔50ms
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Fatalf("5 writes took %v, want >= 200ms at 20 qps", elapsed)
+	}
+	if n := patchCount(cs); n != 5 {
+		t.Fatalf("patches = %d, want 5", n)
+	}
+}
+
+// Close超时后丢弃还没有写回的事件
+func TestWriterCloseTimeout(t *testing.T) {
+	cs := fake.NewSimpleClientset(newDeployment("default", "web"))
+	w, err := NewWriter(cs, Config{Annotate: true, QPS: 1, Burst: 1, Recorder: record.NewFakeRecorder(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		w.Send(depEvent("default/web", constant.K8sResStatusFail, "ImagePullBackOff"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := w.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("close error = %v, want DeadlineExceeded", err)
+	}
+	if n := patchCount(cs); n != 1 {
+		t.Fatalf("patches = %d, want 1", n)
+	}
+}
+
+func TestHealthOf(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 600, time.FixedZone("CST", 8*3600))
+	cases := []struct {
+		name string
+		out  sender.SendOut
+		want Health
+	}{
+		{
+			name: "succeed has no reason",
+			out:  depEvent("default/web", constant.K8sResStatusSucceed, "ignored"),
+			want: Health{Status: constant.K8sResStatusSucceed},
+		},
+		{
+			name: "failure is normalized",
+			out:  depEvent("default/web", constant.K8sResStatusFail, crashLoop),
+			want: Health{
+				Status:   constant.K8sResStatusFail,
+				Category: "CrashLoopBackOff",
+				Reason:   "back-off <duration> restarting failed container=app pod=web-<pod>_default(<uid>)/CrashLoopBackOff",
+			},
+		},
+		{
+			name: "long reason is truncated",
+			out:  depEvent("default/web", constant.K8sResStatusFail, strings.Repeat("x", 400)+"/ImagePullBackOff"),
+			want: Health{Status: constant.K8sResStatusFail, Category: "ImagePullBackOff", Reason: strings.Repeat("x", maxAnnotationReasonLen) + "..."},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := healthOf(c.out, now)
+			c.want.UpdatedAt = time.Date(2024, 1, 1, 19, 4, 5, 0, time.UTC)
+			if h != c.want {
+				t.Fatalf("health = %+v, want %+v", h, c.want)
+			}
+		})
+	}
+}